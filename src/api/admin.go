@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"axial/models"
+	"axial/storage"
+)
+
+type SyncHistoryResponse struct {
+	Sessions []models.SyncSession `json:"sessions"`
+}
+
+// GET /v1/admin/sync/history?peer=10.0.0.2&limit=100
+//
+// Returns the journaled sync sessions, newest first, optionally only those
+// with one peer: either its models.SyncPeer key or its host, which matches
+// every node at that host.
+func (a *API) handleSyncHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil {
+			limit = v
+		}
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	sessions, err := a.Store.SyncSessions(r.URL.Query().Get("peer"), limit)
+	if err != nil {
+		fmt.Printf("Failed to get sync history: %v\n", err)
+		http.Error(w, "Failed to get sync history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SyncHistoryResponse{Sessions: sessions})
+}
+
+type PeerHealthsResponse struct {
+	Peers []models.PeerHealth `json:"peers"`
+}
+
+// GET /v1/admin/peers
+//
+// Returns the health of every peer we synced with: failures, backoff and
+// quarantine.
+func (a *API) handlePeerHealths(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peers, err := a.Store.PeerHealths()
+	if err != nil {
+		fmt.Printf("Failed to get peer health: %v\n", err)
+		http.Error(w, "Failed to get peer health", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PeerHealthsResponse{Peers: peers})
+}
+
+// GET /v1/admin/peers/{peer}
+// DELETE /v1/admin/peers/{peer}
+//
+// Returns or clears the health of one peer host. Clearing it lifts its
+// backoff and quarantine.
+func (a *API) handlePeerHealth(w http.ResponseWriter, r *http.Request) {
+	peer := r.PathValue("peer")
+	switch r.Method {
+	case http.MethodGet:
+		health, err := a.Store.PeerHealth(peer)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to get health of %s: %v\n", peer, err)
+			http.Error(w, "Failed to get peer health", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health)
+	case http.MethodDelete:
+		err := a.Store.DeletePeerHealth(peer)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to clear health of %s: %v\n", peer, err)
+			http.Error(w, "Failed to clear peer health", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("Cleared health of %s\n", peer)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type KnownNodesResponse struct {
+	Nodes []models.KnownNode `json:"nodes"`
+}
+
+// GET /v1/admin/nodes
+//
+// Returns the keys pinned to the node IDs of the beacons we heard.
+func (a *API) handleKnownNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodes, err := a.Store.KnownNodes()
+	if err != nil {
+		fmt.Printf("Failed to get known nodes: %v\n", err)
+		http.Error(w, "Failed to get known nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(KnownNodesResponse{Nodes: nodes})
+}
+
+// GET /v1/admin/nodes/{node}
+// DELETE /v1/admin/nodes/{node}
+//
+// Returns or forgets the key pinned to one node ID. Once forgotten, the next
+// beacon of the node pins its key again, e.g. after the node changed keys.
+func (a *API) handleKnownNode(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.PathValue("node")
+	switch r.Method {
+	case http.MethodGet:
+		node, err := a.Store.KnownNode(nodeID)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Node not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to get key of %s: %v\n", nodeID, err)
+			http.Error(w, "Failed to get known node", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(node)
+	case http.MethodDelete:
+		err := a.Store.ForgetNode(nodeID)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Node not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to forget key of %s: %v\n", nodeID, err)
+			http.Error(w, "Failed to forget node", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("Forgot key of %s\n", nodeID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /v1/admin/nodes/{node}/last-sent-at
+//
+// Forgets when the newest beacon of a node was sent, so that its beacons are
+// accepted again after its clock stepped back further than max_clock_step.
+func (a *API) handleKnownNodeSentAt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.PathValue("node")
+	reset := a.ResetSentAt
+	if reset == nil {
+		reset = func(nodeID string) error { return a.Store.ResetNodeSentAt(nodeID, nil) }
+	}
+	err := reset(nodeID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to reset the beacons of %s: %v\n", nodeID, err)
+		http.Error(w, "Failed to reset node", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"time"
+
+	"axial/models"
+	"axial/storage"
+)
+
+// API serves the HTTP endpoints of one node, backed by that node's store
+// and sync state.
+type API struct {
+	Store storage.Store
+	State *models.SyncState
+	// SignBeacon, if set, signs the hashes ping responses carry
+	SignBeacon func(hashes models.HashSet) ([]byte, error)
+	// ResetSentAt, if set, forgets when the newest beacon of a node was sent
+	ResetSentAt func(nodeID string) error
+	// JournalMaxAge, if set, is how long journaled sync sessions are kept
+	JournalMaxAge time.Duration
+	// QuarantineAfter, if set, is how many sessions in a row a peer may push
+	// items we reject before it is quarantined
+	QuarantineAfter int
+
+	incoming *incomingSessions
+}
+
+// New creates the API for a node
+func New(store storage.Store, state *models.SyncState) *API {
+	return &API{
+		Store:    store,
+		State:    state,
+		incoming: &incomingSessions{sessions: map[string]*incomingSession{}, held: map[string]*heldSession{}},
+	}
+}
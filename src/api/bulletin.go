@@ -8,14 +8,14 @@ import (
 	"axial/models"
 )
 
-func handleGetBulletin(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleGetBulletin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var posts []models.Bulletin
-	if err := models.DB.Order("created_at DESC").Find(&posts).Error; err != nil {
+	posts, err := a.Store.Bulletins()
+	if err != nil {
 		http.Error(w, "Failed to fetch bulletin posts", http.StatusInternalServerError)
 		return
 	}
@@ -24,7 +24,7 @@ func handleGetBulletin(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(posts)
 }
 
-func handleCreateBulletin(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleCreateBulletin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -40,13 +40,13 @@ func handleCreateBulletin(w http.ResponseWriter, r *http.Request) {
 		CreateBulletin: req,
 	}
 
-	if err := models.DB.Create(&post).Error; err != nil {
+	if err := a.Store.CreateBulletin(&post); err != nil {
 		log.Printf("Create bulletin failed: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	models.RefreshHashes(models.DB)
+	a.State.RefreshHashes(a.Store)
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"axial/models"
+	"axial/storage"
+)
+
+// incomingSessionIdle is how long a peer may go without a sync request
+// before its next one is journaled as a new incoming session, and before
+// the sync session it holds is released
+const incomingSessionIdle = 2 * time.Minute
+
+// incomingSessions groups the sync requests of peers into the journaled
+// incoming sessions. A peer's session lasts from its first request until it
+// goes quiet for incomingSessionIdle; the row is updated after every request.
+//
+// It also holds the sync sessions peers take on our SyncState. A session an
+// initiator takes with its first round is kept through its further rounds,
+// so that other peers cannot take its slot in between, and released after
+// its last round. Initiators that stop before it release it once they have
+// gone quiet for incomingSessionIdle.
+type incomingSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*incomingSession // keyed by models.SyncPeer
+	held     map[string]*heldSession     // keyed by models.SyncPeer
+}
+
+// incomingSession is the journaled incoming session of a peer. Its row is
+// saved outside incomingSessions.mu, one save at a time, so that requests
+// of other peers do not wait on it and the row is inserted only once.
+type incomingSession struct {
+	session models.SyncSession
+	saving  sync.Mutex
+	invalid bool // the peer pushed items we rejected
+}
+
+// heldSession is a sync session a peer holds on our SyncState
+type heldSession struct {
+	timer    *time.Timer
+	requests int       // requests of the peer being handled
+	lastSeen time.Time // when the last one was
+}
+
+// acquire takes a sync session on state for peer, unless it already holds
+// one, and reports whether it has one. The caller must call done once it
+// handled the request.
+func (s *incomingSessions) acquire(state *models.SyncState, peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.held[peer]
+	if !ok {
+		if !state.StartSync(peer) {
+			return false
+		}
+		held = &heldSession{}
+		held.timer = time.AfterFunc(incomingSessionIdle, func() { s.release(state, peer, held) })
+		s.held[peer] = held
+	}
+	held.requests++
+	held.lastSeen = time.Now()
+	return true
+}
+
+// done marks a request acquire let through as handled, releasing the
+// session of peer on state if it was the last round and no other request of
+// peer is being handled
+func (s *incomingSessions) done(state *models.SyncState, peer string, last bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held, ok := s.held[peer]
+	if !ok {
+		return
+	}
+	held.requests--
+	held.lastSeen = time.Now()
+	if last && held.requests == 0 {
+		held.timer.Stop()
+		delete(s.held, peer)
+		state.EndSync(peer)
+	}
+}
+
+// holds reports whether peer holds a sync session
+func (s *incomingSessions) holds(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.held[peer]
+	return ok
+}
+
+// release ends the session peer holds on state once it has gone quiet for
+// incomingSessionIdle, and checks again later otherwise
+func (s *incomingSessions) release(state *models.SyncState, peer string, held *heldSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held[peer] != held {
+		return
+	}
+	if idle := time.Since(held.lastSeen); held.requests > 0 || idle < incomingSessionIdle {
+		held.timer.Reset(incomingSessionIdle - idle)
+		return
+	}
+	delete(s.held, peer)
+	state.EndSync(peer)
+}
+
+// incomingRequest is what one request adds to its peer's incoming session
+type incomingRequest struct {
+	session  models.SyncSession
+	refused  bool // answered busy, not part of any session
+	pushed   bool // pushed items to us
+	rejected int  // of which we rejected that many
+}
+
+type incomingRequestKey struct{}
+
+// incoming returns what the request being handled adds to the journal
+func incoming(r *http.Request) *incomingRequest {
+	if req, ok := r.Context().Value(incomingRequestKey{}).(*incomingRequest); ok {
+		return req
+	}
+	return &incomingRequest{}
+}
+
+// journaled journals the sync requests handled by next, with their bytes
+// and, if they failed, their status
+func (a *API) journaled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &incomingRequest{}
+		body := &countingReader{Reader: r.Body}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		writer := &journalWriter{ResponseWriter: w, status: http.StatusOK}
+		next(writer, r.WithContext(context.WithValue(r.Context(), incomingRequestKey{}, req)))
+
+		if req.refused {
+			return
+		}
+		req.session.BytesReceived = body.n
+		req.session.BytesSent = writer.n
+		if writer.status >= http.StatusBadRequest {
+			req.session.Error = fmt.Sprintf("%s %s: %d %s", r.Method, r.URL.Path, writer.status, http.StatusText(writer.status))
+		}
+		a.incoming.record(a, requestPeer(r), req)
+	}
+}
+
+// record adds what req did to the incoming session of peer and saves it.
+// Pushes also count against the health of peer, once per session however
+// many of its pushes were invalid.
+func (s *incomingSessions) record(a *API, peer string, req *incomingRequest) {
+	delta := req.session
+	s.mu.Lock()
+	now := time.Now()
+	for p, incoming := range s.sessions {
+		if now.Sub(incoming.session.EndedAt) > incomingSessionIdle {
+			delete(s.sessions, p)
+		}
+	}
+	// Pushes keep the sync session of the peer, if it holds one
+	if held, ok := s.held[peer]; ok {
+		held.lastSeen = now
+	}
+	incoming, ok := s.sessions[peer]
+	if !ok {
+		defer expireJournal(a)
+		incoming = &incomingSession{session: models.SyncSession{PeerAddress: peer, Direction: models.SyncIncoming, StartedAt: now}}
+		s.sessions[peer] = incoming
+	}
+	session := &incoming.session
+
+	if delta.PeerNodeID != "" {
+		session.PeerNodeID = delta.PeerNodeID
+	}
+	if delta.Engine != "" {
+		session.Engine = delta.Engine
+	}
+	session.Rounds += delta.Rounds
+	session.Sent.Messages += delta.Sent.Messages
+	session.Sent.Bulletins += delta.Sent.Bulletins
+	session.Sent.Users += delta.Sent.Users
+	session.Received.Messages += delta.Received.Messages
+	session.Received.Bulletins += delta.Received.Bulletins
+	session.Received.Users += delta.Received.Users
+	session.BytesSent += delta.BytesSent
+	session.BytesReceived += delta.BytesReceived
+	// The error is that of the last request, so a session a peer recovers
+	// from ends without one. Every failed request is logged.
+	if delta.Error != "" {
+		fmt.Printf("Sync request from %s failed: %s\n", peer, delta.Error)
+	}
+	session.Error = delta.Error
+	session.End(nil)
+	served := req.pushed && !incoming.invalid
+	if served {
+		incoming.invalid = req.rejected > 0
+	}
+	nodeID := session.PeerNodeID
+	s.mu.Unlock()
+
+	incoming.save(a, &s.mu)
+	if served {
+		a.recordPushes(peer, nodeID, req.rejected)
+	}
+}
+
+// recordPushes updates the health of peer after we rejected rejected of
+// the items it pushed, quarantining it once it pushed invalid items in
+// a.QuarantineAfter sessions in a row
+func (a *API) recordPushes(peer string, nodeID string, rejected int) {
+	if a.QuarantineAfter < 1 {
+		return
+	}
+	health, err := a.Store.PeerHealth(peer)
+	if errors.Is(err, storage.ErrNotFound) {
+		health, err = &models.PeerHealth{Peer: peer}, nil
+	}
+	if err != nil {
+		fmt.Printf("Failed to get health of %s: %v\n", peer, err)
+		return
+	}
+	if nodeID != "" {
+		health.NodeID = nodeID
+	}
+
+	quarantined := health.Quarantined()
+	health.Served(rejected > 0, time.Now(), a.QuarantineAfter)
+	if !quarantined && health.Quarantined() {
+		fmt.Printf("Quarantining %s, it pushed invalid items in %d sessions in a row\n", peer, health.InvalidSessions)
+	}
+	if err := a.Store.SavePeerHealth(health); err != nil {
+		fmt.Printf("Failed to save health of %s: %v\n", peer, err)
+	}
+}
+
+// save saves the latest state of the session, which mu guards, and keeps
+// the ID it was inserted with
+func (i *incomingSession) save(a *API, mu *sync.Mutex) {
+	i.saving.Lock()
+	defer i.saving.Unlock()
+
+	mu.Lock()
+	session := i.session
+	mu.Unlock()
+	if err := a.Store.SaveSyncSession(&session); err != nil {
+		fmt.Printf("Failed to journal sync session with %s: %v\n", session.PeerAddress, err)
+		return
+	}
+	mu.Lock()
+	i.session.ID = session.ID
+	mu.Unlock()
+}
+
+// expireJournal deletes the sync sessions that ended longer than
+// a.JournalMaxAge ago
+func expireJournal(a *API) {
+	if a.JournalMaxAge <= 0 {
+		return
+	}
+	expired, err := a.Store.DeleteSyncSessionsBefore(time.Now().Add(-a.JournalMaxAge))
+	if err != nil {
+		fmt.Printf("Failed to expire sync journal: %v\n", err)
+	} else if expired > 0 {
+		fmt.Printf("Expired %d journaled sync sessions older than %s\n", expired, a.JournalMaxAge)
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// journalWriter records the status and size of a response
+type journalWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *journalWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
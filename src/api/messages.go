@@ -9,14 +9,14 @@ import (
 )
 
 
-func handleGetMessages(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var messages []models.Message
-	if err := models.DB.Find(&messages).Error; err != nil {
+	messages, err := a.Store.Messages()
+	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
@@ -25,7 +25,7 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
-func handleCreateMessage(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleCreateMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -41,14 +41,14 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request) {
 		CreateMessage: req,
 	}
 
-	if err := models.DB.Create(&message).Error; err != nil {
+	if err := a.Store.CreateMessage(&message); err != nil {
 		// Validation/analysis errors should be returned to the client
 		log.Printf("Create message failed: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	models.RefreshHashes(models.DB)
+	a.State.RefreshHashes(a.Store)
 
 	w.WriteHeader(http.StatusCreated)
 }
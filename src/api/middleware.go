@@ -1,6 +1,11 @@
 package api
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+
+	"axial/models"
+)
 
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -17,4 +22,19 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		next(w, r)
 	}
-} 
\ No newline at end of file
+} 
+
+// unlessQuarantined refuses the sync requests of quarantined peers. The node
+// ID and port initiators send are not authenticated, so every node at the
+// host of a quarantined peer is refused.
+func (a *API) unlessQuarantined(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer := requestPeer(r)
+		if health, err := a.Store.QuarantinedPeerAt(models.SyncPeerHost(peer)); err == nil {
+			fmt.Printf("Refusing sync request from %s, %s at its host is quarantined\n", peer, health.Peer)
+			http.Error(w, "Quarantined", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -9,21 +9,34 @@ import (
 
 type PingResponse struct {
 	Hashes models.HashSet `json:"hash"`
-	IsBusy bool `json:"is_busy"`
+	// IsBusy is set when a sync request from the caller would be refused
+	// right now. Capacity tells how many sessions are running out of how
+	// many.
+	IsBusy   bool                `json:"is_busy"`
+	Capacity models.SyncCapacity `json:"capacity"`
+	// Beacon is the node's signed beacon with the same hashes, so that
+	// nodes polling it know which node answered
+	Beacon []byte `json:"beacon,omitempty"`
 }
 
-func handlePing(w http.ResponseWriter, _ *http.Request) {
-	hashes, err := models.GetDatabaseHashes(models.DB)
+func (a *API) handlePing(w http.ResponseWriter, r *http.Request) {
+	hashes, err := a.State.GetDatabaseHashes(a.Store)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	isSyncing := models.IsSyncing()
-
+	peer := requestPeer(r)
 	response := PingResponse{
-		Hashes: hashes,
-		IsBusy: isSyncing,
+		Hashes:   hashes,
+		IsBusy:   !a.State.CanSyncWith(peer) && !a.incoming.holds(peer),
+		Capacity: a.State.Capacity(),
+	}
+	if a.SignBeacon != nil {
+		if response.Beacon, err = a.SignBeacon(hashes); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -28,82 +28,105 @@ func (fs *spaFileSystem) Open(name string) (http.File, error) {
 	return f, err
 }
 
-func RegisterRoutes() {
+// RegisterRoutes registers the full API on mux: the peer API used by other
+// nodes and the local API used by the UI.
+func (a *API) RegisterRoutes(mux *http.ServeMux) {
+	a.RegisterPeerRoutes(mux)
+	a.RegisterLocalRoutes(mux)
+}
+
+// RegisterPeerRoutes registers the endpoints other nodes call to discover and
+// synchronize with this node.
+func (a *API) RegisterPeerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/ping", a.handlePing)
+	mux.HandleFunc("/v1/sync", a.unlessQuarantined(a.journaled(a.handleSync)))
+	mux.HandleFunc("/v1/sync/messages", a.unlessQuarantined(a.journaled(a.handleSyncMessages)))
+	mux.HandleFunc("/v1/sync/bulletins", a.unlessQuarantined(a.journaled(a.handleSyncBulletins)))
+	mux.HandleFunc("/v1/sync/users", a.unlessQuarantined(a.journaled(a.handleSyncUsers)))
+}
+
+// RegisterAdminRoutes registers the endpoints operators use to inspect and
+// manage the node. They should not be reachable by peers.
+func (a *API) RegisterAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/admin/sync/history", a.handleSyncHistory)
+	mux.HandleFunc("/v1/admin/peers", a.handlePeerHealths)
+	mux.HandleFunc("/v1/admin/peers/{peer}", a.handlePeerHealth)
+	mux.HandleFunc("/v1/admin/nodes", a.handleKnownNodes)
+	mux.HandleFunc("/v1/admin/nodes/{node}", a.handleKnownNode)
+	mux.HandleFunc("/v1/admin/nodes/{node}/last-sent-at", a.handleKnownNodeSentAt)
+}
+
+// RegisterLocalRoutes registers the frontend and the API used by the UI.
+func (a *API) RegisterLocalRoutes(mux *http.ServeMux) {
 	// Log current working directory
 	cwd, _ := os.Getwd()
 	log.Printf("Current working directory: %s", cwd)
 
 	// Serve frontend files with SPA support
 	fs := &spaFileSystem{root: http.Dir("frontend/dist"), indexes: true}
-	http.Handle("/", http.FileServer(fs))
-
-	http.HandleFunc("/v1/ping", handlePing)
-	http.HandleFunc("/v1/sync", handleSync)
-	http.HandleFunc("/v1/sync/messages", handleSyncMessages)
-	http.HandleFunc("/v1/sync/bulletins", handleSyncBulletins)
-	http.HandleFunc("/v1/sync/users", handleSyncUsers)
+	mux.Handle("/", http.FileServer(fs))
 
 	// User routes
-	http.HandleFunc("/v1/users/search", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/users/search", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Users search endpoint: %s %s", r.Method, r.URL.Path)
 		if r.Method == http.MethodGet {
-			handleSearchUsers(w, r)
+			a.handleSearchUsers(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
-	http.HandleFunc("/v1/users/recent", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/users/recent", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Users recent endpoint: %s %s", r.Method, r.URL.Path)
 		if r.Method == http.MethodGet {
-			handleRecentUsers(w, r)
+			a.handleRecentUsers(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
-	http.HandleFunc("/v1/users/{fingerprint}", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/users/{fingerprint}", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("User endpoint: %s %s", r.Method, r.URL.Path)
 		if r.Method == http.MethodGet {
-			handleGetUser(w, r)
+			a.handleGetUser(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
-	http.HandleFunc("/v1/users", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/users", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Users endpoint: %s %s", r.Method, r.URL.Path)
 		switch r.Method {
 		case http.MethodGet:
-			handleGetUsers(w, r)
+			a.handleGetUsers(w, r)
 		case http.MethodPost:
-			handleRegisterUser(w, r)
+			a.handleRegisterUser(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
 	// Message routes
-	http.HandleFunc("/v1/messages", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/messages", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Messages endpoint: %s %s", r.Method, r.URL.Path)
 		switch r.Method {
 		case http.MethodGet:
-			handleGetMessages(w, r)
+			a.handleGetMessages(w, r)
 		case http.MethodPost:
-			handleCreateMessage(w, r)
+			a.handleCreateMessage(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
 	// Bulletin routes
-	http.HandleFunc("/v1/bulletin", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/bulletin", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Bulletin endpoint: %s %s", r.Method, r.URL.Path)
 		switch r.Method {
 		case http.MethodGet:
-			handleGetBulletin(w, r)
+			a.handleGetBulletin(w, r)
 		case http.MethodPost:
-			handleCreateBulletin(w, r)
+			a.handleCreateBulletin(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -1,63 +1,111 @@
 package api
 
 import (
-	"axial/models"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"sort"
+	"strconv"
 
-	"gorm.io/gorm"
+	"axial/models"
+	"axial/storage"
 )
 
+// Headers initiators identify themselves with on every sync request, so that
+// nodes sharing a host are told apart. Nodes predating them send neither.
 const (
-	maxBatchSize   = 1000 // Maximum number of messages to return in one response
-	numRangeSplits = 10   // Number of parts to split a range into when too large
+	HeaderNodeID  = "X-Axial-Node-Id"
+	HeaderAPIPort = "X-Axial-Api-Port"
 )
 
+// PeerHeader returns the headers identifying the node nodeID, advertising
+// apiPort, to the nodes it calls
+func PeerHeader(nodeID string, apiPort int) http.Header {
+	header := http.Header{}
+	header.Set(HeaderNodeID, nodeID)
+	header.Set(HeaderAPIPort, strconv.Itoa(apiPort))
+	return header
+}
+
+// requestPeer returns the key sessions with the initiator of r are tracked
+// by, see models.SyncPeer
+func requestPeer(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	address := host
+	if port, err := strconv.Atoi(r.Header.Get(HeaderAPIPort)); err == nil && port > 0 && port < 65536 {
+		address = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return models.SyncPeer(r.Header.Get(HeaderNodeID), address)
+}
+
 type SyncRequest struct {
-	MessageRanges  []models.HashedPeriod     `json:"message_ranges"`
-	BulletinRanges []models.HashedPeriod     `json:"bulletin_ranges,omitempty"`
-	Users          []models.HashedUsersRange `json:"users"`
+	// NodeID is the ID of the initiator, for our journal. Nodes predating
+	// the field leave it empty.
+	NodeID string `json:"node_id,omitempty"`
+	// Engine selects how messages and bulletins are reconciled. Empty means
+	// EngineTime, which is all that nodes predating the field speak.
+	Engine           string                    `json:"engine,omitempty"`
+	MessageRanges    []models.HashedPeriod     `json:"message_ranges"`
+	BulletinRanges   []models.HashedPeriod     `json:"bulletin_ranges,omitempty"`
+	MessageIDRanges  []models.HashedIDRange    `json:"message_id_ranges,omitempty"`
+	BulletinIDRanges []models.HashedIDRange    `json:"bulletin_id_ranges,omitempty"`
+	Users            []models.HashedUsersRange `json:"users"`
 }
 
 type SyncResponse struct {
-	Hashes          models.HashSet            `json:"hash"`
-	IsBusy          bool                      `json:"is_busy"`
-	MessageRanges   []models.HashedPeriod     `json:"message_ranges,omitempty"`
-	Messages        []models.MessagesPeriod   `json:"messages,omitempty"`
-	BulletinRanges  []models.HashedPeriod     `json:"bulletin_ranges,omitempty"`
-	Bulletins       []models.BulletinsPeriod  `json:"bulletins,omitempty"`
-	UserRangeHashes []models.HashedUsersRange `json:"user_range_hashes,omitempty"`
-	Users           []models.UsersRange       `json:"users,omitempty"`
+	Hashes models.HashSet `json:"hash"`
+	// IsBusy is set when the request was refused for lack of a session,
+	// Capacity tells how many sessions the node runs out of how many. Nodes
+	// predating Capacity only send IsBusy.
+	IsBusy   bool                 `json:"is_busy"`
+	Capacity *models.SyncCapacity `json:"capacity,omitempty"`
+	// Engine is the engine the response was computed with. Nodes predating
+	// the field leave it empty.
+	Engine           string                    `json:"engine,omitempty"`
+	MessageRanges    []models.HashedPeriod     `json:"message_ranges,omitempty"`
+	Messages         []models.MessagesPeriod   `json:"messages,omitempty"`
+	BulletinRanges   []models.HashedPeriod     `json:"bulletin_ranges,omitempty"`
+	Bulletins        []models.BulletinsPeriod  `json:"bulletins,omitempty"`
+	MessageIDRanges  []models.HashedIDRange    `json:"message_id_ranges,omitempty"`
+	MessagesByID     []models.MessagesIDRange  `json:"messages_by_id,omitempty"`
+	BulletinIDRanges []models.HashedIDRange    `json:"bulletin_id_ranges,omitempty"`
+	BulletinsByID    []models.BulletinsIDRange `json:"bulletins_by_id,omitempty"`
+	UserRangeHashes  []models.HashedUsersRange `json:"user_range_hashes,omitempty"`
+	Users            []models.UsersRange       `json:"users,omitempty"`
 }
 
-func handleSync(w http.ResponseWriter, r *http.Request) {
-	// Check if we're busy
-	if models.IsSyncing() {
-		json.NewEncoder(w).Encode(SyncResponse{
-			IsBusy: true,
-		})
+func (a *API) handleSync(w http.ResponseWriter, r *http.Request) {
+	// Refuse new sessions while shutting down
+	if a.State.IsShuttingDown() {
+		incoming(r).refused = true
+		w.WriteHeader(http.StatusServiceUnavailable)
+		a.writeBusy(w)
 		return
 	}
 
 	if r.Method == http.MethodPost {
-		handleSyncRequest(w, r)
+		a.handleSyncRequest(w, r)
 	} else {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleSyncRequest(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleSyncRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Handling sync request...\n")
-	if !models.StartSync() {
-		fmt.Printf("Sync already in progress, returning busy response\n")
-		json.NewEncoder(w).Encode(SyncResponse{
-			IsBusy: true,
-		})
+	peer := requestPeer(r)
+	if !a.incoming.acquire(a.State, peer) {
+		fmt.Printf("No sync session available for %s, returning busy response\n", peer)
+		incoming(r).refused = true
+		a.writeBusy(w)
 		return
 	}
-	defer models.EndSync()
+	// A round that fails or leaves no ranges to compare is the last one of
+	// the session
+	last := true
+	defer func() { a.incoming.done(a.State, peer, last) }()
 
 	var req SyncRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -65,222 +113,92 @@ func handleSyncRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	resp, err := ComputeSyncResponse(models.DB, req)
+	resp, err := ComputeSyncResponse(a.Store, req)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(resp)
-}
-
-// ComputeSyncResponse encapsulates the core sync logic, producing a response
-// for a given request and database. It is used by the HTTP handler and can be
-// reused by tests to simulate in-memory sync exchanges without HTTP.
-func ComputeSyncResponse(db *gorm.DB, req SyncRequest) (SyncResponse, error) {
-
-	// Messages
-	messagePeriods := []models.Period{}
-	for _, period := range req.MessageRanges {
-		messagePeriods = append(messagePeriods, models.Period{
-			Start: period.Start,
-			End:   period.End,
-		})
-	}
-	fmt.Printf("Received %d time ranges to check\n", len(messagePeriods))
-
-	// Generate our hashes for the same ranges
-	ourMessagesHashRanges, err := models.GetMessagesHashRanges(db, messagePeriods)
-	if err != nil {
-		return SyncResponse{}, fmt.Errorf("failed to generate hash ranges: %v", err)
-	}
-	fmt.Printf("Generated %d message hash ranges\n", len(ourMessagesHashRanges))
-
-	missmatchingMessagesRanges := []models.HashedPeriod{}
-	for _, ourRange := range ourMessagesHashRanges {
-		ourStart := models.RealizeStart(ourRange.Start)
-		ourEnd := models.RealizeEnd(ourRange.End)
-		for _, theirRange := range req.MessageRanges {
-			theirStart := models.RealizeStart(theirRange.Start)
-			theirEnd := models.RealizeEnd(theirRange.End)
-			if ourStart.Equal(theirStart) && ourEnd.Equal(theirEnd) {
-				if ourRange.Hash != theirRange.Hash {
-					fmt.Printf("Found mismatching hash for range %v to %v (our hash: %s, their hash: %s)\n",
-						ourStart, ourEnd, ourRange.Hash, theirRange.Hash)
-					missmatchingMessagesRanges = append(missmatchingMessagesRanges, ourRange)
-				}
-			}
-		}
-	}
-	fmt.Printf("Found %d mismatching message hash ranges\n", len(missmatchingMessagesRanges))
-
-	// Compare hashes and prepare response
-	resp := SyncResponse{}
-	resp.Hashes, err = models.GetDatabaseHashes(db)
+	resp.Hashes, err = a.State.GetDatabaseHashes(a.Store)
 	if err != nil {
-		return SyncResponse{}, fmt.Errorf("failed to get database hash: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
+	capacity := a.State.Capacity()
+	resp.Capacity = &capacity
 	fmt.Printf("Our database hashes: %+v\n", resp.Hashes)
 
-	counts := map[int]int64{}
-	for index, mismatchingRange := range missmatchingMessagesRanges {
-		period := models.Period{
-			Start: mismatchingRange.Start,
-			End:   mismatchingRange.End,
-		}
-		counts[index] = models.CountMessagesByPeriod(db, period)
-		fmt.Printf("Range %d has %d messages\n", index, counts[index])
-	}
+	last = !resp.hasRanges()
 
-	// Sort indices by count in ascending order
-	indicesSortedByCount := make([]int, 0, len(counts))
-	for index := range counts {
-		indicesSortedByCount = append(indicesSortedByCount, index)
-	}
-	sort.Slice(indicesSortedByCount, func(i, j int) bool {
-		return counts[indicesSortedByCount[i]] < counts[indicesSortedByCount[j]]
-	})
+	journal := &incoming(r).session
+	journal.PeerNodeID = req.NodeID
+	journal.Engine = resp.Engine
+	journal.Rounds = 1
+	journal.Sent = resp.itemCounts()
 
-	totalPlainMessages := int64(0)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	for _, index := range indicesSortedByCount {
-		mismatchingRange := missmatchingMessagesRanges[index]
-		// Try to return as many messages as possible
-		if totalPlainMessages+counts[index] < maxBatchSize {
-			fmt.Printf("Getting messages for range %d (count: %d, total so far: %d)\n",
-				index, counts[index], totalPlainMessages)
-			messages, err := models.GetMessagesByPeriod(db, mismatchingRange.Period)
-			if err != nil {
-				return SyncResponse{}, fmt.Errorf("failed to get messages: %v", err)
-			}
+// hasRanges reports whether the response leaves ranges for the initiator to
+// compare in another round
+func (resp SyncResponse) hasRanges() bool {
+	return len(resp.MessageRanges) > 0 || len(resp.BulletinRanges) > 0 ||
+		len(resp.MessageIDRanges) > 0 || len(resp.BulletinIDRanges) > 0 ||
+		len(resp.UserRangeHashes) > 0
+}
 
-			messagesPeriod := models.MessagesPeriod{
-				Period:   mismatchingRange.Period,
-				Messages: messages,
-			}
-			resp.Messages = append(resp.Messages, messagesPeriod)
-			totalPlainMessages += counts[index]
-		} else {
-			fmt.Printf("Range %d too large (%d messages), splitting into smaller ranges\n",
-				index, counts[index])
-			// All batches that don't fit the plain message limit are returned as more granular
-			// hashed ranges, for drilling down to find the mismatching data.
-			//
-			// The following ensures that each split is 1/10 of the size possible to return
-			// in the next step. This is to ensure we get to return actual messages
-			// in the next step instead of further hashed range juggling.
-			splits := int(counts[index]/(maxBatchSize*10)) + 1
-			fmt.Printf("Splitting range into %d parts\n", splits)
-			periods := models.SplitTimeRange(mismatchingRange.Period, splits)
-			for _, period := range periods {
-				hashedMessagePeriods, err := models.GetMessagesHashRanges(db, []models.Period{period})
-				if err != nil {
-					return SyncResponse{}, fmt.Errorf("failed to generate hash ranges for split: %v", err)
-				}
-				for _, hashedMessagesPeriod := range hashedMessagePeriods {
-					resp.MessageRanges = append(resp.MessageRanges, models.HashedPeriod{
-						Period: hashedMessagesPeriod.Period,
-						Hash:   hashedMessagesPeriod.Hash,
-					})
-				}
-			}
-		}
+// itemCounts counts the items sent in the response
+func (resp SyncResponse) itemCounts() models.SyncItemCounts {
+	counts := models.SyncItemCounts{}
+	for _, p := range resp.Messages {
+		counts.Messages += len(p.Messages)
 	}
-
-	// Bulletins (similar logic can be added here)
-	bulletinPeriods := []models.Period{}
-	for _, period := range req.BulletinRanges {
-		bulletinPeriods = append(bulletinPeriods, models.Period{
-			Start: period.Start,
-			End:   period.End,
-		})
+	for _, r := range resp.MessagesByID {
+		counts.Messages += len(r.Messages)
 	}
-	fmt.Printf("Received %d bulletin ranges to check\n", len(bulletinPeriods))
-
-	ourBulletinHashRanges, err := models.GetBulletinsHashRanges(db, bulletinPeriods)
-	if err != nil {
-		return SyncResponse{}, fmt.Errorf("failed to generate bulletin hash ranges: %v", err)
+	for _, p := range resp.Bulletins {
+		counts.Bulletins += len(p.Bulletins)
 	}
-	fmt.Printf("Generated %d bulletin hash ranges\n", len(ourBulletinHashRanges))
-
-	mismatchingBulletinRanges := []models.HashedPeriod{}
-	for _, ourRange := range ourBulletinHashRanges {
-		ourStart := models.RealizeStart(ourRange.Start)
-		ourEnd := models.RealizeEnd(ourRange.End)
-		for _, theirRange := range req.BulletinRanges {
-			theirStart := models.RealizeStart(theirRange.Start)
-			theirEnd := models.RealizeEnd(theirRange.End)
-			if ourStart == theirStart && ourEnd == theirEnd {
-				if ourRange.Hash != theirRange.Hash {
-					fmt.Printf("Found mismatching hash for bulletin range %v to %v (our hash: %s, their hash: %s)\n",
-						ourStart, ourEnd, ourRange.Hash, theirRange.Hash)
-					mismatchingBulletinRanges = append(mismatchingBulletinRanges, ourRange)
-				}
-			}
-		}
+	for _, r := range resp.BulletinsByID {
+		counts.Bulletins += len(r.Bulletins)
 	}
-	fmt.Printf("Found %d mismatching bulletin hash ranges\n", len(mismatchingBulletinRanges))
-
-	for _, mismatchingRange := range mismatchingBulletinRanges {
-		period := models.Period{
-			Start: mismatchingRange.Start,
-			End:   mismatchingRange.End,
-		}
-		bulletins, err := models.GetBulletinsByPeriod(db, period)
-		if err != nil {
-			return SyncResponse{}, fmt.Errorf("failed to get bulletins: %v", err)
-		}
-
-		bulletinsPeriod := models.BulletinsPeriod{
-			Period:    mismatchingRange.Period,
-			Bulletins: bulletins,
-		}
-		resp.Bulletins = append(resp.Bulletins, bulletinsPeriod)
+	for _, r := range resp.Users {
+		counts.Users += len(r.Users)
 	}
+	return counts
+}
 
-	// Users
-	userRanges := []models.StringRange{}
-	for _, ur := range req.Users {
-		userRanges = append(userRanges, models.StringRange{
-			Start: ur.Start,
-			End:   ur.End,
-		})
-	}
-	fmt.Printf("Received %d user ranges to check\n", len(userRanges))
+// writeBusy answers a sync request we have no session for
+func (a *API) writeBusy(w http.ResponseWriter) {
+	capacity := a.State.Capacity()
+	json.NewEncoder(w).Encode(SyncResponse{
+		IsBusy:   true,
+		Capacity: &capacity,
+	})
+}
 
-	ourUserRangeHashes, err := models.GetUsersHashRanges(db, userRanges)
-	if err != nil {
-		return SyncResponse{}, fmt.Errorf("failed to generate user range hashes: %v", err)
+// ComputeSyncResponse encapsulates the core sync logic, producing a response
+// for a given request and store. It is used by the HTTP handler and can be
+// reused by tests to simulate in-memory sync exchanges without HTTP. The
+// response's Hashes are left for the caller to fill in.
+func ComputeSyncResponse(store storage.Store, req SyncRequest) (SyncResponse, error) {
+	resp := SyncResponse{}
+	var err error
+	if req.Engine == EngineRBSR {
+		resp.Engine = EngineRBSR
+		err = computeIDRangeResponse(store, req, &resp)
+	} else {
+		resp.Engine = EngineTime
+		err = computeTimeRangeResponse(store, req, &resp)
 	}
-	fmt.Printf("Generated %d user range hashes\n", len(ourUserRangeHashes))
-
-	mismatchingUserRanges := []models.HashedUsersRange{}
-	for _, ourRange := range ourUserRangeHashes {
-		ourStart := ourRange.Start
-		ourEnd := ourRange.End
-		for _, theirRange := range req.Users {
-			theirStart := theirRange.Start
-			theirEnd := theirRange.End
-			if ourStart == theirStart && ourEnd == theirEnd {
-				if ourRange.Hash != theirRange.Hash {
-					fmt.Printf("Found mismatching hash for user range %s to %s (our hash: %s, their hash: %s)\n",
-						ourStart, ourEnd, ourRange.Hash, theirRange.Hash)
-					mismatchingUserRanges = append(mismatchingUserRanges, ourRange)
-				}
-			}
-		}
+	if err != nil {
+		return SyncResponse{}, err
 	}
-	fmt.Printf("Found %d mismatching user ranges\n", len(mismatchingUserRanges))
-	for _, mismatchingRange := range mismatchingUserRanges {
-		users, err := models.GetUsersByFingerprintRange(db, mismatchingRange.StringRange.Start, mismatchingRange.StringRange.End)
-		if err != nil {
-			return SyncResponse{}, fmt.Errorf("failed to get users: %v", err)
-		}
 
-		usersRange := models.UsersRange{
-			StringRange: mismatchingRange.StringRange,
-			Users:       users,
-		}
-		resp.Users = append(resp.Users, usersRange)
+	// Users
+	fmt.Printf("Received %d user ranges to check\n", len(req.Users))
+	resp.UserRangeHashes, err = reconcileUserRanges(store, req.Users, &resp)
+	if err != nil {
+		return SyncResponse{}, fmt.Errorf("failed to reconcile user ranges: %v", err)
 	}
 
 	// Files
@@ -288,3 +206,21 @@ func ComputeSyncResponse(db *gorm.DB, req SyncRequest) (SyncResponse, error) {
 
 	return resp, nil
 }
+
+// computeTimeRangeResponse reconciles messages and bulletins over the
+// canonical sync range tree
+func computeTimeRangeResponse(store storage.Store, req SyncRequest, resp *SyncResponse) error {
+	fmt.Printf("Received %d message ranges to check\n", len(req.MessageRanges))
+	var err error
+	resp.MessageRanges, err = reconcileSyncRanges(req.MessageRanges, messagesContent(store, resp))
+	if err != nil {
+		return fmt.Errorf("failed to reconcile message ranges: %v", err)
+	}
+
+	fmt.Printf("Received %d bulletin ranges to check\n", len(req.BulletinRanges))
+	resp.BulletinRanges, err = reconcileSyncRanges(req.BulletinRanges, bulletinsContent(store, resp))
+	if err != nil {
+		return fmt.Errorf("failed to reconcile bulletin ranges: %v", err)
+	}
+	return nil
+}
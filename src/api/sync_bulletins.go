@@ -1,16 +1,18 @@
 package api
 
 import (
-	"axial/models"
 	"encoding/json"
+	"fmt"
 	"net/http"
+
+	"axial/models"
 )
 
 type SyncBulletinsRequest struct {
-	Bulletins []models.Bulletin `json:"messages"`
+	Bulletins []models.Bulletin `json:"bulletins"`
 }
 
-func handleSyncBulletins(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleSyncBulletins(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -28,20 +30,23 @@ func handleSyncBulletins(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create bulletins
-	for _, bulletin := range req.Bulletins {
-		if err := models.DB.Create(&bulletin).Error; err != nil {
-			// Ignore duplicate errors
-			if models.IsDuplicateError(err) {
-				continue
-			}
-			http.Error(w, "Failed to create bulletin", http.StatusInternalServerError)
-			return
-		}
+	// Store the whole batch in one transaction and tell the sender what
+	// became of every bulletin
+	report, err := a.Store.IngestBulletins(req.Bulletins)
+	if err != nil {
+		fmt.Printf("Failed to ingest bulletins: %v\n", err)
+		http.Error(w, "Failed to store bulletins", http.StatusInternalServerError)
+		return
 	}
 
-	models.RefreshHashes(models.DB)
-
-	w.WriteHeader(http.StatusCreated)
+	journal := incoming(r)
+	journal.session.Received.Bulletins = report.Accepted
+	journal.pushed = true
+	journal.rejected = report.Rejected
+	if report.Accepted > 0 {
+		a.State.RefreshHashes(a.Store)
+	}
 
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
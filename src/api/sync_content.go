@@ -0,0 +1,236 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+
+	"axial/models"
+	"axial/storage"
+)
+
+const maxBatchSize = 1000 // Maximum number of items of one type to return in one response
+
+// syncContent is everything the sync engines need to reconcile one content
+// type. Both engines handle any type described by one, so a new type only
+// needs its syncContent and its request and response fields.
+type syncContent struct {
+	name string
+
+	// Time engine
+	hash       func(models.Period) (string, error)
+	count      func(models.Period) (int64, error)
+	sendPeriod func(models.SyncRange) error // adds the items of the range to the response
+
+	// ID engine
+	ids         func(models.StringRange) ([]string, error)
+	sendIDRange func(models.StringRange) error // adds the items of the range to the response
+}
+
+func messagesContent(store storage.Store, resp *SyncResponse) syncContent {
+	return syncContent{
+		name:  "message",
+		hash:  store.MessagesHash,
+		count: store.CountMessagesInPeriod,
+		sendPeriod: func(r models.SyncRange) error {
+			messages, err := store.MessagesInPeriod(r.Period())
+			if err != nil {
+				return err
+			}
+			resp.Messages = append(resp.Messages, models.MessagesPeriod{
+				Period:   r.Period(),
+				RangeID:  r.ID,
+				Messages: messages,
+			})
+			return nil
+		},
+		ids: store.MessageIDs,
+		sendIDRange: func(r models.StringRange) error {
+			messages, err := store.MessagesInIDRange(r)
+			if err != nil {
+				return err
+			}
+			resp.MessagesByID = append(resp.MessagesByID, models.MessagesIDRange{StringRange: r, Messages: messages})
+			return nil
+		},
+	}
+}
+
+func bulletinsContent(store storage.Store, resp *SyncResponse) syncContent {
+	return syncContent{
+		name:  "bulletin",
+		hash:  store.BulletinsHash,
+		count: store.CountBulletinsInPeriod,
+		sendPeriod: func(r models.SyncRange) error {
+			bulletins, err := store.BulletinsInPeriod(r.Period())
+			if err != nil {
+				return err
+			}
+			resp.Bulletins = append(resp.Bulletins, models.BulletinsPeriod{
+				Period:    r.Period(),
+				RangeID:   r.ID,
+				Bulletins: bulletins,
+			})
+			return nil
+		},
+		ids: store.BulletinIDs,
+		sendIDRange: func(r models.StringRange) error {
+			bulletins, err := store.BulletinsInIDRange(r)
+			if err != nil {
+				return err
+			}
+			resp.BulletinsByID = append(resp.BulletinsByID, models.BulletinsIDRange{StringRange: r, Bulletins: bulletins})
+			return nil
+		},
+	}
+}
+
+// reconcileSyncRanges compares their hashes of canonical sync ranges with
+// ours. Mismatching ranges are batched by batchRanges: the ones that do not
+// fit are answered with the hashes of their children, for the initiator to
+// drill down into. Hours cannot be split and are always sent.
+func reconcileSyncRanges(theirs []models.HashedPeriod, content syncContent) ([]models.HashedPeriod, error) {
+	mismatching, err := mismatchedSyncRanges(theirs, content.hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s ranges: %v", content.name, err)
+	}
+	fmt.Printf("Found %d mismatching %s hash ranges\n", len(mismatching), content.name)
+
+	counts := make([]int64, len(mismatching))
+	for i, r := range mismatching {
+		counts[i], err = content.count(r.Period())
+		if err != nil {
+			return nil, fmt.Errorf("failed to count %ss: %v", content.name, err)
+		}
+	}
+
+	children := []models.HashedPeriod{}
+	err = batchRanges(counts,
+		func(i int) bool { return mismatching[i].Level() != models.LevelHour },
+		func(i int) error {
+			fmt.Printf("Getting %ss for range %s (count: %d)\n", content.name, mismatching[i].ID, counts[i])
+			if err := content.sendPeriod(mismatching[i]); err != nil {
+				return fmt.Errorf("failed to get %ss: %v", content.name, err)
+			}
+			return nil
+		},
+		func(i int) error {
+			subRanges := mismatching[i].Children()
+			fmt.Printf("Range %s too large (%d %ss), splitting into %d child ranges\n",
+				mismatching[i].ID, counts[i], content.name, len(subRanges))
+			for _, sub := range subRanges {
+				hash, err := content.hash(sub.Period())
+				if err != nil {
+					return fmt.Errorf("failed to hash %s range %s: %v", content.name, sub.ID, err)
+				}
+				children = append(children, models.HashedPeriod{Period: sub.Period(), RangeID: sub.ID, Hash: hash})
+			}
+			return nil
+		})
+	return children, err
+}
+
+// reconcileUserRanges compares their hashes of fingerprint ranges with ours
+// and answers mismatching ranges like reconcileSyncRanges does, splitting
+// large ones by the next fingerprint character.
+func reconcileUserRanges(store storage.Store, theirs []models.HashedUsersRange, resp *SyncResponse) ([]models.HashedUsersRange, error) {
+	mismatching := []models.StringRange{}
+	for _, theirRange := range theirs {
+		ourHash, err := store.UsersRangeHash(theirRange.StringRange)
+		if err != nil {
+			return nil, err
+		}
+		if ourHash != theirRange.Hash {
+			fmt.Printf("Found mismatching hash for user range %q to %q (our hash: %s, their hash: %s)\n",
+				theirRange.Start, theirRange.End, ourHash, theirRange.Hash)
+			mismatching = append(mismatching, theirRange.StringRange)
+		}
+	}
+	fmt.Printf("Found %d mismatching user ranges\n", len(mismatching))
+
+	counts := make([]int64, len(mismatching))
+	for i, r := range mismatching {
+		var err error
+		counts[i], err = store.CountUsersInRange(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count users: %v", err)
+		}
+	}
+
+	children := []models.HashedUsersRange{}
+	err := batchRanges(counts,
+		func(i int) bool { return len(mismatching[i].Children()) > 0 },
+		func(i int) error {
+			users, err := store.UsersInRange(mismatching[i])
+			if err != nil {
+				return fmt.Errorf("failed to get users: %v", err)
+			}
+			resp.Users = append(resp.Users, models.UsersRange{StringRange: mismatching[i], Users: users})
+			return nil
+		},
+		func(i int) error {
+			subRanges := mismatching[i].Children()
+			fmt.Printf("User range %q to %q too large (%d users), splitting into %d child ranges\n",
+				mismatching[i].Start, mismatching[i].End, counts[i], len(subRanges))
+			hashed, err := storage.UsersHashRanges(store, subRanges)
+			if err != nil {
+				return err
+			}
+			children = append(children, hashed...)
+			return nil
+		})
+	return children, err
+}
+
+// batchRanges goes through mismatching ranges holding counts items, smallest
+// first, and sends those that fit in maxBatchSize items. The others are
+// split, unless splittable says they cannot be, in which case they are sent
+// anyway.
+func batchRanges(counts []int64, splittable func(i int) bool, send func(i int) error, split func(i int) error) error {
+	// Sort indices by count in ascending order
+	indicesSortedByCount := make([]int, len(counts))
+	for i := range indicesSortedByCount {
+		indicesSortedByCount[i] = i
+	}
+	sort.Slice(indicesSortedByCount, func(i, j int) bool {
+		return counts[indicesSortedByCount[i]] < counts[indicesSortedByCount[j]]
+	})
+
+	sent := int64(0)
+	for _, index := range indicesSortedByCount {
+		if sent+counts[index] <= maxBatchSize || !splittable(index) {
+			if err := send(index); err != nil {
+				return err
+			}
+			sent += counts[index]
+			continue
+		}
+		if err := split(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mismatchedSyncRanges returns the canonical ranges named in theirs whose
+// hash differs from ours. Ranges are matched by ID only; IDs that are not
+// canonical are skipped, since we could never agree on their contents.
+func mismatchedSyncRanges(theirs []models.HashedPeriod, hash func(models.Period) (string, error)) ([]models.SyncRange, error) {
+	mismatching := []models.SyncRange{}
+	for _, theirRange := range theirs {
+		r, err := models.ParseSyncRange(theirRange.RangeID)
+		if err != nil {
+			fmt.Printf("Skipping range: %v\n", err)
+			continue
+		}
+		ourHash, err := hash(r.Period())
+		if err != nil {
+			return nil, err
+		}
+		if ourHash != theirRange.Hash {
+			fmt.Printf("Found mismatching hash for range %s (our hash: %s, their hash: %s)\n",
+				r.ID, ourHash, theirRange.Hash)
+			mismatching = append(mismatching, r)
+		}
+	}
+	return mismatching, nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+
+	"axial/models"
+	"axial/storage"
+)
+
+// Sync engines. The initiator of a session picks one and names it in every
+// request; the response names the engine it was computed with.
+const (
+	// EngineTime compares hashes over the canonical sync range tree
+	EngineTime = "time"
+	// EngineRBSR is range-based set reconciliation: it compares fingerprints
+	// of ranges of the sorted ID space and splits mismatching ranges at the
+	// responder's IDs, so it does not care how items spread over time.
+	EngineRBSR = "rbsr"
+)
+
+const idRangeSplits = 16 // Number of parts a mismatching ID range is split into
+
+// computeIDRangeResponse reconciles messages and bulletins over ID ranges
+func computeIDRangeResponse(store storage.Store, req SyncRequest, resp *SyncResponse) error {
+	fmt.Printf("Received %d message ID ranges to check\n", len(req.MessageIDRanges))
+	var err error
+	resp.MessageIDRanges, err = reconcileIDRanges(req.MessageIDRanges, messagesContent(store, resp))
+	if err != nil {
+		return fmt.Errorf("failed to reconcile message ID ranges: %v", err)
+	}
+
+	fmt.Printf("Received %d bulletin ID ranges to check\n", len(req.BulletinIDRanges))
+	resp.BulletinIDRanges, err = reconcileIDRanges(req.BulletinIDRanges, bulletinsContent(store, resp))
+	if err != nil {
+		return fmt.Errorf("failed to reconcile bulletin ID ranges: %v", err)
+	}
+	return nil
+}
+
+// reconcileIDRanges compares their fingerprints with ours. Mismatching
+// ranges are sent while they fit in maxBatchSize items, the others are split
+// and their parts returned for the initiator to compare.
+func reconcileIDRanges(theirs []models.HashedIDRange, content syncContent) ([]models.HashedIDRange, error) {
+	parts := []models.HashedIDRange{}
+	sent := 0
+	for _, theirRange := range theirs {
+		ids, err := content.ids(theirRange.StringRange)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s IDs: %v", content.name, err)
+		}
+		if models.HashIDRange(theirRange.StringRange, ids).Matches(theirRange) {
+			continue
+		}
+
+		// A single item cannot be split, so it is always sent
+		if sent+len(ids) <= maxBatchSize || len(ids) <= 1 {
+			if err := content.sendIDRange(theirRange.StringRange); err != nil {
+				return nil, fmt.Errorf("failed to get %s: %v", content.name, err)
+			}
+			sent += len(ids)
+			continue
+		}
+		fmt.Printf("%s ID range %q-%q too large (%d items), splitting\n", content.name, theirRange.Start, theirRange.End, len(ids))
+		parts = append(parts, models.SplitIDRange(theirRange.StringRange, ids, idRangeSplits)...)
+	}
+	return parts, nil
+}
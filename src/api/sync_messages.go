@@ -1,16 +1,18 @@
 package api
 
 import (
-	"axial/models"
 	"encoding/json"
+	"fmt"
 	"net/http"
+
+	"axial/models"
 )
 
 type SyncMessagesRequest struct {
 	Messages []models.Message `json:"messages"`
 }
 
-func handleSyncMessages(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleSyncMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -28,20 +30,23 @@ func handleSyncMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create messages
-	for _, message := range req.Messages {
-		if err := models.DB.Create(&message).Error; err != nil {
-			// Ignore duplicate errors
-			if models.IsDuplicateError(err) {
-				continue
-			}
-			http.Error(w, "Failed to create message", http.StatusInternalServerError)
-			return
-		}
+	// Store the whole batch in one transaction and tell the sender what
+	// became of every message
+	report, err := a.Store.IngestMessages(req.Messages)
+	if err != nil {
+		fmt.Printf("Failed to ingest messages: %v\n", err)
+		http.Error(w, "Failed to store messages", http.StatusInternalServerError)
+		return
 	}
 
-	models.RefreshHashes(models.DB)
-
-	w.WriteHeader(http.StatusCreated)
+	journal := incoming(r)
+	journal.session.Received.Messages = report.Accepted
+	journal.pushed = true
+	journal.rejected = report.Rejected
+	if report.Accepted > 0 {
+		a.State.RefreshHashes(a.Store)
+	}
 
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,445 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"axial/models"
+	"axial/storage"
+)
+
+func TestComputeSyncResponseBatchesEveryType(t *testing.T) {
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	base := time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 2500; i++ {
+		createdAt := base.Add(time.Duration(i) * 20 * time.Minute)
+		m := models.Message{Base: models.Base{ID: "m" + strconv.Itoa(i), CreatedAt: createdAt}}
+		if err := store.CreateMessage(&m); err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+		b := models.Bulletin{Base: models.Base{ID: "b" + strconv.Itoa(i), CreatedAt: createdAt}}
+		if err := store.CreateBulletin(&b); err != nil {
+			t.Fatalf("create bulletin: %v", err)
+		}
+	}
+
+	year, _ := models.ParseSyncRange("Y2025")
+	empty := []models.HashedPeriod{{Period: year.Period(), RangeID: year.ID, Hash: models.HashIDs(nil)}}
+	resp, err := ComputeSyncResponse(store, SyncRequest{MessageRanges: empty, BulletinRanges: empty})
+	if err != nil {
+		t.Fatalf("compute sync response: %v", err)
+	}
+
+	// The year holds too many items of each type, so both are answered
+	// with the hashes of its months instead of the items
+	if len(resp.Messages) != 0 || len(resp.Bulletins) != 0 {
+		t.Fatalf("expected no items, got %d message and %d bulletin ranges", len(resp.Messages), len(resp.Bulletins))
+	}
+	if len(resp.MessageRanges) != 12 || len(resp.BulletinRanges) != 12 {
+		t.Fatalf("expected 12 child ranges each, got %d and %d", len(resp.MessageRanges), len(resp.BulletinRanges))
+	}
+
+	// Asking for the weeks of June returns as many whole weeks as fit in
+	// the batch and splits the others
+	june, _ := models.ParseSyncRange("M2025-06")
+	weeks := []models.HashedPeriod{}
+	for _, week := range june.Children() {
+		weeks = append(weeks, models.HashedPeriod{RangeID: week.ID, Hash: models.HashIDs(nil)})
+	}
+	resp, err = ComputeSyncResponse(store, SyncRequest{MessageRanges: weeks, BulletinRanges: weeks})
+	if err != nil {
+		t.Fatalf("compute sync response: %v", err)
+	}
+	for name, counts := range map[string][]int{"message": messageCounts(resp), "bulletin": bulletinCounts(resp)} {
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		if total == 0 || total > maxBatchSize {
+			t.Fatalf("expected between 1 and %d %ss, got %d", maxBatchSize, name, total)
+		}
+	}
+	if len(resp.MessageRanges) == 0 || len(resp.BulletinRanges) == 0 {
+		t.Fatalf("expected the weeks that did not fit to be split")
+	}
+}
+
+func messageCounts(resp SyncResponse) []int {
+	counts := []int{}
+	for _, p := range resp.Messages {
+		counts = append(counts, len(p.Messages))
+	}
+	return counts
+}
+
+func bulletinCounts(resp SyncResponse) []int {
+	counts := []int{}
+	for _, p := range resp.Bulletins {
+		counts = append(counts, len(p.Bulletins))
+	}
+	return counts
+}
+
+func TestComputeSyncResponseSplitsUserRanges(t *testing.T) {
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	const total = 2500
+	for i := 0; i < total; i++ {
+		fingerprint := fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15)
+		if i%2 == 0 {
+			fingerprint = strings.ToUpper(fingerprint)
+		}
+		u := models.User{Base: models.Base{ID: fingerprint}, Fingerprint: fingerprint}
+		if err := store.CreateUser(&u); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	// Drill down from the whole fingerprint space like an empty peer would,
+	// until every user was returned
+	empty := models.HashIDs(nil)
+	ranges := []models.HashedUsersRange{{StringRange: models.FullFingerprintRange, Hash: empty}}
+	seen := map[string]bool{}
+	for round := 0; len(ranges) > 0; round++ {
+		if round > 10 {
+			t.Fatalf("user ranges did not converge")
+		}
+		resp, err := ComputeSyncResponse(store, SyncRequest{Users: ranges})
+		if err != nil {
+			t.Fatalf("compute sync response: %v", err)
+		}
+		returned := 0
+		for _, usersRange := range resp.Users {
+			for _, u := range usersRange.Users {
+				if seen[u.Fingerprint] {
+					t.Fatalf("user %s returned twice", u.Fingerprint)
+				}
+				seen[u.Fingerprint] = true
+				returned++
+			}
+		}
+		if returned > maxBatchSize {
+			t.Fatalf("round %d returned %d users, more than %d", round, returned, maxBatchSize)
+		}
+
+		ranges = nil
+		for _, r := range resp.UserRangeHashes {
+			ranges = append(ranges, models.HashedUsersRange{StringRange: r.StringRange, Hash: empty})
+		}
+	}
+	if len(seen) != total {
+		t.Fatalf("expected %d users, got %d", total, len(seen))
+	}
+}
+
+func TestSyncPushReturnsIngestReport(t *testing.T) {
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	existing := models.Bulletin{Base: models.Base{ID: "b0"}}
+	if err := store.CreateBulletin(&existing); err != nil {
+		t.Fatalf("create bulletin: %v", err)
+	}
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+
+	body, _ := json.Marshal(SyncBulletinsRequest{Bulletins: []models.Bulletin{{Base: models.Base{ID: "b0"}}, {Base: models.Base{ID: "b1"}}}})
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/sync/bulletins", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var report models.IngestReport
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Accepted != 1 || report.Duplicates != 1 || len(report.Items) != 2 ||
+		report.Items[0].Status != models.IngestDuplicate || report.Items[1].Status != models.IngestAccepted {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestSyncRequestsAreJournaled(t *testing.T) {
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	a.RegisterAdminRoutes(mux)
+	post := func(path string, body any) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, recorder.Code, recorder.Body)
+		}
+	}
+
+	// A round and a push from the same peer make up one incoming session
+	post("/v1/sync", SyncRequest{NodeID: "node-b", Engine: EngineRBSR, MessageIDRanges: []models.HashedIDRange{models.HashIDRange(models.FullIDRange, nil)}})
+	post("/v1/sync/bulletins", SyncBulletinsRequest{Bulletins: []models.Bulletin{{Base: models.Base{ID: "b1"}}}})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/admin/sync/history", nil))
+	var history SyncHistoryResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&history); err != nil {
+		t.Fatalf("decode history: %v", err)
+	}
+	if len(history.Sessions) != 1 {
+		t.Fatalf("expected 1 session, got %+v", history.Sessions)
+	}
+	session := history.Sessions[0]
+	if session.Direction != models.SyncIncoming || session.PeerNodeID != "node-b" || session.Engine != EngineRBSR ||
+		session.Rounds != 1 || session.Received.Bulletins != 1 || session.BytesReceived == 0 || session.BytesSent == 0 {
+		t.Fatalf("unexpected session %+v", session)
+	}
+}
+
+func TestIncomingSessionErrorIsThatOfItsLastRequest(t *testing.T) {
+	store := storage.NewMemory()
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	a.RegisterAdminRoutes(mux)
+	sync := func(body string) models.SyncSession {
+		t.Helper()
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/sync", strings.NewReader(body)))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/admin/sync/history", nil))
+		var history SyncHistoryResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&history); err != nil {
+			t.Fatalf("decode history: %v", err)
+		}
+		if len(history.Sessions) != 1 {
+			t.Fatalf("expected 1 session, got %+v", history.Sessions)
+		}
+		return history.Sessions[0]
+	}
+
+	if session := sync("not json"); session.Error == "" {
+		t.Fatalf("expected the failed request to be journaled, got %+v", session)
+	}
+	// The peer retries successfully within the same session
+	if session := sync("{}"); session.Error != "" || session.Rounds != 1 {
+		t.Fatalf("expected the session to end without error, got %+v", session)
+	}
+}
+
+func TestQuarantinedPeersAreRefused(t *testing.T) {
+	store := storage.NewMemory()
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	a.RegisterAdminRoutes(mux)
+	sync := func() int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/sync", strings.NewReader("{}")))
+		return recorder.Code
+	}
+
+	// httptest requests come from 192.0.2.1
+	now := time.Now()
+	if err := store.SavePeerHealth(&models.PeerHealth{Peer: "192.0.2.1", QuarantinedAt: &now}); err != nil {
+		t.Fatalf("save peer health: %v", err)
+	}
+	if code := sync(); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a quarantined peer, got %d", code)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1/admin/peers/192.0.2.1", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 clearing the peer, got %d", recorder.Code)
+	}
+	if code := sync(); code != http.StatusOK {
+		t.Fatalf("expected 200 once cleared, got %d", code)
+	}
+}
+
+func TestResetKnownNodeSentAt(t *testing.T) {
+	store := storage.NewMemory()
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterAdminRoutes(mux)
+	reset := func(nodeID string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1/admin/nodes/"+nodeID+"/last-sent-at", nil))
+		return recorder.Code
+	}
+
+	sentAt := time.Now()
+	if err := store.PinNode(&models.KnownNode{NodeID: "axial-a", PublicKey: "aa", LastSentAt: &sentAt}); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if code := reset("axial-a"); code != http.StatusNoContent {
+		t.Fatalf("expected 204 resetting a pinned node, got %d", code)
+	}
+	if node, err := store.KnownNode("axial-a"); err != nil || node.LastSentAt != nil || node.PublicKey != "aa" {
+		t.Fatalf("expected only the sending time to be forgotten, got %+v, %v", node, err)
+	}
+	if code := reset("axial-b"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a node not pinned, got %d", code)
+	}
+}
+
+// newMidSessionStore returns a store holding more messages in 2025 than fit
+// in a batch, and a request a round of a session with an empty peer goes on
+// from
+func newMidSessionStore(t *testing.T) (storage.Store, SyncRequest) {
+	t.Helper()
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	base := time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxBatchSize; i++ {
+		m := models.Message{Base: models.Base{ID: "m" + strconv.Itoa(i), CreatedAt: base.Add(time.Duration(i) * time.Minute)}}
+		if err := store.CreateMessage(&m); err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+	}
+	return store, SyncRequest{MessageRanges: []models.HashedPeriod{{RangeID: "Y2025", Hash: models.HashIDs(nil)}}}
+}
+
+func TestPeersSharingAHostAreTrackedApart(t *testing.T) {
+	store, round := newMidSessionStore(t)
+	a := New(store, models.NewSyncState(2))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	sync := func(nodeID string, apiPort int, sourcePort int) SyncResponse {
+		t.Helper()
+		data, _ := json.Marshal(round)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/v1/sync", bytes.NewReader(data))
+		request.RemoteAddr = fmt.Sprintf("127.0.0.1:%d", sourcePort)
+		request.Header = PeerHeader(nodeID, apiPort)
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", nodeID, recorder.Code)
+		}
+		var resp SyncResponse
+		json.NewDecoder(recorder.Body).Decode(&resp)
+		return resp
+	}
+
+	// Each node on the host holds a session of its own
+	if resp := sync("axial-a", 8080, 51234); resp.IsBusy {
+		t.Fatalf("expected a session for axial-a, got %+v", resp)
+	}
+	if resp := sync("axial-b", 8081, 51235); resp.IsBusy || resp.Capacity.Active != 2 {
+		t.Fatalf("expected a second session for axial-b on the same host, got %+v", resp)
+	}
+}
+
+func TestQuarantineCoversThePeerHost(t *testing.T) {
+	store := storage.NewMemory()
+	a := New(store, models.NewSyncState(2))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	sync := func(header http.Header) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/v1/sync", strings.NewReader("{}"))
+		request.Header = header
+		mux.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// httptest requests come from 192.0.2.1
+	now := time.Now()
+	if err := store.SavePeerHealth(&models.PeerHealth{Peer: models.SyncPeer("axial-a", "192.0.2.1:8080"), QuarantinedAt: &now}); err != nil {
+		t.Fatalf("save peer health: %v", err)
+	}
+	// The quarantined node cannot get past by claiming another node ID or
+	// port, or by sending neither
+	for _, header := range []http.Header{PeerHeader("axial-a", 8080), PeerHeader("axial-b", 8080), PeerHeader("axial-a", 9090), {}} {
+		if code := sync(header); code != http.StatusForbidden {
+			t.Fatalf("expected 403 for %v from the quarantined host, got %d", header, code)
+		}
+	}
+}
+
+func TestIncomingSessionIsHeldBetweenRounds(t *testing.T) {
+	store, round := newMidSessionStore(t)
+	a := New(store, models.NewSyncState(1))
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	post := func(nodeID string, path string, body any) SyncResponse {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		request.Header = PeerHeader(nodeID, 8080)
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, recorder.Code, recorder.Body)
+		}
+		var resp SyncResponse
+		json.NewDecoder(recorder.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := post("axial-a", "/v1/sync", round); resp.IsBusy || len(resp.MessageRanges) == 0 {
+		t.Fatalf("expected the first round to start a session with ranges left, got %+v", resp)
+	}
+	// The session of axial-a outlives its round, so axial-b finds no slot
+	if resp := post("axial-b", "/v1/sync", round); !resp.IsBusy || resp.Capacity == nil || resp.Capacity.Active != 1 {
+		t.Fatalf("expected axial-b to be refused while axial-a holds the session, got %+v", resp)
+	}
+	// Further rounds and pushes of axial-a go through
+	post("axial-a", "/v1/sync/bulletins", SyncBulletinsRequest{Bulletins: []models.Bulletin{{Base: models.Base{ID: "b1"}}}})
+	if resp := post("axial-a", "/v1/sync", round); resp.IsBusy {
+		t.Fatalf("expected the second round of axial-a to go through, got %+v", resp)
+	}
+
+	// A round with no ranges left ends the session, so we can start one
+	// with axial-a right away
+	if resp := post("axial-a", "/v1/sync", SyncRequest{}); resp.IsBusy || resp.hasRanges() {
+		t.Fatalf("expected the last round of axial-a to go through, got %+v", resp)
+	}
+	if !a.State.StartSync(models.SyncPeer("axial-a", "192.0.2.1:8080")) {
+		t.Fatalf("expected an outgoing session with axial-a right after serving it, got %+v", a.State.Capacity())
+	}
+}
+
+func TestInvalidPushesQuarantineThePeer(t *testing.T) {
+	store := storage.NewMemory()
+	a := New(store, models.NewSyncState(1))
+	a.QuarantineAfter = 2
+	mux := http.NewServeMux()
+	a.RegisterPeerRoutes(mux)
+	push := func() int {
+		data, _ := json.Marshal(SyncBulletinsRequest{Bulletins: []models.Bulletin{{CreateBulletin: models.CreateBulletin{Content: "not signed"}}}})
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/sync/bulletins", bytes.NewReader(data)))
+		return recorder.Code
+	}
+
+	// Invalid pushes count once per session. httptest requests come from
+	// 192.0.2.1
+	push()
+	push()
+	health, err := store.PeerHealth("192.0.2.1")
+	if err != nil || health.InvalidSessions != 1 || health.Quarantined() {
+		t.Fatalf("expected one invalid session, got %+v, %v", health, err)
+	}
+
+	// The peer goes quiet and comes back with more
+	a.incoming.mu.Lock()
+	delete(a.incoming.sessions, "192.0.2.1")
+	a.incoming.mu.Unlock()
+	push()
+	if health, err := store.PeerHealth("192.0.2.1"); err != nil || !health.Quarantined() {
+		t.Fatalf("expected the peer to be quarantined, got %+v, %v", health, err)
+	}
+	if code := push(); code != http.StatusForbidden {
+		t.Fatalf("expected 403 once quarantined, got %d", code)
+	}
+}
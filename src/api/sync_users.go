@@ -1,16 +1,18 @@
 package api
 
 import (
-	"axial/models"
 	"encoding/json"
+	"fmt"
 	"net/http"
+
+	"axial/models"
 )
 
 type SyncUsersRequest struct {
 	Users []models.User `json:"users"`
 }
 
-func handleSyncUsers(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleSyncUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -28,20 +30,23 @@ func handleSyncUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create users
-	for _, user := range req.Users {
-		if err := models.DB.Create(&user).Error; err != nil {
-			// Ignore duplicate errors
-			if models.IsDuplicateError(err) {
-				continue
-			}
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			return
-		}
+	// Store the whole batch in one transaction and tell the sender what
+	// became of every user
+	report, err := a.Store.IngestUsers(req.Users)
+	if err != nil {
+		fmt.Printf("Failed to ingest users: %v\n", err)
+		http.Error(w, "Failed to store users", http.StatusInternalServerError)
+		return
 	}
 
-	models.RefreshHashes(models.DB)
-
-	w.WriteHeader(http.StatusCreated)
+	journal := incoming(r)
+	journal.session.Received.Users = report.Accepted
+	journal.pushed = true
+	journal.rejected = report.Rejected
+	if report.Accepted > 0 {
+		a.State.RefreshHashes(a.Store)
+	}
 
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
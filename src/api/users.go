@@ -3,7 +3,6 @@ package api
 import (
 	"axial/models"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,14 +14,14 @@ type UserRegistration struct {
 	PublicKey   string `json:"public_key"`
 }
 
-func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleGetUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var users []models.User
-	if err := models.DB.Find(&users).Error; err != nil {
+	users, err := a.Store.Users()
+	if err != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
 	}
@@ -31,7 +30,7 @@ func handleGetUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
-func handleGetUser(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -43,8 +42,8 @@ func handleGetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User
-	if err := models.DB.Where("fingerprint = ?", fingerprint).First(&user).Error; err != nil {
+	user, err := a.Store.UserByFingerprint(fingerprint)
+	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
@@ -53,7 +52,7 @@ func handleGetUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
-func handleRegisterUser(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -71,18 +70,18 @@ func handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	if err := models.DB.Create(&user).Error; err != nil {
+	if err := a.Store.CreateUser(&user); err != nil {
 		http.Error(w, "Failed to register user", http.StatusInternalServerError)
 		return
 	}
 
-	models.RefreshHashes(models.DB)
+	a.State.RefreshHashes(a.Store)
 
 	w.WriteHeader(http.StatusCreated)
 } 
 
 // GET /v1/users/search?q=...&limit=20&offset=0
-func handleSearchUsers(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleSearchUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -124,20 +123,9 @@ func handleSearchUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var users []models.User
-	var total int64
 	// Fingerprint substring match (case-insensitive)
-	if err := models.DB.Model(&models.User{}).
-		Where("fingerprint ILIKE ?", "%"+q+"%").
-		Count(&total).Error; err != nil {
-		http.Error(w, "Failed to count users", http.StatusInternalServerError)
-		return
-	}
-	if err := models.DB.
-		Where("fingerprint ILIKE ?", "%"+q+"%").
-		Order("fingerprint ASC").
-		Limit(limit).Offset(offset).
-		Find(&users).Error; err != nil {
+	users, total, err := a.Store.SearchUsers(q, limit, offset)
+	if err != nil {
 		http.Error(w, "Failed to search users", http.StatusInternalServerError)
 		return
 	}
@@ -154,7 +142,7 @@ func handleSearchUsers(w http.ResponseWriter, r *http.Request) {
 
 // GET /v1/users/recent?limit=10
 // Derive distinct counterpart fingerprints from messages involving the current user.
-func handleRecentUsers(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleRecentUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -174,14 +162,9 @@ func handleRecentUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch messages where the user is sender or among recipients (JSONB array contains)
-	var messages []models.Message
-	arrayContains := fmt.Sprintf("[\"%s\"]", current)
-	if err := models.DB.
-		Where("sender = ?", current).
-		Or("to_jsonb(recipients)::jsonb @> ?", arrayContains).
-		Order("created_at DESC").
-		Find(&messages).Error; err != nil {
+	// Fetch messages where the user is sender or among recipients (JSON array contains)
+	messages, err := a.Store.MessagesInvolving(current)
+	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
@@ -226,12 +209,10 @@ func handleRecentUsers(w http.ResponseWriter, r *http.Request) {
 	// Fetch users for these fingerprints, preserving order
 	fps := make([]string, 0, len(pairs))
 	for _, p := range pairs { fps = append(fps, p.fp) }
-	var users []models.User
-	if len(fps) > 0 {
-		if err := models.DB.Where("fingerprint IN ?", fps).Find(&users).Error; err != nil {
-			http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
-			return
-		}
+	users, err := a.Store.UsersByFingerprints(fps)
+	if err != nil {
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
 	}
 	// Map for quick lookup
 	umap := map[string]models.User{}
@@ -1,54 +1,232 @@
 package config
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
-func LoadConfig() (Config, error) {
-	cfg := Config{}
+// DefaultConfigPath is the YAML file read when no --config flag is given.
+const DefaultConfigPath = "config.yaml"
 
-	// Load from ./config.yaml
-	file, err := os.Open("config.yaml")
+// Source identifies the configuration layer that supplied a value.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceArgs    Source = "args"
+)
+
+// Sources maps each configuration key, written as its dotted yaml path
+// (e.g. "database.host"), to the layer that supplied its value.
+type Sources map[string]Source
+
+// Defaults returns the configuration used before any file, environment
+// variable or command-line flag is applied.
+func Defaults() Config {
+	hostname, err := os.Hostname()
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("Config file not found, using default values")
-			hostname, err := os.Hostname()
-			if err != nil {
-				hostname = "no-hostname"
-			}
-			cfg = Config{
-				NodeID:           fmt.Sprintf("axial-%s", hostname),
-				MulticastAddress: "255.255.255.255",
-				MulticastPort:    45678,
-				APIPort:          8080,
-				LogLevel:         "info",
-				FileStoragePath:  "./data/files",
-				MaxFileSize:      100 * 1024 * 1024, // 100MB default
-				Database: DatabaseConfig{
-					Host:     "localhost",
-					Port:     5432,
-					User:     "axial",
-					Password: "development_only",
-					Name:     "axial",
-				},
-			}
-			return cfg, nil
-		}
-		return cfg, err
+		hostname = "no-hostname"
+	}
+	return Config{
+		NodeID:           fmt.Sprintf("axial-%s", hostname),
+		MulticastAddress: "255.255.255.255",
+		MulticastPort:    45678,
+		APIPort:          8080,
+		AdminAddress:     "127.0.0.1:0", // any free port, so nodes in one process do not collide
+		LogLevel:         "info",
+		FileStoragePath:  "./data/files",
+		MaxFileSize:      100 * 1024 * 1024, // 100MB default
+		ShutdownTimeout:  10 * time.Second,
+		Database: DatabaseConfig{
+			Driver:   "postgres",
+			Path:     "./data/axial.db",
+			Host:     "localhost",
+			Port:     5432,
+			User:     "axial",
+			Password: "development_only",
+			Name:     "axial",
+		},
+		Sync: SyncConfig{
+			Engine:           "rbsr",
+			MaxSessions:      4,
+			CheckpointMaxAge: 30 * 24 * time.Hour,
+			JournalMaxAge:    7 * 24 * time.Hour,
+			RetryBackoff:     10 * time.Second,
+			MaxRetryBackoff:  time.Hour,
+			QuarantineAfter:  3,
+		},
+		Discovery: DiscoveryConfig{
+			NodeKey:           "./data/node.key",
+			LegacyBeacons:     true,
+			MaxKnownNodes:     1000,
+			MaxClockStep:      time.Minute,
+			MulticastTTL:      2,
+			MulticastAddress6: "ff02::a71a",
+			RescanInterval:    10 * time.Second,
+			PeerPollInterval:  30 * time.Second,
+		},
 	}
-	defer file.Close()
+}
 
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&cfg)
+// LoadConfig loads the configuration from the command-line arguments and the
+// process environment, and prints where each value came from.
+func LoadConfig(args []string) (Config, error) {
+	cfg, sources, err := Load(args, os.LookupEnv)
 	if err != nil {
 		return cfg, err
 	}
-	
-	fmt.Println("Config loaded from config.yaml:")
-	fmt.Printf("%+v\n", cfg)
+
+	fmt.Println("Configuration:")
+	fmt.Print(sources.Describe(cfg))
 
 	return cfg, nil
 }
+
+// Load merges, in increasing order of precedence, the defaults, the YAML file
+// chosen with --config (or ./config.yaml if present), environment variables
+// named by the `env` struct tags and command-line flags named by the `args`
+// struct tags. It returns the merged configuration and the source of every
+// value.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, Sources, error) {
+	cfg := Defaults()
+	fields := collectFields(&cfg)
+
+	sources := Sources{}
+	for _, f := range fields {
+		sources[f.key] = SourceDefault
+	}
+
+	// Flags are parsed first so --config is known before reading the file,
+	// but their values are only applied after the file and the environment.
+	configPath := ""
+	flagValues := map[string]string{}
+	flagSet := flag.NewFlagSet("axial", flag.ContinueOnError)
+	flagSet.StringVar(&configPath, "config", "", "path to a YAML configuration file")
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		key := f.key
+		usage := fmt.Sprintf("sets %s (env %s)", f.key, f.env)
+		set := func(value string) error {
+			flagValues[key] = value
+			return nil
+		}
+		// Bools may be given bare, like --legacy-beacons
+		if f.value.Kind() == reflect.Bool {
+			flagSet.BoolFunc(f.flag, usage, set)
+		} else {
+			flagSet.Func(f.flag, usage, set)
+		}
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return cfg, sources, err
+	}
+	if flagSet.NArg() > 0 {
+		return cfg, sources, fmt.Errorf("unexpected arguments: %v", flagSet.Args())
+	}
+
+	if err := loadFile(&cfg, fields, sources, configPath); err != nil {
+		return cfg, sources, err
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		value, ok := lookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, value); err != nil {
+			return cfg, sources, fmt.Errorf("invalid value for %s: %v", f.env, err)
+		}
+		sources[f.key] = SourceEnv
+	}
+
+	for _, f := range fields {
+		value, ok := flagValues[f.key]
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, value); err != nil {
+			return cfg, sources, fmt.Errorf("invalid value for --%s: %v", f.flag, err)
+		}
+		sources[f.key] = SourceArgs
+	}
+
+	return cfg, sources, nil
+}
+
+// loadFile decodes the YAML file at path into cfg. An empty path falls back
+// to DefaultConfigPath, which is allowed to be missing.
+func loadFile(cfg *Config, fields []field, sources Sources, path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfigPath
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			fmt.Println("Config file not found, using default values")
+			return nil
+		}
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	// Decode once more without a schema to learn which keys the file set.
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	for _, f := range fields {
+		if hasKey(raw, strings.Split(f.key, ".")) {
+			sources[f.key] = SourceFile
+		}
+	}
+
+	fmt.Printf("Config loaded from %s\n", path)
+	return nil
+}
+
+func hasKey(node map[interface{}]interface{}, path []string) bool {
+	value, ok := node[path[0]]
+	if !ok {
+		return false
+	}
+	if len(path) == 1 {
+		return true
+	}
+	child, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	return hasKey(child, path[1:])
+}
+
+// Describe renders one line per configuration key with its value and source.
+// Secrets are masked.
+func (s Sources) Describe(cfg Config) string {
+	b := strings.Builder{}
+	for _, f := range collectFields(&cfg) {
+		value := fmt.Sprintf("%v", f.value.Interface())
+		if strings.Contains(f.key, "password") && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(&b, "  %s = %s (%s)\n", f.key, value, s[f.key])
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func envMap(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+node_id: from-file
+api_port: 9000
+multicast_port: 4000
+database:
+  host: db.file
+  port: 6543
+`)
+
+	env := envMap(map[string]string{
+		"API_PORT": "9100",
+		"DB_HOST":  "db.env",
+	})
+	args := []string{"--config", path, "--api-port", "9200"}
+
+	cfg, sources, err := Load(args, env)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	cases := []struct {
+		key    string
+		got    interface{}
+		want   interface{}
+		source Source
+	}{
+		{"node_id", cfg.NodeID, "from-file", SourceFile},
+		{"multicast_port", cfg.MulticastPort, 4000, SourceFile},
+		{"api_port", cfg.APIPort, 9200, SourceArgs},
+		{"log_level", cfg.LogLevel, "info", SourceDefault},
+		{"database.host", cfg.Database.Host, "db.env", SourceEnv},
+		{"database.port", cfg.Database.Port, 6543, SourceFile},
+		{"database.user", cfg.Database.User, "axial", SourceDefault},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.key, c.got, c.want)
+		}
+		if sources[c.key] != c.source {
+			t.Errorf("%s source = %s, want %s", c.key, sources[c.key], c.source)
+		}
+	}
+}
+
+func TestLoadMissingExplicitFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	if _, _, err := Load([]string{"--config", missing}, envMap(nil)); err == nil {
+		t.Fatalf("expected error for missing --config file")
+	}
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+	path := writeConfigFile(t, "node_id: n\n")
+	env := envMap(map[string]string{"MULTICAST_PORT": "not-a-number"})
+	if _, _, err := Load([]string{"--config", path}, env); err == nil {
+		t.Fatalf("expected error for invalid MULTICAST_PORT")
+	}
+}
+
+func TestLoadBareBoolFlag(t *testing.T) {
+	path := writeConfigFile(t, "discovery:\n  legacy_beacons: false\n")
+	cfg, sources, err := Load([]string{"--config", path, "--legacy-beacons"}, envMap(nil))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !cfg.Discovery.LegacyBeacons || sources["discovery.legacy_beacons"] != SourceArgs {
+		t.Fatalf("expected a bare flag to set legacy_beacons, got %v from %s", cfg.Discovery.LegacyBeacons, sources["discovery.legacy_beacons"])
+	}
+
+	cfg, _, err = Load([]string{"--config", path, "--legacy-beacons=false"}, envMap(nil))
+	if err != nil || cfg.Discovery.LegacyBeacons {
+		t.Fatalf("expected --legacy-beacons=false to clear it, got %v, %v", cfg.Discovery.LegacyBeacons, err)
+	}
+}
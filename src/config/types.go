@@ -1,20 +1,73 @@
 package config
 
+import "time"
+
 type DatabaseConfig struct {
-	Host     string `yaml:"host" env:"DB_HOST"`
-	Port     int    `yaml:"port" env:"DB_PORT"`
-	User     string `yaml:"user" env:"DB_USER"`
-	Password string `yaml:"password" env:"DB_PASSWORD"`
-	Name     string `yaml:"name" env:"DB_NAME"`
+	Driver   string `args:"--db-driver" yaml:"driver" env:"DB_DRIVER"` // postgres or sqlite
+	Path     string `args:"--db-path" yaml:"path" env:"DB_PATH"`       // sqlite database file
+	Host     string `args:"--db-host" yaml:"host" env:"DB_HOST"`
+	Port     int    `args:"--db-port" yaml:"port" env:"DB_PORT"`
+	User     string `args:"--db-user" yaml:"user" env:"DB_USER"`
+	Password string `args:"--db-password" yaml:"password" env:"DB_PASSWORD"`
+	Name     string `args:"--db-name" yaml:"name" env:"DB_NAME"`
+}
+
+// SyncConfig tunes the sync sessions this node runs
+type SyncConfig struct {
+	Engine           string        `args:"--sync-engine" yaml:"engine" env:"SYNC_ENGINE"`                                     // rbsr or time, rbsr falls back to time
+	MaxSessions      int           `args:"--sync-max-sessions" yaml:"max_sessions" env:"SYNC_MAX_SESSIONS"`                   // concurrent sessions, at most one per peer
+	CheckpointMaxAge time.Duration `args:"--sync-checkpoint-max-age" yaml:"checkpoint_max_age" env:"SYNC_CHECKPOINT_MAX_AGE"` // unfinished sessions older than this start over
+	JournalMaxAge    time.Duration `args:"--sync-journal-max-age" yaml:"journal_max_age" env:"SYNC_JOURNAL_MAX_AGE"`          // journaled sessions that ended longer ago are deleted
+	RetryBackoff     time.Duration `args:"--sync-retry-backoff" yaml:"retry_backoff" env:"SYNC_RETRY_BACKOFF"`                // wait after a failed session, doubled with every failure in a row
+	MaxRetryBackoff  time.Duration `args:"--sync-max-retry-backoff" yaml:"max_retry_backoff" env:"SYNC_MAX_RETRY_BACKOFF"`
+	QuarantineAfter  int           `args:"--sync-quarantine-after" yaml:"quarantine_after" env:"SYNC_QUARANTINE_AFTER"` // sessions in a row serving invalid items
+}
+
+// DiscoveryConfig sets how nodes announce themselves and which
+// announcements they trust
+type DiscoveryConfig struct {
+	NodeKey           string        `args:"--node-key" yaml:"node_key" env:"NODE_KEY"`                                          // ed25519 key our beacons are signed with, created if missing
+	TrustedKeys       []string      `args:"--trusted-keys" yaml:"trusted_keys" env:"TRUSTED_KEYS"`                              // hex public keys; when set, beacons signed by other keys are ignored. Without them any node, forged or not, can trigger syncs
+	MaxKnownNodes     int           `args:"--max-known-nodes" yaml:"max_known_nodes" env:"MAX_KNOWN_NODES"`                     // node IDs whose keys are pinned at most; beacons of new ones are ignored beyond
+	MaxClockStep      time.Duration `args:"--max-clock-step" yaml:"max_clock_step" env:"MAX_CLOCK_STEP"`                        // how far back the clock of a node may step between its beacons before they count as replays
+	LegacyBeacons     bool          `args:"--legacy-beacons" yaml:"legacy_beacons" env:"LEGACY_BEACONS"`                        // also send and accept unsigned pipe-separated beacons
+	Modes             []string      `args:"--discovery-modes" yaml:"modes" env:"DISCOVERY_MODES"`                               // multicast, multicast6, broadcast and/or directed; defaults to the mode of multicast_address
+	MulticastTTL      int           `args:"--multicast-ttl" yaml:"multicast_ttl" env:"MULTICAST_TTL"`                           // hops multicast beacons may travel
+	MulticastAddress6 string        `args:"--multicast-address6" yaml:"multicast_address6" env:"MULTICAST_ADDRESS6"`            // IPv6 group of the multicast6 mode, e.g. ff02:: link-local or ff05:: site-local
+	RescanInterval    time.Duration `args:"--discovery-rescan-interval" yaml:"rescan_interval" env:"DISCOVERY_RESCAN_INTERVAL"` // how often interfaces are checked for ones that came up or went away
+	PeerPollInterval  time.Duration `args:"--peer-poll-interval" yaml:"peer_poll_interval" env:"PEER_POLL_INTERVAL"`            // how often the configured peers are pinged
+}
+
+// ListenerConfig describes one TCP address the API is served on. Setting both
+// CertFile and KeyFile serves HTTPS instead of plain HTTP.
+type ListenerConfig struct {
+	Address  string `yaml:"address"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// PeerConfig is a node polled for its hashes, for networks beacons do not
+// reach. Address is host:port, or an http or https URL. Setting NodeKey
+// syncs with the node only if it signs with that key.
+type PeerConfig struct {
+	Address string `yaml:"address"`
+	NodeKey string `yaml:"node_key"` // hex public key
 }
 
 type Config struct {
-	NodeID           string         `args:"--node-id" yaml:"node_id" env:"NODE_ID"`
-	MulticastAddress string         `args:"--multicast-address" yaml:"multicast_address" env:"MULTICAST_ADDRESS"`
-	MulticastPort    int            `args:"--multicast-port" yaml:"multicast_port" env:"MULTICAST_PORT"`
-	APIPort          int            `args:"--api-port" yaml:"api_port" env:"API_PORT"`
-	LogLevel         string         `args:"--log-level" yaml:"log_level" env:"LOG_LEVEL"`
-	FileStoragePath  string         `args:"--file-storage-path" yaml:"file_storage_path" env:"FILE_STORAGE_PATH"`
-	MaxFileSize      int64          `args:"--max-file-size" yaml:"max_file_size" env:"MAX_FILE_SIZE"` // in bytes
-	Database         DatabaseConfig `yaml:"database"`
+	NodeID           string           `args:"--node-id" yaml:"node_id" env:"NODE_ID"`
+	MulticastAddress string           `args:"--multicast-address" yaml:"multicast_address" env:"MULTICAST_ADDRESS"`
+	MulticastPort    int              `args:"--multicast-port" yaml:"multicast_port" env:"MULTICAST_PORT"`
+	APIPort          int              `args:"--api-port" yaml:"api_port" env:"API_PORT"`
+	Listeners        []ListenerConfig `yaml:"listeners"`                                                // defaults to ":<api_port>"
+	UnixSocket       string           `args:"--unix-socket" yaml:"unix_socket" env:"UNIX_SOCKET"`       // serves the UI and admin API locally
+	AdminAddress     string           `args:"--admin-address" yaml:"admin_address" env:"ADMIN_ADDRESS"` // loopback address serving them without unix_socket
+	LogLevel         string           `args:"--log-level" yaml:"log_level" env:"LOG_LEVEL"`
+	FileStoragePath  string           `args:"--file-storage-path" yaml:"file_storage_path" env:"FILE_STORAGE_PATH"`
+	MaxFileSize      int64            `args:"--max-file-size" yaml:"max_file_size" env:"MAX_FILE_SIZE"`          // in bytes
+	ShutdownTimeout  time.Duration    `args:"--shutdown-timeout" yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // grace period for in-flight syncs
+	Database         DatabaseConfig   `yaml:"database"`
+	Sync             SyncConfig       `yaml:"sync"`
+	Discovery        DiscoveryConfig  `yaml:"discovery"`
+	Peers            []PeerConfig     `yaml:"peers"` // polled every discovery.peer_poll_interval
 }
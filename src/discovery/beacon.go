@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"axial/models"
+)
+
+// A beacon announces a node, the hashes of its data and where its API is.
+// Version 1 is laid out as, in network byte order:
+//
+//	magic         4 bytes  "AXBN"
+//	version       1 byte
+//	capabilities  4 bytes  Capability flags
+//	api port      2 bytes
+//	sent at       8 bytes  Unix nanoseconds
+//	node ID       1 byte length, then the ID
+//	hashes        32 bytes each: messages, bulletins, users
+//	public key    32 bytes ed25519
+//	signature     64 bytes ed25519, of everything before it
+//
+// The full hash is derived from the per-type hashes. Nodes before version 1
+// sent "nodeID|hash|:port|localIP" strings, which are still understood while
+// legacy beacons are enabled.
+var beaconMagic = []byte("AXBN")
+
+// BeaconVersion is the beacon format this node sends
+const BeaconVersion = 1
+
+// Capability flags a node announces in its beacons
+const (
+	CapabilityRBSR uint32 = 1 << iota // speaks the rbsr sync engine
+	CapabilityTime                    // speaks the time sync engine
+)
+
+// ourCapabilities are the capabilities of this build
+const ourCapabilities = CapabilityRBSR | CapabilityTime
+
+const hashSize = 32
+
+// ErrBadSignature is returned for beacons whose signature does not match
+// their content and key
+var ErrBadSignature = errors.New("invalid beacon signature")
+
+// Beacon is a decoded beacon
+type Beacon struct {
+	Version      int
+	NodeID       string
+	Hashes       models.HashSet
+	APIPort      int
+	Capabilities uint32
+	SentAt       time.Time
+	// PublicKey is the key the beacon was signed with, nil for legacy
+	// beacons
+	PublicKey ed25519.PublicKey
+}
+
+// Signed reports whether the beacon was signed, i.e. is not a legacy one
+func (b Beacon) Signed() bool {
+	return b.PublicKey != nil
+}
+
+func (b Beacon) String() string {
+	if !b.Signed() {
+		return fmt.Sprintf("legacy beacon of %s: hash %s, port %d", b.NodeID, b.Hashes.Full, b.APIPort)
+	}
+	return fmt.Sprintf("beacon v%d of %s (key %x): hash %s, port %d", b.Version, b.NodeID, []byte(b.PublicKey), b.Hashes.Full, b.APIPort)
+}
+
+// EncodeBeacon returns b in the current format, signed with key. Its
+// Version and PublicKey are ignored.
+func EncodeBeacon(b Beacon, key ed25519.PrivateKey) ([]byte, error) {
+	if len(b.NodeID) == 0 || len(b.NodeID) > 255 {
+		return nil, fmt.Errorf("node ID must be 1 to 255 bytes long, got %d", len(b.NodeID))
+	}
+	if b.APIPort <= 0 || b.APIPort > 65535 {
+		return nil, fmt.Errorf("invalid API port %d", b.APIPort)
+	}
+
+	buf := bytes.Buffer{}
+	buf.Write(beaconMagic)
+	buf.WriteByte(BeaconVersion)
+	binary.Write(&buf, binary.BigEndian, b.Capabilities)
+	binary.Write(&buf, binary.BigEndian, uint16(b.APIPort))
+	binary.Write(&buf, binary.BigEndian, b.SentAt.UnixNano())
+	buf.WriteByte(byte(len(b.NodeID)))
+	buf.WriteString(b.NodeID)
+	for _, hash := range []string{b.Hashes.Messages, b.Hashes.Bulletins, b.Hashes.Users} {
+		raw, err := hex.DecodeString(hash)
+		if err != nil || len(raw) != hashSize {
+			return nil, fmt.Errorf("invalid hash %q", hash)
+		}
+		buf.Write(raw)
+	}
+	buf.Write(key.Public().(ed25519.PublicKey))
+	buf.Write(ed25519.Sign(key, buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// IsBinaryBeacon reports whether data looks like a beacon of any version
+// rather than a legacy one
+func IsBinaryBeacon(data []byte) bool {
+	return bytes.HasPrefix(data, beaconMagic)
+}
+
+// DecodeBeacon parses a binary beacon and checks it is signed by the key it
+// carries. Whether that key is to be trusted is up to the caller.
+func DecodeBeacon(data []byte) (Beacon, error) {
+	if !IsBinaryBeacon(data) {
+		return Beacon{}, fmt.Errorf("not a beacon")
+	}
+	r := bytes.NewReader(data[len(beaconMagic):])
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return Beacon{}, fmt.Errorf("truncated beacon")
+	}
+	if version != BeaconVersion {
+		return Beacon{}, fmt.Errorf("unsupported beacon version %d", version)
+	}
+
+	var header struct {
+		Capabilities uint32
+		APIPort      uint16
+		SentAt       int64
+		NodeIDLength uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return Beacon{}, fmt.Errorf("truncated beacon")
+	}
+	nodeID := make([]byte, header.NodeIDLength)
+	hashes := make([]byte, 3*hashSize)
+	publicKey := make([]byte, ed25519.PublicKeySize)
+	signature := make([]byte, ed25519.SignatureSize)
+	for _, part := range [][]byte{nodeID, hashes, publicKey, signature} {
+		if _, err := io.ReadFull(r, part); err != nil {
+			return Beacon{}, fmt.Errorf("truncated beacon")
+		}
+	}
+	if r.Len() != 0 {
+		return Beacon{}, fmt.Errorf("%d trailing bytes in beacon", r.Len())
+	}
+	if len(nodeID) == 0 {
+		return Beacon{}, fmt.Errorf("beacon without node ID")
+	}
+
+	if !ed25519.Verify(publicKey, data[:len(data)-ed25519.SignatureSize], signature) {
+		return Beacon{}, ErrBadSignature
+	}
+
+	return Beacon{
+		Version:      int(version),
+		NodeID:       string(nodeID),
+		Hashes:       models.NewHashSet(hex.EncodeToString(hashes[:hashSize]), hex.EncodeToString(hashes[hashSize:2*hashSize]), hex.EncodeToString(hashes[2*hashSize:])),
+		APIPort:      int(header.APIPort),
+		Capabilities: header.Capabilities,
+		SentAt:       time.Unix(0, header.SentAt),
+		PublicKey:    ed25519.PublicKey(publicKey),
+	}, nil
+}
+
+// encodeLegacyBeacon returns b as the unsigned string of the nodes before
+// BeaconVersion
+func encodeLegacyBeacon(b Beacon, localIP string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|:%d|%s", b.NodeID, b.Hashes.Full, b.APIPort, localIP))
+}
+
+// decodeLegacyBeacon parses an unsigned "nodeID|hash|:port|localIP" beacon.
+// Only its node ID, full hash and port are known.
+func decodeLegacyBeacon(data []byte) (Beacon, error) {
+	// axial.local|74d63e48f0e18e7c300904b49457a630ec782c244fb212273742ce1499cd21ef|:8080|0.0.0.0
+	parts := strings.Split(string(data), "|")
+	if len(parts) != 4 {
+		return Beacon{}, fmt.Errorf("not a beacon")
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(parts[2], ":"))
+	if err != nil || port <= 0 || port > 65535 {
+		return Beacon{}, fmt.Errorf("invalid port %q in legacy beacon", parts[2])
+	}
+	return Beacon{
+		NodeID:  parts[0],
+		Hashes:  models.HashSet{Full: parts[1]},
+		APIPort: port,
+	}, nil
+}
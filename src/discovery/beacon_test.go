@@ -0,0 +1,327 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"axial/config"
+	"axial/models"
+	"axial/storage"
+	"axial/synchronization"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func testHashes() models.HashSet {
+	return models.NewHashSet(models.HashIDs([]string{"m1"}), models.HashIDs([]string{"b1"}), models.HashIDs(nil))
+}
+
+func newTestBeacons(t *testing.T, nodeID string, key ed25519.PrivateKey, store storage.Store, configure func(*config.Config)) *Beacons {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.NodeID = nodeID
+	if configure != nil {
+		configure(&cfg)
+	}
+	beacons, err := NewBeacons(cfg, key, store)
+	if err != nil {
+		t.Fatalf("new beacons: %v", err)
+	}
+	return beacons
+}
+
+func TestBeaconRoundTrip(t *testing.T) {
+	key := newKey(t)
+	sent := Beacon{NodeID: "axial-a", Hashes: testHashes(), APIPort: 8080, Capabilities: ourCapabilities, SentAt: time.Now()}
+	data, err := EncodeBeacon(sent, key)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	got, err := DecodeBeacon(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.NodeID != sent.NodeID || got.Hashes != sent.Hashes || got.APIPort != 8080 || got.Capabilities != ourCapabilities || !got.SentAt.Equal(sent.SentAt) || got.Version != BeaconVersion {
+		t.Fatalf("expected %+v back, got %+v", sent, got)
+	}
+	if !got.PublicKey.Equal(key.Public()) {
+		t.Fatalf("expected the signing key in the beacon")
+	}
+
+	// Any change to the content invalidates the signature
+	for _, i := range []int{len(beaconMagic) + 6, len(data) - ed25519.SignatureSize - 1} {
+		tampered := append([]byte(nil), data...)
+		tampered[i] ^= 1
+		if _, err := DecodeBeacon(tampered); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("expected ErrBadSignature with byte %d changed, got %v", i, err)
+		}
+	}
+	if _, err := DecodeBeacon(data[:len(data)-1]); err == nil {
+		t.Fatalf("expected a truncated beacon to be refused")
+	}
+	future := append([]byte(nil), data...)
+	future[len(beaconMagic)] = BeaconVersion + 1
+	if _, err := DecodeBeacon(future); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("expected an unsupported version to be refused, got %v", err)
+	}
+}
+
+func TestBeaconsPinKeysAndRefuseReplays(t *testing.T) {
+	store := storage.NewMemory()
+	us := newTestBeacons(t, "axial-us", newKey(t), store, nil)
+	peerKey := newKey(t)
+	peer := newTestBeacons(t, "axial-peer", peerKey, storage.NewMemory(), nil)
+
+	messages, err := peer.Encode(testHashes(), 8080, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected a signed and a legacy beacon, got %d", len(messages))
+	}
+	beacon, err := us.Accept(messages[0])
+	if err != nil || beacon.NodeID != "axial-peer" {
+		t.Fatalf("expected the first beacon to be accepted, got %+v, %v", beacon, err)
+	}
+	if pinned, err := store.KnownNode("axial-peer"); err != nil || pinned.PublicKey != hex.EncodeToString(peerKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("expected the peer key to be pinned, got %+v, %v", pinned, err)
+	}
+	if _, err := us.Accept(messages[0]); !errors.Is(err, errDuplicateBeacon) {
+		t.Fatalf("expected another copy of the beacon to be a duplicate, got %v", err)
+	}
+	// Beacons sent within max_clock_step of the newest may be the clock of
+	// the node stepping back, older ones are replays
+	older, err := EncodeBeacon(Beacon{NodeID: "axial-peer", Hashes: testHashes(), APIPort: 8080, SentAt: time.Now().Add(-time.Hour)}, peerKey)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	newer, err := peer.Encode(testHashes(), 8080, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := us.Accept(newer[0]); err != nil {
+		t.Fatalf("expected a newer beacon to be accepted, got %v", err)
+	}
+	if _, err := us.Accept(older); err == nil || errors.Is(err, errDuplicateBeacon) {
+		t.Fatalf("expected a replayed beacon to be refused, got %v", err)
+	}
+	// Once the node signs, its legacy beacons may be forged
+	if _, err := us.Accept(messages[1]); err == nil {
+		t.Fatalf("expected a legacy beacon of a pinned node to be refused")
+	}
+
+	// Another key cannot speak for the pinned node
+	impostor := newTestBeacons(t, "axial-peer", newKey(t), storage.NewMemory(), nil)
+	forged, err := impostor.Encode(testHashes(), 8080, "10.0.0.3")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := us.Accept(forged[0]); err == nil {
+		t.Fatalf("expected a beacon signed with another key to be refused")
+	}
+
+	// Until the operator forgets it
+	if err := store.ForgetNode("axial-peer"); err != nil {
+		t.Fatalf("forget: %v", err)
+	}
+	if _, err := us.Accept(forged[0]); err != nil {
+		t.Fatalf("expected the new key to be pinned once forgotten, got %v", err)
+	}
+
+	// Our own beacons are skipped
+	own, err := us.Encode(testHashes(), 8080, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := us.Accept(own[0]); !errors.Is(err, errOwnBeacon) {
+		t.Fatalf("expected our own beacon to be skipped, got %v", err)
+	}
+}
+
+func TestBeaconsRememberReplaysAndCapPins(t *testing.T) {
+	store := storage.NewMemory()
+	us := newTestBeacons(t, "axial-us", newKey(t), store, func(cfg *config.Config) {
+		cfg.Discovery.MaxKnownNodes = 1
+	})
+	peerKey := newKey(t)
+	peer := newTestBeacons(t, "axial-peer", peerKey, storage.NewMemory(), nil)
+	older, err := EncodeBeacon(Beacon{NodeID: "axial-peer", Hashes: testHashes(), APIPort: 8080, SentAt: time.Now().Add(-time.Hour)}, peerKey)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	newer, err := peer.Sign(testHashes(), 8080)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := us.Accept(newer); err != nil {
+		t.Fatalf("expected the beacon to be accepted, got %v", err)
+	}
+
+	// A restarted node still knows the older beacon is a replay
+	restarted := newTestBeacons(t, "axial-us", newKey(t), store, func(cfg *config.Config) {
+		cfg.Discovery.MaxKnownNodes = 1
+	})
+	if _, err := restarted.Accept(older); err == nil || errors.Is(err, errDuplicateBeacon) {
+		t.Fatalf("expected a beacon replayed after a restart to be refused, got %v", err)
+	}
+
+	// Node IDs past max_known_nodes are not pinned
+	other := newTestBeacons(t, "axial-other", newKey(t), storage.NewMemory(), nil)
+	beacon, err := other.Sign(testHashes(), 8080)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := restarted.Accept(beacon); err == nil {
+		t.Fatalf("expected a beacon of a node past max_known_nodes to be refused")
+	}
+	if count, _ := store.CountKnownNodes(); count != 1 {
+		t.Fatalf("expected 1 pinned node, got %d", count)
+	}
+}
+
+func TestBeaconsAcceptClocksSteppingBack(t *testing.T) {
+	store := storage.NewMemory()
+	us := newTestBeacons(t, "axial-us", newKey(t), store, nil)
+	peerKey := newKey(t)
+	sentAt := func(at time.Time) []byte {
+		t.Helper()
+		data, err := EncodeBeacon(Beacon{NodeID: "axial-peer", Hashes: testHashes(), APIPort: 8080, SentAt: at}, peerKey)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return data
+	}
+	base := time.Now()
+	if _, err := us.Accept(sentAt(base)); err != nil {
+		t.Fatalf("expected the first beacon to be accepted, got %v", err)
+	}
+
+	// The clock of the peer steps back by less than max_clock_step: its
+	// beacons go on from there, and copies are still duplicates
+	stepped := base.Add(-30 * time.Second)
+	if _, err := us.Accept(sentAt(stepped)); err != nil {
+		t.Fatalf("expected a beacon after a small clock step to be accepted, got %v", err)
+	}
+	if _, err := us.Accept(sentAt(stepped)); !errors.Is(err, errDuplicateBeacon) {
+		t.Fatalf("expected another copy to be a duplicate, got %v", err)
+	}
+	next := stepped.Add(10 * time.Second)
+	if _, err := us.Accept(sentAt(next)); err != nil {
+		t.Fatalf("expected the next beacon to be accepted, got %v", err)
+	}
+	if node, err := store.KnownNode("axial-peer"); err != nil || node.LastSentAt == nil || !node.LastSentAt.Equal(base) {
+		t.Fatalf("expected the newest beacon to be sent at %s, got %+v, %v", base, node, err)
+	}
+
+	// Replaying the beacons within max_clock_step in turn gets none of them
+	// accepted again
+	for i := 0; i < 3; i++ {
+		for _, at := range []time.Time{base, stepped, next} {
+			if _, err := us.Accept(sentAt(at)); !errors.Is(err, errDuplicateBeacon) {
+				t.Fatalf("expected the replayed beacon sent at %s to be a duplicate, got %v", at, err)
+			}
+		}
+	}
+	// Nor do steps back add up past max_clock_step
+	if _, err := us.Accept(sentAt(base.Add(-70 * time.Second))); err == nil {
+		t.Fatalf("expected a beacon more than max_clock_step before the newest to be refused")
+	}
+
+	// A larger step is taken as a replay until an operator resets the node
+	far := next.Add(-time.Hour)
+	if _, err := us.Accept(sentAt(far)); err == nil || !strings.Contains(err.Error(), "last-sent-at") {
+		t.Fatalf("expected a beacon an hour older to be refused with how to reset, got %v", err)
+	}
+	if err := us.ResetSentAt("axial-peer"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if _, err := us.Accept(sentAt(far)); err != nil {
+		t.Fatalf("expected the beacon to be accepted once reset, got %v", err)
+	}
+	if err := us.ResetSentAt("axial-unknown"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound resetting a node not pinned, got %v", err)
+	}
+
+	// Our own beacons keep going forward when our clock steps back
+	us.sentAt = base.Add(time.Hour)
+	own, err := us.Sign(testHashes(), 8080)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if beacon, err := DecodeBeacon(own); err != nil || !beacon.SentAt.After(base.Add(time.Hour)) {
+		t.Fatalf("expected our beacon to be sent after the previous one, got %+v, %v", beacon, err)
+	}
+}
+
+func TestBeaconsTrustedKeysAndLegacy(t *testing.T) {
+	trustedKey := newKey(t)
+	us := newTestBeacons(t, "axial-us", newKey(t), storage.NewMemory(), func(cfg *config.Config) {
+		cfg.Discovery.TrustedKeys = []string{hex.EncodeToString(trustedKey.Public().(ed25519.PublicKey))}
+	})
+
+	trusted, err := newTestBeacons(t, "axial-trusted", trustedKey, storage.NewMemory(), nil).Encode(testHashes(), 8080, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	beacon, err := us.Accept(trusted[0])
+	if err != nil {
+		t.Fatalf("expected a beacon signed with a trusted key to be accepted, got %v", err)
+	}
+	if priority := us.priority(beacon); priority != synchronization.PriorityTrusted {
+		t.Fatalf("expected trusted priority, got %d", priority)
+	}
+	stranger, err := newTestBeacons(t, "axial-stranger", newKey(t), storage.NewMemory(), nil).Encode(testHashes(), 8080, "10.0.0.3")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := us.Accept(stranger[0]); err == nil {
+		t.Fatalf("expected a beacon signed with another key to be refused")
+	}
+	if _, err := us.Accept(stranger[1]); err == nil {
+		t.Fatalf("expected legacy beacons to be refused with trusted keys")
+	}
+
+	// Without legacy beacons, only signed ones are sent and accepted
+	strict := newTestBeacons(t, "axial-strict", newKey(t), storage.NewMemory(), func(cfg *config.Config) {
+		cfg.Discovery.LegacyBeacons = false
+	})
+	if _, err := strict.Accept([]byte("axial-old|" + testHashes().Full + "|:8080|10.0.0.4")); err == nil {
+		t.Fatalf("expected legacy beacons to be refused when disabled")
+	}
+	messages, err := strict.Encode(testHashes(), 8080, "10.0.0.5")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(messages) != 1 || !IsBinaryBeacon(messages[0]) {
+		t.Fatalf("expected only a signed beacon, got %d messages", len(messages))
+	}
+
+	// Legacy beacons of nodes not signing yet are understood
+	open := newTestBeacons(t, "axial-open", newKey(t), storage.NewMemory(), nil)
+	legacy, err := open.Accept([]byte("axial-old|" + testHashes().Full + "|:8080|10.0.0.4"))
+	if err != nil || legacy.NodeID != "axial-old" || legacy.APIPort != 8080 || legacy.Hashes.Full != testHashes().Full || legacy.Signed() {
+		t.Fatalf("expected the legacy beacon to be accepted, got %+v, %v", legacy, err)
+	}
+
+	// Without trusted keys, signed beacons still go before legacy ones
+	signed, err := open.Accept(stranger[0])
+	if err != nil {
+		t.Fatalf("expected the signed beacon to be accepted, got %v", err)
+	}
+	if open.priority(signed) != synchronization.PrioritySigned || open.priority(legacy) != synchronization.PriorityUnsigned {
+		t.Fatalf("expected signed and unsigned priorities, got %d and %d", open.priority(signed), open.priority(legacy))
+	}
+}
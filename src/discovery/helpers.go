@@ -22,38 +22,57 @@ func getLocalIP() string {
 	panic("Unable to determine local IP")
 }
 
-func isUsableInterface(iface net.Interface) bool {
-	// Skip interfaces that are:
-	if iface.Flags&net.FlagUp == 0 {  // Not up
-			return false
+// isUsableInterface reports whether discovery can run on iface, over IPv6 or
+// IPv4
+func isUsableInterface(iface net.Interface, ipv6 bool) bool {
+	if !usableFlags(iface.Flags, ipv6) {
+		return false
 	}
-	if iface.Flags&net.FlagLoopback != 0 {  // Loopback
-			return false
-	}
-	if iface.Flags&net.FlagPointToPoint != 0 {  // Point-to-point
-			return false
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
 	}
-	if iface.Flags&net.FlagMulticast == 0 {  // Not multicast capable
-			return false
+	return addrsIP(addrs, ipv6) != ""
+}
+
+// usableFlags reports whether an interface with flags can take part in
+// discovery over IPv6 or IPv4. It must be up, not loopback, and multicast
+// capable. Point-to-point links are only used over IPv6, where multicast6
+// reaches the other end; IPv4 broadcasts have nowhere to go on them.
+//
+// The tun interfaces of meshes such as Yggdrasil or cjdns are usually
+// point-to-point without multicast, and neither mesh carries multicast
+// between its nodes, so beacons never cross them: nodes on these meshes
+// find each other through the configured peers.
+func usableFlags(flags net.Flags, ipv6 bool) bool {
+	if flags&net.FlagUp == 0 || flags&net.FlagLoopback != 0 || flags&net.FlagMulticast == 0 {
+		return false
 	}
+	return ipv6 || flags&net.FlagPointToPoint == 0
+}
 
-	// Check if interface has any usable addresses
+// interfaceIP returns the first address of iface of the family, or "" if it
+// has none
+func interfaceIP(iface net.Interface, ipv6 bool) string {
 	addrs, err := iface.Addrs()
 	if err != nil {
-			return false
+		return ""
 	}
-	
+	return addrsIP(addrs, ipv6)
+}
+
+// addrsIP returns the first address of addrs of the family that is not a
+// loopback address, or "" if there is none
+func addrsIP(addrs []net.Addr, ipv6 bool) string {
 	for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if !ok {
-					continue
-			}
-			if ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
-					return true  // Found a usable IPv4 address
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && (ipNet.IP.To4() == nil) == ipv6 {
+			if ipv6 {
+				return ipNet.IP.String()
 			}
+			return ipNet.IP.To4().String()
+		}
 	}
-	
-	return false  // No usable addresses found
+	return ""
 }
 
 func findMulticastInterface() (*net.Interface, error) {
@@ -63,7 +82,7 @@ func findMulticastInterface() (*net.Interface, error) {
 	}
 
 	for _, iface := range ifaces {
-			if isUsableInterface(iface) {
+			if isUsableInterface(iface, false) {
 					fmt.Printf("Found interface %s with addresses: %v\n", iface.Name, getInterfaceAddrs(iface))
 					return &iface, nil
 			}
@@ -0,0 +1,180 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+
+	"axial/config"
+)
+
+// Discovery modes, i.e. where beacons are sent. Whatever the modes, every
+// socket also receives broadcasts sent to the discovery port.
+const (
+	// ModeMulticast sends to the multicast group in multicast_address,
+	// which the sockets join
+	ModeMulticast = "multicast"
+	// ModeMulticast6 sends to the IPv6 group in multicast_address6, which
+	// the sockets of every IPv6 capable interface join
+	ModeMulticast6 = "multicast6"
+	// ModeBroadcast sends to multicast_address if it is a broadcast
+	// address such as 10.0.0.255, and to 255.255.255.255 otherwise
+	ModeBroadcast = "broadcast"
+	// ModeDirected sends to the broadcast address of every IPv4 subnet of
+	// the interfaces, e.g. 10.0.0.255 for 10.0.0.7/24, which routers may
+	// forward where limited broadcasts are dropped
+	ModeDirected = "directed"
+)
+
+// sendModes are the resolved discovery modes
+type sendModes struct {
+	group     net.IP // multicast group, nil without ModeMulticast
+	group6    net.IP // IPv6 multicast group, nil without ModeMulticast6
+	broadcast net.IP // broadcast address, nil without ModeBroadcast
+	directed  bool
+}
+
+// resolveModes resolves the discovery modes of cfg. Without any, the mode is
+// multicast if multicast_address is a multicast group and broadcast
+// otherwise.
+func resolveModes(cfg config.Config) (sendModes, error) {
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(cfg.MulticastAddress, fmt.Sprint(cfg.MulticastPort)))
+	if err != nil {
+		return sendModes{}, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	address := addr.IP.To4()
+
+	names := cfg.Discovery.Modes
+	if len(names) == 0 {
+		names = []string{ModeBroadcast}
+		if address.IsMulticast() {
+			names = []string{ModeMulticast}
+		}
+	}
+
+	modes := sendModes{}
+	for _, name := range names {
+		switch name {
+		case ModeMulticast:
+			if !address.IsMulticast() {
+				return sendModes{}, fmt.Errorf("discovery mode %s needs a multicast group in multicast_address, got %s", name, cfg.MulticastAddress)
+			}
+			modes.group = address
+		case ModeMulticast6:
+			group6 := net.ParseIP(cfg.Discovery.MulticastAddress6)
+			if group6 == nil || group6.To4() != nil || !group6.IsMulticast() {
+				return sendModes{}, fmt.Errorf("discovery mode %s needs an IPv6 multicast group in multicast_address6, got %q", name, cfg.Discovery.MulticastAddress6)
+			}
+			modes.group6 = group6
+		case ModeBroadcast:
+			modes.broadcast = net.IPv4bcast
+			if !address.IsMulticast() && !address.IsUnspecified() {
+				modes.broadcast = address
+			}
+		case ModeDirected:
+			modes.directed = true
+		default:
+			return sendModes{}, fmt.Errorf("unknown discovery mode %q", name)
+		}
+	}
+	if (modes.group != nil || modes.group6 != nil) && (cfg.Discovery.MulticastTTL < 1 || cfg.Discovery.MulticastTTL > 255) {
+		return sendModes{}, fmt.Errorf("multicast_ttl must be between 1 and 255, got %d", cfg.Discovery.MulticastTTL)
+	}
+	return modes, nil
+}
+
+// ipv4 returns the modes sent over IPv4 sockets, if any
+func (m sendModes) ipv4() (sendModes, bool) {
+	m.group6 = nil
+	return m, m.group != nil || m.broadcasting()
+}
+
+// ipv6 returns the modes sent over IPv6 sockets, if any
+func (m sendModes) ipv6() (sendModes, bool) {
+	return sendModes{group6: m.group6}, m.group6 != nil
+}
+
+// broadcasting reports whether the sockets send broadcasts
+func (m sendModes) broadcasting() bool {
+	return m.broadcast != nil || m.directed
+}
+
+// targets returns where to send beacons from a socket bound to iface, or to
+// all interfaces if iface is nil. Directed broadcast addresses are looked up
+// every time, so that they follow address changes.
+func (m sendModes) targets(iface *net.Interface, port int) []*net.UDPAddr {
+	targets := []*net.UDPAddr{}
+	if m.group != nil {
+		targets = append(targets, &net.UDPAddr{IP: m.group, Port: port})
+	}
+	if m.group6 != nil && iface != nil {
+		// Link-local groups exist once per link, the zone picks ours
+		targets = append(targets, &net.UDPAddr{IP: m.group6, Port: port, Zone: iface.Name})
+	}
+	if m.broadcast != nil {
+		targets = append(targets, &net.UDPAddr{IP: m.broadcast, Port: port})
+	}
+	if m.directed {
+		for _, ip := range directedBroadcasts(iface) {
+			targets = append(targets, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	return targets
+}
+
+// directedBroadcasts returns the broadcast address of every IPv4 subnet of
+// iface, or of every usable interface if iface is nil
+func directedBroadcasts(iface *net.Interface) []net.IP {
+	ifaces := []net.Interface{}
+	if iface != nil {
+		ifaces = append(ifaces, *iface)
+	} else if all, err := net.Interfaces(); err == nil {
+		for _, i := range all {
+			if isUsableInterface(i, false) {
+				ifaces = append(ifaces, i)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	ips := []net.IP{}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := subnetBroadcast(ipNet)
+			if ip == nil || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// subnetBroadcast returns the broadcast address of an IPv4 subnet, or nil
+// for IPv6, loopback and subnets too small to have one
+func subnetBroadcast(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	mask := ipNet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if ones, bits := mask.Size(); bits != 8*net.IPv4len || ones > 30 {
+		return nil
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
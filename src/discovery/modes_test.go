@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"axial/config"
+)
+
+func TestResolveModes(t *testing.T) {
+	cfg := config.Defaults()
+
+	// The default broadcast address keeps the old behaviour
+	modes, err := resolveModes(cfg)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if modes.group != nil || !modes.broadcast.Equal(net.IPv4bcast) || modes.directed {
+		t.Fatalf("expected limited broadcast only, got %+v", modes)
+	}
+
+	cfg.MulticastAddress = "10.0.0.255"
+	if modes, err = resolveModes(cfg); err != nil || !modes.broadcast.Equal(net.IPv4(10, 0, 0, 255)) {
+		t.Fatalf("expected broadcasts to the configured address, got %+v, %v", modes, err)
+	}
+
+	cfg.MulticastAddress = "239.255.0.1"
+	if modes, err = resolveModes(cfg); err != nil || !modes.group.Equal(net.IPv4(239, 255, 0, 1)) || modes.broadcasting() {
+		t.Fatalf("expected the multicast group only, got %+v, %v", modes, err)
+	}
+	targets := modes.targets(nil, cfg.MulticastPort)
+	if len(targets) != 1 || targets[0].String() != "239.255.0.1:45678" {
+		t.Fatalf("expected to send to the group, got %v", targets)
+	}
+
+	cfg.Discovery.Modes = []string{ModeMulticast, ModeBroadcast, ModeDirected}
+	modes, err = resolveModes(cfg)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if modes.group == nil || !modes.broadcast.Equal(net.IPv4bcast) || !modes.directed {
+		t.Fatalf("expected every mode, got %+v", modes)
+	}
+
+	// IPv6 groups are sent to per interface, IPv4 modes keep their sockets
+	cfg.Discovery.Modes = []string{ModeBroadcast, ModeMulticast6}
+	cfg.MulticastAddress = "255.255.255.255"
+	modes, err = resolveModes(cfg)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	modes4, ok4 := modes.ipv4()
+	modes6, ok6 := modes.ipv6()
+	if !ok4 || modes4.group6 != nil || !ok6 || modes6.broadcasting() || !modes6.group6.Equal(net.ParseIP("ff02::a71a")) {
+		t.Fatalf("expected broadcast over IPv4 and the group over IPv6, got %+v and %+v", modes4, modes6)
+	}
+	targets = modes6.targets(&net.Interface{Name: "wlan0"}, cfg.MulticastPort)
+	if len(targets) != 1 || targets[0].String() != "[ff02::a71a%wlan0]:45678" {
+		t.Fatalf("expected to send to the group on the interface, got %v", targets)
+	}
+	cfg.Discovery.MulticastAddress6 = "fd00::1"
+	if _, err := resolveModes(cfg); err == nil {
+		t.Fatalf("expected multicast6 mode without an IPv6 group to be refused")
+	}
+
+	cfg.Discovery.Modes = []string{ModeMulticast, ModeBroadcast, ModeDirected}
+	if _, err := resolveModes(cfg); err == nil {
+		t.Fatalf("expected multicast mode without a group to be refused")
+	}
+	cfg.Discovery.Modes = []string{"anycast"}
+	if _, err := resolveModes(cfg); err == nil {
+		t.Fatalf("expected an unknown mode to be refused")
+	}
+}
+
+func TestSubnetBroadcast(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"10.0.0.7/24":    "10.0.0.255",
+		"192.168.4.1/22": "192.168.7.255",
+		"10.1.2.3/31":    "<nil>",
+		"127.0.0.1/8":    "<nil>",
+		"fd00::1/64":     "<nil>",
+	} {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("parse %s: %v", cidr, err)
+		}
+		ipNet.IP = ip
+		if got := subnetBroadcast(ipNet).String(); got != want {
+			t.Fatalf("expected %s for %s, got %s", want, cidr, got)
+		}
+	}
+}
+
+func TestUsableFlags(t *testing.T) {
+	cases := []struct {
+		name       string
+		flags      net.Flags
+		ipv4, ipv6 bool
+	}{
+		{"ethernet", net.FlagUp | net.FlagBroadcast | net.FlagMulticast, true, true},
+		{"down", net.FlagBroadcast | net.FlagMulticast, false, false},
+		{"loopback", net.FlagUp | net.FlagLoopback | net.FlagMulticast, false, false},
+		// A GRE or PPP link carrying multicast to its other end
+		{"point-to-point", net.FlagUp | net.FlagPointToPoint | net.FlagMulticast, false, true},
+		// A Yggdrasil tun: only reachable through configured peers
+		{"mesh tun", net.FlagUp | net.FlagPointToPoint, false, false},
+	}
+	for _, c := range cases {
+		if got := usableFlags(c.flags, false); got != c.ipv4 {
+			t.Errorf("%s: expected usable over IPv4 %v, got %v", c.name, c.ipv4, got)
+		}
+		if got := usableFlags(c.flags, true); got != c.ipv6 {
+			t.Errorf("%s: expected usable over IPv6 %v, got %v", c.name, c.ipv6, got)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package discovery
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 
 	"axial/config"
 	"axial/models"
@@ -15,104 +18,97 @@ import (
 	"axial/synchronization"
 )
 
+// Node is the local node as seen by discovery: the hashes it announces and
+// where it schedules syncs with peers announcing a different hash.
+type Node interface {
+	GetHashes() models.HashSet
+	ScheduleSync(event synchronization.SyncEvent)
+}
+
 // New type to hold our connections
 type MulticastConnection struct {
 	Conn    *net.UDPConn
 	iface   *net.Interface
 	localIP string
+	modes   sendModes
 }
 
-func CreateMulticastSockets(cfg config.Config) ([]MulticastConnection, error) {
-	var connections []MulticastConnection
-
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get interfaces: %v", err)
+// openSocket opens the discovery socket of iface for the family, with the
+// modes of that family, or the IPv4 socket bound to all interfaces if iface
+// is nil
+func openSocket(cfg config.Config, modes sendModes, iface *net.Interface, ipv6 bool) (MulticastConnection, error) {
+	modes4, _ := modes.ipv4()
+	switch {
+	case ipv6:
+		modes6, _ := modes.ipv6()
+		return createIPv6Socket(cfg, modes6, *iface)
+	case iface != nil:
+		return createIPv4Socket(cfg, modes4, *iface)
 	}
 
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", cfg.MulticastAddress, cfg.MulticastPort))
+	fmt.Printf("Attempting to bind to all interfaces (port %d)\n", cfg.MulticastPort)
+	conn, err := setupMulticastConn(cfg, modes4, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve address: %v", err)
-	}
-
-	fmt.Printf("Attempting to bind to all interfaces first (port %d)\n", cfg.MulticastPort)
-	// First try binding to ALL interfaces
-	if conn, err := setupMulticastConn(cfg, nil, addr); err == nil {
-		fmt.Printf("Successfully bound to all interfaces\n")
-		connections = append(connections, MulticastConnection{
-			Conn:    conn,
-			iface:   nil,
-			localIP: "0.0.0.0",
-		})
-		return connections, nil  // Return early if we successfully bound to all interfaces
-	} else {
 		fmt.Printf("Failed to bind to all interfaces: %v\n", err)
-		// Only try individual interfaces if binding to all interfaces failed
-		for _, iface := range ifaces {
-			if !isUsableInterface(iface) {
-				fmt.Printf("Skipping interface %s (not usable)\n", iface.Name)
-				continue
-			}
-
-			fmt.Printf("Attempting to bind to interface %s (port %d)\n", iface.Name, cfg.MulticastPort)
-			conn, err := setupMulticastConn(cfg, &iface, addr)
-			if err != nil {
-				fmt.Printf("Warning: failed to setup multicast on interface %s: %v\n", iface.Name, err)
-				continue
-			}
-
-			// Get the local IP for this interface
-			addrs, err := iface.Addrs()
-			if err != nil {
-				continue
-			}
-
-			var localIP string
-			for _, addr := range addrs {
-				if ipNet, ok := addr.(*net.IPNet); ok {
-					if ip4 := ipNet.IP.To4(); ip4 != nil && !ip4.IsLoopback() {
-						localIP = ip4.String()
-						break
-					}
-				}
-			}
-
-			connections = append(connections, MulticastConnection{
-				Conn:    conn,
-				iface:   &iface,
-				localIP: localIP,
-			})
-
-			fmt.Printf("Successfully joined multicast group on interface %s (IP: %s)\n",
-				iface.Name, localIP)
-		}
+		return MulticastConnection{}, err
 	}
+	fmt.Printf("Successfully bound to all interfaces\n")
+	return MulticastConnection{
+		Conn:    conn,
+		iface:   nil,
+		localIP: "0.0.0.0",
+		modes:   modes4,
+	}, nil
+}
 
-	if len(connections) == 0 {
-		return nil, fmt.Errorf("no usable interfaces found")
+// createIPv6Socket opens the IPv6 socket of iface
+func createIPv6Socket(cfg config.Config, modes6 sendModes, iface net.Interface) (MulticastConnection, error) {
+	conn, err := setupMulticastConn6(cfg, modes6, &iface)
+	if err != nil {
+		fmt.Printf("Warning: failed to setup IPv6 multicast on interface %s: %v\n", iface.Name, err)
+		return MulticastConnection{}, err
 	}
-
-	return connections, nil
+	localIP := interfaceIP(iface, true)
+	fmt.Printf("Successfully joined IPv6 multicast group %s on interface %s (IP: %s)\n", modes6.group6, iface.Name, localIP)
+	return MulticastConnection{
+		Conn:    conn,
+		iface:   &iface,
+		localIP: localIP,
+		modes:   modes6,
+	}, nil
 }
 
-func isBroadcast(ip net.IP) bool {
-	// Check for 255.255.255.255 or x.x.x.255
-	if ip == nil {
-			return false
-	}
-	if ip.To4() == nil {
-			return false
+// createIPv4Socket opens the IPv4 socket of iface
+func createIPv4Socket(cfg config.Config, modes sendModes, iface net.Interface) (MulticastConnection, error) {
+	fmt.Printf("Attempting to bind to interface %s (port %d)\n", iface.Name, cfg.MulticastPort)
+	conn, err := setupMulticastConn(cfg, modes, &iface)
+	if err != nil {
+		fmt.Printf("Warning: failed to setup multicast on interface %s: %v\n", iface.Name, err)
+		return MulticastConnection{}, err
 	}
-	return ip[len(ip)-1] == 255
-}
 
+	// Get the local IP for this interface
+	localIP := interfaceIP(iface, false)
+
+	fmt.Printf("Successfully joined multicast group on interface %s (IP: %s)\n",
+		iface.Name, localIP)
+	return MulticastConnection{
+		Conn:    conn,
+		iface:   &iface,
+		localIP: localIP,
+		modes:   modes,
+	}, nil
+}
 
-func setupMulticastConn(cfg config.Config, iface *net.Interface, addr *net.UDPAddr) (*net.UDPConn, error) {
+// setupMulticastConn opens the discovery socket for iface, or for all
+// interfaces if iface is nil: a member of the multicast group in multicast
+// mode, a plain socket on the discovery port otherwise. Either receives
+// broadcasts, and may send them in the broadcast modes.
+func setupMulticastConn(cfg config.Config, modes sendModes, iface *net.Interface) (*net.UDPConn, error) {
 	var conn *net.UDPConn
 	var err error
 
-	// Check if we're using broadcast
-	if isBroadcast(addr.IP) {
+	if modes.group == nil {
 		// For broadcast, bind to 0.0.0.0
 		laddr := &net.UDPAddr{
 			IP:   net.IPv4zero,
@@ -147,7 +143,8 @@ func setupMulticastConn(cfg config.Config, iface *net.Interface, addr *net.UDPAd
 		}
 	} else {
 
-		conn, err := net.ListenMulticastUDP("udp4", iface, addr)
+		addr := &net.UDPAddr{IP: modes.group, Port: cfg.MulticastPort}
+		conn, err = net.ListenMulticastUDP("udp4", iface, addr)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create socket: %v. Addr: %v", err, addr)
 		}
@@ -189,27 +186,25 @@ func setupMulticastConn(cfg config.Config, iface *net.Interface, addr *net.UDPAd
 			}
 
 			// Set multicast TTL
-			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 2)
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, cfg.Discovery.MulticastTTL)
 			if err != nil {
 				panic(fmt.Errorf("failed to set multicast TTL: %v", err))
 			}
+
+			// Other modes send broadcasts from the same socket
+			if modes.broadcasting() {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+				if err != nil {
+					panic(fmt.Errorf("failed to set SO_BROADCAST: %v", err))
+				}
+			}
 		})
 		if err != nil {
 			conn.Close()
 			return nil, fmt.Errorf("failed to set socket options: %v", err)
 		}
 
-		// Check if MulticastAddress is an IP address or hostname
-		multicastIP := net.ParseIP(cfg.MulticastAddress)
-		if multicastIP == nil {
-			// Resolve hostname to IP address
-			multicastIPs, err := net.LookupIP(cfg.MulticastAddress)
-			if err != nil {
-				conn.Close()
-				return nil, fmt.Errorf("failed to resolve multicast address: %v", err)
-			}
-			multicastIP = multicastIPs[0]
-		}
+		multicastIP := modes.group
 
 		// Force leave and rejoin of the multicast group
 		if err := p.LeaveGroup(iface, &net.UDPAddr{IP: multicastIP}); err != nil {
@@ -241,89 +236,125 @@ func setupMulticastConn(cfg config.Config, iface *net.Interface, addr *net.UDPAd
 	return conn, nil
 }
 
-func StartMulticastListener(cfg config.Config, conn *MulticastConnection) {
+// setupMulticastConn6 opens the IPv6 discovery socket of iface, a member of
+// the multicast6 group on that interface only
+func setupMulticastConn6(cfg config.Config, modes sendModes, iface *net.Interface) (*net.UDPConn, error) {
+	addr := &net.UDPAddr{IP: modes.group6, Port: cfg.MulticastPort}
+	conn, err := net.ListenMulticastUDP("udp6", iface, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v. Addr: %v", err, addr)
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if err := p.SetMulticastInterface(iface); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SetMulticastInterface failed: %v", err)
+	}
+	if err := p.SetMulticastHopLimit(cfg.Discovery.MulticastTTL); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SetMulticastHopLimit failed: %v", err)
+	}
+	if err := p.SetMulticastLoopback(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SetMulticastLoopback failed: %v", err)
+	}
+
+	if err := conn.SetReadBuffer(1048576); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set read buffer: %v", err)
+	}
+	if err := conn.SetWriteBuffer(1048576); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set write buffer: %v", err)
+	}
+	return conn, nil
+}
+
+// StartMulticastListener reads beacons from conn and has node schedule a
+// sync with the peers beacons accepts whose hash differs from ours. It only
+// parses and enqueues, so it never waits for a sync. It returns once conn is
+// closed.
+func StartMulticastListener(cfg config.Config, conn *MulticastConnection, node Node, beacons *Beacons) {
 	fmt.Printf("Listening for messages on %v\n", conn.Conn.LocalAddr())
 	buffer := make([]byte, 4096)
 
 	for {
 		n, src, err := conn.Conn.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Stopped listening on %v\n", conn.Conn.LocalAddr())
+				return
+			}
 			fmt.Println("Error receiving message:", err)
 			continue
 		}
 
-		message := string(buffer[:n])
-
 		// Check for both our configured port and the Mac's port (60090)
 		if !strings.Contains(src.String(), fmt.Sprintf(":%d", cfg.MulticastPort)) {
 			if strings.Contains(src.String(), ":60090") {
-				fmt.Printf("Got message on port 60090 from %s: %q\n", src, message)
+				fmt.Printf("Got message on port 60090 from %s: %q\n", src, buffer[:n])
 			} else {
 				fmt.Printf("Message on unexpected port from %s\n", src)
 			}
 		}
 
-		// Only process messages that look like ours (4 pipe-separated fields)
-		if parts := strings.Split(message, "|"); len(parts) == 4 {
-			fmt.Printf("RECV: %s (from %s)\n", message, src)
-			// axial.local|74d63e48f0e18e7c300904b49457a630ec782c244fb212273742ce1499cd21ef|:8080|0.0.0.0 (from 192.168.1.207:45678)
-			if !models.IsSyncing() {
-				hash := parts[1]
-				ourHashes := models.GetHashes()
-				if err != nil {
-					fmt.Printf("Failed to get database hash: %v\n", err)
-					continue
-				}
-				ourHash := ourHashes.Full
-
-				if hash != ourHash {
-					fmt.Printf("Mismatching hash from %s: %s != %s\n", src, hash, ourHash)
-					port := parts[2]
-					remoteNode := remote.API{
-						Address: fmt.Sprintf("%s%s", src.IP, port),
-					}
-					
-					err := synchronization.StartSync(remoteNode, hash)
-					if err != nil {
-						fmt.Printf("Failed to start sync: %v\n", err)
-					} else {
-						fmt.Printf("Synchronized with %s\n", remoteNode.Address)
-					}
-				} else {
-					fmt.Printf("Matching hash from %s\n", src)
-				}
-			} else {
-				fmt.Printf("Ignoring ping from %s because we're already syncing\n", src)
-			}
+		beacon, err := beacons.Accept(buffer[:n])
+		if errors.Is(err, errOwnBeacon) || errors.Is(err, errDuplicateBeacon) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Ignored message from %s (len=%d): %v\n", src, n, err)
+			continue
+		}
 
+		fmt.Printf("RECV: %s (from %s)\n", beacon, src)
+		// Link-local IPv6 peers are only reachable through the interface
+		// they were heard on, which the zone names
+		apiAddr := net.UDPAddr{IP: src.IP, Port: beacon.APIPort, Zone: src.Zone}
+		remoteNode := remote.API{
+			Address: apiAddr.String(),
+			NodeID:  beacon.NodeID,
+		}
+		if beacon.Hashes.Full != node.GetHashes().Full {
+			fmt.Printf("Mismatching hash from %s: %s, scheduling sync\n", src, beacon.Hashes.Full)
+			node.ScheduleSync(synchronization.SyncEvent{Peer: remoteNode, Hash: beacon.Hashes.Full, Priority: beacons.priority(beacon)})
 		} else {
-			// Debug log for non-matching messages
-			fmt.Printf("Ignored non-axial message from %s (len=%d)\n", src, len(message))
+			fmt.Printf("Matching hash from %s\n", src)
 		}
 	}
 }
 
-func StartBroadcast(cfg config.Config,conn *MulticastConnection) {
+// StartBroadcast announces node's hash on conn every few seconds until ctx is
+// cancelled, to the targets of every discovery mode.
+func StartBroadcast(ctx context.Context, cfg config.Config, conn *MulticastConnection, node Node, beacons *Beacons) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
-	addr := fmt.Sprintf(":%d", cfg.APIPort)
-
-	targetAddr := net.UDPAddr{
-		IP:   net.IPv4(255, 255, 255, 255),
-		Port: cfg.MulticastPort,
-	}
+	fmt.Printf("Starting broadcast from %s to %v\n", conn.localIP, conn.modes.targets(conn.iface, cfg.MulticastPort))
 
-	fmt.Printf("Starting broadcast from %s to %s:%d\n", conn.localIP, targetAddr.IP, targetAddr.Port)
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Stopped broadcasting from %s\n", conn.localIP)
+			return
+		case <-ticker.C:
+		}
 
-	for range ticker.C {
-		hashes := models.GetHashes()
-		message := fmt.Sprintf("%s|%s|%s|%s", cfg.NodeID, hashes.Full, addr, conn.localIP)
-		_, err := conn.Conn.WriteToUDP([]byte(message), &targetAddr)
+		hashes := node.GetHashes()
+		messages, err := beacons.Encode(hashes, cfg.APIPort, conn.localIP)
 		if err != nil {
-			fmt.Printf("Error sending broadcast message: %v\n", err)
-		} else {
-			fmt.Printf("SENT: %s\n", message)
+			fmt.Printf("Error encoding beacon: %v\n", err)
+			continue
+		}
+		for _, target := range conn.modes.targets(conn.iface, cfg.MulticastPort) {
+			for _, message := range messages {
+				_, err := conn.Conn.WriteToUDP(message, target)
+				if err != nil {
+					fmt.Printf("Error sending broadcast message to %s: %v\n", target, err)
+				} else {
+					fmt.Printf("SENT: beacon of %s to %s, hash %s (%d bytes)\n", cfg.NodeID, target, hashes.Full, len(message))
+				}
+			}
 		}
 	}
 }
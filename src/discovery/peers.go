@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"axial/api"
+	"axial/config"
+	"axial/remote"
+	"axial/synchronization"
+)
+
+// Peers polls the nodes configured in peers, which beacons cannot reach
+// across routed networks, VPNs or the internet. Every peer is pinged each
+// peer_poll_interval and a sync is scheduled when its hashes differ from
+// ours, the way a beacon would.
+//
+// Ping responses carry the peer's signed beacon, which is trusted like the
+// beacons heard on the network. A peer with a node key must sign with it; a
+// peer not signing its pings is only synced with while legacy beacons are
+// accepted.
+type Peers struct {
+	cfg     config.Config
+	peers   []staticPeer
+	beacons *Beacons
+}
+
+// staticPeer is one entry of peers
+type staticPeer struct {
+	address string // as configured
+	api     remote.API
+	nodeKey ed25519.PublicKey // nil if any trusted key will do
+}
+
+// errOwnPing is returned when a configured peer turns out to be us
+var errOwnPing = errors.New("our own ping")
+
+// NewPeers returns the poller of the peers configured in cfg, whose pings
+// are checked with beacons
+func NewPeers(cfg config.Config, beacons *Beacons) (*Peers, error) {
+	if len(cfg.Peers) > 0 && cfg.Discovery.PeerPollInterval <= 0 {
+		return nil, fmt.Errorf("discovery peer_poll_interval must be positive, got %s", cfg.Discovery.PeerPollInterval)
+	}
+	peers := make([]staticPeer, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		peer, err := parsePeer(p)
+		if err != nil {
+			return nil, err
+		}
+		peer.api.Header = api.PeerHeader(cfg.NodeID, cfg.APIPort)
+		peers = append(peers, peer)
+	}
+	return &Peers{cfg: cfg, peers: peers, beacons: beacons}, nil
+}
+
+// parsePeer parses a peers entry
+func parsePeer(p config.PeerConfig) (staticPeer, error) {
+	scheme, address := "http", p.Address
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return staticPeer{}, fmt.Errorf("invalid peer address %q, expected host:port or an http(s) URL", p.Address)
+		}
+		scheme, address = u.Scheme, u.Host
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return staticPeer{}, fmt.Errorf("peer address %q needs a port: %v", p.Address, err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return staticPeer{}, fmt.Errorf("invalid port in peer address %q", p.Address)
+	}
+
+	peer := staticPeer{address: p.Address, api: remote.API{Scheme: scheme, Address: host, Port: portNumber}}
+	if p.NodeKey != "" {
+		key, err := hex.DecodeString(p.NodeKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return staticPeer{}, fmt.Errorf("invalid node key %q of peer %s", p.NodeKey, p.Address)
+		}
+		peer.nodeKey = key
+	}
+	return peer, nil
+}
+
+// Run polls every peer until ctx is cancelled, scheduling syncs with node
+func (p *Peers) Run(ctx context.Context, node Node) {
+	var wg sync.WaitGroup
+	for _, peer := range p.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.pollEvery(ctx, peer, node)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Peers) pollEvery(ctx context.Context, peer staticPeer, node Node) {
+	address := peer.address
+	fmt.Printf("Polling peer %s every %s\n", address, p.cfg.Discovery.PeerPollInterval)
+
+	ticker := time.NewTicker(p.cfg.Discovery.PeerPollInterval)
+	defer ticker.Stop()
+	for {
+		err := p.poll(peer, node)
+		if errors.Is(err, errOwnPing) {
+			fmt.Printf("Peer %s is this node, no longer polling it\n", address)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to poll peer %s: %v\n", address, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll pings peer and schedules a sync if its hashes differ from node's
+func (p *Peers) poll(peer staticPeer, node Node) error {
+	remoteNode := peer.api
+	ping := remoteNode.Ping()
+	response, _, err := ping.Get()
+	if err != nil {
+		return err
+	}
+	beacon, err := p.verify(peer, response)
+	if err != nil {
+		return err
+	}
+	hashes := beacon.Hashes
+
+	if hashes.Full == node.GetHashes().Full {
+		fmt.Printf("Matching hash from peer %s\n", peer.address)
+		return nil
+	}
+	if response.IsBusy {
+		fmt.Printf("Mismatching hash from peer %s, which is busy\n", peer.address)
+		return nil
+	}
+	fmt.Printf("Mismatching hash from peer %s: %s, scheduling sync\n", peer.address, hashes.Full)
+	remoteNode.NodeID = beacon.NodeID
+	priority := p.beacons.priority(beacon)
+	if peer.nodeKey != nil {
+		priority = synchronization.PriorityTrusted
+	}
+	node.ScheduleSync(synchronization.SyncEvent{Peer: remoteNode, Hash: hashes.Full, Priority: priority})
+	return nil
+}
+
+// verify returns the beacon of a ping response if it is one to act on.
+// Unsigned responses give an unsigned beacon with only their hashes.
+func (p *Peers) verify(peer staticPeer, response api.PingResponse) (Beacon, error) {
+	if len(response.Beacon) == 0 {
+		if peer.nodeKey != nil {
+			return Beacon{}, fmt.Errorf("unsigned ping, expected one signed with %x", []byte(peer.nodeKey))
+		}
+		if !p.beacons.legacyBeacons || len(p.beacons.trusted) > 0 {
+			return Beacon{}, fmt.Errorf("unsigned pings cannot be trusted")
+		}
+		return Beacon{Hashes: response.Hashes}, nil
+	}
+
+	// Check the expected key first, so that another one is never pinned
+	beacon, err := DecodeBeacon(response.Beacon)
+	if err != nil {
+		return Beacon{}, err
+	}
+	if peer.nodeKey != nil && !bytes.Equal(beacon.PublicKey, peer.nodeKey) {
+		return Beacon{}, fmt.Errorf("node %s signed with key %x instead of %x", beacon.NodeID, []byte(beacon.PublicKey), []byte(peer.nodeKey))
+	}
+	_, err = p.beacons.Accept(response.Beacon)
+	if errors.Is(err, errOwnBeacon) {
+		return Beacon{}, errOwnPing
+	}
+	if err != nil && !errors.Is(err, errDuplicateBeacon) {
+		return Beacon{}, err
+	}
+	return beacon, nil
+}
@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"axial/api"
+	"axial/config"
+	"axial/models"
+	"axial/storage"
+	"axial/synchronization"
+)
+
+func TestParsePeer(t *testing.T) {
+	for address, want := range map[string]string{
+		"peer.example.org:8080":          "http://peer.example.org:8080/v1/ping",
+		"https://peer.example.org:8443/": "https://peer.example.org:8443/v1/ping",
+		"[fd00::7]:8080":                 "http://[fd00::7]:8080/v1/ping",
+	} {
+		peer, err := parsePeer(config.PeerConfig{Address: address})
+		if err != nil {
+			t.Fatalf("parse %s: %v", address, err)
+		}
+		ping := peer.api.Ping()
+		if got := ping.URL().String(); got != want {
+			t.Fatalf("expected %s for %s, got %s", want, address, got)
+		}
+	}
+	for _, address := range []string{"peer.example.org", "ftp://peer.example.org:21", "https://peer.example.org:8443/axial", "peer.example.org:0"} {
+		if _, err := parsePeer(config.PeerConfig{Address: address}); err == nil {
+			t.Fatalf("expected %s to be refused", address)
+		}
+	}
+	if _, err := parsePeer(config.PeerConfig{Address: "peer.example.org:8080", NodeKey: "abcd"}); err == nil {
+		t.Fatalf("expected an invalid node key to be refused")
+	}
+}
+
+func TestPeersVerifyPings(t *testing.T) {
+	store := storage.NewMemory()
+	us := newTestBeacons(t, "axial-us", newKey(t), store, nil)
+	peerKey := newKey(t)
+	signed, err := newTestBeacons(t, "axial-peer", peerKey, storage.NewMemory(), nil).Sign(testHashes(), 8080)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	response := api.PingResponse{Hashes: testHashes(), Beacon: signed}
+
+	// Another node answering at the address of a peer with a node key is
+	// refused, and its key is not pinned
+	expecting, err := parsePeer(config.PeerConfig{Address: "peer:8080", NodeKey: hex.EncodeToString(newKey(t).Public().(ed25519.PublicKey))})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	peers := &Peers{beacons: us}
+	if _, err := peers.verify(expecting, response); err == nil {
+		t.Fatalf("expected a ping signed with another key to be refused")
+	}
+	if _, err := store.KnownNode("axial-peer"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected the key not to be pinned, got %v", err)
+	}
+	if _, err := peers.verify(expecting, api.PingResponse{Hashes: testHashes()}); err == nil {
+		t.Fatalf("expected an unsigned ping to be refused from a peer with a node key")
+	}
+
+	expecting.nodeKey = peerKey.Public().(ed25519.PublicKey)
+	beacon, err := peers.verify(expecting, response)
+	if err != nil || beacon.Hashes != testHashes() || beacon.NodeID != "axial-peer" {
+		t.Fatalf("expected the ping to be accepted, got %+v, %v", beacon, err)
+	}
+
+	// Pings of this node are recognized
+	own, err := us.Sign(testHashes(), 8080)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := peers.verify(staticPeer{}, api.PingResponse{Beacon: own}); !errors.Is(err, errOwnPing) {
+		t.Fatalf("expected our own ping to be recognized, got %v", err)
+	}
+}
+
+// schedulingNode records the syncs scheduled with it
+type schedulingNode struct {
+	events []synchronization.SyncEvent
+}
+
+func (n *schedulingNode) GetHashes() models.HashSet { return models.HashSet{} }
+func (n *schedulingNode) ScheduleSync(event synchronization.SyncEvent) {
+	n.events = append(n.events, event)
+}
+
+func TestPeersPollHTTPSPeers(t *testing.T) {
+	peerKey := newKey(t)
+	signed, err := newTestBeacons(t, "axial-peer", peerKey, storage.NewMemory(), nil).Sign(testHashes(), 8443)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.PingResponse{Hashes: testHashes(), Beacon: signed})
+	}))
+	defer server.Close()
+
+	peer, err := parsePeer(config.PeerConfig{
+		Address: "https://" + server.Listener.Addr().String(),
+		NodeKey: hex.EncodeToString(peerKey.Public().(ed25519.PublicKey)),
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	// The test server is on loopback, which peers are never dialed at
+	peer.api.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	peer.api.TLSConfig = &tls.Config{RootCAs: roots}
+
+	node := &schedulingNode{}
+	peers := &Peers{beacons: newTestBeacons(t, "axial-us", newKey(t), storage.NewMemory(), nil)}
+	if err := peers.poll(peer, node); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if len(node.events) != 1 || node.events[0].Peer.NodeID != "axial-peer" || node.events[0].Peer.Scheme != "https" {
+		t.Fatalf("expected a sync with the https peer, got %+v", node.events)
+	}
+}
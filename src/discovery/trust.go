@@ -0,0 +1,331 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"axial/config"
+	"axial/models"
+	"axial/storage"
+	"axial/synchronization"
+)
+
+// LoadNodeKey reads the node key at path, creating one if there is none.
+// The file holds the hex encoded ed25519 seed.
+func LoadNodeKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid node key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read node key: %v", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create node key directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write node key: %v", err)
+	}
+	fmt.Printf("Created node key %s\n", path)
+	return key, nil
+}
+
+// errOwnBeacon is returned for the beacons we hear from ourselves, and
+// errDuplicateBeacon for another copy of a beacon accepted from a node,
+// heard on another socket or replayed
+var (
+	errOwnBeacon       = errors.New("our own beacon")
+	errDuplicateBeacon = errors.New("duplicate beacon")
+)
+
+// Beacons encodes the beacons of this node and decides which of the beacons
+// it hears to act on.
+//
+// A signed beacon is accepted if its key is trusted and pinned to its node
+// ID, and it was sent after the last one accepted with that key. With
+// trusted keys configured only those are trusted, otherwise any key is. A
+// node ID is pinned to the key of the first beacon heard with it, so that
+// nobody else can speak for that node later. Legacy beacons cannot be
+// verified: they are accepted only while legacy beacons are enabled and no
+// trusted keys are configured, and only for node IDs without a pinned key.
+//
+// Pinning only stops others from speaking for a node already heard. Without
+// trusted keys anyone can make up a node ID and key and have its beacons
+// trigger syncs; only trusted keys prevent that. New node IDs stop being
+// pinned once max_known_nodes are, so that made up ones cannot fill the
+// store.
+//
+// When the newest beacon of a node was sent is kept with its pinned key, so
+// that beacons recorded before a restart are still replays after it. A
+// beacon sent up to max_clock_step before it is taken as the clock of the
+// node stepping back; one sent longer before is a replay until an operator
+// resets the node with ResetSentAt. Every beacon accepted within that window
+// is remembered, so that none is accepted twice; only those heard within
+// max_clock_step before a restart may be replayed once after it. Our own beacons
+// are never stamped before the previous one, whatever our clock does.
+type Beacons struct {
+	nodeID        string
+	key           ed25519.PrivateKey
+	store         storage.Store
+	trusted       map[string]bool
+	legacyBeacons bool
+	maxKnownNodes int
+	maxClockStep  time.Duration
+
+	mu sync.Mutex
+	// lastSentAt is when the newest beacon accepted with each key was sent,
+	// and recentSentAt when those accepted within maxClockStep of it were
+	lastSentAt   map[string]time.Time
+	recentSentAt map[string][]time.Time
+	// sentAt is when our newest beacon was sent
+	sentAt time.Time
+}
+
+// NewBeacons returns the beacons of the node configured by cfg, signed with
+// key. Pinned keys are kept in store.
+func NewBeacons(cfg config.Config, key ed25519.PrivateKey, store storage.Store) (*Beacons, error) {
+	if cfg.Discovery.MaxKnownNodes <= 0 {
+		return nil, fmt.Errorf("discovery max_known_nodes must be positive, got %d", cfg.Discovery.MaxKnownNodes)
+	}
+	if cfg.Discovery.MaxClockStep < 0 {
+		return nil, fmt.Errorf("discovery max_clock_step must not be negative, got %s", cfg.Discovery.MaxClockStep)
+	}
+	trusted := map[string]bool{}
+	for _, k := range cfg.Discovery.TrustedKeys {
+		raw, err := hex.DecodeString(k)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %q", k)
+		}
+		trusted[hex.EncodeToString(raw)] = true
+	}
+	return &Beacons{
+		nodeID:        cfg.NodeID,
+		key:           key,
+		store:         store,
+		trusted:       trusted,
+		legacyBeacons: cfg.Discovery.LegacyBeacons,
+		maxKnownNodes: cfg.Discovery.MaxKnownNodes,
+		maxClockStep:  cfg.Discovery.MaxClockStep,
+		lastSentAt:    map[string]time.Time{},
+		recentSentAt:  map[string][]time.Time{},
+	}, nil
+}
+
+// PublicKey returns the key our beacons are signed with
+func (b *Beacons) PublicKey() ed25519.PublicKey {
+	return b.key.Public().(ed25519.PublicKey)
+}
+
+// Encode returns the beacons announcing hashes and our API port: the signed
+// beacon, and the legacy one while legacy beacons are enabled. localIP is
+// only used by the legacy beacon.
+func (b *Beacons) Encode(hashes models.HashSet, apiPort int, localIP string) ([][]byte, error) {
+	beacon := b.beacon(hashes, apiPort)
+	signed, err := EncodeBeacon(beacon, b.key)
+	if err != nil {
+		return nil, err
+	}
+	if !b.legacyBeacons {
+		return [][]byte{signed}, nil
+	}
+	return [][]byte{signed, encodeLegacyBeacon(beacon, localIP)}, nil
+}
+
+// Sign returns the signed beacon announcing hashes and our API port, which
+// ping responses carry to prove who answered
+func (b *Beacons) Sign(hashes models.HashSet, apiPort int) ([]byte, error) {
+	return EncodeBeacon(b.beacon(hashes, apiPort), b.key)
+}
+
+func (b *Beacons) beacon(hashes models.HashSet, apiPort int) Beacon {
+	return Beacon{
+		NodeID:       b.nodeID,
+		Hashes:       hashes,
+		APIPort:      apiPort,
+		Capabilities: ourCapabilities,
+		SentAt:       b.now(),
+	}
+}
+
+// now returns the sending time of our next beacon, after that of the
+// previous one even if our clock stepped back
+func (b *Beacons) now() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Compared on the wall clock, which is what beacons carry
+	now := time.Now().Round(0)
+	if !now.After(b.sentAt) {
+		now = b.sentAt.Add(time.Nanosecond)
+	}
+	b.sentAt = now
+	return now
+}
+
+// Accept decodes data and returns the beacon if it is one to act on
+func (b *Beacons) Accept(data []byte) (Beacon, error) {
+	if !IsBinaryBeacon(data) {
+		return b.acceptLegacy(data)
+	}
+
+	beacon, err := DecodeBeacon(data)
+	if err != nil {
+		return Beacon{}, err
+	}
+	key := hex.EncodeToString(beacon.PublicKey)
+	if bytes.Equal(beacon.PublicKey, b.PublicKey()) {
+		return Beacon{}, errOwnBeacon
+	}
+	if len(b.trusted) > 0 && !b.trusted[key] {
+		return Beacon{}, fmt.Errorf("untrusted key %s", key)
+	}
+	known, err := b.pin(beacon.NodeID, key)
+	if err != nil {
+		return Beacon{}, err
+	}
+
+	b.mu.Lock()
+	last := b.lastSentAt[key]
+	if known.LastSentAt != nil && known.LastSentAt.After(last) {
+		last = *known.LastSentAt
+	}
+	if beacon.SentAt.Equal(last) || slices.ContainsFunc(b.recentSentAt[key], beacon.SentAt.Equal) {
+		b.mu.Unlock()
+		return Beacon{}, errDuplicateBeacon
+	}
+	step := last.Sub(beacon.SentAt)
+	if step > b.maxClockStep {
+		b.mu.Unlock()
+		return Beacon{}, fmt.Errorf("replayed beacon of %s, sent %s before its newest one; if its clock stepped back, reset it with DELETE /v1/admin/nodes/%s/last-sent-at", beacon.NodeID, step, beacon.NodeID)
+	}
+	newest := last
+	if step < 0 {
+		newest = beacon.SentAt
+	}
+	recent := []time.Time{beacon.SentAt}
+	for _, sentAt := range b.recentSentAt[key] {
+		if newest.Sub(sentAt) <= b.maxClockStep {
+			recent = append(recent, sentAt)
+		}
+	}
+	b.lastSentAt[key] = newest
+	b.recentSentAt[key] = recent
+	b.mu.Unlock()
+
+	if step > 0 {
+		fmt.Printf("Beacon of %s sent %s before its newest one, taking it as its clock stepping back\n", beacon.NodeID, step)
+	}
+	// The store never moves it back, so listeners may save out of order
+	err = b.store.AdvanceNodeSentAt(beacon.NodeID, beacon.SentAt)
+	if err != nil {
+		fmt.Printf("Failed to save when the beacon of %s was sent: %v\n", beacon.NodeID, err)
+	}
+	return beacon, nil
+}
+
+// ResetSentAt forgets when the newest beacon of nodeID was sent, so that
+// its next beacon is accepted however far back its clock stepped. It
+// returns storage.ErrNotFound if nodeID has no pinned key.
+func (b *Beacons) ResetSentAt(nodeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	known, err := b.store.KnownNode(nodeID)
+	if err != nil {
+		return err
+	}
+	if err := b.store.ResetNodeSentAt(nodeID, nil); err != nil {
+		return err
+	}
+	delete(b.lastSentAt, known.PublicKey)
+	delete(b.recentSentAt, known.PublicKey)
+	fmt.Printf("Forgot when the newest beacon of %s was sent\n", nodeID)
+	return nil
+}
+
+// priority returns the priority of syncing with the sender of beacon, once
+// accepted
+func (b *Beacons) priority(beacon Beacon) int {
+	switch {
+	case !beacon.Signed():
+		return synchronization.PriorityUnsigned
+	case b.trusted[hex.EncodeToString(beacon.PublicKey)]:
+		return synchronization.PriorityTrusted
+	default:
+		return synchronization.PrioritySigned
+	}
+}
+
+// pin checks key is the one pinned to nodeID, pinning it if nodeID has none,
+// and returns the pin
+func (b *Beacons) pin(nodeID string, key string) (*models.KnownNode, error) {
+	known, err := b.store.KnownNode(nodeID)
+	if errors.Is(err, storage.ErrNotFound) {
+		count, err := b.store.CountKnownNodes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count pinned keys: %v", err)
+		}
+		if count >= int64(b.maxKnownNodes) {
+			return nil, fmt.Errorf("not pinning key of %s: max_known_nodes (%d) keys are pinned already", nodeID, count)
+		}
+		known = &models.KnownNode{NodeID: nodeID, PublicKey: key}
+		err = b.store.PinNode(known)
+		if errors.Is(err, storage.ErrDuplicate) {
+			// Pinned by another listener in the meantime
+			return b.pin(nodeID, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to pin key of %s: %v", nodeID, err)
+		}
+		fmt.Printf("Pinned key %s to node %s\n", key, nodeID)
+		return known, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pinned key of %s: %v", nodeID, err)
+	}
+	if known.PublicKey != key {
+		return nil, fmt.Errorf("node %s signed with key %s instead of its pinned key %s", nodeID, key, known.PublicKey)
+	}
+	return known, nil
+}
+
+func (b *Beacons) acceptLegacy(data []byte) (Beacon, error) {
+	beacon, err := decodeLegacyBeacon(data)
+	if err != nil {
+		return Beacon{}, err
+	}
+	if !b.legacyBeacons {
+		return Beacon{}, fmt.Errorf("legacy beacons are disabled")
+	}
+	if len(b.trusted) > 0 {
+		return Beacon{}, fmt.Errorf("legacy beacons cannot be trusted")
+	}
+	if beacon.NodeID == b.nodeID {
+		return Beacon{}, errOwnBeacon
+	}
+	_, err = b.store.KnownNode(beacon.NodeID)
+	if err == nil {
+		return Beacon{}, fmt.Errorf("legacy beacon of %s, which signs its beacons", beacon.NodeID)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return Beacon{}, fmt.Errorf("failed to get pinned key of %s: %v", beacon.NodeID, err)
+	}
+	return beacon, nil
+}
@@ -0,0 +1,304 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"axial/config"
+)
+
+// Watcher keeps the discovery sockets in line with the network interfaces,
+// so that interfaces coming up after the node started, such as a wlan or
+// mesh interface on a Pi, take part in discovery.
+//
+// It opens the sockets when it starts and rescans the interfaces every
+// rescan_interval. Usable interfaces without a socket get one, and the
+// sockets of interfaces that went away or changed index or address are
+// closed. Every socket has its own listener and broadcaster. A socket bound
+// to all interfaces stays open; in multicast mode it joins the group on
+// every interface as it comes up. Sockets that fail to open are retried
+// with a backoff, at once if their interface changes index.
+type Watcher struct {
+	cfg     config.Config
+	modes   sendModes
+	beacons *Beacons
+	// interfaces lists the network interfaces and open opens the socket
+	// of one for a family, or the one bound to all if iface is nil
+	interfaces func() ([]watchedInterface, error)
+	open       func(iface *net.Interface, ipv6 bool) (MulticastConnection, error)
+
+	mu          sync.Mutex
+	connections map[string]*watchedConnection
+	// failed are the sockets that failed to open
+	failed map[string]failedSocket
+	// joined are the interfaces the socket bound to all interfaces joined
+	// the multicast group on
+	joined map[string]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type watchedConnection struct {
+	MulticastConnection
+	cancel context.CancelFunc
+}
+
+// maxSocketRetry is the longest a socket that failed to open waits for its
+// next attempt
+const maxSocketRetry = 5 * time.Minute
+
+// failedSocket is a socket that failed to open on the interface with index
+type failedSocket struct {
+	index    int
+	attempts int
+	retryAt  time.Time
+}
+
+// watchedInterface is a network interface with its addresses
+type watchedInterface struct {
+	net.Interface
+	addrs []net.Addr
+}
+
+// usable reports whether discovery can run on the interface over the family
+func (i watchedInterface) usable(ipv6 bool) bool {
+	return usableFlags(i.Flags, ipv6) && i.ip(ipv6) != ""
+}
+
+// ip returns the address of the interface a socket of the family announces
+func (i watchedInterface) ip(ipv6 bool) string {
+	return addrsIP(i.addrs, ipv6)
+}
+
+// listInterfaces returns the network interfaces of the host. Those whose
+// addresses cannot be read have none.
+func listInterfaces() ([]watchedInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	watched := make([]watchedInterface, len(ifaces))
+	for i, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		watched[i] = watchedInterface{Interface: iface, addrs: addrs}
+	}
+	return watched, nil
+}
+
+// NewWatcher returns a watcher for the discovery modes of cfg, announcing
+// the beacons of beacons
+func NewWatcher(cfg config.Config, beacons *Beacons) (*Watcher, error) {
+	modes, err := resolveModes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Discovery.RescanInterval <= 0 {
+		return nil, fmt.Errorf("discovery rescan_interval must be positive, got %s", cfg.Discovery.RescanInterval)
+	}
+	return &Watcher{
+		cfg:        cfg,
+		modes:      modes,
+		beacons:    beacons,
+		interfaces: listInterfaces,
+		open: func(iface *net.Interface, ipv6 bool) (MulticastConnection, error) {
+			return openSocket(cfg, modes, iface, ipv6)
+		},
+		connections: map[string]*watchedConnection{},
+		failed:      map[string]failedSocket{},
+		joined:      map[string]bool{},
+	}, nil
+}
+
+// Run opens the sockets for node and keeps them in line with the interfaces
+// until ctx is cancelled. Broadcasts stop with ctx; listeners stop once
+// Close closes their sockets.
+func (w *Watcher) Run(ctx context.Context, node Node) {
+	w.rescan(ctx, node)
+
+	ticker := time.NewTicker(w.cfg.Discovery.RescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.rescan(ctx, node)
+		}
+	}
+}
+
+// Close closes every socket and waits for their listeners and broadcasters
+// to return
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	w.closed = true
+	for key := range w.connections {
+		w.stop(key)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (w *Watcher) rescan(ctx context.Context, node Node) {
+	ifaces, err := w.interfaces()
+	if err != nil {
+		fmt.Printf("Failed to get interfaces: %v\n", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || ctx.Err() != nil {
+		return
+	}
+
+	_, ok4 := w.modes.ipv4()
+	_, ok6 := w.modes.ipv6()
+	// Without any socket, try binding to all interfaces again
+	if ok4 && len(w.connections) == 0 {
+		if conn, err := w.open(nil, false); err == nil {
+			w.start(ctx, node, conn)
+		}
+	}
+
+	wildcard, bound := w.connections[socketKey(nil, false)]
+	wanted := map[string]watchedInterface{}
+	for _, iface := range ifaces {
+		if ok4 && !bound && iface.usable(false) {
+			wanted[socketKey(&iface.Interface, false)] = iface
+		}
+		if ok6 && iface.usable(true) {
+			wanted[socketKey(&iface.Interface, true)] = iface
+		}
+	}
+
+	for key, conn := range w.connections {
+		if conn.iface == nil {
+			continue
+		}
+		iface, ok := wanted[key]
+		if ok && iface.Index == conn.iface.Index && iface.ip(conn.modes.group6 != nil) == conn.localIP {
+			continue
+		}
+		fmt.Printf("Interface %s went away or changed, closing its discovery socket\n", conn.iface.Name)
+		w.stop(key)
+	}
+
+	now := time.Now()
+	for key, iface := range wanted {
+		if _, ok := w.connections[key]; ok {
+			continue
+		}
+		failed, ok := w.failed[key]
+		if ok && failed.index == iface.Index && now.Before(failed.retryAt) {
+			continue
+		}
+		conn, err := w.open(&iface.Interface, key == socketKey(&iface.Interface, true))
+		if err != nil {
+			if failed.index != iface.Index {
+				failed = failedSocket{index: iface.Index}
+			}
+			failed.attempts++
+			delay := w.cfg.Discovery.RescanInterval
+			for i := 1; i < failed.attempts && delay < maxSocketRetry; i++ {
+				delay *= 2
+			}
+			delay = min(delay, maxSocketRetry)
+			failed.retryAt = now.Add(delay)
+			w.failed[key] = failed
+			fmt.Printf("Failed to open discovery socket on interface %s, retrying in %s: %v\n", iface.Name, delay, err)
+			continue
+		}
+		delete(w.failed, key)
+		fmt.Printf("Interface %s came up, discovering on it\n", iface.Name)
+		w.start(ctx, node, conn)
+	}
+	for key := range w.failed {
+		if _, ok := wanted[key]; !ok {
+			delete(w.failed, key)
+		}
+	}
+	if len(w.connections) == 0 {
+		fmt.Printf("No usable interfaces for discovery yet, rescanning every %s\n", w.cfg.Discovery.RescanInterval)
+	}
+
+	if bound && w.modes.group != nil {
+		w.joinGroup(wildcard, ifaces)
+	}
+}
+
+// joinGroup joins the multicast group on the usable interfaces the socket
+// bound to all interfaces has not joined it on yet. It was only joined on
+// the default multicast interface when it was opened.
+func (w *Watcher) joinGroup(conn *watchedConnection, ifaces []watchedInterface) {
+	p := ipv4.NewPacketConn(conn.Conn)
+	up := map[string]bool{}
+	for _, iface := range ifaces {
+		if !iface.usable(false) {
+			continue
+		}
+		up[iface.Name] = true
+		if w.joined[iface.Name] {
+			continue
+		}
+		w.joined[iface.Name] = true
+		err := p.JoinGroup(&iface.Interface, &net.UDPAddr{IP: w.modes.group})
+		if err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+			fmt.Printf("Warning: failed to join multicast group on interface %s: %v\n", iface.Name, err)
+			continue
+		}
+		fmt.Printf("Joined multicast group %s on interface %s\n", w.modes.group, iface.Name)
+	}
+	// The kernel drops the membership of interfaces that go away, so join
+	// again when they come back
+	for name := range w.joined {
+		if !up[name] {
+			delete(w.joined, name)
+		}
+	}
+}
+
+// start records conn and starts its listener and broadcaster
+func (w *Watcher) start(ctx context.Context, node Node, conn MulticastConnection) {
+	broadcastCtx, cancel := context.WithCancel(ctx)
+	c := &watchedConnection{MulticastConnection: conn, cancel: cancel}
+	w.connections[socketKey(conn.iface, conn.modes.group6 != nil)] = c
+
+	w.wg.Add(2)
+	go func() {
+		defer w.wg.Done()
+		StartMulticastListener(w.cfg, &c.MulticastConnection, node, w.beacons)
+	}()
+	go func() {
+		defer w.wg.Done()
+		StartBroadcast(broadcastCtx, w.cfg, &c.MulticastConnection, node, w.beacons)
+	}()
+}
+
+// stop closes the socket of key, which ends its listener and broadcaster
+func (w *Watcher) stop(key string) {
+	conn := w.connections[key]
+	conn.cancel()
+	conn.Conn.Close()
+	delete(w.connections, key)
+}
+
+// socketKey identifies the socket of iface for the family, or the one bound
+// to all interfaces if iface is nil
+func socketKey(iface *net.Interface, ipv6 bool) string {
+	switch {
+	case iface == nil:
+		return "*"
+	case ipv6:
+		return "ipv6/" + iface.Name
+	default:
+		return "ipv4/" + iface.Name
+	}
+}
@@ -0,0 +1,184 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"axial/config"
+	"axial/models"
+	"axial/storage"
+	"axial/synchronization"
+)
+
+func TestNewWatcher(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Discovery.RescanInterval = 0
+	if _, err := NewWatcher(cfg, nil); err == nil {
+		t.Fatalf("expected a rescan interval of 0 to be refused")
+	}
+
+	cfg = config.Defaults()
+	watcher, err := NewWatcher(cfg, nil)
+	if err != nil {
+		t.Fatalf("new watcher: %v", err)
+	}
+	// Closing before it ran has nothing to stop
+	watcher.Close()
+
+	// Each interface has a socket per family, besides the one bound to all
+	wlan := &net.Interface{Name: "wlan0"}
+	keys := map[string]bool{socketKey(nil, false): true, socketKey(wlan, false): true, socketKey(wlan, true): true}
+	if len(keys) != 3 {
+		t.Fatalf("expected distinct socket keys, got %v", keys)
+	}
+}
+
+type testNode struct{}
+
+func (testNode) GetHashes() models.HashSet                    { return testHashes() }
+func (testNode) ScheduleSync(event synchronization.SyncEvent) {}
+
+// fakeInterfaces stands in for the interfaces of the host and their
+// sockets, which are loopback sockets
+type fakeInterfaces struct {
+	mu      sync.Mutex
+	ifaces  []watchedInterface
+	failing map[string]bool
+}
+
+func (f *fakeInterfaces) set(ifaces ...watchedInterface) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ifaces = ifaces
+}
+
+func (f *fakeInterfaces) list() ([]watchedInterface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]watchedInterface(nil), f.ifaces...), nil
+}
+
+func (f *fakeInterfaces) open(modes sendModes) func(iface *net.Interface, ipv6 bool) (MulticastConnection, error) {
+	return func(iface *net.Interface, ipv6 bool) (MulticastConnection, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if iface == nil {
+			return MulticastConnection{}, fmt.Errorf("cannot bind to all interfaces")
+		}
+		if f.failing[iface.Name] {
+			return MulticastConnection{}, fmt.Errorf("cannot bind to %s", iface.Name)
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return MulticastConnection{}, err
+		}
+		localIP := ""
+		for _, i := range f.ifaces {
+			if i.Name == iface.Name {
+				localIP = i.ip(ipv6)
+			}
+		}
+		return MulticastConnection{Conn: conn, iface: iface, localIP: localIP, modes: modes}, nil
+	}
+}
+
+func newFakeInterface(name string, index int, ip string) watchedInterface {
+	return watchedInterface{
+		Interface: net.Interface{Index: index, Name: name, Flags: net.FlagUp | net.FlagBroadcast | net.FlagMulticast},
+		addrs:     []net.Addr{&net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}},
+	}
+}
+
+func TestWatcherFollowsInterfaces(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Discovery.RescanInterval = 100 * time.Millisecond
+	watcher, err := NewWatcher(cfg, newTestBeacons(t, "axial-us", newKey(t), storage.NewMemory(), nil))
+	if err != nil {
+		t.Fatalf("new watcher: %v", err)
+	}
+	defer watcher.Close()
+	fake := &fakeInterfaces{failing: map[string]bool{}}
+	modes4, _ := watcher.modes.ipv4()
+	watcher.interfaces = fake.list
+	watcher.open = fake.open(modes4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wlan := socketKey(&net.Interface{Name: "wlan0"}, false)
+	connection := func(key string) *watchedConnection {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		return watcher.connections[key]
+	}
+	isClosed := func(conn *watchedConnection) bool {
+		return errors.Is(conn.Conn.Close(), net.ErrClosed)
+	}
+
+	watcher.rescan(ctx, testNode{})
+	if conn := connection(wlan); conn != nil {
+		t.Fatalf("expected no socket without interfaces, got %+v", conn)
+	}
+
+	// A socket is opened when the interface comes up
+	fake.set(newFakeInterface("wlan0", 3, "10.0.0.7"))
+	watcher.rescan(ctx, testNode{})
+	first := connection(wlan)
+	if first == nil || first.localIP != "10.0.0.7" {
+		t.Fatalf("expected a socket on wlan0 at 10.0.0.7, got %+v", first)
+	}
+	watcher.rescan(ctx, testNode{})
+	if connection(wlan) != first {
+		t.Fatalf("expected the socket to stay open while wlan0 is unchanged")
+	}
+
+	// Reopened when its address changes
+	fake.set(newFakeInterface("wlan0", 3, "10.0.0.8"))
+	watcher.rescan(ctx, testNode{})
+	second := connection(wlan)
+	if second == nil || second == first || second.localIP != "10.0.0.8" {
+		t.Fatalf("expected a new socket on wlan0 at 10.0.0.8, got %+v", second)
+	}
+	if !isClosed(first) {
+		t.Fatalf("expected the socket of the old address to be closed")
+	}
+
+	// Closed when the interface goes away
+	fake.set()
+	watcher.rescan(ctx, testNode{})
+	if conn := connection(wlan); conn != nil {
+		t.Fatalf("expected no socket once wlan0 went away, got %+v", conn)
+	}
+	if !isClosed(second) {
+		t.Fatalf("expected the socket of wlan0 to be closed")
+	}
+
+	// A socket that failed to open is retried with a backoff
+	eth := socketKey(&net.Interface{Name: "eth0"}, false)
+	fake.mu.Lock()
+	fake.failing["eth0"] = true
+	fake.mu.Unlock()
+	fake.set(newFakeInterface("eth0", 2, "10.0.1.7"))
+	watcher.rescan(ctx, testNode{})
+	watcher.mu.Lock()
+	failed := watcher.failed[eth]
+	watcher.mu.Unlock()
+	if connection(eth) != nil || failed.attempts != 1 || failed.retryAt.IsZero() {
+		t.Fatalf("expected a failed attempt on eth0, got %+v", failed)
+	}
+	fake.mu.Lock()
+	fake.failing["eth0"] = false
+	fake.mu.Unlock()
+	watcher.rescan(ctx, testNode{})
+	if time.Now().Before(failed.retryAt) && connection(eth) != nil {
+		t.Fatalf("expected eth0 not to be retried before its backoff is over")
+	}
+	time.Sleep(time.Until(failed.retryAt))
+	watcher.rescan(ctx, testNode{})
+	if connection(eth) == nil {
+		t.Fatalf("expected eth0 to get its socket once retried")
+	}
+}
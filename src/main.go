@@ -1,66 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"axial/api"
 	"axial/config"
-	"axial/discovery"
-	"axial/models"
+	"axial/node"
 )
 
 func main() {
-	cfg, err := config.LoadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	cfg, err := config.LoadConfig(os.Args[1:])
 	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
 		panic(err)
 	}
 
-	nodeID := cfg.NodeID
-	if nodeID == "" {
+	if cfg.NodeID == "" {
 		// Default to hostname
-		nodeID, _ = os.Hostname()
-	}
-
-	// Initialize database connection
-	err = models.InitDB(cfg.Database)
-	if err != nil {
-		panic(fmt.Errorf("failed to initialize database: %v", err))
+		cfg.NodeID, _ = os.Hostname()
 	}
 
-	fmt.Printf("Starting node %s\n", nodeID)
+	fmt.Printf("Starting node %s\n", cfg.NodeID)
 
-	// Calculate initial hash
-	err = models.RefreshHashes(models.DB)
+	n, err := node.New(cfg)
 	if err != nil {
-		panic(fmt.Errorf("failed to calculate database hash: %v", err))
+		panic(err)
 	}
 
-	hashes := models.GetHashes()
+	// The node runs until SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Printf("Node %s hash: %s\n", nodeID, hashes.Full)
-
-	// Create single multicast socket
-	connections, err := discovery.CreateMulticastSockets(cfg)
-	if err != nil {
+	if err := n.Start(ctx); err != nil {
+		n.Stop()
 		panic(err)
 	}
 
-	for _, conn := range connections {
-		defer conn.Conn.Close()
-		go discovery.StartMulticastListener(cfg, &conn)
-		go discovery.StartBroadcast(cfg, &conn)
-	}
-
-	// Register API routes
-	api.RegisterRoutes()
-
-	// Start server
-	port := 8080
-	fmt.Printf("Server starting on port %d...\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	if err := n.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Node stopped: %v\n", err)
+		os.Exit(1)
 	}
 }
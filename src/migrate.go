@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"axial/config"
+	"axial/models"
+)
+
+const migrateUsage = "usage: axial migrate up|down|status [config flags]"
+
+// runMigrate implements `axial migrate up|down|status`. The remaining
+// arguments are the usual configuration flags, so the same config file,
+// environment and --db-* flags select the database.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	action := args[0]
+
+	cfg, err := config.LoadConfig(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 2
+	}
+
+	db, err := models.ConnectDB(cfg.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer models.CloseDB(db)
+
+	switch action {
+	case "up":
+		if err := models.Migrate(db); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("Schema is at version %d\n", models.LatestVersion())
+	case "down":
+		version, err := models.MigrateDown(db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("Schema is at version %d\n", version)
+	case "status":
+		states, err := models.MigrationStatus(db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		for _, s := range states {
+			status := "pending"
+			if s.Applied {
+				status = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Unknown {
+				status += " (unknown to this binary)"
+			}
+			fmt.Printf("%4d  %-28s %s\n", s.Version, s.Name, status)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
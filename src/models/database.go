@@ -1,79 +1,92 @@
 package models
 
 import (
-	"errors"
 	"fmt"
-	"log"
+	"os"
+	"path/filepath"
 
-	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
 	"axial/config"
 )
 
-var DB *gorm.DB
-
 const (
 	UniqueViolationErr = "23505"
 )
 
-// InitDB establishes a connection to the database and performs migrations
-func InitDB(cfg config.DatabaseConfig) error {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name)
+// OpenDB connects to the database and applies any pending migrations. It
+// fails if the schema was migrated by a newer binary.
+func OpenDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := ConnectDB(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	// Enable detailed logging for migrations
-	gormConfig := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+	if err := Migrate(db); err != nil {
+		CloseDB(db)
+		return nil, fmt.Errorf("failed to run migrations: %v", err)
 	}
 
-	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), gormConfig)
+	return db, nil
+}
+
+// ConnectDB connects to the database without touching its schema
+func ConnectDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	dialector, err := openDialector(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %v", err)
+		return nil, err
 	}
 
-	log.Println("Running migrations...")
-	// Run migrations
-	if err := DB.AutoMigrate(&User{}, &Message{}, &Bulletin{}); err != nil {
-		return fmt.Errorf("failed to run migrations: %v", err)
+	// Enable detailed logging for migrations
+	gormConfig := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Info),
 	}
 
-	// Debug: Print table schema
-	var tableInfo []struct {
-		ColumnName string `gorm:"column:column_name"`
-		DataType   string `gorm:"column:data_type"`
-		IsNullable string `gorm:"column:is_nullable"`
+	db, err := gorm.Open(dialector, gormConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
+	return db, nil
+}
 
-	if err := DB.Raw(`
-		SELECT column_name, data_type, is_nullable 
-		FROM information_schema.columns 
-		WHERE table_name = 'bulletin_board'
-		ORDER BY ordinal_position
-	`).Scan(&tableInfo).Error; err != nil {
-		log.Printf("Failed to get table info: %v", err)
-	} else {
-		log.Println("Bulletin table schema:")
-		for _, col := range tableInfo {
-			log.Printf("  %s (%s, nullable: %s)", col.ColumnName, col.DataType, col.IsNullable)
+// openDialector returns the GORM dialector for the configured driver
+func openDialector(cfg config.DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case "", DriverPostgres:
+		dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+			cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name)
+		return postgres.Open(dsn), nil
+	case DriverSQLite:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("database.path is required for the sqlite driver")
 		}
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %v", err)
+		}
+		// WAL lets readers proceed while a sync writes, and the busy timeout
+		// makes concurrent writers wait instead of failing immediately.
+		dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on", cfg.Path)
+		return sqlite.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
 	}
-
-	return nil
 }
 
-func GetUserByFingerprint(fingerprint Fingerprint) (*User, error) {
-	var user User
-	if err := DB.Where("fingerprint = ?", fingerprint).First(&user).Error; err != nil {
-		return nil, err
+// CloseDB closes the database connection pool
+func CloseDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
 	}
-	return &user, nil
+	return sqlDB.Close()
 }
 
+// IsDuplicateError reports whether err is a unique constraint violation from
+// any supported driver. Prefer DialectOf(db).IsDuplicateError when the
+// database is at hand.
 func IsDuplicateError(err error) bool {
-	var pgErr *pgconn.PgError
-	return errors.As(err, &pgErr) && pgErr.Code == UniqueViolationErr
+	return postgresDialect{}.IsDuplicateError(err) || sqliteDialect{}.IsDuplicateError(err)
 }
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// Dialect holds the queries and error checks that differ between the
+// supported database drivers.
+type Dialect interface {
+	// ContainsFold returns a condition matching rows where column contains
+	// the bound pattern, ignoring case. The pattern uses LIKE wildcards.
+	ContainsFold(column string) string
+
+	// JSONArrayContains returns a condition matching rows where the JSON
+	// array stored in column contains value, and the argument to bind.
+	JSONArrayContains(column string, value string) (string, interface{})
+
+	// IsDuplicateError reports whether err is a unique constraint violation.
+	IsDuplicateError(err error) bool
+
+	// LockForUpdate makes query lock the rows it selects until the end of
+	// the transaction.
+	LockForUpdate(query *gorm.DB) *gorm.DB
+}
+
+// DialectOf returns the Dialect for the driver db was opened with.
+func DialectOf(db *gorm.DB) Dialect {
+	if db.Dialector.Name() == DriverSQLite {
+		return sqliteDialect{}
+	}
+	return postgresDialect{}
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) ContainsFold(column string) string {
+	return column + " ILIKE ?"
+}
+
+func (postgresDialect) JSONArrayContains(column string, value string) (string, interface{}) {
+	arrayContains, _ := json.Marshal([]string{value})
+	return "to_jsonb(" + column + ")::jsonb @> ?", string(arrayContains)
+}
+
+func (postgresDialect) IsDuplicateError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == UniqueViolationErr
+}
+
+func (postgresDialect) LockForUpdate(query *gorm.DB) *gorm.DB {
+	return query.Clauses(clause.Locking{Strength: "UPDATE"})
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) ContainsFold(column string) string {
+	return "LOWER(" + column + ") LIKE LOWER(?)"
+}
+
+func (sqliteDialect) JSONArrayContains(column string, value string) (string, interface{}) {
+	return "EXISTS (SELECT 1 FROM json_each(" + column + ") WHERE json_each.value = ?)", value
+}
+
+func (sqliteDialect) IsDuplicateError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+// LockForUpdate returns query unchanged: SQLite has no row locks, a write
+// transaction already holds the lock on the whole database.
+func (sqliteDialect) LockForUpdate(query *gorm.DB) *gorm.DB {
+	return query
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newSQLiteTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return db.Session(&gorm.Session{SkipHooks: true})
+}
+
+func TestSQLiteDialectQueries(t *testing.T) {
+	db := newSQLiteTestDB(t)
+	dialect := DialectOf(db)
+
+	users := []User{
+		{Base: Base{ID: "u1"}, Fingerprint: "ABCDEF0123456789"},
+		{Base: Base{ID: "u2"}, Fingerprint: "0123456789abcdef"},
+	}
+	for _, u := range users {
+		if err := db.Create(&u).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	var found []User
+	if err := db.Where(dialect.ContainsFold("fingerprint"), "%cdef%").Order("fingerprint").Find(&found).Error; err != nil {
+		t.Fatalf("contains query: %v", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected case-insensitive match on both users, got %d", len(found))
+	}
+
+	messages := []Message{
+		{Base: Base{ID: "m1"}, Sender: "alice", Recipients: Fingerprints{"bob", "carol"}},
+		{Base: Base{ID: "m2"}, Sender: "carol", Recipients: Fingerprints{"alice"}},
+	}
+	for _, m := range messages {
+		if err := db.Create(&m).Error; err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+	}
+
+	query, arg := dialect.JSONArrayContains("recipients", "bob")
+	var received []Message
+	if err := db.Where(query, arg).Find(&received).Error; err != nil {
+		t.Fatalf("recipient query: %v", err)
+	}
+	if len(received) != 1 || received[0].ID != "m1" {
+		t.Fatalf("expected only m1 to be addressed to bob, got %+v", received)
+	}
+
+	duplicate := User{Base: Base{ID: "u1"}, Fingerprint: "other"}
+	err := db.Create(&duplicate).Error
+	if err == nil || !dialect.IsDuplicateError(err) || !IsDuplicateError(err) {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package models
+
+// fingerprintAlphabet holds the characters fingerprint ranges are split at,
+// in byte order. Fingerprints are hex key IDs; both cases are listed so that
+// upper case fingerprints split as finely as lower case ones.
+const fingerprintAlphabet = "0123456789ABCDEFabcdef"
+
+// FullFingerprintRange covers every fingerprint, whatever its case or
+// alphabet. User reconciliation starts from it.
+var FullFingerprintRange = StringRange{}
+
+// Children splits r at the fingerprints made of r.Start followed by one more
+// character, the way sync ranges split into the next level. The children
+// tile r, so strings outside the alphabet are covered too, by the child
+// that sorts them. A range with nothing to split at has no children.
+func (r StringRange) Children() []StringRange {
+	children := []StringRange{}
+	start := r.Start
+	for _, c := range fingerprintAlphabet {
+		point := r.Start + string(c)
+		if r.End != "" && point >= r.End {
+			break
+		}
+		children = append(children, StringRange{Start: start, End: point})
+		start = point
+	}
+	if len(children) == 0 {
+		return children
+	}
+	return append(children, StringRange{Start: start, End: r.End})
+}
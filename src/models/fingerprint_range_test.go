@@ -0,0 +1,39 @@
+package models
+
+import "testing"
+
+func TestFingerprintRangeChildrenTileParent(t *testing.T) {
+	for _, r := range []StringRange{FullFingerprintRange, {Start: "a", End: "b"}, {Start: "9", End: "A"}} {
+		children := r.Children()
+		if len(children) != len(fingerprintAlphabet)+1 {
+			t.Fatalf("%+v: expected %d children, got %d", r, len(fingerprintAlphabet)+1, len(children))
+		}
+		if children[0].Start != r.Start || children[len(children)-1].End != r.End {
+			t.Fatalf("%+v: children do not cover the range: %+v", r, children)
+		}
+		for i := 1; i < len(children); i++ {
+			if children[i].Start != children[i-1].End || children[i].Start <= children[i-1].Start {
+				t.Fatalf("%+v: children out of order at %d: %+v", r, i, children)
+			}
+		}
+	}
+
+	// Upper and lower case fingerprints land in different children
+	children := FullFingerprintRange.Children()
+	in := func(s string) int {
+		for i, c := range children {
+			if s >= c.Start && (c.End == "" || s < c.End) {
+				return i
+			}
+		}
+		return -1
+	}
+	if in("ABCDEF0123456789") == in("abcdef0123456789") || in("ABCDEF0123456789") < 0 {
+		t.Fatalf("expected upper and lower case fingerprints in different children")
+	}
+
+	// The leading child of a range holds only its start and cannot split
+	if leaf := children[0].Children(); len(leaf) != 0 {
+		t.Fatalf("expected no children for %+v, got %+v", children[0], leaf)
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// BucketSize is the span of time covered by one HashBucket
+const BucketSize = time.Hour
+
+const (
+	BucketKindMessages  = "messages"
+	BucketKindBulletins = "bulletins"
+)
+
+// HashBucket holds the accumulated hash and the number of the items of one
+// kind created within one BucketSize aligned span of time. The buckets are
+// maintained on insert, so range hashes and counts can be summed from them
+// instead of rescanning the content tables.
+type HashBucket struct {
+	Kind   string    `gorm:"column:kind;primaryKey"`
+	Bucket time.Time `gorm:"column:bucket;primaryKey"`
+	Hash   string    `gorm:"column:hash;not null"`
+	Count  int64     `gorm:"column:count;not null"`
+}
+
+func (HashBucket) TableName() string {
+	return "hash_buckets"
+}
+
+// BucketStart returns the start of the bucket t falls in
+func BucketStart(t time.Time) time.Time {
+	return t.UTC().Truncate(BucketSize)
+}
+
+// ParseAccumulator decodes an accumulator from its String form
+func ParseAccumulator(s string) (Accumulator, error) {
+	var acc Accumulator
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return acc, err
+	}
+	if len(b) != len(acc) {
+		return acc, fmt.Errorf("invalid accumulator length %d", len(b))
+	}
+	copy(acc[:], b)
+	return acc, nil
+}
+
+// Combine folds every ID accumulated in other into a
+func (a *Accumulator) Combine(other Accumulator) {
+	for i := range a {
+		a[i] ^= other[i]
+	}
+}
@@ -3,11 +3,6 @@ package models
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
-	"strings"
-	"time"
-
-	"gorm.io/gorm"
 )
 
 type HashSet struct {
@@ -17,160 +12,51 @@ type HashSet struct {
 	Full      string `json:"full"`
 }
 
-var (
-	hashes = HashSet{
-		Messages:  "",
-		Users:     "",
-		Bulletins: "",
-		Full:      "",
-	}
-)
-
-// GetMessagesHash calculates a hash of message IDs ordered by timestamp
-// If timeRange is provided, only messages within that range are included
-func GetMessagesHash(db *gorm.DB, start, end *time.Time) (string, error) {
-	query := db.Model(&Message{}).Order("created_at")
-
-	if start != nil {
-		query = query.Where("created_at >= ?", start)
-	}
-	if end != nil {
-		query = query.Where("created_at <= ?", end)
-	}
-
-	var messageIDs []string
-	// Prefer current schema `id`; fall back to legacy `message_id` only if present
-	if err := query.Select("id AS combined_id").Pluck("combined_id", &messageIDs).Error; err != nil {
-		// If selecting `id` fails for any reason, try legacy column (older deployments)
-		// Note: referencing a missing column causes SQLSTATE 42703; guard by checking error text
-		legacyErr := query.Select("message_id AS combined_id").Pluck("combined_id", &messageIDs).Error
-		if legacyErr != nil {
-			// Provide clearer context, include both errors
-			combined := fmt.Errorf("failed to get message IDs (id err: %v, legacy err: %v)", err, legacyErr)
-			// If error mentions missing column, surface a concise hint
-			if strings.Contains(strings.ToLower(legacyErr.Error()), "does not exist") || strings.Contains(legacyErr.Error(), "42703") {
-				return "", fmt.Errorf("failed to get message IDs: column 'message_id' not found; current schema uses 'id': %w", combined)
-			}
-			return "", combined
-		}
-	}
-
-	hasher := sha256.New()
-	for _, id := range messageIDs {
-		hasher.Write([]byte(id))
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+// HashProvider calculates the hashes of a node's data set
+type HashProvider interface {
+	Hashes() (HashSet, error)
 }
 
-// GetBulletinsHash calculates a hash of bulletins just like messages
-// Bulletins have topic, content and parent id where message has content only
-//
-//	type CreateBulletin struct {
-//		Topic string `json:"topic" gorm:"column:topic;not null"`
-//		Content Crypto `json:"content" gorm:"column:content;not null"`
-//		ParentID *string `json:"parent_id,omitempty" gorm:"column:parent_id;default:null"`
-//	}
-func GetBulletinsHash(db *gorm.DB, start, end *time.Time) (string, error) {
-	query := db.Model(&Bulletin{}).Order("created_at")
-
-	if start != nil {
-		query = query.Where("created_at >= ?", start)
-	}
-	if end != nil {
-		query = query.Where("created_at <= ?", end)
-	}
+// Accumulator is an order independent hash of a set of IDs: the XOR of
+// their SHA-256 digests. Adding an ID is O(1), so stores can keep the hash
+// of a whole table up to date on every insert, and two nodes holding the
+// same IDs always get the same value however the rows were inserted.
+type Accumulator [sha256.Size]byte
 
-	var bulletinIDs []string
-	if err := query.Select("id AS combined_id").Pluck("combined_id", &bulletinIDs).Error; err != nil {
-		return "", fmt.Errorf("failed to get bulletin IDs: %v", err)
+// Add folds id into the accumulator. Adding the same ID twice removes it
+// again, so callers must only add IDs that were really inserted.
+func (a *Accumulator) Add(id string) {
+	sum := sha256.Sum256([]byte(id))
+	for i := range a {
+		a[i] ^= sum[i]
 	}
-
-	hasher := sha256.New()
-	for _, id := range bulletinIDs {
-		hasher.Write([]byte(id))
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-// GetUsersHash calculates a hash of user fingerprints in alphabetical order
-func GetUsersHash(db *gorm.DB) (string, error) {
-	var fingerprints []string
-	if err := db.Model(&User{}).Order("fingerprint").Pluck("fingerprint", &fingerprints).Error; err != nil {
-		return "", fmt.Errorf("failed to get user fingerprints: %v", err)
-	}
-
-	hasher := sha256.New()
-	for _, fp := range fingerprints {
-		hasher.Write([]byte(fp))
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+func (a Accumulator) String() string {
+	return hex.EncodeToString(a[:])
 }
 
-func RefreshHashes(db *gorm.DB) error {
-	messagesHash, err := GetMessagesHash(db, nil, nil)
-	if err != nil {
-		return err
-	}
-
-	bulletinsHash, err := GetBulletinsHash(db, nil, nil)
-	if err != nil {
-		return err
-	}
-
-	usersHash, err := GetUsersHash(db)
-	if err != nil {
-		return err
+// HashIDs returns the accumulated hash of ids. Messages and bulletins are
+// hashed by ID and users by fingerprint.
+func HashIDs(ids []string) string {
+	var acc Accumulator
+	for _, id := range ids {
+		acc.Add(id)
 	}
+	return acc.String()
+}
 
-	// Combine hashes in a deterministic order
+// NewHashSet combines the per-table hashes in a deterministic order
+func NewHashSet(messagesHash, bulletinsHash, usersHash string) HashSet {
 	hasher := sha256.New()
 	hasher.Write([]byte("messages:" + messagesHash))
 	hasher.Write([]byte("bulletins:" + bulletinsHash))
 	hasher.Write([]byte("users:" + usersHash))
 
-	hashes = HashSet{
+	return HashSet{
 		Messages:  messagesHash,
 		Bulletins: bulletinsHash,
 		Users:     usersHash,
 		Full:      hex.EncodeToString(hasher.Sum(nil)),
 	}
-
-	UpdateHashes(hashes)
-
-	return nil
-}
-
-// GetDatabaseHashes returns a hash combining all table hashes
-func GetDatabaseHashes(db *gorm.DB) (HashSet, error) {
-	if hashes.Full == "" {
-		err := RefreshHashes(db)
-		if err != nil {
-			return HashSet{}, err
-		}
-	}
-	return hashes, nil
-}
-
-// GetMessageHashForRange returns a hash of messages within a specific time range
-func GetMessageHashForRange(db *gorm.DB, start, end time.Time) (string, error) {
-	return GetMessagesHash(db, &start, &end)
-}
-
-func GetUsersHashByFingerprintRange(db *gorm.DB, start, end string) (string, error) {
-	query := db.Model(&User{}).Where("fingerprint >= ?", start).Where("fingerprint <= ?", end)
-
-	var fingerprints []string
-	if err := query.Order("fingerprint").Pluck("fingerprint", &fingerprints).Error; err != nil {
-		return "", fmt.Errorf("failed to get user fingerprints: %v", err)
-	}
-
-	hasher := sha256.New()
-	for _, fp := range fingerprints {
-		hasher.Write([]byte(fp))
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
@@ -0,0 +1,43 @@
+package models
+
+// IngestStatus is what became of one item a peer sent us
+type IngestStatus string
+
+const (
+	IngestAccepted  IngestStatus = "accepted"  // stored
+	IngestDuplicate IngestStatus = "duplicate" // already stored, or sent twice in the batch
+	IngestRejected  IngestStatus = "rejected"  // failed validation, see Error
+)
+
+// IngestResult reports on one item of a batch. ID is the item's ID, or the
+// fingerprint for users.
+type IngestResult struct {
+	ID     string       `json:"id"`
+	Status IngestStatus `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// IngestReport tells the sender of a batch exactly what landed. Items are
+// in the order they were sent.
+type IngestReport struct {
+	Accepted   int            `json:"accepted"`
+	Duplicates int            `json:"duplicates"`
+	Rejected   int            `json:"rejected"`
+	Items      []IngestResult `json:"items"`
+}
+
+// NewIngestReport counts the results of a batch
+func NewIngestReport(items []IngestResult) IngestReport {
+	report := IngestReport{Items: items}
+	for _, item := range items {
+		switch item.Status {
+		case IngestAccepted:
+			report.Accepted++
+		case IngestDuplicate:
+			report.Duplicates++
+		case IngestRejected:
+			report.Rejected++
+		}
+	}
+	return report
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// KnownNode pins the key a node signed its beacons with the first time we
+// heard it. Beacons announcing its node ID signed with any other key are
+// ignored until an operator forgets the node. Beacons sent before
+// LastSentAt are replays.
+type KnownNode struct {
+	NodeID     string     `gorm:"column:node_id;primaryKey" json:"node_id"`
+	PublicKey  string     `gorm:"column:public_key;not null" json:"public_key"` // hex
+	PinnedAt   time.Time  `gorm:"column:pinned_at;not null" json:"pinned_at"`
+	LastSentAt *time.Time `gorm:"column:last_sent_at" json:"last_sent_at,omitempty"` // newest beacon accepted
+}
+
+func (KnownNode) TableName() string {
+	return "known_nodes"
+}
@@ -0,0 +1,490 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one step of the database schema history. Migrations are
+// applied in Version order and each one can be reverted with Down.
+//
+// Migrations must not use the current model types: they describe the schema
+// as it was when the migration was written, so they declare their own
+// snapshot structs.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaVersion is a row of the schema_version table, one per applied
+// migration.
+type SchemaVersion struct {
+	Version   int       `gorm:"column:version;primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"column:name;not null"`
+	AppliedAt time.Time `gorm:"column:applied_at;not null"`
+}
+
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// MigrationState describes whether a migration has been applied.
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Unknown is set for versions recorded in the database that this binary
+	// does not know about, i.e. the schema was migrated by a newer binary.
+	Unknown bool
+}
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// binary than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Migrations returns the known migrations in the order they are applied.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// LatestVersion returns the schema version this binary expects.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentVersion returns the highest migration version applied to db, or 0
+// for an empty database.
+func CurrentVersion(db *gorm.DB) (int, error) {
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return 0, fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+	var version int
+	if err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// CheckSchemaVersion returns ErrSchemaTooNew if db was migrated past the
+// latest version known to this binary.
+func CheckSchemaVersion(db *gorm.DB) (int, error) {
+	version, err := CurrentVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if version > LatestVersion() {
+		return version, fmt.Errorf("%w: database is at version %d, binary supports up to %d",
+			ErrSchemaTooNew, version, LatestVersion())
+	}
+	return version, nil
+}
+
+// Migrate applies every pending migration, each in its own transaction.
+// It refuses to touch a schema that is newer than this binary.
+func Migrate(db *gorm.DB) error {
+	current, err := CheckSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		fmt.Printf("Applying migration %d_%s\n", m.Version, m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the most recently applied migration. It returns the
+// version the schema is at afterwards.
+func MigrateDown(db *gorm.DB) (int, error) {
+	current, err := CheckSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if current == 0 {
+		return 0, fmt.Errorf("no migrations to revert")
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version != current {
+			continue
+		}
+		fmt.Printf("Reverting migration %d_%s\n", m.Version, m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaVersion{}, "version = ?", m.Version).Error
+		})
+		if err != nil {
+			return current, fmt.Errorf("reverting migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		return CurrentVersion(db)
+	}
+	return current, fmt.Errorf("migration %d is not known to this binary", current)
+}
+
+// MigrationStatus lists every known migration and whether it is applied,
+// followed by any applied versions this binary does not know about.
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	if _, err := CurrentVersion(db); err != nil {
+		return nil, err
+	}
+	var applied []SchemaVersion
+	if err := db.Order("version").Find(&applied).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema versions: %v", err)
+	}
+	appliedByVersion := map[int]SchemaVersion{}
+	for _, v := range applied {
+		appliedByVersion[v.Version] = v
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if v, ok := appliedByVersion[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = v.AppliedAt
+			delete(appliedByVersion, m.Version)
+		}
+		states = append(states, state)
+	}
+	for _, v := range applied {
+		if _, ok := appliedByVersion[v.Version]; ok {
+			states = append(states, MigrationState{
+				Version: v.Version, Name: v.Name, Applied: true, AppliedAt: v.AppliedAt, Unknown: true,
+			})
+		}
+	}
+	return states, nil
+}
+
+var migrations = []Migration{
+	{
+		// Creates the tables previously managed by AutoMigrate. Creating
+		// them is idempotent, so databases set up before versioned
+		// migrations existed are adopted as version 1 unchanged.
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v1User{}, &v1Message{}, &v1Bulletin{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v1Bulletin{}, &v1Message{}, &v1User{})
+		},
+	},
+	{
+		// Very old deployments keyed messages by a message_id column,
+		// which current inserts never fill.
+		Version: 2,
+		Name:    "drop_legacy_message_id",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn("messages", "message_id") {
+				return nil
+			}
+			return tx.Migrator().DropColumn("messages", "message_id")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE messages ADD COLUMN message_id TEXT").Error
+		},
+	},
+	{
+		// Per-hour hashes and counts of messages and bulletins, so range
+		// hashes no longer rescan the content tables.
+		Version: 3,
+		Name:    "hash_buckets",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&v3HashBucket{}); err != nil {
+				return err
+			}
+			if err := backfillHashBuckets(tx, "messages", "messages"); err != nil {
+				return err
+			}
+			return backfillHashBuckets(tx, "bulletin_board", "bulletins")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v3HashBucket{})
+		},
+	},
+	{
+		// Progress of unfinished sync sessions, so they can be resumed
+		Version: 4,
+		Name:    "sync_checkpoints",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v4SyncCheckpoint{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v4SyncCheckpoint{})
+		},
+	},
+	{
+		// Journal of the sync sessions with peers
+		Version: 5,
+		Name:    "sync_sessions",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v5SyncSession{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v5SyncSession{})
+		},
+	},
+	{
+		// Failures, backoff and quarantine of the peers we sync with
+		Version: 6,
+		Name:    "peer_health",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v6PeerHealth{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v6PeerHealth{})
+		},
+	},
+	{
+		// Keys pinned to the node IDs of the beacons we heard
+		Version: 7,
+		Name:    "known_nodes",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v7KnownNode{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v7KnownNode{})
+		},
+	},
+	{
+		// created_at in Unix nanoseconds. SQLite keeps created_at as text
+		// in the zone it was written in, so periods compared on it
+		// disagreed with the UTC hash buckets.
+		Version: 8,
+		Name:    "created_unix",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&v8User{}, &v8Message{}, &v8Bulletin{}} {
+				if err := tx.AutoMigrate(model); err != nil {
+					return err
+				}
+			}
+			for _, table := range []string{"users", "messages", "bulletin_board"} {
+				if err := backfillCreatedUnix(tx, table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&v8Message{}, &v8Bulletin{}} {
+				if err := tx.Migrator().DropIndex(model, "CreatedUnix"); err != nil {
+					return err
+				}
+			}
+			for _, model := range []interface{}{&v8User{}, &v8Message{}, &v8Bulletin{}} {
+				if err := tx.Migrator().DropColumn(model, "created_unix"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// When the newest beacon accepted from each node was sent, so that
+		// beacons recorded before a restart cannot be replayed after it
+		Version: 9,
+		Name:    "known_nodes_last_sent_at",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v9KnownNode{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&v9KnownNode{}, "last_sent_at")
+		},
+	},
+}
+
+// backfillCreatedUnix sets created_unix from created_at in every row of table
+func backfillCreatedUnix(tx *gorm.DB, table string) error {
+	var rows []struct {
+		ID        string
+		CreatedAt time.Time
+	}
+	if err := tx.Table(table).Select("id, created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := tx.Table(table).Where("id = ?", row.ID).Update("created_unix", row.CreatedAt.UnixNano()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillHashBuckets fills the hash buckets of kind from the rows of table
+func backfillHashBuckets(tx *gorm.DB, table string, kind string) error {
+	var rows []struct {
+		ID        string
+		CreatedAt time.Time
+	}
+	if err := tx.Table(table).Select("id, created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	buckets := map[time.Time]*v3HashBucket{}
+	for _, row := range rows {
+		start := row.CreatedAt.UTC().Truncate(time.Hour)
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &v3HashBucket{Kind: kind, Bucket: start}
+			buckets[start] = bucket
+		}
+		bucket.acc.Add(row.ID)
+		bucket.Count++
+	}
+
+	batch := make([]v3HashBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		bucket.Hash = bucket.acc.String()
+		batch = append(batch, *bucket)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(batch, 500).Error
+}
+
+type v1User struct {
+	ID          string    `gorm:"primaryKey"`
+	CreatedAt   time.Time `gorm:"column:created_at;not null"`
+	PublicKey   string    `gorm:"column:public_key;not null"`
+	Fingerprint string    `gorm:"uniqueIndex:idx_users_fingerprint"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Message struct {
+	ID         string    `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null"`
+	Sender     string    `gorm:"column:sender;type:text"`
+	Recipients string    `gorm:"column:recipients;type:jsonb"`
+	Content    string    `gorm:"column:content;not null"`
+}
+
+func (v1Message) TableName() string { return "messages" }
+
+type v1Bulletin struct {
+	ID        string    `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"column:created_at;not null"`
+	Sender    string    `gorm:"column:sender;not null"`
+	Topic     string    `gorm:"column:topic;not null"`
+	Content   string    `gorm:"column:content;not null"`
+	ParentID  *string   `gorm:"column:parent_id;default:null"`
+}
+
+func (v1Bulletin) TableName() string { return "bulletin_board" }
+
+type v3HashBucket struct {
+	Kind   string    `gorm:"column:kind;primaryKey"`
+	Bucket time.Time `gorm:"column:bucket;primaryKey"`
+	Hash   string    `gorm:"column:hash;not null"`
+	Count  int64     `gorm:"column:count;not null"`
+
+	acc Accumulator
+}
+
+func (v3HashBucket) TableName() string { return "hash_buckets" }
+
+type v4SyncCheckpoint struct {
+	Peer      string    `gorm:"column:peer;primaryKey"`
+	Engine    string    `gorm:"column:engine;not null"`
+	Progress  string    `gorm:"column:progress;type:text;not null"`
+	UpdatedAt time.Time `gorm:"column:updated_at;not null"`
+}
+
+func (v4SyncCheckpoint) TableName() string { return "sync_checkpoints" }
+
+type v5SyncSession struct {
+	ID                uint64    `gorm:"column:id;primaryKey;autoIncrement"`
+	PeerNodeID        string    `gorm:"column:peer_node_id"`
+	PeerAddress       string    `gorm:"column:peer_address;not null;index"`
+	Direction         string    `gorm:"column:direction;not null"`
+	Engine            string    `gorm:"column:engine"`
+	StartedAt         time.Time `gorm:"column:started_at;not null;index"`
+	EndedAt           time.Time `gorm:"column:ended_at;not null"`
+	DurationMs        int64     `gorm:"column:duration_ms;not null"`
+	Rounds            int       `gorm:"column:rounds;not null"`
+	SentMessages      int       `gorm:"column:sent_messages;not null"`
+	SentBulletins     int       `gorm:"column:sent_bulletins;not null"`
+	SentUsers         int       `gorm:"column:sent_users;not null"`
+	ReceivedMessages  int       `gorm:"column:received_messages;not null"`
+	ReceivedBulletins int       `gorm:"column:received_bulletins;not null"`
+	ReceivedUsers     int       `gorm:"column:received_users;not null"`
+	BytesSent         int64     `gorm:"column:bytes_sent;not null"`
+	BytesReceived     int64     `gorm:"column:bytes_received;not null"`
+	Error             string    `gorm:"column:error"`
+}
+
+func (v5SyncSession) TableName() string { return "sync_sessions" }
+
+type v6PeerHealth struct {
+	Peer                string     `gorm:"column:peer;primaryKey"`
+	NodeID              string     `gorm:"column:node_id"`
+	ConsecutiveFailures int        `gorm:"column:consecutive_failures;not null"`
+	LastError           string     `gorm:"column:last_error"`
+	LastFailureAt       *time.Time `gorm:"column:last_failure_at"`
+	LastSuccessAt       *time.Time `gorm:"column:last_success_at"`
+	NextAttemptAt       time.Time  `gorm:"column:next_attempt_at;not null"`
+	InvalidSessions     int        `gorm:"column:invalid_sessions;not null"`
+	QuarantinedAt       *time.Time `gorm:"column:quarantined_at"`
+	UpdatedAt           time.Time  `gorm:"column:updated_at;not null"`
+}
+
+func (v6PeerHealth) TableName() string { return "peer_health" }
+
+type v7KnownNode struct {
+	NodeID    string    `gorm:"column:node_id;primaryKey"`
+	PublicKey string    `gorm:"column:public_key;not null"`
+	PinnedAt  time.Time `gorm:"column:pinned_at;not null"`
+}
+
+func (v7KnownNode) TableName() string { return "known_nodes" }
+
+type v8User struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedUnix int64  `gorm:"column:created_unix;not null;default:0"`
+}
+
+func (v8User) TableName() string { return "users" }
+
+type v8Message struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedUnix int64  `gorm:"column:created_unix;not null;default:0;index"`
+}
+
+func (v8Message) TableName() string { return "messages" }
+
+type v8Bulletin struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedUnix int64  `gorm:"column:created_unix;not null;default:0;index"`
+}
+
+func (v8Bulletin) TableName() string { return "bulletin_board" }
+
+type v9KnownNode struct {
+	NodeID     string     `gorm:"column:node_id;primaryKey"`
+	LastSentAt *time.Time `gorm:"column:last_sent_at"`
+}
+
+func (v9KnownNode) TableName() string { return "known_nodes" }
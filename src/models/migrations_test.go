@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrateUpDownStatus(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	if version, _ := CurrentVersion(db); version != LatestVersion() {
+		t.Fatalf("expected version %d after up, got %d", LatestVersion(), version)
+	}
+	for _, table := range []string{"users", "messages", "bulletin_board", "sync_checkpoints", "sync_sessions", "peer_health", "known_nodes"} {
+		if !db.Migrator().HasTable(table) {
+			t.Fatalf("expected table %s to exist", table)
+		}
+	}
+
+	// Applying again is a no-op
+	if err := Migrate(db); err != nil {
+		t.Fatalf("second migrate up: %v", err)
+	}
+
+	for want := LatestVersion() - 1; want >= 0; want-- {
+		version, err := MigrateDown(db)
+		if err != nil {
+			t.Fatalf("migrate down: %v", err)
+		}
+		if version != want {
+			t.Fatalf("expected version %d after down, got %d", want, version)
+		}
+	}
+	if db.Migrator().HasTable("users") {
+		t.Fatalf("expected users table to be dropped")
+	}
+
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if len(states) != len(Migrations()) {
+		t.Fatalf("expected %d migrations in status, got %d", len(Migrations()), len(states))
+	}
+	for _, s := range states {
+		if s.Applied {
+			t.Fatalf("expected migration %d to be pending", s.Version)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := newSQLiteTestDB(t)
+	future := SchemaVersion{Version: LatestVersion() + 1, Name: "from_the_future", AppliedAt: time.Now()}
+	if err := db.Create(&future).Error; err != nil {
+		t.Fatalf("record future version: %v", err)
+	}
+
+	if err := Migrate(db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if last := states[len(states)-1]; !last.Unknown || last.Version != future.Version {
+		t.Fatalf("expected unknown future version in status, got %+v", last)
+	}
+}
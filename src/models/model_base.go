@@ -9,11 +9,20 @@ import (
 type Base struct {
 	ID string `json:"id" gorm:"primaryKey"`
 	CreatedAt time.Time `json:"created_at" gorm:"column:created_at;not null"`
+	// CreatedUnix is CreatedAt in Unix nanoseconds. Periods are compared
+	// on it, as SQLite compares created_at as text in the writer's zone.
+	CreatedUnix int64 `json:"-" gorm:"column:created_unix;not null"`
 }
 
 func (b *Base) BeforeCreate(tx *gorm.DB) (err error) {
 	if b.CreatedAt.IsZero() {
 		b.CreatedAt = time.Now()
 	}
+	b.SetCreatedUnix()
 	return nil
 }
+
+// SetCreatedUnix sets CreatedUnix from CreatedAt
+func (b *Base) SetCreatedUnix() {
+	b.CreatedUnix = b.CreatedAt.UnixNano()
+}
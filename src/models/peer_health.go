@@ -0,0 +1,91 @@
+package models
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// PeerHealth tracks how syncing with a peer host has been going. After a
+// failed session the peer is not dialed again before NextAttemptAt, which
+// backs off exponentially with the consecutive failures. A peer that serves
+// invalid items in too many sessions in a row is quarantined until an
+// operator clears its health.
+type PeerHealth struct {
+	Peer                string     `gorm:"column:peer;primaryKey" json:"peer"`
+	NodeID              string     `gorm:"column:node_id" json:"node_id,omitempty"`
+	ConsecutiveFailures int        `gorm:"column:consecutive_failures;not null" json:"consecutive_failures"`
+	LastError           string     `gorm:"column:last_error" json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `gorm:"column:last_failure_at" json:"last_failure_at,omitempty"`
+	LastSuccessAt       *time.Time `gorm:"column:last_success_at" json:"last_success_at,omitempty"`
+	NextAttemptAt       time.Time  `gorm:"column:next_attempt_at;not null" json:"next_attempt_at"`
+	// InvalidSessions counts the sessions in a row in which the peer served
+	// items we rejected
+	InvalidSessions int        `gorm:"column:invalid_sessions;not null" json:"invalid_sessions"`
+	QuarantinedAt   *time.Time `gorm:"column:quarantined_at" json:"quarantined_at,omitempty"`
+	UpdatedAt       time.Time  `gorm:"column:updated_at;not null" json:"updated_at"`
+}
+
+func (PeerHealth) TableName() string {
+	return "peer_health"
+}
+
+// Backoff is how long to wait before retrying a failing peer: Base after
+// the first failure, doubling with every other one up to Max. Jitter spreads
+// the delay by up to that fraction either way, so that peers failing
+// together do not retry together.
+type Backoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// Delay returns the wait after failures consecutive failures
+func (b Backoff) Delay(failures int) time.Duration {
+	delay := b.Base
+	for i := 1; i < failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.Max)
+	if b.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Quarantined reports whether the peer is quarantined
+func (h *PeerHealth) Quarantined() bool {
+	return h.QuarantinedAt != nil
+}
+
+// Ready reports whether the peer may be synced with at now
+func (h *PeerHealth) Ready(now time.Time) bool {
+	return !h.Quarantined() && !now.Before(h.NextAttemptAt)
+}
+
+// Succeeded records a session that went through at now
+func (h *PeerHealth) Succeeded(now time.Time) {
+	h.ConsecutiveFailures = 0
+	h.LastSuccessAt = &now
+	h.NextAttemptAt = now
+}
+
+// Failed records a session that failed with err at now, and backs off
+func (h *PeerHealth) Failed(err error, now time.Time, backoff Backoff) {
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	h.LastFailureAt = &now
+	h.NextAttemptAt = now.Add(backoff.Delay(h.ConsecutiveFailures))
+}
+
+// Served records whether the peer served invalid items in a session, and
+// quarantines it at now once it did in quarantineAfter sessions in a row
+func (h *PeerHealth) Served(invalid bool, now time.Time, quarantineAfter int) {
+	if !invalid {
+		h.InvalidSessions = 0
+		return
+	}
+	h.InvalidSessions++
+	if h.InvalidSessions >= quarantineAfter && !h.Quarantined() {
+		h.QuarantinedAt = &now
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	backoff := Backoff{Base: 10 * time.Second, Max: time.Minute}
+	for failures, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 50: time.Minute} {
+		if got := backoff.Delay(failures); got != want {
+			t.Fatalf("after %d failures: expected %s, got %s", failures, want, got)
+		}
+	}
+
+	backoff.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := backoff.Delay(1); got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("expected 10s give or take 20%%, got %s", got)
+		}
+	}
+}
+
+func TestPeerHealthBacksOffAndQuarantines(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	backoff := Backoff{Base: 10 * time.Second, Max: time.Minute}
+	health := PeerHealth{Peer: "10.0.0.2"}
+
+	health.Failed(errors.New("connection refused"), now, backoff)
+	health.Failed(errors.New("connection refused"), now, backoff)
+	if health.Ready(now.Add(19*time.Second)) || !health.Ready(now.Add(20*time.Second)) {
+		t.Fatalf("expected to be ready 20s after the second failure, next attempt at %s", health.NextAttemptAt)
+	}
+	health.Succeeded(now)
+	if health.ConsecutiveFailures != 0 || !health.Ready(now) {
+		t.Fatalf("expected a success to reset the backoff, got %+v", health)
+	}
+
+	// A clean session in between starts the count over
+	health.Served(true, now, 2)
+	health.Served(false, now, 2)
+	health.Served(true, now, 2)
+	if health.Quarantined() {
+		t.Fatalf("expected no quarantine after one invalid session in a row")
+	}
+	health.Served(true, now, 2)
+	if !health.Quarantined() || health.Ready(now.Add(time.Hour)) {
+		t.Fatalf("expected quarantine after two invalid sessions in a row")
+	}
+}
@@ -1,58 +1,106 @@
 package models
 
 import (
-	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
-
-	"gorm.io/gorm"
 )
 
-// SyncState manages the synchronization state
+// SyncState manages the sync sessions and the cached database hashes of one
+// node. Use NewSyncState to create one per node.
+//
+// Sessions are keyed by peer: a node runs up to maxSessions of them at once,
+// but never two with the same peer, whichever side started them.
 type SyncState struct {
-	mu        sync.RWMutex
-	isSyncing bool
-	hashes    HashSet
+	mu           sync.RWMutex
+	maxSessions  int
+	sessions     map[string]bool
+	shuttingDown bool
+	hashes       HashSet
+}
+
+// NewSyncState returns a SyncState with no sessions and no cached hashes
+// that allows up to maxSessions concurrent sessions
+func NewSyncState(maxSessions int) *SyncState {
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+	return &SyncState{
+		maxSessions: maxSessions,
+		sessions:    map[string]bool{},
+	}
 }
 
-var (
-	syncState = &SyncState{}
-)
+// SyncCapacity is how many sync sessions a node is running and how many it
+// runs at most. Nodes report it so that peers know whether to try again.
+type SyncCapacity struct {
+	Active int `json:"active"`
+	Max    int `json:"max"`
+}
 
-type Period struct {
-	Start *time.Time `json:"start,omitempty"`
-	End   *time.Time `json:"end,omitempty"`
+// Full reports whether no more sessions can be started
+func (c SyncCapacity) Full() bool {
+	return c.Active >= c.Max
 }
 
-func RealizeStart(start *time.Time) time.Time {
-	if start == nil {
-		// Start at 2025-01-01, the release year
-		return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+// SyncPeer returns the key sessions with a peer are tracked by, in both
+// directions, given its node ID and its address with its advertised API
+// port. Sessions, checkpoints, backoff and quarantine are kept per key, so
+// nodes sharing a host or a NAT each get their own.
+//
+// A peer with a node ID is keyed by it at its host, so that another host
+// claiming that node ID cannot take over its sessions or get it
+// quarantined. Without one it is keyed by its host and port, or by its host
+// alone for initiators that do not advertise their port.
+func SyncPeer(nodeID string, address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	switch {
+	case nodeID != "":
+		return nodeID + "@" + host
+	case port != "":
+		return net.JoinHostPort(host, port)
+	default:
+		return host
 	}
-	return *start
 }
 
-func RealizeEnd(end *time.Time) time.Time {
-	if end == nil {
-		// End at the current time
-		return time.Now()
+// SyncPeerHost returns the host of the peer keyed peer by SyncPeer
+func SyncPeerHost(peer string) string {
+	if i := strings.LastIndex(peer, "@"); i >= 0 {
+		return peer[i+1:]
 	}
-	return *end
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		return host
+	}
+	return peer
+}
+
+type Period struct {
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
 }
 
-// HashedPeriod represents a time period and its hash
+// HashedPeriod is the hash of one canonical sync range. RangeID is what
+// peers match on; Period repeats its boundaries for readability.
 type HashedPeriod struct {
 	Period
-	Hash string `json:"hash"`
+	RangeID string `json:"range_id"`
+	Hash    string `json:"hash"`
 }
 
 type MessagesPeriod struct {
 	Period
+	RangeID  string    `json:"range_id"`
 	Messages []Message `json:"messages"`
 }
 
 type BulletinsPeriod struct {
 	Period
+	RangeID   string     `json:"range_id"`
 	Bulletins []Bulletin `json:"bulletins"`
 }
 
@@ -76,152 +124,96 @@ type HashedFilesRange struct {
 	Hash string `json:"hash"`
 }
 
-// StartSync attempts to start a sync operation
-func StartSync() bool {
-	syncState.mu.Lock()
-	defer syncState.mu.Unlock()
+// StartSync attempts to start a sync session with peer. It fails if a
+// session with peer is already running, every session is taken or the node
+// is shutting down.
+func (s *SyncState) StartSync(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if syncState.isSyncing {
+	if s.shuttingDown || s.sessions[peer] || len(s.sessions) >= s.maxSessions {
 		return false
 	}
 
-	syncState.isSyncing = true
+	s.sessions[peer] = true
 	return true
 }
 
-// EndSync marks the sync operation as complete
-func EndSync() {
-	syncState.mu.Lock()
-	defer syncState.mu.Unlock()
-	syncState.isSyncing = false
-}
-
-// IsSyncing checks if a sync is in progress
-func IsSyncing() bool {
-	syncState.mu.RLock()
-	defer syncState.mu.RUnlock()
-	return syncState.isSyncing
+// EndSync marks the sync session with peer as complete
+func (s *SyncState) EndSync(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, peer)
 }
 
-// UpdateHashes updates the current database hash
-func UpdateHashes(hash HashSet) {
-	syncState.mu.Lock()
-	defer syncState.mu.Unlock()
-	syncState.hashes = hashes
+// IsSyncingWith checks if a sync session with peer is in progress
+func (s *SyncState) IsSyncingWith(peer string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions[peer]
 }
 
-// GetHashes returns the current database hash
-func GetHashes() HashSet {
-	syncState.mu.RLock()
-	defer syncState.mu.RUnlock()
-	return syncState.hashes
-}
-
-// GetMessagesHashRanges creates the standard set of time ranges to check
-func GetMessagesHashRanges(db *gorm.DB, periods []Period) ([]HashedPeriod, error) {
-	hashedPeriods := []HashedPeriod{}
-	for _, period := range periods {
-		hash, err := GetMessagesHash(db, period.Start, period.End)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get messages hash: %v", err)
-		}
-		hashedPeriods = append(hashedPeriods, HashedPeriod{
-			Period: period,
-			Hash:   hash,
-		})
-	}
-	return hashedPeriods, nil
-}
-
-// GetBulletinsHashRanges creates hashed ranges for bulletins
-func GetBulletinsHashRanges(db *gorm.DB, periods []Period) ([]HashedPeriod, error) {
-	hashedPeriods := []HashedPeriod{}
-	for _, period := range periods {
-		hash, err := GetBulletinsHash(db, period.Start, period.End)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get bulletins hash: %v", err)
-		}
-		hashedPeriods = append(hashedPeriods, HashedPeriod{
-			Period: period,
-			Hash:   hash,
-		})
-	}
-	return hashedPeriods, nil
-}
-
-func GetUsersHashRanges(db *gorm.DB, stringRanges []StringRange) ([]HashedUsersRange, error) {
-	hashedRanges := []HashedUsersRange{}
-	for _, stringRange := range stringRanges {
-		hash, err := GetUsersHashByFingerprintRange(db, stringRange.Start, stringRange.End)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get users hash: %v", err)
-		}
-		hashedRanges = append(hashedRanges, HashedUsersRange{
-			StringRange: stringRange,
-			Hash:        hash,
-		})
-	}
-
-	return hashedRanges, nil
+// Capacity returns how many sessions are running out of how many are allowed
+func (s *SyncState) Capacity() SyncCapacity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return SyncCapacity{Active: len(s.sessions), Max: s.maxSessions}
 }
 
-// SplitTimeRange splits a time range into n equal parts
-func SplitTimeRange(period Period, n int) []Period {
-	start := RealizeStart(period.Start)
-	end := RealizeEnd(period.End)
-
-	duration := end.Sub(start)
-	partDuration := duration / time.Duration(n)
-
-	ranges := make([]Period, n)
-	for i := 0; i < n; i++ {
-		partStart := start.Add(partDuration * time.Duration(i))
-		partEnd := partStart.Add(partDuration)
-		if i == n-1 {
-			partEnd = end // Ensure we don't miss any time due to rounding
-		}
-
-		ranges[i] = Period{
-			Start: &partStart,
-			End:   &partEnd,
-		}
-	}
-
-	return ranges
+// CanSyncWith reports whether StartSync(peer) would currently succeed
+func (s *SyncState) CanSyncWith(peer string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.shuttingDown && !s.sessions[peer] && len(s.sessions) < s.maxSessions
 }
 
-func GetMessagesByPeriod(db *gorm.DB, period Period) ([]Message, error) {
-	var messages []Message
-	err := db.Where("created_at >= ? AND created_at < ?", period.Start, period.End).Find(&messages).Error
-	return messages, err
+// BeginShutdown makes StartSync refuse every new sync session. Sessions
+// that are already running are not affected.
+func (s *SyncState) BeginShutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shuttingDown = true
 }
 
-func CountMessagesByPeriod(db *gorm.DB, period Period) int64 {
-	var count int64
-	db.Model(&Message{}).Where("created_at >= ? AND created_at < ?", period.Start, period.End).Count(&count)
-	return count
+// IsShuttingDown checks if the node is shutting down
+func (s *SyncState) IsShuttingDown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shuttingDown
 }
 
-func GetBulletinsByPeriod(db *gorm.DB, period Period) ([]Bulletin, error) {
-	var bulletins []Bulletin
-	err := db.Where("created_at >= ? AND created_at < ?", period.Start, period.End).Find(&bulletins).Error
-	return bulletins, err
+// UpdateHashes updates the current database hash
+func (s *SyncState) UpdateHashes(hashes HashSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes = hashes
 }
 
-func CountBulletinsByPeriod(db *gorm.DB, period Period) int64 {
-	var count int64
-	db.Model(&Bulletin{}).Where("created_at >= ? AND created_at < ?", period.Start, period.End).Count(&count)
-	return count
+// GetHashes returns the current database hash
+func (s *SyncState) GetHashes() HashSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hashes
 }
 
-func GetUsersByFingerprintRange(db *gorm.DB, start, end string) ([]User, error) {
-	var users []User
-	err := db.Where("fingerprint >= ? AND fingerprint < ?", start, end).Order("fingerprint").Find(&users).Error
-	return users, err
+// RefreshHashes recalculates the database hashes and caches them
+func (s *SyncState) RefreshHashes(source HashProvider) error {
+	hashes, err := source.Hashes()
+	if err != nil {
+		return err
+	}
+	s.UpdateHashes(hashes)
+	return nil
 }
 
-func CountUsersByFingerprintRange(db *gorm.DB, start, end string) int64 {
-	var count int64
-	db.Model(&User{}).Where("fingerprint >= ? AND fingerprint < ?", start, end).Count(&count)
-	return count
+// GetDatabaseHashes returns the cached database hashes, calculating them
+// first if needed
+func (s *SyncState) GetDatabaseHashes(source HashProvider) (HashSet, error) {
+	if hashes := s.GetHashes(); hashes.Full != "" {
+		return hashes, nil
+	}
+	if err := s.RefreshHashes(source); err != nil {
+		return HashSet{}, err
+	}
+	return s.GetHashes(), nil
 }
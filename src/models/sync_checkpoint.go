@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// SyncCheckpoint is the progress of an unfinished sync session with Peer,
+// saved after every round. A later session with the same peer and engine
+// resumes from it instead of starting over from the top ranges.
+type SyncCheckpoint struct {
+	Peer      string       `gorm:"column:peer;primaryKey" json:"peer"`
+	Engine    string       `gorm:"column:engine;not null" json:"engine"`
+	Progress  SyncProgress `gorm:"column:progress;type:text;not null;serializer:json" json:"progress"`
+	UpdatedAt time.Time    `gorm:"column:updated_at;not null" json:"updated_at"`
+}
+
+func (SyncCheckpoint) TableName() string {
+	return "sync_checkpoints"
+}
+
+// SyncProgress is what a session has left to do. Only range boundaries are
+// kept, our hashes of them are recomputed when resuming since our data may
+// have changed in between. Items are kept by ID, fingerprint for users.
+type SyncProgress struct {
+	// Ranges still to compare: canonical range IDs with the time engine,
+	// ID ranges with the rbsr engine
+	MessageRanges    []string      `json:"message_ranges,omitempty"`
+	BulletinRanges   []string      `json:"bulletin_ranges,omitempty"`
+	MessageIDRanges  []StringRange `json:"message_id_ranges,omitempty"`
+	BulletinIDRanges []StringRange `json:"bulletin_id_ranges,omitempty"`
+	UserRanges       []StringRange `json:"user_ranges,omitempty"`
+
+	// Our items found missing in the remote, still to be pushed
+	MissingMessages  []string `json:"missing_messages,omitempty"`
+	MissingBulletins []string `json:"missing_bulletins,omitempty"`
+	MissingUsers     []string `json:"missing_users,omitempty"`
+}
@@ -0,0 +1,63 @@
+package models
+
+// HashedIDRange is the fingerprint of the items whose IDs lie in a range of
+// the ID space: the XOR of their IDs and how many there are. It is what the
+// range-based reconciliation engine exchanges instead of time ranges.
+type HashedIDRange struct {
+	StringRange
+	Hash  string `json:"hash"`
+	Count int    `json:"count"`
+}
+
+type MessagesIDRange struct {
+	StringRange
+	Messages []Message `json:"messages"`
+}
+
+type BulletinsIDRange struct {
+	StringRange
+	Bulletins []Bulletin `json:"bulletins"`
+}
+
+// FullIDRange covers every ID
+var FullIDRange = StringRange{}
+
+// HashIDRange fingerprints the sorted ids of the items in r
+func HashIDRange(r StringRange, ids []string) HashedIDRange {
+	return HashedIDRange{
+		StringRange: r,
+		Hash:        HashIDs(ids),
+		Count:       len(ids),
+	}
+}
+
+// Matches reports whether two fingerprints of the same range agree
+func (h HashedIDRange) Matches(other HashedIDRange) bool {
+	return h.Hash == other.Hash && h.Count == other.Count
+}
+
+// SplitIDRange splits r, holding the sorted ids, into at most parts
+// consecutive ranges with about the same number of ids each, and
+// fingerprints them. Split points are taken from ids, so the split always
+// makes progress while r holds more than one id.
+func SplitIDRange(r StringRange, ids []string, parts int) []HashedIDRange {
+	if parts > len(ids) {
+		parts = len(ids)
+	}
+	if parts < 2 {
+		return []HashedIDRange{HashIDRange(r, ids)}
+	}
+
+	ranges := []HashedIDRange{}
+	start, from := r.Start, 0
+	for i := 1; i < parts; i++ {
+		to := i * len(ids) / parts
+		if to == from {
+			continue
+		}
+		sub := StringRange{Start: start, End: ids[to]}
+		ranges = append(ranges, HashIDRange(sub, ids[from:to]))
+		start, from = ids[to], to
+	}
+	return append(ranges, HashIDRange(StringRange{Start: start, End: r.End}, ids[from:]))
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitIDRangeTilesRange(t *testing.T) {
+	ids := []string{}
+	for i := 0; i < 50; i++ {
+		ids = append(ids, fmt.Sprintf("%02x", i*5))
+	}
+	r := StringRange{Start: "", End: "ff"}
+
+	parts := SplitIDRange(r, ids, 16)
+	if len(parts) != 16 {
+		t.Fatalf("expected 16 parts, got %d", len(parts))
+	}
+	if parts[0].Start != r.Start || parts[len(parts)-1].End != r.End {
+		t.Fatalf("parts do not cover %+v: %+v", r, parts)
+	}
+	total := 0
+	for i, part := range parts {
+		if i > 0 && part.Start != parts[i-1].End {
+			t.Fatalf("gap or overlap before part %d: %+v", i, parts)
+		}
+		if part.Count == 0 {
+			t.Fatalf("part %d is empty", i)
+		}
+		total += part.Count
+	}
+	if total != len(ids) {
+		t.Fatalf("parts hold %d ids, expected %d", total, len(ids))
+	}
+
+	// A single id cannot be split
+	if single := SplitIDRange(r, ids[:1], 16); len(single) != 1 || single[0].StringRange != r {
+		t.Fatalf("expected the range itself, got %+v", single)
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// Directions of a journaled sync session
+const (
+	SyncOutgoing = "outgoing" // we initiated it
+	SyncIncoming = "incoming" // the peer did
+)
+
+// SyncSession is the journal entry of one sync session with a peer. Received
+// counts the items we stored. Sent counts the items the peer stored when we
+// pushed them, or, in incoming sessions, the items we answered it with.
+type SyncSession struct {
+	ID            uint64         `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	PeerNodeID    string         `gorm:"column:peer_node_id" json:"peer_node_id,omitempty"`
+	PeerAddress   string         `gorm:"column:peer_address;not null;index" json:"peer_address"`
+	Direction     string         `gorm:"column:direction;not null" json:"direction"`
+	Engine        string         `gorm:"column:engine" json:"engine,omitempty"`
+	StartedAt     time.Time      `gorm:"column:started_at;not null;index" json:"started_at"`
+	EndedAt       time.Time      `gorm:"column:ended_at;not null" json:"ended_at"`
+	DurationMs    int64          `gorm:"column:duration_ms;not null" json:"duration_ms"`
+	Rounds        int            `gorm:"column:rounds;not null" json:"rounds"`
+	Sent          SyncItemCounts `gorm:"embedded;embeddedPrefix:sent_" json:"sent"`
+	Received      SyncItemCounts `gorm:"embedded;embeddedPrefix:received_" json:"received"`
+	BytesSent     int64          `gorm:"column:bytes_sent;not null" json:"bytes_sent"`
+	BytesReceived int64          `gorm:"column:bytes_received;not null" json:"bytes_received"`
+	Error         string         `gorm:"column:error" json:"error,omitempty"`
+}
+
+func (SyncSession) TableName() string {
+	return "sync_sessions"
+}
+
+// SyncItemCounts counts items of each content type
+type SyncItemCounts struct {
+	Messages  int `gorm:"column:messages;not null" json:"messages"`
+	Bulletins int `gorm:"column:bulletins;not null" json:"bulletins"`
+	Users     int `gorm:"column:users;not null" json:"users"`
+}
+
+// End stamps the session as ended now, with err if it failed
+func (s *SyncSession) End(err error) {
+	s.EndedAt = time.Now()
+	s.DurationMs = s.EndedAt.Sub(s.StartedAt).Milliseconds()
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
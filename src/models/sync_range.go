@@ -0,0 +1,184 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncEpoch is the start of the first sync range, 2025-01-01, the release
+// year. Content created earlier is never synchronized.
+var SyncEpoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Levels of the canonical sync range tree, from the widest to the narrowest.
+// Each level is the prefix of its range IDs.
+const (
+	LevelYear  = 'Y'
+	LevelMonth = 'M'
+	LevelWeek  = 'W'
+	LevelDay   = 'D'
+	LevelHour  = 'H'
+)
+
+// SyncRange is one node of the canonical sync range tree. Years split into
+// months, months into weeks, weeks into days and days into hours. All
+// boundaries are UTC and epoch aligned, so two peers always agree on them,
+// and every range is half-open: it contains Start but not End.
+//
+// Weeks start on Monday but are clipped to their month, so every week lies
+// within a single month. A week's ID is its first day within the month.
+//
+// IDs look like Y2025, M2025-06, W2025-06-02, D2025-06-03 and H2025-06-03T14.
+type SyncRange struct {
+	ID    string
+	Start time.Time
+	End   time.Time
+}
+
+// Period returns the time span of the range
+func (r SyncRange) Period() Period {
+	start, end := r.Start, r.End
+	return Period{Start: &start, End: &end}
+}
+
+// Level returns the level of the range in the tree
+func (r SyncRange) Level() byte {
+	return r.ID[0]
+}
+
+// Children splits the range into the ranges of the next level. Hours have
+// no children.
+func (r SyncRange) Children() []SyncRange {
+	children := []SyncRange{}
+	switch r.Level() {
+	case LevelYear:
+		for start := r.Start; start.Before(r.End); start = start.AddDate(0, 1, 0) {
+			children = append(children, monthRange(start))
+		}
+	case LevelMonth:
+		for start := r.Start; start.Before(r.End); {
+			week := weekRange(start)
+			children = append(children, week)
+			start = week.End
+		}
+	case LevelWeek:
+		for start := r.Start; start.Before(r.End); start = start.AddDate(0, 0, 1) {
+			children = append(children, dayRange(start))
+		}
+	case LevelDay:
+		for start := r.Start; start.Before(r.End); start = start.Add(time.Hour) {
+			children = append(children, hourRange(start))
+		}
+	}
+	return children
+}
+
+// TopSyncRanges returns the year ranges from SyncEpoch through the year
+// after now, which covers peers whose clocks run somewhat ahead.
+func TopSyncRanges(now time.Time) []SyncRange {
+	ranges := []SyncRange{}
+	last := now.UTC().Year() + 1
+	for year := SyncEpoch.Year(); year <= last; year++ {
+		ranges = append(ranges, yearRange(year))
+	}
+	return ranges
+}
+
+// ParseSyncRange returns the range identified by id
+func ParseSyncRange(id string) (SyncRange, error) {
+	if id == "" {
+		return SyncRange{}, fmt.Errorf("empty sync range ID")
+	}
+	layouts := map[byte]string{
+		LevelYear:  "2006",
+		LevelMonth: "2006-01",
+		LevelWeek:  "2006-01-02",
+		LevelDay:   "2006-01-02",
+		LevelHour:  "2006-01-02T15",
+	}
+	layout, ok := layouts[id[0]]
+	if !ok {
+		return SyncRange{}, fmt.Errorf("unknown sync range level in %q", id)
+	}
+	start, err := time.ParseInLocation(layout, id[1:], time.UTC)
+	if err != nil {
+		return SyncRange{}, fmt.Errorf("invalid sync range %q: %v", id, err)
+	}
+
+	var r SyncRange
+	switch id[0] {
+	case LevelYear:
+		r = yearRange(start.Year())
+	case LevelMonth:
+		r = monthRange(start)
+	case LevelWeek:
+		r = weekRange(start)
+		// Only the first day of a clipped week names it
+		if start.Weekday() != time.Monday && start.Day() != 1 {
+			return SyncRange{}, fmt.Errorf("invalid sync range %q: weeks start on Monday or the 1st", id)
+		}
+	case LevelDay:
+		r = dayRange(start)
+	case LevelHour:
+		r = hourRange(start)
+	}
+	if r.ID != id {
+		return SyncRange{}, fmt.Errorf("invalid sync range %q", id)
+	}
+	return r, nil
+}
+
+func yearRange(year int) SyncRange {
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	return SyncRange{
+		ID:    fmt.Sprintf("%c%04d", LevelYear, year),
+		Start: start,
+		End:   start.AddDate(1, 0, 0),
+	}
+}
+
+func monthRange(t time.Time) SyncRange {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return SyncRange{
+		ID:    string(LevelMonth) + start.Format("2006-01"),
+		Start: start,
+		End:   start.AddDate(0, 1, 0),
+	}
+}
+
+// weekRange returns the week starting at start, which must be a Monday or
+// the first of a month, ending at the next Monday or month, whichever is
+// first.
+func weekRange(start time.Time) SyncRange {
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	daysToMonday := (8 - int(start.Weekday())) % 7
+	if daysToMonday == 0 {
+		daysToMonday = 7
+	}
+	end := start.AddDate(0, 0, daysToMonday)
+	if monthEnd := monthRange(start).End; monthEnd.Before(end) {
+		end = monthEnd
+	}
+	return SyncRange{
+		ID:    string(LevelWeek) + start.Format("2006-01-02"),
+		Start: start,
+		End:   end,
+	}
+}
+
+func dayRange(t time.Time) SyncRange {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return SyncRange{
+		ID:    string(LevelDay) + start.Format("2006-01-02"),
+		Start: start,
+		End:   start.AddDate(0, 0, 1),
+	}
+}
+
+func hourRange(t time.Time) SyncRange {
+	start := t.UTC().Truncate(time.Hour)
+	return SyncRange{
+		ID:    string(LevelHour) + start.Format("2006-01-02T15"),
+		Start: start,
+		End:   start.Add(time.Hour),
+	}
+}
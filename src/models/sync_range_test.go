@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncRangeTreeTilesParents(t *testing.T) {
+	// Descend along the first child, checking every level on the way
+	var walk func(r SyncRange)
+	walk = func(r SyncRange) {
+		children := r.Children()
+		if r.Level() == LevelHour {
+			if len(children) != 0 {
+				t.Fatalf("%s: hours must not have children", r.ID)
+			}
+			return
+		}
+		if len(children) == 0 {
+			t.Fatalf("%s: expected children", r.ID)
+		}
+		if !children[0].Start.Equal(r.Start) || !children[len(children)-1].End.Equal(r.End) {
+			t.Fatalf("%s: children do not cover the range", r.ID)
+		}
+		for i, child := range children {
+			if i > 0 && !child.Start.Equal(children[i-1].End) {
+				t.Fatalf("%s: gap or overlap before %s", r.ID, child.ID)
+			}
+			parsed, err := ParseSyncRange(child.ID)
+			if err != nil {
+				t.Fatalf("parse %s: %v", child.ID, err)
+			}
+			if parsed != child {
+				t.Fatalf("%s does not round-trip: %+v != %+v", child.ID, parsed, child)
+			}
+		}
+		walk(children[0])
+	}
+	for _, year := range TopSyncRanges(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		walk(year)
+	}
+}
+
+func TestSyncRangeWeeksClippedToMonth(t *testing.T) {
+	// June 2025 starts on a Sunday and ends on a Monday
+	june, err := ParseSyncRange("M2025-06")
+	if err != nil {
+		t.Fatalf("parse month: %v", err)
+	}
+	var ids []string
+	for _, week := range june.Children() {
+		ids = append(ids, week.ID)
+	}
+	expected := []string{"W2025-06-01", "W2025-06-02", "W2025-06-09", "W2025-06-16", "W2025-06-23", "W2025-06-30"}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected weeks %v, got %v", expected, ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatalf("expected weeks %v, got %v", expected, ids)
+		}
+	}
+
+	for _, id := range []string{"W2025-06-03", "M2025-6", "X2025", "H2025-06-03T24", ""} {
+		if _, err := ParseSyncRange(id); err == nil {
+			t.Fatalf("expected %q to be rejected", id)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package models
+
+import "testing"
+
+func TestSyncStateSessionsPerPeer(t *testing.T) {
+	state := NewSyncState(2)
+
+	if !state.StartSync(SyncPeer("axial-a", "10.0.0.1:8080")) {
+		t.Fatalf("expected a session with axial-a")
+	}
+	// The same peer calling us is the same peer
+	if state.StartSync(SyncPeer("axial-a", "10.0.0.1")) {
+		t.Fatalf("expected a second session with axial-a to be refused")
+	}
+	if !state.StartSync(SyncPeer("", "[fd00::2]:8080")) {
+		t.Fatalf("expected a session with fd00::2")
+	}
+	if state.CanSyncWith("10.0.0.3") || state.StartSync("10.0.0.3") {
+		t.Fatalf("expected sessions to be full")
+	}
+	if capacity := state.Capacity(); !capacity.Full() || capacity.Active != 2 || capacity.Max != 2 {
+		t.Fatalf("unexpected capacity %+v", capacity)
+	}
+
+	state.EndSync("axial-a@10.0.0.1")
+	if !state.StartSync("10.0.0.3") {
+		t.Fatalf("expected the freed session to be reused")
+	}
+
+	state.EndSync("10.0.0.3")
+	state.BeginShutdown()
+	if state.StartSync("10.0.0.4") {
+		t.Fatalf("expected no new sessions while shutting down")
+	}
+}
+
+func TestSyncPeersSharingAHost(t *testing.T) {
+	state := NewSyncState(4)
+
+	// Two nodes on one host, or behind one NAT, are different peers
+	a, b := SyncPeer("axial-a", "127.0.0.1:8080"), SyncPeer("axial-b", "127.0.0.1:8081")
+	if a == b || !state.StartSync(a) || !state.StartSync(b) {
+		t.Fatalf("expected a session with each of %s and %s", a, b)
+	}
+	// So are they without node IDs, by their advertised ports
+	a, b = SyncPeer("", "127.0.0.1:8080"), SyncPeer("", "127.0.0.1:8081")
+	if a == b || !state.StartSync(a) || !state.StartSync(b) {
+		t.Fatalf("expected a session with each of %s and %s", a, b)
+	}
+
+	// A node ID claimed from another host is another peer
+	if SyncPeer("axial-a", "127.0.0.1:8080") == SyncPeer("axial-a", "10.0.0.9:8080") {
+		t.Fatalf("expected a node ID to be bound to its host")
+	}
+}
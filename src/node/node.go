@@ -0,0 +1,316 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"axial/api"
+	"axial/config"
+	"axial/discovery"
+	"axial/models"
+	"axial/remote"
+	"axial/server"
+	"axial/storage"
+	"axial/synchronization"
+)
+
+// Node is one Axial node. It owns its store, hash and sync state,
+// HTTP router, listeners and discovery sockets, so several nodes can run in
+// the same process.
+type Node struct {
+	cfg     config.Config
+	store   storage.Store
+	state   *models.SyncState
+	api     *api.API
+	syncs   *synchronization.Scheduler
+	beacons *discovery.Beacons
+	mux     *http.ServeMux
+	local   *http.ServeMux
+	server  *server.Server
+
+	watcher       *discovery.Watcher
+	peers         *discovery.Peers
+	wg            sync.WaitGroup
+	cancelBeacons context.CancelFunc
+	cancelSyncs   context.CancelFunc
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	done      chan struct{}
+	mu        sync.Mutex
+	err       error
+}
+
+// New opens the store, calculates the initial hashes and binds the API
+// listeners. Nothing is served or announced until Start is called.
+func New(cfg config.Config) (*Node, error) {
+	if cfg.Sync.Engine != api.EngineRBSR && cfg.Sync.Engine != api.EngineTime {
+		return nil, fmt.Errorf("unsupported sync engine %q", cfg.Sync.Engine)
+	}
+	if cfg.Sync.MaxSessions < 1 {
+		return nil, fmt.Errorf("sync max_sessions must be at least 1, got %d", cfg.Sync.MaxSessions)
+	}
+	if cfg.Sync.CheckpointMaxAge <= 0 {
+		return nil, fmt.Errorf("sync checkpoint_max_age must be positive, got %s", cfg.Sync.CheckpointMaxAge)
+	}
+	if cfg.Sync.JournalMaxAge <= 0 {
+		return nil, fmt.Errorf("sync journal_max_age must be positive, got %s", cfg.Sync.JournalMaxAge)
+	}
+	if cfg.Sync.RetryBackoff <= 0 || cfg.Sync.MaxRetryBackoff < cfg.Sync.RetryBackoff {
+		return nil, fmt.Errorf("sync retry_backoff must be positive and at most max_retry_backoff, got %s and %s", cfg.Sync.RetryBackoff, cfg.Sync.MaxRetryBackoff)
+	}
+	if cfg.Sync.QuarantineAfter < 1 {
+		return nil, fmt.Errorf("sync quarantine_after must be at least 1, got %d", cfg.Sync.QuarantineAfter)
+	}
+
+	store, err := storage.Open(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %v", err)
+	}
+
+	state := models.NewSyncState(cfg.Sync.MaxSessions)
+	if err := state.RefreshHashes(store); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to calculate database hash: %v", err)
+	}
+
+	key, err := discovery.LoadNodeKey(cfg.Discovery.NodeKey)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	beacons, err := discovery.NewBeacons(cfg, key, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	// Bind the API listeners before announcing ourselves, so the port
+	// advertised through discovery is one we really listen on.
+	srv, err := server.New(cfg)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to bind listeners: %v", err)
+	}
+	if srv.Port() != cfg.APIPort {
+		fmt.Printf("Advertising port %d instead of api_port %d\n", srv.Port(), cfg.APIPort)
+		cfg.APIPort = srv.Port()
+	}
+	watcher, err := discovery.NewWatcher(cfg, beacons)
+	if err != nil {
+		srv.Close()
+		store.Close()
+		return nil, err
+	}
+	peers, err := discovery.NewPeers(cfg, beacons)
+	if err != nil {
+		srv.Close()
+		store.Close()
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:     cfg,
+		store:   store,
+		state:   state,
+		api:     api.New(store, state),
+		mux:     http.NewServeMux(),
+		local:   http.NewServeMux(),
+		server:  srv,
+		beacons: beacons,
+		watcher: watcher,
+		peers:   peers,
+		done:    make(chan struct{}),
+	}
+	n.syncs = synchronization.NewScheduler(cfg.Sync.MaxSessions, n.Sync, n.CanSyncWith)
+	n.api.SignBeacon = func(hashes models.HashSet) ([]byte, error) {
+		return beacons.Sign(hashes, cfg.APIPort)
+	}
+	n.api.ResetSentAt = beacons.ResetSentAt
+	n.api.JournalMaxAge = cfg.Sync.JournalMaxAge
+	n.api.QuarantineAfter = cfg.Sync.QuarantineAfter
+	n.api.RegisterRoutes(n.mux)
+	n.api.RegisterLocalRoutes(n.local)
+	// The admin API is never served to peers
+	n.api.RegisterAdminRoutes(n.local)
+	if srv.LocalAddr() == "" {
+		fmt.Printf("No unix_socket or admin_address, the admin API is not served\n")
+	} else {
+		fmt.Printf("Admin API served on %s\n", srv.LocalAddr())
+	}
+
+	fmt.Printf("Node %s hash: %s\n", cfg.NodeID, state.GetHashes().Full)
+	fmt.Printf("Node %s key: %x\n", cfg.NodeID, []byte(beacons.PublicKey()))
+	return n, nil
+}
+
+// Start opens the discovery sockets and starts announcing, listening and
+// serving. The node runs until ctx is cancelled or Stop is called.
+func (n *Node) Start(ctx context.Context) error {
+	err := errors.New("node already started")
+	n.startOnce.Do(func() {
+		err = n.start(ctx)
+	})
+	return err
+}
+
+func (n *Node) start(ctx context.Context) error {
+	// Beacons and new syncs stop with ctx; running syncs get their own
+	// context so they can finish within the shutdown grace period.
+	beaconCtx, cancelBeacons := context.WithCancel(ctx)
+	syncCtx, cancelSyncs := context.WithCancel(context.Background())
+	n.cancelBeacons = cancelBeacons
+	n.cancelSyncs = cancelSyncs
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.syncs.Run(beaconCtx, syncCtx)
+	}()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.watcher.Run(beaconCtx, n)
+	}()
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.peers.Run(beaconCtx, n)
+	}()
+
+	fmt.Printf("Node %s starting, advertising port %d...\n", n.cfg.NodeID, n.cfg.APIPort)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- n.server.Serve(n.mux, n.local)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Shutting down node %s...\n", n.cfg.NodeID)
+		case err := <-serveErr:
+			if err != nil {
+				log.Printf("Server failed: %v", err)
+				n.setErr(err)
+			}
+		case <-n.done:
+			return
+		}
+		n.Stop()
+	}()
+
+	return nil
+}
+
+// Stop shuts the node down in order: no new syncs, closed discovery sockets,
+// in-flight syncs given the shutdown grace period to finish, drained HTTP
+// requests and finally the database pool. It blocks until the node has
+// stopped and is safe to call more than once.
+func (n *Node) Stop() error {
+	n.stopOnce.Do(func() {
+		n.state.BeginShutdown()
+
+		if n.cancelBeacons != nil {
+			n.cancelBeacons()
+		}
+		n.watcher.Close()
+
+		// Abort syncs still running once the grace period is over
+		if n.cancelSyncs != nil {
+			grace := time.AfterFunc(n.cfg.ShutdownTimeout, func() {
+				fmt.Println("Shutdown grace period expired, aborting in-flight syncs")
+				n.cancelSyncs()
+			})
+			n.wg.Wait()
+			grace.Stop()
+			n.cancelSyncs()
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), n.cfg.ShutdownTimeout)
+		defer cancel()
+		if err := n.server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down server cleanly: %v", err)
+		}
+		n.server.Close()
+
+		if err := n.store.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+
+		fmt.Printf("Node %s stopped\n", n.cfg.NodeID)
+		close(n.done)
+	})
+	<-n.done
+	return n.Err()
+}
+
+func (n *Node) setErr(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err == nil {
+		n.err = err
+	}
+}
+
+// Done is closed once the node has stopped.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Err returns why the node stopped, or nil if it was asked to.
+func (n *Node) Err() error {
+	<-n.done
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+// Handler returns the node's full HTTP API, for embedding in another server.
+func (n *Node) Handler() http.Handler {
+	return n.mux
+}
+
+// Port returns the TCP port the node advertises to peers.
+func (n *Node) Port() int {
+	return n.cfg.APIPort
+}
+
+// AdminAddress returns where the node serves its local and admin API, the
+// unix socket path or the bound admin address, or "" if nowhere.
+func (n *Node) AdminAddress() string {
+	return n.server.LocalAddr()
+}
+
+// Store returns the node's store.
+func (n *Node) Store() storage.Store {
+	return n.store
+}
+
+// GetHashes returns the node's current database hashes.
+func (n *Node) GetHashes() models.HashSet {
+	return n.state.GetHashes()
+}
+
+// CanSyncWith reports whether the node has a free sync session for peer, and
+// peer is neither backing off nor quarantined. peer is a key returned by
+// models.SyncPeer.
+func (n *Node) CanSyncWith(peer string) bool {
+	return n.state.CanSyncWith(peer) && synchronization.PeerReady(n.store, peer)
+}
+
+// ScheduleSync has the node sync with the peer of event once a worker is
+// free, unless it has a newer event of the same peer by then.
+func (n *Node) ScheduleSync(event synchronization.SyncEvent) {
+	n.syncs.Enqueue(event)
+}
+
+// Sync runs a sync session with peer, which announced hash.
+func (n *Node) Sync(ctx context.Context, peer remote.API, hash string) error {
+	return synchronization.StartSync(ctx, n.store, n.state, peer, hash, n.cfg)
+}
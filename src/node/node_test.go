@@ -0,0 +1,53 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"axial/config"
+)
+
+func TestTwoNodesRunInOneProcess(t *testing.T) {
+	nodes := []*Node{}
+	for i := range 2 {
+		dir := t.TempDir()
+		cfg := config.Defaults()
+		cfg.NodeID = fmt.Sprintf("axial-test-%d", i)
+		cfg.Database.Driver = "sqlite"
+		cfg.Database.Path = filepath.Join(dir, "axial.db")
+		cfg.Discovery.NodeKey = filepath.Join(dir, "node.key")
+		cfg.Listeners = []config.ListenerConfig{{Address: "127.0.0.1:0"}}
+
+		n, err := New(cfg)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(func() {
+			cancel()
+			n.Stop()
+		})
+		if err := n.Start(ctx); err != nil {
+			t.Fatalf("node %d: start: %v", i, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	// Each serves its admin API on its own port of the default address
+	if nodes[0].AdminAddress() == nodes[1].AdminAddress() {
+		t.Fatalf("expected distinct admin addresses, both got %s", nodes[0].AdminAddress())
+	}
+	for i, n := range nodes {
+		response, err := http.Get("http://" + n.AdminAddress() + "/v1/admin/sync/history")
+		if err != nil {
+			t.Fatalf("node %d: admin API: %v", i, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("node %d: expected 200 from the admin API, got %d", i, response.StatusCode)
+		}
+	}
+}
@@ -3,19 +3,49 @@ package remote
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"path"
 	"strings"
 	"time"
+
+	"axial/models"
 )
 
 type API struct {
 	Scheme  string
 	Address string
 	Port    int
+	// NodeID is the ID the node announced itself with, if known
+	NodeID string
+	// Traffic, if set, counts the bytes exchanged with the node
+	Traffic *Traffic
+	// Header is sent with every request, e.g. api.PeerHeader to tell the
+	// node who we are
+	Header http.Header
+	// TLSConfig, if set, verifies https nodes instead of the system roots
+	TLSConfig *tls.Config
+	// DialContext, if set, replaces the dialer that refuses local and
+	// metadata addresses, e.g. to reach a test server
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// hostPort returns the host and port the node is dialed at
+func (n *API) hostPort() string {
+	if n.Port != 0 {
+		return net.JoinHostPort(n.Address, fmt.Sprint(n.Port))
+	}
+	return n.Address
+}
+
+// SyncPeer returns the key sessions with the node are tracked by
+func (n *API) SyncPeer() string {
+	return models.SyncPeer(n.NodeID, n.hostPort())
 }
 
 type Endpoint[PostRequestType any, PostResponseType any, GetResponseType any] struct {
@@ -26,19 +56,39 @@ type Endpoint[PostRequestType any, PostResponseType any, GetResponseType any] st
 	ValidGetResponse  func(http.Response) bool
 }
 
+// URL returns where the endpoint is served: /<Version>/<Path> on the node.
+// The scheme defaults to http. A node without a Port has it in its Address,
+// the way discovery fills it in.
 func (e *Endpoint[_, _, _]) URL() *url.URL {
 	if e.Node == nil {
 		return nil
 	}
+	scheme := e.Node.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
 	return &url.URL{
-		Scheme: e.Node.Scheme,
-		Host:   fmt.Sprintf("%s:%d", e.Node.Address, e.Node.Port),
-		Path:   e.Path,
+		Scheme: scheme,
+		Host:   e.Node.hostPort(),
+		Path:   path.Join("/", e.Version, e.Path),
 	}
 }
 
-// isBlockedIP returns true if the IP is loopback, link-local, multicast, unspecified,
+// blockedIPv6 are IPv6 ranges that reach this host or cloud metadata
+// services. Mesh networks use unique local (cjdns, fc00::/8) and 200::/7
+// (Yggdrasil) addresses, which are allowed.
+var blockedIPv6 = []netip.Prefix{
+	netip.MustParsePrefix("::/96"),             // IPv4-compatible, deprecated
+	netip.MustParsePrefix("fd00:ec2::254/128"), // EC2 metadata
+}
+
+// nat64Prefix embeds IPv4 addresses in its last 32 bits
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// isBlockedIP returns true if the IP is loopback, IPv4 link-local, multicast, unspecified,
 // or matches any of the local interface addresses (to avoid hitting services on this host).
+// IPv6 link-local addresses are allowed, as IPv6 discovery finds peers by them; they
+// are only reachable through the interface named by their zone.
 func isBlockedIP(ip net.IP) bool {
 	if ip == nil {
 		return true
@@ -61,16 +111,20 @@ func isBlockedIP(ip net.IP) bool {
 			return true
 		}
 	}
-	// Link-local IPv6 fe80::/10
-	if ip.To16() != nil && ip.To4() == nil {
-		// Check fe80::/10
-		// First 10 bits: 1111111010 -> fe80::/10
-		b0 := ip[0]
-		b1 := ip[1]
-		if b0 == 0xfe && (b1&0xc0) == 0x80 {
-			return true
+	// IPv6 ranges reaching this host or metadata services, directly or
+	// through an embedded IPv4 address. ::1 is handled by IsLoopback above.
+	if addr, ok := netip.AddrFromSlice(ip); ok && addr.Is6() && !addr.Is4In6() {
+		for _, prefix := range blockedIPv6 {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		if nat64Prefix.Contains(addr) {
+			v4 := addr.As16()
+			if isBlockedIP(net.IP(v4[12:])) {
+				return true
+			}
 		}
-		// ::1 handled by IsLoopback above
 	}
 
 	// Block any address assigned to local interfaces
@@ -110,14 +164,18 @@ func restrictedDial(ctx context.Context, network, address string, allowedPort in
 		return nil, fmt.Errorf("blocked host: localhost")
 	}
 
-	// If host is an IP, check directly
-	ip := net.ParseIP(host)
-	if ip != nil {
+	// If host is an IP, check directly. IPv6 link-local addresses carry
+	// the zone of the interface they are reached through.
+	if addr, err := netip.ParseAddr(host); err == nil {
+		ip := net.IP(addr.AsSlice())
 		if isBlockedIP(ip) {
-			return nil, fmt.Errorf("blocked IP address: %s", ip.String())
+			return nil, fmt.Errorf("blocked IP address: %s", addr.String())
+		}
+		if addr.Is6() && addr.IsLinkLocalUnicast() && addr.Zone() == "" {
+			return nil, fmt.Errorf("link-local address %s needs a zone", addr.String())
 		}
 		d := &net.Dialer{Timeout: 30 * time.Second}
-		return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		return d.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
 	}
 
 	// Resolve hostname and choose the first allowed IP
@@ -130,25 +188,33 @@ func restrictedDial(ctx context.Context, network, address string, allowedPort in
 			continue
 		}
 		d := &net.Dialer{Timeout: 30 * time.Second}
-		return d.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		return d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
 	}
 	return nil, fmt.Errorf("blocked: all resolved IPs are disallowed for host %s", host)
 }
 
 // safeHTTPClient builds an HTTP client that prevents SSRF to localhost/metadata and enforces port.
-func safeHTTPClient(allowedPort int) *http.Client {
-	// Transport with restricted dialers for both HTTP and HTTPS
-	tr := &http.Transport{}
+func safeHTTPClient(node *API) *http.Client {
+	// The transport negotiates TLS for https over the restricted dialer
+	tr := &http.Transport{TLSClientConfig: node.TLSConfig}
 	tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-		return restrictedDial(ctx, network, address, allowedPort)
+		return restrictedDial(ctx, network, address, node.Port)
 	}
-	// Enforce the same restriction for TLS
-	tr.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-		return restrictedDial(ctx, network, address, allowedPort)
+	if node.DialContext != nil {
+		tr.DialContext = node.DialContext
 	}
 	return &http.Client{Transport: tr, Timeout: 30 * time.Second}
 }
 
+// setHeader adds the node's Header to request
+func (n *API) setHeader(request *http.Request) {
+	for key, values := range n.Header {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+}
+
 func (e *Endpoint[T, R, _]) Post(data T) (R, *http.Response, error) {
 	var result R
 	// Basic URL scheme validation
@@ -164,11 +230,19 @@ func (e *Endpoint[T, R, _]) Post(data T) (R, *http.Response, error) {
 	if err != nil {
 		return result, nil, fmt.Errorf("failed to marshal data: %w", err)
 	}
-	client := safeHTTPClient(e.Node.Port)
-	resp, err := client.Post(url.String(), "application/json", bytes.NewBuffer(body))
+	request, err := http.NewRequest(http.MethodPost, url.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return result, nil, fmt.Errorf("failed to create POST request: %w", err)
+	}
+	e.Node.setHeader(request)
+	request.Header.Set("Content-Type", "application/json")
+	client := safeHTTPClient(e.Node)
+	e.Node.Traffic.AddSent(len(body))
+	resp, err := client.Do(request)
 	if err != nil {
 		return result, resp, fmt.Errorf("failed to perform POST request: %w", err)
 	}
+	resp.Body = e.Node.Traffic.CountBody(resp.Body)
 
 	if e.ValidPostResponse != nil && !e.ValidPostResponse(*resp) {
 		return result, resp, fmt.Errorf("invalid response: %s", resp.Status)
@@ -192,11 +266,17 @@ func (e *Endpoint[_, _, R]) Get() (R, *http.Response, error) {
 	if url.Scheme != "http" && url.Scheme != "https" {
 		return result, nil, fmt.Errorf("unsupported URL scheme: %s", url.Scheme)
 	}
-	client := safeHTTPClient(e.Node.Port)
-	resp, err := client.Get(url.String())
+	request, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return result, nil, fmt.Errorf("failed to create GET request: %w", err)
+	}
+	e.Node.setHeader(request)
+	client := safeHTTPClient(e.Node)
+	resp, err := client.Do(request)
 	if err != nil {
 		return result, resp, fmt.Errorf("failed to perform GET request: %w", err)
 	}
+	resp.Body = e.Node.Traffic.CountBody(resp.Body)
 
 	if e.ValidGetResponse != nil && !e.ValidGetResponse(*resp) {
 		return result, resp, fmt.Errorf("invalid response: %s", resp.Status)
@@ -0,0 +1,59 @@
+package remote
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	for address, blocked := range map[string]bool{
+		"127.0.0.1":              true,
+		"169.254.169.254":        true,
+		"::ffff:127.0.0.1":       true,
+		"::127.0.0.1":            true,
+		"64:ff9b::a9fe:a9fe":     true, // 169.254.169.254 through NAT64
+		"fd00:ec2::254":          true,
+		"ff02::1":                true,
+		"::1":                    true,
+		"10.0.0.2":               false,
+		"fe80::1":                false, // IPv6 discovery finds peers by link-local address
+		"fc12:3456::1":           false, // cjdns
+		"200:1234:5678::1":       false, // Yggdrasil
+		"64:ff9b::a00:2":         false, // 10.0.0.2 through NAT64
+		"2001:db8::1":            false,
+		"fd00:ec2::253":          false,
+		"::ffff:10.0.0.2":        false,
+		"2001:db8:0:0:0:0:0:255": false,
+	} {
+		if got := isBlockedIP(net.ParseIP(address)); got != blocked {
+			t.Errorf("expected isBlockedIP(%s) = %v, got %v", address, blocked, got)
+		}
+	}
+}
+
+func TestURLBracketsIPv6Hosts(t *testing.T) {
+	for _, c := range []struct {
+		node API
+		want string
+	}{
+		{API{Address: "10.0.0.2", Port: 8080}, "http://10.0.0.2:8080/v1/ping"},
+		{API{Address: "fc12::1", Port: 8080}, "http://[fc12::1]:8080/v1/ping"},
+		{API{Address: "fe80::1%eth0", Port: 8080}, "http://[fe80::1%25eth0]:8080/v1/ping"},
+		// Discovery puts the port in the address
+		{API{Address: "[fe80::1%eth0]:8080"}, "http://[fe80::1%25eth0]:8080/v1/ping"},
+	} {
+		endpoint := c.node.Ping()
+		if got := endpoint.URL().String(); got != c.want {
+			t.Errorf("expected %s for %+v, got %s", c.want, c.node, got)
+		}
+	}
+}
+
+func TestRestrictedDialNeedsZoneForLinkLocal(t *testing.T) {
+	_, err := restrictedDial(context.Background(), "tcp", "[fe80::1]:8080", 8080)
+	if err == nil || !strings.Contains(err.Error(), "zone") {
+		t.Fatalf("expected a link-local address without zone to be refused, got %v", err)
+	}
+}
@@ -11,7 +11,7 @@ func (n *API) Messages() Endpoint[models.CreateMessage, models.Message, models.M
 	return Endpoint[models.CreateMessage, models.Message, models.Message]{
 		Node:    n,
 		Version: "v1",
-		Path:    "v1/messages",
+		Path:    "messages",
 		ValidPostResponse: func(response http.Response) bool {
 			return response.StatusCode == http.StatusCreated
 		},
@@ -48,26 +48,34 @@ func (n *API) Sync() Endpoint[api.SyncRequest, api.SyncResponse, interface{}] {
 	}
 }
 
-func (n *API) SyncMessages() Endpoint[[]models.Message, interface{}, interface{}] {
-	return Endpoint[[]models.Message, interface{}, interface{}]{
-		Node:    n,
-		Version: "v1",
-		Path:    "sync/messages",
+// syncPushAccepted reports whether a sync push was answered with a report
+func syncPushAccepted(response http.Response) bool {
+	return response.StatusCode == http.StatusOK
+}
+
+func (n *API) SyncMessages() Endpoint[api.SyncMessagesRequest, models.IngestReport, interface{}] {
+	return Endpoint[api.SyncMessagesRequest, models.IngestReport, interface{}]{
+		Node:              n,
+		Version:           "v1",
+		Path:              "sync/messages",
+		ValidPostResponse: syncPushAccepted,
 	}
 }
 
-func (n *API) SyncBulletins() Endpoint[[]models.Bulletin, interface{}, interface{}] {
-	return Endpoint[[]models.Bulletin, interface{}, interface{}]{
-		Node:    n,
-		Version: "v1",
-		Path:    "sync/bulletins",
+func (n *API) SyncBulletins() Endpoint[api.SyncBulletinsRequest, models.IngestReport, interface{}] {
+	return Endpoint[api.SyncBulletinsRequest, models.IngestReport, interface{}]{
+		Node:              n,
+		Version:           "v1",
+		Path:              "sync/bulletins",
+		ValidPostResponse: syncPushAccepted,
 	}
 }
 
-func (n *API) SyncUsers() Endpoint[[]models.User, interface{}, interface{}] {
-	return Endpoint[[]models.User, interface{}, interface{}]{
-		Node:    n,
-		Version: "v1",
-		Path:    "sync/users",
+func (n *API) SyncUsers() Endpoint[api.SyncUsersRequest, models.IngestReport, interface{}] {
+	return Endpoint[api.SyncUsersRequest, models.IngestReport, interface{}]{
+		Node:              n,
+		Version:           "v1",
+		Path:              "sync/users",
+		ValidPostResponse: syncPushAccepted,
 	}
 }
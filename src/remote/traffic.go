@@ -0,0 +1,57 @@
+package remote
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Traffic counts the bytes of the requests made to a node and of their
+// responses. It is safe for concurrent use, and a nil Traffic counts
+// nothing.
+type Traffic struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// Sent returns the bytes of the request bodies sent so far
+func (t *Traffic) Sent() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.sent.Load()
+}
+
+// Received returns the bytes of the response bodies read so far
+func (t *Traffic) Received() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.received.Load()
+}
+
+// AddSent counts n bytes sent
+func (t *Traffic) AddSent(n int) {
+	if t != nil {
+		t.sent.Add(int64(n))
+	}
+}
+
+// CountBody wraps a response body so that the bytes read from it are
+// counted as received
+func (t *Traffic) CountBody(body io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return body
+	}
+	return countingBody{ReadCloser: body, traffic: t}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	traffic *Traffic
+}
+
+func (c countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.traffic.received.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"axial/config"
+)
+
+// Listener is a bound socket and the way it is served. Local listeners, the
+// unix socket or the loopback admin address, serve only the local API.
+type Listener struct {
+	net.Listener
+	TLS   bool
+	Unix  bool
+	Local bool
+}
+
+// Port returns the TCP port the listener is bound to, or 0 for unix sockets.
+func (l Listener) Port() int {
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Server serves the node API on every configured listener. TCP listeners
+// serve the full API; the optional unix socket, or the admin address when
+// there is none, serves only the local API.
+type Server struct {
+	listeners []Listener
+	port      int
+
+	mu       sync.Mutex
+	servers  []*http.Server
+	shutdown bool
+}
+
+// New binds every listener in cfg. When cfg.Listeners is empty a single plain
+// HTTP listener on cfg.APIPort is used.
+func New(cfg config.Config) (*Server, error) {
+	listenerConfigs := cfg.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []config.ListenerConfig{{Address: fmt.Sprintf(":%d", cfg.APIPort)}}
+	}
+
+	s := &Server{}
+	for _, lc := range listenerConfigs {
+		l, err := listenTCP(lc)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, l)
+	} else if cfg.AdminAddress != "" {
+		l, err := listenLoopback(cfg.AdminAddress)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+
+	s.port = advertisedPort(cfg.APIPort, s.listeners)
+	return s, nil
+}
+
+func listenTCP(lc config.ListenerConfig) (Listener, error) {
+	if (lc.CertFile == "") != (lc.KeyFile == "") {
+		return Listener{}, fmt.Errorf("listener %s: cert_file and key_file must be set together", lc.Address)
+	}
+
+	l, err := net.Listen("tcp", lc.Address)
+	if err != nil {
+		return Listener{}, fmt.Errorf("failed to listen on %s: %v", lc.Address, err)
+	}
+
+	if lc.CertFile == "" {
+		return Listener{Listener: l}, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+	if err != nil {
+		l.Close()
+		return Listener{}, fmt.Errorf("listener %s: failed to load TLS key pair: %v", lc.Address, err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return Listener{Listener: tls.NewListener(l, tlsConfig), TLS: true}, nil
+}
+
+func listenUnix(path string) (Listener, error) {
+	// Remove a stale socket left behind by an earlier process
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Listener{}, fmt.Errorf("failed to remove stale unix socket %s: %v", path, err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return Listener{}, fmt.Errorf("failed to listen on unix socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		l.Close()
+		return Listener{}, fmt.Errorf("failed to set unix socket permissions: %v", err)
+	}
+	return Listener{Listener: l, Unix: true, Local: true}, nil
+}
+
+// listenLoopback binds the admin address, which must not be reachable from
+// other hosts
+func listenLoopback(address string) (Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid admin address %q: %v", address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return Listener{}, fmt.Errorf("admin address %q must be a loopback address", address)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return Listener{}, fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	return Listener{Listener: l, Local: true}, nil
+}
+
+// advertisedPort picks the port peers should dial. The configured API port is
+// preferred when something listens on it, then the first plain HTTP listener,
+// then the first TLS listener.
+func advertisedPort(apiPort int, listeners []Listener) int {
+	for _, l := range listeners {
+		if !l.Local && l.Port() == apiPort {
+			return apiPort
+		}
+	}
+	for _, l := range listeners {
+		if !l.Local && !l.TLS {
+			return l.Port()
+		}
+	}
+	for _, l := range listeners {
+		if !l.Local {
+			return l.Port()
+		}
+	}
+	return 0
+}
+
+// LocalAddr returns the address the local API is served on, the unix socket
+// path or the bound admin address, or "" if there is none.
+func (s *Server) LocalAddr() string {
+	for _, l := range s.listeners {
+		if l.Local {
+			return l.Addr().String()
+		}
+	}
+	return ""
+}
+
+// Port returns the TCP port announced to peers through discovery. It always
+// belongs to one of the bound listeners, or is 0 if only local ones are bound.
+func (s *Server) Port() int {
+	return s.port
+}
+
+// Serve serves api on the TCP listeners and local on the local ones until
+// one of them fails or Shutdown is called. After Shutdown it returns nil.
+func (s *Server) Serve(api http.Handler, local http.Handler) error {
+	errs := make(chan error, len(s.listeners))
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	for _, l := range s.listeners {
+		handler := api
+		kind := "http"
+		switch {
+		case l.Unix:
+			handler = local
+			kind = "unix"
+		case l.Local:
+			handler = local
+			kind = "local http"
+		case l.TLS:
+			kind = "https"
+		}
+		fmt.Printf("Serving %s on %s\n", kind, l.Addr())
+
+		srv := &http.Server{Handler: handler}
+		s.servers = append(s.servers, srv)
+		go func(l Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+	s.mu.Unlock()
+
+	err := <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish, or for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+
+	var errs []error
+	for _, srv := range s.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every listener.
+func (s *Server) Close() error {
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"axial/config"
+)
+
+func TestAdvertisedPortMatchesListener(t *testing.T) {
+	cfg := config.Config{
+		APIPort: 1, // not bound by any listener
+		Listeners: []config.ListenerConfig{
+			{Address: "127.0.0.1:0"},
+			{Address: "127.0.0.1:0"},
+		},
+		UnixSocket: filepath.Join(t.TempDir(), "axial.sock"),
+	}
+
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	defer srv.Close()
+
+	if srv.Port() == 0 || srv.Port() == cfg.APIPort {
+		t.Fatalf("expected advertised port from a bound listener, got %d", srv.Port())
+	}
+	if srv.Port() != srv.listeners[0].Port() {
+		t.Fatalf("expected first plain listener port %d, got %d", srv.listeners[0].Port(), srv.Port())
+	}
+}
+
+type fakeListener struct {
+	net.Listener
+	port int
+}
+
+func (f fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero, Port: f.port}
+}
+
+func TestAdvertisedPortPrefersAPIPort(t *testing.T) {
+	listeners := []Listener{
+		{Listener: fakeListener{port: 9443}, TLS: true},
+		{Listener: fakeListener{port: 9080}},
+		{Listener: fakeListener{port: 8080}, TLS: true},
+	}
+	if got := advertisedPort(8080, listeners); got != 8080 {
+		t.Fatalf("expected api port 8080, got %d", got)
+	}
+	if got := advertisedPort(7000, listeners); got != 9080 {
+		t.Fatalf("expected plain listener port 9080, got %d", got)
+	}
+	if got := advertisedPort(7000, listeners[:1]); got != 9443 {
+		t.Fatalf("expected tls listener port 9443, got %d", got)
+	}
+}
+
+func TestAdminAddressIsLocal(t *testing.T) {
+	cfg := config.Config{
+		Listeners:    []config.ListenerConfig{{Address: "127.0.0.1:0"}},
+		AdminAddress: "127.0.0.1:0",
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	defer srv.Close()
+
+	if len(srv.listeners) != 2 || srv.listeners[0].Local || !srv.listeners[1].Local {
+		t.Fatalf("expected the admin address to be the only local listener, got %+v", srv.listeners)
+	}
+	if srv.Port() != srv.listeners[0].Port() {
+		t.Fatalf("expected the API listener port %d to be advertised, got %d", srv.listeners[0].Port(), srv.Port())
+	}
+
+	// Peers must not reach the admin API
+	for _, address := range []string{"0.0.0.0:0", ":0", "[::]:0", "192.0.2.1:0"} {
+		cfg.AdminAddress = address
+		if srv, err := New(cfg); err == nil {
+			srv.Close()
+			t.Fatalf("expected admin address %s to be refused", address)
+		}
+	}
+}
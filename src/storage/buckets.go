@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+// addToBucket folds ids, all created within the bucket of createdAt, into
+// that hash bucket. It runs in the transaction that inserts the items, so
+// the buckets never disagree with the content tables.
+func addToBucket(tx *gorm.DB, dialect models.Dialect, kind string, createdAt time.Time, ids ...string) error {
+	start := models.BucketStart(createdAt)
+
+	// Make sure the row exists, then lock it so concurrent inserts into the
+	// same bucket apply their XOR one after the other.
+	empty := models.HashBucket{Kind: kind, Bucket: start, Hash: models.Accumulator{}.String()}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&empty).Error; err != nil {
+		return fmt.Errorf("failed to create hash bucket: %v", err)
+	}
+
+	var bucket models.HashBucket
+	if err := dialect.LockForUpdate(tx).Where("kind = ? AND bucket = ?", kind, start).First(&bucket).Error; err != nil {
+		return fmt.Errorf("failed to lock hash bucket: %v", err)
+	}
+
+	acc, err := models.ParseAccumulator(bucket.Hash)
+	if err != nil {
+		return fmt.Errorf("invalid hash in bucket %s %v: %v", kind, start, err)
+	}
+	for _, id := range ids {
+		acc.Add(id)
+	}
+
+	return tx.Model(&models.HashBucket{}).
+		Where("kind = ? AND bucket = ?", kind, start).
+		Updates(map[string]interface{}{"hash": acc.String(), "count": gorm.Expr("count + ?", len(ids))}).Error
+}
+
+// fullBuckets returns the span [lo, hi) of the buckets lying entirely within
+// period. A nil bound is open. ok is false when no whole bucket fits.
+func fullBuckets(period models.Period) (lo, hi *time.Time, ok bool) {
+	if period.Start != nil {
+		start := models.BucketStart(*period.Start)
+		if start.Before(*period.Start) {
+			start = start.Add(models.BucketSize)
+		}
+		lo = &start
+	}
+	if period.End != nil {
+		end := models.BucketStart(*period.End)
+		hi = &end
+	}
+	if lo != nil && hi != nil && !lo.Before(*hi) {
+		return nil, nil, false
+	}
+	return lo, hi, true
+}
+
+// rangeSummary returns the accumulated hash and the number of the items of
+// kind in period. Whole buckets are read from hash_buckets and only the
+// partial buckets at either edge are scanned in table.
+func (s *SQLStore) rangeSummary(kind string, model interface{}, period models.Period) (models.Accumulator, int64, error) {
+	var acc models.Accumulator
+	var count int64
+
+	scan := func(p models.Period) error {
+		var ids []string
+		if err := inPeriod(s.db.Model(model), p).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			acc.Add(id)
+		}
+		count += int64(len(ids))
+		return nil
+	}
+
+	lo, hi, ok := fullBuckets(period)
+	if !ok {
+		return acc, count, scan(period)
+	}
+
+	query := s.db.Model(&models.HashBucket{}).Where("kind = ?", kind)
+	if lo != nil {
+		query = query.Where("bucket >= ?", *lo)
+	}
+	if hi != nil {
+		query = query.Where("bucket < ?", *hi)
+	}
+	var buckets []models.HashBucket
+	if err := query.Find(&buckets).Error; err != nil {
+		return acc, count, err
+	}
+	for _, bucket := range buckets {
+		bucketAcc, err := models.ParseAccumulator(bucket.Hash)
+		if err != nil {
+			return acc, count, fmt.Errorf("invalid hash in bucket %s %v: %v", kind, bucket.Bucket, err)
+		}
+		acc.Combine(bucketAcc)
+		count += bucket.Count
+	}
+
+	if lo != nil {
+		if err := scan(models.Period{Start: period.Start, End: lo}); err != nil {
+			return acc, count, err
+		}
+	}
+	if hi != nil {
+		if err := scan(models.Period{Start: hi, End: period.End}); err != nil {
+			return acc, count, err
+		}
+	}
+	return acc, count, nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+func (s *SQLStore) Checkpoint(peer string) (*models.SyncCheckpoint, error) {
+	var checkpoint models.SyncCheckpoint
+	if err := s.db.Where("peer = ?", peer).First(&checkpoint).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *SQLStore) SaveCheckpoint(checkpoint *models.SyncCheckpoint) error {
+	if checkpoint.UpdatedAt.IsZero() {
+		checkpoint.UpdatedAt = time.Now()
+	}
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(checkpoint).Error
+}
+
+func (s *SQLStore) DeleteCheckpoint(peer string) error {
+	return s.db.Where("peer = ?", peer).Delete(&models.SyncCheckpoint{}).Error
+}
+
+func (s *SQLStore) DeleteCheckpointsBefore(t time.Time) (int64, error) {
+	result := s.db.Where("updated_at < ?", t).Delete(&models.SyncCheckpoint{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *MemoryStore) Checkpoint(peer string) (*models.SyncCheckpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	checkpoint, ok := s.checkpoints[peer]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &checkpoint, nil
+}
+
+func (s *MemoryStore) SaveCheckpoint(checkpoint *models.SyncCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if checkpoint.UpdatedAt.IsZero() {
+		checkpoint.UpdatedAt = time.Now()
+	}
+	s.checkpoints[checkpoint.Peer] = *checkpoint
+	return nil
+}
+
+func (s *MemoryStore) DeleteCheckpoint(peer string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.checkpoints, peer)
+	return nil
+}
+
+func (s *MemoryStore) DeleteCheckpointsBefore(t time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := int64(0)
+	for peer, checkpoint := range s.checkpoints {
+		if checkpoint.UpdatedAt.Before(t) {
+			delete(s.checkpoints, peer)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"sync"
+
+	"axial/models"
+)
+
+// hashCache keeps the whole-table hashes of a store up to date as items are
+// inserted, so Hashes does not rescan the tables after every write.
+//
+// Inserts hold the lock until their ID is added. Otherwise a first load
+// running concurrently could see a committed row and then have the insert
+// add the same ID again, which cancels it out of the XOR.
+type hashCache struct {
+	mu        sync.Mutex
+	loaded    bool
+	messages  models.Accumulator
+	bulletins models.Accumulator
+	users     models.Accumulator
+}
+
+// hashSet returns the cached hashes. Call with mu held and loaded set.
+func (c *hashCache) hashSet() models.HashSet {
+	return models.NewHashSet(c.messages.String(), c.bulletins.String(), c.users.String())
+}
+
+// load replaces the cache with the given table hashes and the fingerprints
+// of every user. Call with mu held.
+func (c *hashCache) load(messages, bulletins models.Accumulator, fingerprints []string) {
+	c.messages = messages
+	c.bulletins = bulletins
+	c.users = models.Accumulator{}
+	for _, fp := range fingerprints {
+		c.users.Add(fp)
+	}
+	c.loaded = true
+}
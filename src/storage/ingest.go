@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+const ingestBatchSize = 100 // Rows per INSERT statement when ingesting a batch
+
+// ingestResult reports on an item stored with err as the outcome
+func ingestResult(id string, err error) models.IngestResult {
+	switch {
+	case err == nil:
+		return models.IngestResult{ID: id, Status: models.IngestAccepted}
+	case errors.Is(err, ErrDuplicate):
+		return models.IngestResult{ID: id, Status: models.IngestDuplicate}
+	default:
+		return models.IngestResult{ID: id, Status: models.IngestRejected, Error: err.Error()}
+	}
+}
+
+// ingestItem is what ingest needs to know about one item of a batch
+type ingestItem struct {
+	key       string // unique column value, added to the table hash
+	id        string // primary key, also checked when keyColumn is not "id"
+	createdAt time.Time
+	base      *models.Base
+}
+
+// ingest stores a batch of items in one transaction. Each item is first
+// validated by its BeforeCreate hook, unless hooks are skipped; those that
+// fail are rejected. Items already stored, or sent twice, are duplicates,
+// and so are those another writer stores before this transaction does.
+// Items keyed by another column than "id" whose ID is taken by a stored
+// item, or an earlier one of the batch, are rejected with ErrIDTaken.
+// Only the items inserted are added to their hash buckets, then to acc once
+// committed.
+//
+// keyColumn is the unique column describe returns the key of. If the
+// transaction fails nothing is stored and the error is returned.
+func ingest[T any](s *SQLStore, items []T, kind string, keyColumn string, acc *models.Accumulator, validate func(*T) error, describe func(*T) ingestItem) (models.IngestReport, error) {
+	s.hashes.mu.Lock()
+	defer s.hashes.mu.Unlock()
+
+	results := make([]models.IngestResult, len(items))
+	candidates := []int{}
+	for i := range items {
+		if !s.db.Statement.SkipHooks {
+			if err := validate(&items[i]); err != nil {
+				results[i] = ingestResult(describe(&items[i]).key, err)
+				continue
+			}
+		}
+		candidates = append(candidates, i)
+	}
+
+	var fresh []T
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		keys := make([]string, len(candidates))
+		for j, i := range candidates {
+			keys[j] = describe(&items[i]).key
+		}
+		stored, err := lookUpStored[T](tx, keyColumn, keys)
+		if err != nil {
+			return err
+		}
+		takenIDs := map[string]bool{}
+		if keyColumn != "id" {
+			ids := make([]string, len(candidates))
+			for j, i := range candidates {
+				ids[j] = describe(&items[i]).id
+			}
+			if takenIDs, err = lookUpStored[T](tx, "id", ids); err != nil {
+				return err
+			}
+		}
+
+		fresh = []T{}
+		freshIndex := []int{} // index in items of each fresh item
+		for j, i := range candidates {
+			if stored[keys[j]] {
+				results[i] = ingestResult(keys[j], ErrDuplicate)
+				continue
+			}
+			if keyColumn != "id" {
+				id := describe(&items[i]).id
+				if takenIDs[id] {
+					results[i] = ingestResult(keys[j], fmt.Errorf("%w: %s", ErrIDTaken, id))
+					continue
+				}
+				takenIDs[id] = true
+			}
+			stored[keys[j]] = true
+			results[i] = ingestResult(keys[j], nil)
+			fresh = append(fresh, items[i])
+			freshIndex = append(freshIndex, i)
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+
+		// Hooks already ran during validation, or are skipped
+		for i := range fresh {
+			describe(&fresh[i]).base.SetCreatedUnix()
+		}
+		inserted, err := insertFresh(tx, keyColumn, fresh)
+		if err != nil {
+			return err
+		}
+		// Rows another writer stored since the lookup are duplicates
+		storedNow := []T{}
+		for i := range fresh {
+			if inserted[i] {
+				storedNow = append(storedNow, fresh[i])
+				continue
+			}
+			results[freshIndex[i]] = ingestResult(describe(&fresh[i]).key, ErrDuplicate)
+		}
+		fresh = storedNow
+		if kind == "" {
+			return nil
+		}
+
+		// One bucket update per bucket rather than per item
+		buckets := map[time.Time][]string{}
+		for i := range fresh {
+			item := describe(&fresh[i])
+			start := models.BucketStart(item.createdAt)
+			buckets[start] = append(buckets[start], item.key)
+		}
+		for start, keys := range buckets {
+			if err := addToBucket(tx, s.dialect, kind, start, keys...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return models.IngestReport{}, err
+	}
+
+	if s.hashes.loaded {
+		for i := range fresh {
+			acc.Add(describe(&fresh[i]).key)
+		}
+	}
+	return models.NewIngestReport(results), nil
+}
+
+// lookUpStored returns which of values the column of stored items holds
+func lookUpStored[T any](tx *gorm.DB, column string, values []string) (map[string]bool, error) {
+	stored := map[string]bool{}
+	for start := 0; start < len(values); start += ingestBatchSize {
+		end := min(start+ingestBatchSize, len(values))
+		var found []string
+		if err := tx.Model(new(T)).Where(column+" IN ?", values[start:end]).Pluck(column, &found).Error; err != nil {
+			return nil, fmt.Errorf("failed to look up stored items: %v", err)
+		}
+		for _, value := range found {
+			stored[value] = true
+		}
+	}
+	return stored, nil
+}
+
+// insertFresh inserts items in batches with ON CONFLICT (keyColumn) DO
+// NOTHING and reports which of them were inserted. A batch storing fewer
+// rows than it holds, because another writer stored some of them meanwhile,
+// is rolled back and inserted one row at a time to find out which. Any other
+// conflict, such as on the ID of an item keyed by another column, fails.
+func insertFresh[T any](tx *gorm.DB, keyColumn string, items []T) ([]bool, error) {
+	conflict := clause.OnConflict{Columns: []clause.Column{{Name: keyColumn}}, DoNothing: true}
+	tx = tx.Session(&gorm.Session{SkipHooks: true}).Clauses(conflict)
+	inserted := make([]bool, len(items))
+	for start := 0; start < len(items); start += ingestBatchSize {
+		end := min(start+ingestBatchSize, len(items))
+		if err := tx.SavePoint("ingest_batch").Error; err != nil {
+			return nil, err
+		}
+		result := tx.Create(items[start:end])
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == int64(end-start) {
+			for i := start; i < end; i++ {
+				inserted[i] = true
+			}
+			continue
+		}
+
+		if err := tx.RollbackTo("ingest_batch").Error; err != nil {
+			return nil, err
+		}
+		for i := start; i < end; i++ {
+			result := tx.Create(&items[i])
+			if result.Error != nil {
+				return nil, result.Error
+			}
+			inserted[i] = result.RowsAffected == 1
+		}
+	}
+	return inserted, nil
+}
+
+func (s *SQLStore) IngestUsers(users []models.User) (models.IngestReport, error) {
+	return ingest(s, users, "", "fingerprint", &s.hashes.users,
+		func(u *models.User) error { return u.BeforeCreate(nil) },
+		func(u *models.User) ingestItem {
+			return ingestItem{key: u.Fingerprint, id: u.ID, createdAt: u.CreatedAt, base: &u.Base}
+		})
+}
+
+func (s *SQLStore) IngestMessages(messages []models.Message) (models.IngestReport, error) {
+	return ingest(s, messages, models.BucketKindMessages, "id", &s.hashes.messages,
+		func(m *models.Message) error { return m.BeforeCreate(nil) },
+		func(m *models.Message) ingestItem {
+			return ingestItem{key: m.ID, id: m.ID, createdAt: m.CreatedAt, base: &m.Base}
+		})
+}
+
+func (s *SQLStore) IngestBulletins(bulletins []models.Bulletin) (models.IngestReport, error) {
+	return ingest(s, bulletins, models.BucketKindBulletins, "id", &s.hashes.bulletins,
+		func(b *models.Bulletin) error { return b.BeforeCreate(nil) },
+		func(b *models.Bulletin) ingestItem {
+			return ingestItem{key: b.ID, id: b.ID, createdAt: b.CreatedAt, base: &b.Base}
+		})
+}
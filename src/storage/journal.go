@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"axial/models"
+)
+
+func (s *SQLStore) SaveSyncSession(session *models.SyncSession) error {
+	return s.db.Save(session).Error
+}
+
+func (s *SQLStore) SyncSessions(peer string, limit int) ([]models.SyncSession, error) {
+	var sessions []models.SyncSession
+	query := s.db.Order("started_at DESC, id DESC").Limit(limit)
+	if peer != "" {
+		condition, args := syncPeerCondition("peer_address", peer)
+		query = query.Where(condition, args...)
+	}
+	if err := query.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *SQLStore) DeleteSyncSessionsBefore(t time.Time) (int64, error) {
+	result := s.db.Where("ended_at < ?", t).Delete(&models.SyncSession{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *MemoryStore) SaveSyncSession(session *models.SyncSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session.ID == 0 {
+		s.lastSessionID++
+		session.ID = s.lastSessionID
+	}
+	s.syncSessions[session.ID] = *session
+	return nil
+}
+
+func (s *MemoryStore) SyncSessions(peer string, limit int) ([]models.SyncSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := []models.SyncSession{}
+	for _, session := range s.syncSessions {
+		if peer == "" || syncPeerMatches(session.PeerAddress, peer) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if !sessions[i].StartedAt.Equal(sessions[j].StartedAt) {
+			return sessions[i].StartedAt.After(sessions[j].StartedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+// syncPeerCondition returns the condition matching the models.SyncPeer
+// keys in column that are peer itself or keys of nodes at the host peer
+func syncPeerCondition(column string, peer string) (string, []any) {
+	// Keys are nodeID@host, host:port or host
+	condition := column + " = ? OR " + column + " LIKE ? OR " + column + " LIKE ?"
+	return condition, []any{peer, "%@" + peer, net.JoinHostPort(peer, "") + "%"}
+}
+
+// syncPeerMatches reports whether the models.SyncPeer key is peer itself or
+// a key of a node at the host peer
+func syncPeerMatches(key string, peer string) bool {
+	if key == peer || strings.HasSuffix(key, "@"+peer) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(key)
+	return err == nil && host == peer
+}
+
+func (s *MemoryStore) DeleteSyncSessionsBefore(t time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := int64(0)
+	for id, session := range s.syncSessions {
+		if session.EndedAt.Before(t) {
+			delete(s.syncSessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
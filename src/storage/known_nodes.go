@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+func (s *SQLStore) KnownNode(nodeID string) (*models.KnownNode, error) {
+	var node models.KnownNode
+	if err := s.db.Where("node_id = ?", nodeID).First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (s *SQLStore) KnownNodes() ([]models.KnownNode, error) {
+	var nodes []models.KnownNode
+	if err := s.db.Order("node_id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (s *SQLStore) CountKnownNodes() (int64, error) {
+	var count int64
+	err := s.db.Model(&models.KnownNode{}).Count(&count).Error
+	return count, err
+}
+
+func (s *SQLStore) PinNode(node *models.KnownNode) error {
+	node.PinnedAt = time.Now()
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(node)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: node %s", ErrDuplicate, node.NodeID)
+	}
+	return nil
+}
+
+func (s *SQLStore) AdvanceNodeSentAt(nodeID string, sentAt time.Time) error {
+	// Compared here rather than in SQL, since SQLite keeps times as text in
+	// the zone they were written in
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var node models.KnownNode
+		err := tx.Where("node_id = ?", nodeID).First(&node).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if node.LastSentAt != nil && !node.LastSentAt.Before(sentAt) {
+			return nil
+		}
+		return tx.Model(&node).Update("last_sent_at", sentAt).Error
+	})
+}
+
+func (s *SQLStore) ResetNodeSentAt(nodeID string, sentAt *time.Time) error {
+	result := s.db.Model(&models.KnownNode{}).Where("node_id = ?", nodeID).Update("last_sent_at", sentAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) ForgetNode(nodeID string) error {
+	result := s.db.Where("node_id = ?", nodeID).Delete(&models.KnownNode{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) KnownNode(nodeID string) (*models.KnownNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node, ok := s.knownNodes[nodeID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &node, nil
+}
+
+func (s *MemoryStore) KnownNodes() ([]models.KnownNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := []models.KnownNode{}
+	for _, node := range s.knownNodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	return nodes, nil
+}
+
+func (s *MemoryStore) CountKnownNodes() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.knownNodes)), nil
+}
+
+func (s *MemoryStore) PinNode(node *models.KnownNode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.knownNodes[node.NodeID]; ok {
+		return fmt.Errorf("%w: node %s", ErrDuplicate, node.NodeID)
+	}
+	node.PinnedAt = time.Now()
+	s.knownNodes[node.NodeID] = *node
+	return nil
+}
+
+func (s *MemoryStore) AdvanceNodeSentAt(nodeID string, sentAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.knownNodes[nodeID]
+	if ok && (node.LastSentAt == nil || node.LastSentAt.Before(sentAt)) {
+		node.LastSentAt = &sentAt
+		s.knownNodes[nodeID] = node
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetNodeSentAt(nodeID string, sentAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.knownNodes[nodeID]
+	if !ok {
+		return ErrNotFound
+	}
+	node.LastSentAt = sentAt
+	s.knownNodes[nodeID] = node
+	return nil
+}
+
+func (s *MemoryStore) ForgetNode(nodeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.knownNodes[nodeID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.knownNodes, nodeID)
+	return nil
+}
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"axial/models"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It orders and
+// hashes exactly like SQLStore, so tests can mix the two.
+type MemoryStore struct {
+	// SkipHooks stores items as given instead of running the models'
+	// BeforeCreate validation, like gorm.Session{SkipHooks: true}.
+	SkipHooks bool
+
+	mu          sync.RWMutex
+	users       map[string]models.User
+	messages    map[string]models.Message
+	bulletins   map[string]models.Bulletin
+	checkpoints map[string]models.SyncCheckpoint
+	peerHealth  map[string]models.PeerHealth
+	knownNodes  map[string]models.KnownNode
+	// syncSessions is the journal, keyed by ID
+	syncSessions  map[uint64]models.SyncSession
+	lastSessionID uint64
+	hashes        hashCache
+}
+
+// NewMemory returns an empty in-memory Store
+func NewMemory() *MemoryStore {
+	return &MemoryStore{
+		users:        map[string]models.User{},
+		messages:     map[string]models.Message{},
+		bulletins:    map[string]models.Bulletin{},
+		checkpoints:  map[string]models.SyncCheckpoint{},
+		peerHealth:   map[string]models.PeerHealth{},
+		knownNodes:   map[string]models.KnownNode{},
+		syncSessions: map[uint64]models.SyncSession{},
+		hashes:       hashCache{loaded: true},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func inMemoryPeriod(t time.Time, period models.Period) bool {
+	if period.Start != nil && t.Before(*period.Start) {
+		return false
+	}
+	return period.End == nil || t.Before(*period.End)
+}
+
+func inStringRange(s string, r models.StringRange) bool {
+	return s >= r.Start && (r.End == "" || s < r.End)
+}
+
+func stringSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func byCreatedAt(a, b models.Base) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+// Users
+
+func (s *MemoryStore) CreateUser(user *models.User) error {
+	if !s.SkipHooks {
+		if err := user.BeforeCreate(nil); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Fingerprint == user.Fingerprint {
+			return fmt.Errorf("%w: fingerprint %s", ErrDuplicate, user.Fingerprint)
+		}
+	}
+	if _, ok := s.users[user.ID]; ok {
+		return fmt.Errorf("%w: user %s", ErrIDTaken, user.ID)
+	}
+	s.users[user.ID] = *user
+	s.hashes.users.Add(user.Fingerprint)
+	return nil
+}
+
+func (s *MemoryStore) IngestUsers(users []models.User) (models.IngestReport, error) {
+	results := make([]models.IngestResult, len(users))
+	for i := range users {
+		err := s.CreateUser(&users[i])
+		results[i] = ingestResult(users[i].Fingerprint, err)
+	}
+	return models.NewIngestReport(results), nil
+}
+
+// sortedUsers returns the users matching keep, ordered by fingerprint
+func (s *MemoryStore) sortedUsers(keep func(models.User) bool) []models.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []models.User{}
+	for _, u := range s.users {
+		if keep(u) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Fingerprint < users[j].Fingerprint })
+	return users
+}
+
+func (s *MemoryStore) Users() ([]models.User, error) {
+	return s.sortedUsers(func(models.User) bool { return true }), nil
+}
+
+func (s *MemoryStore) UserByFingerprint(fingerprint string) (*models.User, error) {
+	users := s.sortedUsers(func(u models.User) bool { return u.Fingerprint == fingerprint })
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users[0], nil
+}
+
+func (s *MemoryStore) UsersByFingerprints(fingerprints []string) ([]models.User, error) {
+	wanted := stringSet(fingerprints)
+	return s.sortedUsers(func(u models.User) bool { return wanted[u.Fingerprint] }), nil
+}
+
+func (s *MemoryStore) SearchUsers(query string, limit, offset int) ([]models.User, int64, error) {
+	query = strings.ToLower(query)
+	users := s.sortedUsers(func(u models.User) bool {
+		return strings.Contains(strings.ToLower(u.Fingerprint), query)
+	})
+	total := int64(len(users))
+	if offset > len(users) {
+		offset = len(users)
+	}
+	users = users[offset:]
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users, total, nil
+}
+
+func (s *MemoryStore) UsersInRange(r models.StringRange) ([]models.User, error) {
+	return s.sortedUsers(func(u models.User) bool { return inStringRange(u.Fingerprint, r) }), nil
+}
+
+func (s *MemoryStore) CountUsersInRange(r models.StringRange) (int64, error) {
+	users, _ := s.UsersInRange(r)
+	return int64(len(users)), nil
+}
+
+func (s *MemoryStore) UsersRangeHash(r models.StringRange) (string, error) {
+	users := s.sortedUsers(func(u models.User) bool { return inStringRange(u.Fingerprint, r) })
+	return hashFingerprints(users), nil
+}
+
+func hashFingerprints(users []models.User) string {
+	fingerprints := make([]string, len(users))
+	for i, u := range users {
+		fingerprints[i] = u.Fingerprint
+	}
+	return models.HashIDs(fingerprints)
+}
+
+// Messages
+
+func (s *MemoryStore) CreateMessage(message *models.Message) error {
+	if !s.SkipHooks {
+		if err := message.BeforeCreate(nil); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[message.ID]; ok {
+		return fmt.Errorf("%w: message %s", ErrDuplicate, message.ID)
+	}
+	s.messages[message.ID] = *message
+	s.hashes.messages.Add(message.ID)
+	return nil
+}
+
+func (s *MemoryStore) IngestMessages(messages []models.Message) (models.IngestReport, error) {
+	results := make([]models.IngestResult, len(messages))
+	for i := range messages {
+		err := s.CreateMessage(&messages[i])
+		results[i] = ingestResult(messages[i].ID, err)
+	}
+	return models.NewIngestReport(results), nil
+}
+
+// sortedMessages returns the messages matching keep, oldest first
+func (s *MemoryStore) sortedMessages(keep func(models.Message) bool) []models.Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := []models.Message{}
+	for _, m := range s.messages {
+		if keep(m) {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return byCreatedAt(messages[i].Base, messages[j].Base) })
+	return messages
+}
+
+func (s *MemoryStore) Messages() ([]models.Message, error) {
+	return s.sortedMessages(func(models.Message) bool { return true }), nil
+}
+
+func (s *MemoryStore) MessagesInvolving(fingerprint string) ([]models.Message, error) {
+	messages := s.sortedMessages(func(m models.Message) bool {
+		if string(m.Sender) == fingerprint {
+			return true
+		}
+		for _, r := range m.Recipients {
+			if string(r) == fingerprint {
+				return true
+			}
+		}
+		return false
+	})
+	// Newest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) MessagesInPeriod(period models.Period) ([]models.Message, error) {
+	return s.sortedMessages(func(m models.Message) bool { return inMemoryPeriod(m.CreatedAt, period) }), nil
+}
+
+func (s *MemoryStore) CountMessagesInPeriod(period models.Period) (int64, error) {
+	messages, _ := s.MessagesInPeriod(period)
+	return int64(len(messages)), nil
+}
+
+func (s *MemoryStore) MessagesHash(period models.Period) (string, error) {
+	messages := s.sortedMessages(func(m models.Message) bool { return inMemoryPeriod(m.CreatedAt, period) })
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return models.HashIDs(ids), nil
+}
+
+func (s *MemoryStore) MessageIDs(r models.StringRange) ([]string, error) {
+	messages, _ := s.MessagesInIDRange(r)
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) MessagesInIDRange(r models.StringRange) ([]models.Message, error) {
+	messages := s.sortedMessages(func(m models.Message) bool { return inStringRange(m.ID, r) })
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (s *MemoryStore) MessagesByIDs(ids []string) ([]models.Message, error) {
+	wanted := stringSet(ids)
+	return s.sortedMessages(func(m models.Message) bool { return wanted[m.ID] }), nil
+}
+
+// Bulletins
+
+func (s *MemoryStore) CreateBulletin(bulletin *models.Bulletin) error {
+	if !s.SkipHooks {
+		if err := bulletin.BeforeCreate(nil); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bulletins[bulletin.ID]; ok {
+		return fmt.Errorf("%w: bulletin %s", ErrDuplicate, bulletin.ID)
+	}
+	s.bulletins[bulletin.ID] = *bulletin
+	s.hashes.bulletins.Add(bulletin.ID)
+	return nil
+}
+
+func (s *MemoryStore) IngestBulletins(bulletins []models.Bulletin) (models.IngestReport, error) {
+	results := make([]models.IngestResult, len(bulletins))
+	for i := range bulletins {
+		err := s.CreateBulletin(&bulletins[i])
+		results[i] = ingestResult(bulletins[i].ID, err)
+	}
+	return models.NewIngestReport(results), nil
+}
+
+// sortedBulletins returns the bulletins matching keep, oldest first
+func (s *MemoryStore) sortedBulletins(keep func(models.Bulletin) bool) []models.Bulletin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bulletins := []models.Bulletin{}
+	for _, b := range s.bulletins {
+		if keep(b) {
+			bulletins = append(bulletins, b)
+		}
+	}
+	sort.Slice(bulletins, func(i, j int) bool { return byCreatedAt(bulletins[i].Base, bulletins[j].Base) })
+	return bulletins
+}
+
+func (s *MemoryStore) Bulletins() ([]models.Bulletin, error) {
+	bulletins := s.sortedBulletins(func(models.Bulletin) bool { return true })
+	// Newest first
+	for i, j := 0, len(bulletins)-1; i < j; i, j = i+1, j-1 {
+		bulletins[i], bulletins[j] = bulletins[j], bulletins[i]
+	}
+	return bulletins, nil
+}
+
+func (s *MemoryStore) BulletinsInPeriod(period models.Period) ([]models.Bulletin, error) {
+	return s.sortedBulletins(func(b models.Bulletin) bool { return inMemoryPeriod(b.CreatedAt, period) }), nil
+}
+
+func (s *MemoryStore) CountBulletinsInPeriod(period models.Period) (int64, error) {
+	bulletins, _ := s.BulletinsInPeriod(period)
+	return int64(len(bulletins)), nil
+}
+
+func (s *MemoryStore) BulletinsHash(period models.Period) (string, error) {
+	bulletins := s.sortedBulletins(func(b models.Bulletin) bool { return inMemoryPeriod(b.CreatedAt, period) })
+	ids := make([]string, len(bulletins))
+	for i, b := range bulletins {
+		ids[i] = b.ID
+	}
+	return models.HashIDs(ids), nil
+}
+
+func (s *MemoryStore) BulletinIDs(r models.StringRange) ([]string, error) {
+	bulletins, _ := s.BulletinsInIDRange(r)
+	ids := make([]string, len(bulletins))
+	for i, b := range bulletins {
+		ids[i] = b.ID
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) BulletinsInIDRange(r models.StringRange) ([]models.Bulletin, error) {
+	bulletins := s.sortedBulletins(func(b models.Bulletin) bool { return inStringRange(b.ID, r) })
+	sort.Slice(bulletins, func(i, j int) bool { return bulletins[i].ID < bulletins[j].ID })
+	return bulletins, nil
+}
+
+func (s *MemoryStore) BulletinsByIDs(ids []string) ([]models.Bulletin, error) {
+	wanted := stringSet(ids)
+	return s.sortedBulletins(func(b models.Bulletin) bool { return wanted[b.ID] }), nil
+}
+
+func (s *MemoryStore) Hashes() (models.HashSet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hashes.hashSet(), nil
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+func (s *SQLStore) PeerHealth(peer string) (*models.PeerHealth, error) {
+	var health models.PeerHealth
+	if err := s.db.Where("peer = ?", peer).First(&health).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &health, nil
+}
+
+func (s *SQLStore) PeerHealths() ([]models.PeerHealth, error) {
+	var healths []models.PeerHealth
+	if err := s.db.Order("peer").Find(&healths).Error; err != nil {
+		return nil, err
+	}
+	return healths, nil
+}
+
+func (s *SQLStore) QuarantinedPeerAt(host string) (*models.PeerHealth, error) {
+	var health models.PeerHealth
+	condition, args := syncPeerCondition("peer", host)
+	if err := s.db.Where("quarantined_at IS NOT NULL").Where(condition, args...).Order("peer").First(&health).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &health, nil
+}
+
+func (s *SQLStore) SavePeerHealth(health *models.PeerHealth) error {
+	health.UpdatedAt = time.Now()
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(health).Error
+}
+
+func (s *SQLStore) DeletePeerHealth(peer string) error {
+	result := s.db.Where("peer = ?", peer).Delete(&models.PeerHealth{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) PeerHealth(peer string) (*models.PeerHealth, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	health, ok := s.peerHealth[peer]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &health, nil
+}
+
+func (s *MemoryStore) PeerHealths() ([]models.PeerHealth, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	healths := []models.PeerHealth{}
+	for _, health := range s.peerHealth {
+		healths = append(healths, health)
+	}
+	sort.Slice(healths, func(i, j int) bool { return healths[i].Peer < healths[j].Peer })
+	return healths, nil
+}
+
+func (s *MemoryStore) QuarantinedPeerAt(host string) (*models.PeerHealth, error) {
+	healths, _ := s.PeerHealths()
+	for _, health := range healths {
+		if health.Quarantined() && syncPeerMatches(health.Peer, host) {
+			return &health, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SavePeerHealth(health *models.PeerHealth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health.UpdatedAt = time.Now()
+	s.peerHealth[health.Peer] = *health
+	return nil
+}
+
+func (s *MemoryStore) DeletePeerHealth(peer string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.peerHealth[peer]; !ok {
+		return ErrNotFound
+	}
+	delete(s.peerHealth, peer)
+	return nil
+}
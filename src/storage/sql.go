@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"axial/models"
+)
+
+// SQLStore is the Store for the PostgreSQL and SQLite drivers. Queries whose
+// SQL differs between the two go through the driver's models.Dialect.
+//
+// The whole-table hashes are calculated once and then updated on every
+// insert made through the store. Rows written to the database behind its
+// back are only picked up by a new SQLStore.
+type SQLStore struct {
+	db      *gorm.DB
+	dialect models.Dialect
+	hashes  hashCache
+}
+
+// NewSQL returns a Store backed by db, which must already be migrated
+func NewSQL(db *gorm.DB) *SQLStore {
+	return &SQLStore{
+		db:      db,
+		dialect: models.DialectOf(db),
+	}
+}
+
+// DB returns the underlying database handle
+func (s *SQLStore) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *SQLStore) Close() error {
+	return models.CloseDB(s.db)
+}
+
+// insert creates item and, once it is stored, adds key() to acc. Items
+// with a bucket kind are also added to their hash bucket in the same
+// transaction. An item that is already stored, possibly by a concurrent
+// sync session, is skipped without failing the transaction and reported as
+// ErrDuplicate.
+func (s *SQLStore) insert(item interface{}, kind string, base *models.Base, acc *models.Accumulator, key func() string) error {
+	s.hashes.mu.Lock()
+	defer s.hashes.mu.Unlock()
+
+	// Set again by the BeforeCreate hooks, unless they are skipped
+	base.SetCreatedUnix()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(item)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: %s", ErrDuplicate, key())
+		}
+		if kind == "" {
+			return nil
+		}
+		return addToBucket(tx, s.dialect, kind, base.CreatedAt, key())
+	})
+	if err != nil {
+		if s.dialect.IsDuplicateError(err) {
+			return fmt.Errorf("%w: %v", ErrDuplicate, err)
+		}
+		return err
+	}
+
+	if s.hashes.loaded {
+		acc.Add(key())
+	}
+	return nil
+}
+
+// inPeriod restricts query to created_at within the half-open period. Nil
+// bounds are open. It compares created_unix, as SQLite would compare
+// created_at as text in the zone each row was written in.
+func inPeriod(query *gorm.DB, period models.Period) *gorm.DB {
+	if period.Start != nil {
+		query = query.Where("created_unix >= ?", period.Start.UnixNano())
+	}
+	if period.End != nil {
+		query = query.Where("created_unix < ?", period.End.UnixNano())
+	}
+	return query
+}
+
+// inRange restricts column to the half-open string range r. An empty End is
+// open.
+func inRange(query *gorm.DB, column string, r models.StringRange) *gorm.DB {
+	query = query.Where(column+" >= ?", r.Start)
+	if r.End != "" {
+		query = query.Where(column+" < ?", r.End)
+	}
+	return query
+}
+
+// pluckHash hashes the values of column selected by query
+func pluckHash(query *gorm.DB, column string) (string, error) {
+	var ids []string
+	if err := query.Pluck(column, &ids).Error; err != nil {
+		return "", err
+	}
+	return models.HashIDs(ids), nil
+}
+
+// Users
+
+func (s *SQLStore) CreateUser(user *models.User) error {
+	return s.insert(user, "", &user.Base, &s.hashes.users, func() string { return user.Fingerprint })
+}
+
+func (s *SQLStore) Users() ([]models.User, error) {
+	var users []models.User
+	err := s.db.Order("fingerprint").Find(&users).Error
+	return users, err
+}
+
+func (s *SQLStore) UserByFingerprint(fingerprint string) (*models.User, error) {
+	var user models.User
+	if err := s.db.Where("fingerprint = ?", fingerprint).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *SQLStore) UsersByFingerprints(fingerprints []string) ([]models.User, error) {
+	var users []models.User
+	if len(fingerprints) == 0 {
+		return users, nil
+	}
+	err := s.db.Where("fingerprint IN ?", fingerprints).Find(&users).Error
+	return users, err
+}
+
+func (s *SQLStore) SearchUsers(query string, limit, offset int) ([]models.User, int64, error) {
+	contains := s.dialect.ContainsFold("fingerprint")
+	pattern := "%" + query + "%"
+
+	var total int64
+	if err := s.db.Model(&models.User{}).Where(contains, pattern).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []models.User
+	err := s.db.Where(contains, pattern).
+		Order("fingerprint ASC").
+		Limit(limit).Offset(offset).
+		Find(&users).Error
+	return users, total, err
+}
+
+func (s *SQLStore) UsersInRange(r models.StringRange) ([]models.User, error) {
+	var users []models.User
+	err := inRange(s.db, "fingerprint", r).Order("fingerprint").Find(&users).Error
+	return users, err
+}
+
+func (s *SQLStore) CountUsersInRange(r models.StringRange) (int64, error) {
+	var count int64
+	err := inRange(s.db.Model(&models.User{}), "fingerprint", r).Count(&count).Error
+	return count, err
+}
+
+func (s *SQLStore) UsersRangeHash(r models.StringRange) (string, error) {
+	query := inRange(s.db.Model(&models.User{}), "fingerprint", r)
+	hash, err := pluckHash(query, "fingerprint")
+	if err != nil {
+		return "", fmt.Errorf("failed to get user fingerprints: %v", err)
+	}
+	return hash, nil
+}
+
+// Messages
+
+func (s *SQLStore) CreateMessage(message *models.Message) error {
+	return s.insert(message, models.BucketKindMessages, &message.Base, &s.hashes.messages, func() string { return message.ID })
+}
+
+func (s *SQLStore) Messages() ([]models.Message, error) {
+	var messages []models.Message
+	err := s.db.Order("created_unix, id").Find(&messages).Error
+	return messages, err
+}
+
+func (s *SQLStore) MessagesInvolving(fingerprint string) ([]models.Message, error) {
+	var messages []models.Message
+	recipientQuery, recipientArg := s.dialect.JSONArrayContains("recipients", fingerprint)
+	err := s.db.
+		Where("sender = ?", fingerprint).
+		Or(recipientQuery, recipientArg).
+		Order("created_unix DESC").
+		Find(&messages).Error
+	return messages, err
+}
+
+func (s *SQLStore) MessagesInPeriod(period models.Period) ([]models.Message, error) {
+	var messages []models.Message
+	err := inPeriod(s.db, period).Order("created_unix, id").Find(&messages).Error
+	return messages, err
+}
+
+func (s *SQLStore) CountMessagesInPeriod(period models.Period) (int64, error) {
+	_, count, err := s.rangeSummary(models.BucketKindMessages, &models.Message{}, period)
+	return count, err
+}
+
+func (s *SQLStore) MessagesHash(period models.Period) (string, error) {
+	acc, _, err := s.rangeSummary(models.BucketKindMessages, &models.Message{}, period)
+	if err != nil {
+		return "", fmt.Errorf("failed to get messages hash: %v", err)
+	}
+	return acc.String(), nil
+}
+
+func (s *SQLStore) MessageIDs(r models.StringRange) ([]string, error) {
+	var ids []string
+	err := inRange(s.db.Model(&models.Message{}), "id", r).Order("id").Pluck("id", &ids).Error
+	return ids, err
+}
+
+func (s *SQLStore) MessagesInIDRange(r models.StringRange) ([]models.Message, error) {
+	var messages []models.Message
+	err := inRange(s.db, "id", r).Order("id").Find(&messages).Error
+	return messages, err
+}
+
+func (s *SQLStore) MessagesByIDs(ids []string) ([]models.Message, error) {
+	var messages []models.Message
+	if len(ids) == 0 {
+		return messages, nil
+	}
+	err := s.db.Where("id IN ?", ids).Order("created_unix, id").Find(&messages).Error
+	return messages, err
+}
+
+// Bulletins
+
+func (s *SQLStore) CreateBulletin(bulletin *models.Bulletin) error {
+	return s.insert(bulletin, models.BucketKindBulletins, &bulletin.Base, &s.hashes.bulletins, func() string { return bulletin.ID })
+}
+
+func (s *SQLStore) Bulletins() ([]models.Bulletin, error) {
+	var bulletins []models.Bulletin
+	err := s.db.Order("created_unix DESC").Find(&bulletins).Error
+	return bulletins, err
+}
+
+func (s *SQLStore) BulletinsInPeriod(period models.Period) ([]models.Bulletin, error) {
+	var bulletins []models.Bulletin
+	err := inPeriod(s.db, period).Order("created_unix, id").Find(&bulletins).Error
+	return bulletins, err
+}
+
+func (s *SQLStore) CountBulletinsInPeriod(period models.Period) (int64, error) {
+	_, count, err := s.rangeSummary(models.BucketKindBulletins, &models.Bulletin{}, period)
+	return count, err
+}
+
+func (s *SQLStore) BulletinsHash(period models.Period) (string, error) {
+	acc, _, err := s.rangeSummary(models.BucketKindBulletins, &models.Bulletin{}, period)
+	if err != nil {
+		return "", fmt.Errorf("failed to get bulletins hash: %v", err)
+	}
+	return acc.String(), nil
+}
+
+func (s *SQLStore) BulletinIDs(r models.StringRange) ([]string, error) {
+	var ids []string
+	err := inRange(s.db.Model(&models.Bulletin{}), "id", r).Order("id").Pluck("id", &ids).Error
+	return ids, err
+}
+
+func (s *SQLStore) BulletinsInIDRange(r models.StringRange) ([]models.Bulletin, error) {
+	var bulletins []models.Bulletin
+	err := inRange(s.db, "id", r).Order("id").Find(&bulletins).Error
+	return bulletins, err
+}
+
+func (s *SQLStore) BulletinsByIDs(ids []string) ([]models.Bulletin, error) {
+	var bulletins []models.Bulletin
+	if len(ids) == 0 {
+		return bulletins, nil
+	}
+	err := s.db.Where("id IN ?", ids).Order("created_unix, id").Find(&bulletins).Error
+	return bulletins, err
+}
+
+// Hashes returns the cached whole-table hashes, scanning the tables on the
+// first call only.
+func (s *SQLStore) Hashes() (models.HashSet, error) {
+	s.hashes.mu.Lock()
+	defer s.hashes.mu.Unlock()
+	if s.hashes.loaded {
+		return s.hashes.hashSet(), nil
+	}
+
+	// Messages and bulletins are summed from their hash buckets
+	messages, _, err := s.rangeSummary(models.BucketKindMessages, &models.Message{}, models.Period{})
+	if err != nil {
+		return models.HashSet{}, fmt.Errorf("failed to get messages hash: %v", err)
+	}
+	bulletins, _, err := s.rangeSummary(models.BucketKindBulletins, &models.Bulletin{}, models.Period{})
+	if err != nil {
+		return models.HashSet{}, fmt.Errorf("failed to get bulletins hash: %v", err)
+	}
+	var fingerprints []string
+	if err := s.db.Model(&models.User{}).Pluck("fingerprint", &fingerprints).Error; err != nil {
+		return models.HashSet{}, fmt.Errorf("failed to get user fingerprints: %v", err)
+	}
+	s.hashes.load(messages, bulletins, fingerprints)
+
+	return s.hashes.hashSet(), nil
+}
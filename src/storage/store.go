@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"axial/config"
+	"axial/models"
+)
+
+// ErrDuplicate is returned, wrapped, when an item is already stored.
+// Synchronization treats it as success since the item is content addressed.
+var ErrDuplicate = errors.New("duplicate item")
+
+// ErrIDTaken is returned, wrapped, when an item has the ID of another stored
+// item. Unlike ErrDuplicate it is a rejection.
+var ErrIDTaken = errors.New("id taken by another item")
+
+// ErrNotFound is returned when a looked up item does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is the persistence layer of a node. The API handlers and the
+// synchronization code only talk to the database through it.
+//
+// Periods and string ranges are half-open: they include Start and exclude
+// End. A nil Start or End leaves a period unbounded on that side, an empty
+// End leaves a string range unbounded above.
+type Store interface {
+	// Users
+	CreateUser(user *models.User) error
+	Users() ([]models.User, error)
+	UserByFingerprint(fingerprint string) (*models.User, error)
+	UsersByFingerprints(fingerprints []string) ([]models.User, error)
+	// SearchUsers returns a page of users whose fingerprint contains query,
+	// ignoring case, and the total number of matches.
+	SearchUsers(query string, limit, offset int) ([]models.User, int64, error)
+	UsersInRange(r models.StringRange) ([]models.User, error)
+	CountUsersInRange(r models.StringRange) (int64, error)
+	UsersRangeHash(r models.StringRange) (string, error)
+
+	// Messages
+	CreateMessage(message *models.Message) error
+	Messages() ([]models.Message, error)
+	// MessagesInvolving returns the messages sent by or to fingerprint,
+	// newest first.
+	MessagesInvolving(fingerprint string) ([]models.Message, error)
+	MessagesInPeriod(period models.Period) ([]models.Message, error)
+	CountMessagesInPeriod(period models.Period) (int64, error)
+	MessagesHash(period models.Period) (string, error)
+	// MessageIDs returns the IDs within r, sorted. MessagesInIDRange returns
+	// the same messages ordered by ID.
+	MessageIDs(r models.StringRange) ([]string, error)
+	MessagesInIDRange(r models.StringRange) ([]models.Message, error)
+	// MessagesByIDs returns the stored messages among ids, oldest first
+	MessagesByIDs(ids []string) ([]models.Message, error)
+
+	// Bulletins
+	CreateBulletin(bulletin *models.Bulletin) error
+	// Bulletins returns every bulletin post, newest first.
+	Bulletins() ([]models.Bulletin, error)
+	BulletinsInPeriod(period models.Period) ([]models.Bulletin, error)
+	CountBulletinsInPeriod(period models.Period) (int64, error)
+	BulletinsHash(period models.Period) (string, error)
+	BulletinIDs(r models.StringRange) ([]string, error)
+	BulletinsInIDRange(r models.StringRange) ([]models.Bulletin, error)
+	BulletinsByIDs(ids []string) ([]models.Bulletin, error)
+
+	// IngestUsers, IngestMessages and IngestBulletins store a batch of items
+	// received from a peer, all or nothing, and report what became of each
+	// item. Items that fail validation are rejected without failing the
+	// batch; an error means nothing was stored.
+	IngestUsers(users []models.User) (models.IngestReport, error)
+	IngestMessages(messages []models.Message) (models.IngestReport, error)
+	IngestBulletins(bulletins []models.Bulletin) (models.IngestReport, error)
+
+	// Sync checkpoints, one per peer. Checkpoint returns ErrNotFound when
+	// there is none; SaveCheckpoint replaces any previous one and stamps
+	// UpdatedAt unless it is set.
+	Checkpoint(peer string) (*models.SyncCheckpoint, error)
+	SaveCheckpoint(checkpoint *models.SyncCheckpoint) error
+	DeleteCheckpoint(peer string) error
+	// DeleteCheckpointsBefore removes checkpoints last updated before t and
+	// returns how many there were.
+	DeleteCheckpointsBefore(t time.Time) (int64, error)
+
+	// Sync journal. SaveSyncSession inserts a session without an ID, which
+	// it assigns, and updates it otherwise. SyncSessions returns the last
+	// limit sessions, newest first. If peer is set, only those with the
+	// models.SyncPeer key peer or with any key at the host peer.
+	SaveSyncSession(session *models.SyncSession) error
+	SyncSessions(peer string, limit int) ([]models.SyncSession, error)
+	// DeleteSyncSessionsBefore removes sessions that ended before t and
+	// returns how many there were.
+	DeleteSyncSessionsBefore(t time.Time) (int64, error)
+
+	// Peer health, one per models.SyncPeer key. PeerHealth returns ErrNotFound for
+	// peers without any, and so does DeletePeerHealth. SavePeerHealth
+	// replaces any previous one and stamps UpdatedAt.
+	PeerHealth(peer string) (*models.PeerHealth, error)
+	PeerHealths() ([]models.PeerHealth, error)
+	// QuarantinedPeerAt returns the health of a quarantined peer at host,
+	// whatever its node ID or port, or ErrNotFound if there is none.
+	QuarantinedPeerAt(host string) (*models.PeerHealth, error)
+	SavePeerHealth(health *models.PeerHealth) error
+	DeletePeerHealth(peer string) error
+
+	// Keys pinned to node IDs. KnownNode returns ErrNotFound for nodes not
+	// pinned yet, and so does ForgetNode. PinNode never replaces a pinned
+	// key: it returns ErrDuplicate instead. AdvanceNodeSentAt records the
+	// sending time of a newer beacon of a pinned node, and never moves it
+	// back. ResetNodeSentAt sets it to sentAt whatever it was, or clears it
+	// when sentAt is nil, and returns ErrNotFound for nodes not pinned.
+	KnownNode(nodeID string) (*models.KnownNode, error)
+	KnownNodes() ([]models.KnownNode, error)
+	CountKnownNodes() (int64, error)
+	PinNode(node *models.KnownNode) error
+	AdvanceNodeSentAt(nodeID string, sentAt time.Time) error
+	ResetNodeSentAt(nodeID string, sentAt *time.Time) error
+	ForgetNode(nodeID string) error
+
+	// Hashes calculates the hashes of every content type and combines them
+	Hashes() (models.HashSet, error)
+
+	Close() error
+}
+
+// Open connects to the configured database, applies pending migrations and
+// returns a Store backed by it.
+func Open(cfg config.DatabaseConfig) (Store, error) {
+	db, err := models.OpenDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQL(db), nil
+}
+
+// MessagesHashRanges hashes the messages of every sync range
+func MessagesHashRanges(store Store, ranges []models.SyncRange) ([]models.HashedPeriod, error) {
+	hashedPeriods := []models.HashedPeriod{}
+	for _, r := range ranges {
+		hash, err := store.MessagesHash(r.Period())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get messages hash: %v", err)
+		}
+		hashedPeriods = append(hashedPeriods, models.HashedPeriod{
+			Period:  r.Period(),
+			RangeID: r.ID,
+			Hash:    hash,
+		})
+	}
+	return hashedPeriods, nil
+}
+
+// BulletinsHashRanges hashes the bulletins of every sync range
+func BulletinsHashRanges(store Store, ranges []models.SyncRange) ([]models.HashedPeriod, error) {
+	hashedPeriods := []models.HashedPeriod{}
+	for _, r := range ranges {
+		hash, err := store.BulletinsHash(r.Period())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bulletins hash: %v", err)
+		}
+		hashedPeriods = append(hashedPeriods, models.HashedPeriod{
+			Period:  r.Period(),
+			RangeID: r.ID,
+			Hash:    hash,
+		})
+	}
+	return hashedPeriods, nil
+}
+
+// MessagesHashIDRanges fingerprints the messages of every ID range
+func MessagesHashIDRanges(store Store, ranges []models.StringRange) ([]models.HashedIDRange, error) {
+	hashedRanges := []models.HashedIDRange{}
+	for _, r := range ranges {
+		ids, err := store.MessageIDs(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message IDs: %v", err)
+		}
+		hashedRanges = append(hashedRanges, models.HashIDRange(r, ids))
+	}
+	return hashedRanges, nil
+}
+
+// BulletinsHashIDRanges fingerprints the bulletins of every ID range
+func BulletinsHashIDRanges(store Store, ranges []models.StringRange) ([]models.HashedIDRange, error) {
+	hashedRanges := []models.HashedIDRange{}
+	for _, r := range ranges {
+		ids, err := store.BulletinIDs(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bulletin IDs: %v", err)
+		}
+		hashedRanges = append(hashedRanges, models.HashIDRange(r, ids))
+	}
+	return hashedRanges, nil
+}
+
+// UsersHashRanges hashes the users of every fingerprint range
+func UsersHashRanges(store Store, stringRanges []models.StringRange) ([]models.HashedUsersRange, error) {
+	hashedRanges := []models.HashedUsersRange{}
+	for _, stringRange := range stringRanges {
+		hash, err := store.UsersRangeHash(stringRange)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get users hash: %v", err)
+		}
+		hashedRanges = append(hashedRanges, models.HashedUsersRange{
+			StringRange: stringRange,
+			Hash:        hash,
+		})
+	}
+	return hashedRanges, nil
+}
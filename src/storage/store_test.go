@@ -0,0 +1,616 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"axial/models"
+)
+
+func newSQLiteStore(t *testing.T) Store {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return NewSQL(db.Session(&gorm.Session{SkipHooks: true}))
+}
+
+func newMemoryStore(t *testing.T) Store {
+	store := NewMemory()
+	store.SkipHooks = true
+	return store
+}
+
+// seed inserts the same synthetic data set into store
+func seed(t *testing.T, store Store, base time.Time) {
+	t.Helper()
+	for i, fp := range []string{"c0ffee", "ABCDEF", "0badf00d"} {
+		u := models.User{Base: models.Base{ID: fp, CreatedAt: base}, Fingerprint: fp}
+		if err := store.CreateUser(&u); err != nil {
+			t.Fatalf("create user %d: %v", i, err)
+		}
+	}
+	for i, id := range []string{"m3", "m1", "m2", "m0"} {
+		m := models.Message{
+			Base:       models.Base{ID: id, CreatedAt: base.Add(time.Duration(i%3) * time.Hour)},
+			Sender:     "c0ffee",
+			Recipients: models.Fingerprints{"ABCDEF"},
+		}
+		if err := store.CreateMessage(&m); err != nil {
+			t.Fatalf("create message %s: %v", id, err)
+		}
+	}
+	for i, id := range []string{"b1", "b0"} {
+		b := models.Bulletin{Base: models.Base{ID: id, CreatedAt: base.Add(time.Duration(i) * time.Hour)}, Sender: "c0ffee"}
+		if err := store.CreateBulletin(&b); err != nil {
+			t.Fatalf("create bulletin %s: %v", id, err)
+		}
+	}
+}
+
+func TestStoresAgree(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	sqlStore := newSQLiteStore(t)
+	memStore := newMemoryStore(t)
+	seed(t, sqlStore, base)
+	seed(t, memStore, base)
+
+	sqlHashes, err := sqlStore.Hashes()
+	if err != nil {
+		t.Fatalf("sql hashes: %v", err)
+	}
+	memHashes, _ := memStore.Hashes()
+	if sqlHashes != memHashes {
+		t.Fatalf("hashes differ:\nsql    %+v\nmemory %+v", sqlHashes, memHashes)
+	}
+
+	start := base
+	end := base.Add(time.Hour)
+	period := models.Period{Start: &start, End: &end}
+	for name, store := range map[string]Store{"sql": sqlStore, "memory": memStore} {
+		// Periods exclude their end, so m2 at base+2h is left out
+		messages, err := store.MessagesInPeriod(period)
+		if err != nil {
+			t.Fatalf("%s: messages in period: %v", name, err)
+		}
+		if len(messages) != 2 || messages[0].ID != "m0" || messages[1].ID != "m3" {
+			t.Fatalf("%s: expected m0 and m3 in created_at, id order, got %+v", name, messages)
+		}
+		if count, _ := store.CountMessagesInPeriod(period); count != 2 {
+			t.Fatalf("%s: expected count 2, got %d", name, count)
+		}
+
+		users, total, err := store.SearchUsers("abc", 10, 0)
+		if err != nil {
+			t.Fatalf("%s: search users: %v", name, err)
+		}
+		if total != 1 || len(users) != 1 || users[0].Fingerprint != "ABCDEF" {
+			t.Fatalf("%s: expected case-insensitive match on ABCDEF, got %d %+v", name, total, users)
+		}
+
+		involving, err := store.MessagesInvolving("ABCDEF")
+		if err != nil {
+			t.Fatalf("%s: messages involving: %v", name, err)
+		}
+		if len(involving) != 4 || !involving[0].CreatedAt.Equal(base.Add(2*time.Hour)) {
+			t.Fatalf("%s: expected 4 messages newest first, got %+v", name, involving)
+		}
+
+		if _, err := store.UserByFingerprint("missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected ErrNotFound, got %v", name, err)
+		}
+
+		duplicate := models.Message{Base: models.Base{ID: "m1", CreatedAt: base}}
+		if err := store.CreateMessage(&duplicate); !errors.Is(err, ErrDuplicate) {
+			t.Fatalf("%s: expected ErrDuplicate, got %v", name, err)
+		}
+	}
+
+	hour, _ := models.ParseSyncRange("H2025-06-01T12")
+	sqlRange, _ := MessagesHashRanges(sqlStore, []models.SyncRange{hour})
+	memRange, _ := MessagesHashRanges(memStore, []models.SyncRange{hour})
+	if sqlRange[0].Hash != memRange[0].Hash || sqlRange[0].RangeID != hour.ID {
+		t.Fatalf("range hashes differ: %s != %s", sqlRange[0].Hash, memRange[0].Hash)
+	}
+}
+
+func TestPeriodsIgnoreTheWritersZone(t *testing.T) {
+	sqlStore := newSQLiteStore(t)
+	memStore := newMemoryStore(t)
+	// 10:30Z, written by a node two hours ahead of UTC
+	createdAt := time.Date(2025, 6, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for name, store := range map[string]Store{"sql": sqlStore, "memory": memStore} {
+		created := models.Message{Base: models.Base{ID: "created", CreatedAt: createdAt}}
+		if err := store.CreateMessage(&created); err != nil {
+			t.Fatalf("%s: create message: %v", name, err)
+		}
+		ingested := []models.Message{{Base: models.Base{ID: "ingested", CreatedAt: createdAt.Add(time.Minute)}}}
+		if _, err := store.IngestMessages(ingested); err != nil {
+			t.Fatalf("%s: ingest messages: %v", name, err)
+		}
+	}
+
+	for _, id := range []string{"H2025-06-01T10", "H2025-06-01T12"} {
+		hour, _ := models.ParseSyncRange(id)
+		want := 0
+		if hour.Start.Equal(models.BucketStart(createdAt)) {
+			want = 2
+		}
+		for name, store := range map[string]Store{"sql": sqlStore, "memory": memStore} {
+			messages, err := store.MessagesInPeriod(hour.Period())
+			if err != nil {
+				t.Fatalf("%s: messages in period: %v", name, err)
+			}
+			if len(messages) != want {
+				t.Fatalf("%s: expected %d messages in %s, got %d", name, want, id, len(messages))
+			}
+		}
+		sqlRange, _ := MessagesHashRanges(sqlStore, []models.SyncRange{hour})
+		memRange, _ := MessagesHashRanges(memStore, []models.SyncRange{hour})
+		if sqlRange[0].Hash != memRange[0].Hash {
+			t.Fatalf("range hashes of %s differ: %s != %s", id, sqlRange[0].Hash, memRange[0].Hash)
+		}
+	}
+
+	// Edge scans of partial buckets agree with the fetch too
+	start, end := createdAt.Add(-time.Minute), createdAt.Add(30*time.Second)
+	partial := models.Period{Start: &start, End: &end}
+	if count, err := sqlStore.CountMessagesInPeriod(partial); err != nil || count != 1 {
+		t.Fatalf("expected 1 message in the partial period, got %d, %v", count, err)
+	}
+}
+
+func TestSQLHashesStayCurrent(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	db = db.Session(&gorm.Session{SkipHooks: true})
+
+	store := NewSQL(db)
+	before, err := store.Hashes()
+	if err != nil {
+		t.Fatalf("hashes: %v", err)
+	}
+
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	seed(t, store, base)
+	duplicate := models.Bulletin{Base: models.Base{ID: "b0", CreatedAt: base}}
+	if err := store.CreateBulletin(&duplicate); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+
+	incremental, _ := store.Hashes()
+	if incremental == before {
+		t.Fatalf("expected hashes to change after inserts")
+	}
+
+	// A fresh store scans the tables; it must agree with the running one
+	rescanned, err := NewSQL(db).Hashes()
+	if err != nil {
+		t.Fatalf("rescanned hashes: %v", err)
+	}
+	if incremental != rescanned {
+		t.Fatalf("incremental hashes drifted:\nincremental %+v\nrescanned   %+v", incremental, rescanned)
+	}
+}
+
+func TestHashBucketsMatchScan(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	db = db.Session(&gorm.Session{SkipHooks: true})
+	sqlStore := NewSQL(db)
+	memStore := newMemoryStore(t)
+
+	base := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		createdAt := base.Add(time.Duration(i*23) * time.Minute)
+		for _, store := range []Store{sqlStore, memStore} {
+			m := models.Message{Base: models.Base{ID: fmt.Sprintf("m%02d", i), CreatedAt: createdAt}}
+			if err := store.CreateMessage(&m); err != nil {
+				t.Fatalf("create message: %v", err)
+			}
+		}
+	}
+
+	at := func(minutes int) *time.Time {
+		t := base.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+	periods := []models.Period{
+		{},
+		{Start: at(0), End: at(60)},     // exactly one bucket
+		{Start: at(10), End: at(50)},    // inside one bucket
+		{Start: at(17), End: at(605)},   // partial buckets at both edges
+		{Start: at(23 * 4), End: nil},   // open end
+		{Start: nil, End: at(23 * 30)},  // open start, end on an item
+		{Start: at(-600), End: at(-60)}, // before everything
+	}
+	for _, period := range periods {
+		sqlHash, err := sqlStore.MessagesHash(period)
+		if err != nil {
+			t.Fatalf("sql hash: %v", err)
+		}
+		memHash, _ := memStore.MessagesHash(period)
+		if sqlHash != memHash {
+			t.Fatalf("hash for %v-%v differs between buckets and scan", period.Start, period.End)
+		}
+		sqlCount, err := sqlStore.CountMessagesInPeriod(period)
+		if err != nil {
+			t.Fatalf("sql count: %v", err)
+		}
+		memCount, _ := memStore.CountMessagesInPeriod(period)
+		if sqlCount != memCount {
+			t.Fatalf("count for %v-%v: buckets %d, scan %d", period.Start, period.End, sqlCount, memCount)
+		}
+	}
+
+	// Rebuilding the buckets from the tables gives the same hashes
+	before, _ := sqlStore.Hashes()
+	if _, err := models.MigrateDown(db); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	after, err := NewSQL(db).Hashes()
+	if err != nil {
+		t.Fatalf("hashes after backfill: %v", err)
+	}
+	if before != after {
+		t.Fatalf("backfilled buckets disagree:\nbefore %+v\nafter  %+v", before, after)
+	}
+}
+
+func TestIngestReportsEachItem(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	sqlStore := newSQLiteStore(t)
+	memStore := newMemoryStore(t)
+	for name, store := range map[string]Store{"sql": sqlStore, "memory": memStore} {
+		seed(t, store, base)
+
+		// m1 is stored already and m9 is sent twice
+		batch := []models.Message{}
+		for i, id := range []string{"m8", "m1", "m9", "m9"} {
+			batch = append(batch, models.Message{Base: models.Base{ID: id, CreatedAt: base.Add(time.Duration(i) * 40 * time.Minute)}})
+		}
+		report, err := store.IngestMessages(batch)
+		if err != nil {
+			t.Fatalf("%s: ingest messages: %v", name, err)
+		}
+		want := []models.IngestStatus{models.IngestAccepted, models.IngestDuplicate, models.IngestAccepted, models.IngestDuplicate}
+		for i, item := range report.Items {
+			if item.ID != batch[i].ID || item.Status != want[i] {
+				t.Fatalf("%s: item %d: expected %s %s, got %+v", name, i, batch[i].ID, want[i], item)
+			}
+		}
+		if report.Accepted != 2 || report.Duplicates != 2 || report.Rejected != 0 {
+			t.Fatalf("%s: unexpected counts %+v", name, report)
+		}
+
+		users, err := store.IngestUsers([]models.User{{Base: models.Base{ID: "ABCDEF"}, Fingerprint: "ABCDEF"}, {Base: models.Base{ID: "beef"}, Fingerprint: "beef"}})
+		if err != nil {
+			t.Fatalf("%s: ingest users: %v", name, err)
+		}
+		if users.Accepted != 1 || users.Duplicates != 1 {
+			t.Fatalf("%s: unexpected user counts %+v", name, users)
+		}
+	}
+
+	// Both stores took the same items, and the SQL buckets and cached
+	// hashes kept up with the batch inserts
+	sqlHashes, _ := sqlStore.Hashes()
+	memHashes, _ := memStore.Hashes()
+	if sqlHashes != memHashes {
+		t.Fatalf("hashes differ:\nsql    %+v\nmemory %+v", sqlHashes, memHashes)
+	}
+	rescanned, err := NewSQL(sqlStore.(*SQLStore).DB()).Hashes()
+	if err != nil {
+		t.Fatalf("rescanned hashes: %v", err)
+	}
+	if rescanned != sqlHashes {
+		t.Fatalf("incremental hashes drifted:\nincremental %+v\nrescanned   %+v", sqlHashes, rescanned)
+	}
+	day, _ := models.ParseSyncRange("D2025-06-01")
+	sqlCount, _ := sqlStore.CountMessagesInPeriod(day.Period())
+	memCount, _ := memStore.CountMessagesInPeriod(day.Period())
+	if sqlCount != memCount || sqlCount != 6 {
+		t.Fatalf("expected 6 messages in both stores, got %d and %d", sqlCount, memCount)
+	}
+}
+
+func TestIngestRejectsUsersWithTakenIDs(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range map[string]Store{"sql": newSQLiteStore(t), "memory": newMemoryStore(t)} {
+		seed(t, store, base)
+
+		// A new fingerprint under the ID of a stored user, and two new
+		// fingerprints sharing an ID
+		batch := []models.User{
+			{Base: models.Base{ID: "c0ffee", CreatedAt: base}, Fingerprint: "decaf"},
+			{Base: models.Base{ID: "beef", CreatedAt: base}, Fingerprint: "beef"},
+			{Base: models.Base{ID: "beef", CreatedAt: base}, Fingerprint: "f00d"},
+			{Base: models.Base{ID: "ABCDEF", CreatedAt: base}, Fingerprint: "ABCDEF"},
+		}
+		report, err := store.IngestUsers(batch)
+		if err != nil {
+			t.Fatalf("%s: ingest users: %v", name, err)
+		}
+		want := []models.IngestStatus{models.IngestRejected, models.IngestAccepted, models.IngestRejected, models.IngestDuplicate}
+		for i, item := range report.Items {
+			if item.ID != batch[i].Fingerprint || item.Status != want[i] {
+				t.Fatalf("%s: item %d: expected %s %s, got %+v", name, i, batch[i].Fingerprint, want[i], item)
+			}
+		}
+
+		// The stored user keeps its fingerprint
+		if _, err := store.UserByFingerprint("decaf"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected the colliding user not to be stored, got %v", name, err)
+		}
+		if user, err := store.UserByFingerprint("c0ffee"); err != nil || user.ID != "c0ffee" {
+			t.Fatalf("%s: expected c0ffee to stay stored, got %+v, %v", name, user, err)
+		}
+	}
+}
+
+func TestIngestRejectsInvalidItems(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	// Hooks run, so content is validated
+	for name, store := range map[string]Store{"sql": NewSQL(db), "memory": NewMemory()} {
+		report, err := store.IngestBulletins([]models.Bulletin{{CreateBulletin: models.CreateBulletin{Content: "not signed"}}})
+		if err != nil {
+			t.Fatalf("%s: ingest bulletins: %v", name, err)
+		}
+		if report.Rejected != 1 || report.Items[0].Status != models.IngestRejected || report.Items[0].Error == "" {
+			t.Fatalf("%s: expected the bulletin to be rejected, got %+v", name, report)
+		}
+		if bulletins, _ := store.Bulletins(); len(bulletins) != 0 {
+			t.Fatalf("%s: expected nothing stored, got %d bulletins", name, len(bulletins))
+		}
+	}
+}
+
+func TestSyncJournal(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range map[string]Store{"sql": newSQLiteStore(t), "memory": newMemoryStore(t)} {
+		first := models.SyncSession{PeerAddress: "10.0.0.2", Direction: models.SyncOutgoing, StartedAt: base}
+		second := models.SyncSession{PeerAddress: "10.0.0.3", Direction: models.SyncIncoming, StartedAt: base.Add(time.Minute)}
+		for _, session := range []*models.SyncSession{&first, &second} {
+			if err := store.SaveSyncSession(session); err != nil {
+				t.Fatalf("%s: save session: %v", name, err)
+			}
+		}
+		if first.ID == 0 || first.ID == second.ID {
+			t.Fatalf("%s: expected distinct IDs, got %d and %d", name, first.ID, second.ID)
+		}
+
+		// Saving again updates the session in place
+		first.Rounds = 3
+		first.Received.Messages = 7
+		if err := store.SaveSyncSession(&first); err != nil {
+			t.Fatalf("%s: update session: %v", name, err)
+		}
+
+		sessions, err := store.SyncSessions("", 10)
+		if err != nil {
+			t.Fatalf("%s: sessions: %v", name, err)
+		}
+		if len(sessions) != 2 || sessions[0].ID != second.ID || sessions[1].Rounds != 3 || sessions[1].Received.Messages != 7 {
+			t.Fatalf("%s: unexpected sessions %+v", name, sessions)
+		}
+		sessions, err = store.SyncSessions("10.0.0.2", 10)
+		if err != nil {
+			t.Fatalf("%s: peer sessions: %v", name, err)
+		}
+		if len(sessions) != 1 || sessions[0].ID != first.ID {
+			t.Fatalf("%s: expected only the session with 10.0.0.2, got %+v", name, sessions)
+		}
+
+		// Peers are keyed by node ID or advertised port, and found by either
+		// their key or their host
+		keyed := models.SyncSession{PeerAddress: models.SyncPeer("axial-b", "10.0.0.4:8080"), Direction: models.SyncOutgoing, StartedAt: base.Add(2 * time.Minute)}
+		ported := models.SyncSession{PeerAddress: models.SyncPeer("", "10.0.0.4:8081"), Direction: models.SyncIncoming, StartedAt: base.Add(3 * time.Minute)}
+		other := models.SyncSession{PeerAddress: models.SyncPeer("axial-c", "10.0.0.40:8080"), Direction: models.SyncIncoming, StartedAt: base.Add(4 * time.Minute)}
+		for _, session := range []*models.SyncSession{&keyed, &ported, &other} {
+			if err := store.SaveSyncSession(session); err != nil {
+				t.Fatalf("%s: save session: %v", name, err)
+			}
+		}
+		sessions, err = store.SyncSessions("10.0.0.4", 10)
+		if err != nil {
+			t.Fatalf("%s: host sessions: %v", name, err)
+		}
+		if len(sessions) != 2 || sessions[0].ID != ported.ID || sessions[1].ID != keyed.ID {
+			t.Fatalf("%s: expected the sessions with nodes at 10.0.0.4, got %+v", name, sessions)
+		}
+		sessions, err = store.SyncSessions(keyed.PeerAddress, 10)
+		if err != nil {
+			t.Fatalf("%s: keyed sessions: %v", name, err)
+		}
+		if len(sessions) != 1 || sessions[0].ID != keyed.ID {
+			t.Fatalf("%s: expected only the session with %s, got %+v", name, keyed.PeerAddress, sessions)
+		}
+	}
+}
+
+func TestSyncJournalExpiry(t *testing.T) {
+	now := time.Now()
+	for name, store := range map[string]Store{"sql": newSQLiteStore(t), "memory": newMemoryStore(t)} {
+		old := models.SyncSession{PeerAddress: "10.0.0.2", Direction: models.SyncOutgoing, StartedAt: now.Add(-48 * time.Hour), EndedAt: now.Add(-47 * time.Hour)}
+		recent := models.SyncSession{PeerAddress: "10.0.0.2", Direction: models.SyncIncoming, StartedAt: now.Add(-48 * time.Hour), EndedAt: now.Add(-time.Hour)}
+		for _, session := range []*models.SyncSession{&old, &recent} {
+			if err := store.SaveSyncSession(session); err != nil {
+				t.Fatalf("%s: save session: %v", name, err)
+			}
+		}
+
+		// Sessions are expired by when they ended, not when they started
+		expired, err := store.DeleteSyncSessionsBefore(now.Add(-24 * time.Hour))
+		if err != nil {
+			t.Fatalf("%s: expire sessions: %v", name, err)
+		}
+		if expired != 1 {
+			t.Fatalf("%s: expected 1 expired session, got %d", name, expired)
+		}
+		sessions, err := store.SyncSessions("", 10)
+		if err != nil {
+			t.Fatalf("%s: sessions: %v", name, err)
+		}
+		if len(sessions) != 1 || sessions[0].ID != recent.ID {
+			t.Fatalf("%s: expected only the recent session, got %+v", name, sessions)
+		}
+
+		// New sessions get IDs of their own after others were deleted
+		next := models.SyncSession{PeerAddress: "10.0.0.3", Direction: models.SyncOutgoing, StartedAt: now, EndedAt: now}
+		if err := store.SaveSyncSession(&next); err != nil {
+			t.Fatalf("%s: save session: %v", name, err)
+		}
+		if next.ID == recent.ID || next.ID == old.ID {
+			t.Fatalf("%s: expected a new ID, got %d", name, next.ID)
+		}
+		if sessions, _ := store.SyncSessions("", 10); len(sessions) != 2 {
+			t.Fatalf("%s: expected 2 sessions, got %+v", name, sessions)
+		}
+	}
+}
+
+func TestPinnedNodeKeysAreNotReplaced(t *testing.T) {
+	for name, store := range map[string]Store{"sql": newSQLiteStore(t), "memory": newMemoryStore(t)} {
+		if err := store.PinNode(&models.KnownNode{NodeID: "axial-a", PublicKey: "aa"}); err != nil {
+			t.Fatalf("%s: pin: %v", name, err)
+		}
+		err := store.PinNode(&models.KnownNode{NodeID: "axial-a", PublicKey: "bb"})
+		if !errors.Is(err, ErrDuplicate) {
+			t.Fatalf("%s: expected ErrDuplicate pinning another key, got %v", name, err)
+		}
+		node, err := store.KnownNode("axial-a")
+		if err != nil || node.PublicKey != "aa" {
+			t.Fatalf("%s: expected the first key to stay pinned, got %+v, %v", name, node, err)
+		}
+
+		// The sending time of its newest beacon only moves forward
+		sentAt := time.Date(2025, 6, 3, 14, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+		for _, at := range []time.Time{sentAt, sentAt.Add(-time.Hour).UTC()} {
+			if err := store.AdvanceNodeSentAt("axial-a", at); err != nil {
+				t.Fatalf("%s: advance: %v", name, err)
+			}
+		}
+		node, err = store.KnownNode("axial-a")
+		if err != nil || node.LastSentAt == nil || !node.LastSentAt.Equal(sentAt) {
+			t.Fatalf("%s: expected the newest beacon to be sent at %s, got %+v, %v", name, sentAt, node, err)
+		}
+		// Unless reset, back or to nothing
+		earlier := sentAt.Add(-time.Minute)
+		if err := store.ResetNodeSentAt("axial-a", &earlier); err != nil {
+			t.Fatalf("%s: reset: %v", name, err)
+		}
+		if node, err = store.KnownNode("axial-a"); err != nil || node.LastSentAt == nil || !node.LastSentAt.Equal(earlier) {
+			t.Fatalf("%s: expected the reset sending time %s, got %+v, %v", name, earlier, node, err)
+		}
+		if err := store.ResetNodeSentAt("axial-a", nil); err != nil {
+			t.Fatalf("%s: clear: %v", name, err)
+		}
+		if node, err = store.KnownNode("axial-a"); err != nil || node.LastSentAt != nil {
+			t.Fatalf("%s: expected no sending time once cleared, got %+v, %v", name, node, err)
+		}
+		if err := store.ResetNodeSentAt("axial-b", nil); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected ErrNotFound resetting a node not pinned, got %v", name, err)
+		}
+		if count, err := store.CountKnownNodes(); err != nil || count != 1 {
+			t.Fatalf("%s: expected 1 pinned node, got %d, %v", name, count, err)
+		}
+
+		if err := store.ForgetNode("axial-a"); err != nil {
+			t.Fatalf("%s: forget: %v", name, err)
+		}
+		if err := store.ForgetNode("axial-a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected ErrNotFound forgetting twice, got %v", name, err)
+		}
+		if _, err := store.KnownNode("axial-a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected ErrNotFound once forgotten, got %v", name, err)
+		}
+	}
+}
+
+func TestIngestCountsRowsStoredMeanwhileAsDuplicates(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite memory DB: %v", err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	sqlStore := NewSQL(db.Session(&gorm.Session{SkipHooks: true}))
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Another writer stores m2 right after the lookup of the stored items
+	raced := false
+	err = db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if raced || tx.Statement.Table != "messages" {
+			return
+		}
+		raced = true
+		err := tx.Session(&gorm.Session{NewDB: true}).Exec(
+			"INSERT INTO messages (id, created_at, created_unix, content) VALUES (?, ?, ?, '')", "m2", base, base.UnixNano()).Error
+		if err != nil {
+			t.Errorf("insert as the other writer: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+
+	batch := []models.Message{}
+	for i, id := range []string{"m1", "m2", "m3"} {
+		batch = append(batch, models.Message{Base: models.Base{ID: id, CreatedAt: base.Add(time.Duration(i) * time.Minute)}})
+	}
+	report, err := sqlStore.IngestMessages(batch)
+	if err != nil {
+		t.Fatalf("ingest messages: %v", err)
+	}
+	if !raced {
+		t.Fatalf("expected the other writer to run")
+	}
+	want := []models.IngestStatus{models.IngestAccepted, models.IngestDuplicate, models.IngestAccepted}
+	for i, item := range report.Items {
+		if item.ID != batch[i].ID || item.Status != want[i] {
+			t.Fatalf("item %d: expected %s %s, got %+v", i, batch[i].ID, want[i], item)
+		}
+	}
+
+	// Only the rows this store inserted are in its bucket and hashes
+	hashes, err := sqlStore.Hashes()
+	if err != nil {
+		t.Fatalf("hashes: %v", err)
+	}
+	if want := models.HashIDs([]string{"m1", "m3"}); hashes.Messages != want {
+		t.Fatalf("expected the hash of m1 and m3, got %s", hashes.Messages)
+	}
+	hour := models.Period{Start: &base, End: nil}
+	if count, err := sqlStore.CountMessagesInPeriod(hour); err != nil || count != 2 {
+		t.Fatalf("expected 2 messages in the bucket, got %d, %v", count, err)
+	}
+}
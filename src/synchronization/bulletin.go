@@ -3,18 +3,26 @@ package synchronization
 import (
 	"fmt"
 
+	"axial/api"
 	"axial/models"
 	"axial/remote"
 )
 
-func SyncBulletins(node remote.API, bulletins []models.Bulletin) error {
+// SyncBulletins pushes bulletins the remote node is missing and returns its report of
+// what it stored
+func SyncBulletins(node remote.API, bulletins []models.Bulletin) (models.IngestReport, error) {
+	if len(bulletins) == 0 {
+		return models.IngestReport{}, nil
+	}
+
 	endpoint := node.SyncBulletins()
-	responseData, response, err := endpoint.Post(bulletins)
+	report, response, err := endpoint.Post(api.SyncBulletinsRequest{Bulletins: bulletins})
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	fmt.Printf("Received %s response from %s: %+v\n", response.Status, node.Address, responseData)
+	fmt.Printf("Received %s response from %s: ", response.Status, node.Address)
+	logIngestReport("bulletin", report)
 
-	return nil
+	return report, nil
 }
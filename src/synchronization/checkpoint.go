@@ -0,0 +1,185 @@
+package synchronization
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"axial/api"
+	"axial/models"
+	"axial/storage"
+)
+
+// checkpointer saves the progress of a session with peer. Items found
+// missing in the remote by the session it resumed were not pushed yet, so
+// they are kept in every checkpoint until the session ends.
+type checkpointer struct {
+	store     storage.Store
+	peer      string
+	messages  []models.Message
+	bulletins []models.Bulletin
+	users     []models.User
+}
+
+// resumeCheckpoint loads the items progress had left to push. Items we no
+// longer have are dropped.
+func resumeCheckpoint(store storage.Store, peer string, progress models.SyncProgress) (*checkpointer, error) {
+	c := &checkpointer{store: store, peer: peer}
+	var err error
+	if c.messages, err = store.MessagesByIDs(progress.MissingMessages); err != nil {
+		return nil, fmt.Errorf("failed to load checkpointed messages: %v", err)
+	}
+	if c.bulletins, err = store.BulletinsByIDs(progress.MissingBulletins); err != nil {
+		return nil, fmt.Errorf("failed to load checkpointed bulletins: %v", err)
+	}
+	if c.users, err = store.UsersByFingerprints(progress.MissingUsers); err != nil {
+		return nil, fmt.Errorf("failed to load checkpointed users: %v", err)
+	}
+	return c, nil
+}
+
+// saver returns the function the session loops call after every round
+func (c *checkpointer) saver(engine string) func(models.SyncProgress) error {
+	return func(progress models.SyncProgress) error {
+		progress.MissingMessages = append(messageIDs(c.messages), progress.MissingMessages...)
+		progress.MissingBulletins = append(bulletinIDs(c.bulletins), progress.MissingBulletins...)
+		progress.MissingUsers = append(userFingerprints(c.users), progress.MissingUsers...)
+		return c.store.SaveCheckpoint(&models.SyncCheckpoint{Peer: c.peer, Engine: engine, Progress: progress})
+	}
+}
+
+// loadCheckpoint expires checkpoints older than maxAge and returns the one
+// of peer, or nil if there is none
+func loadCheckpoint(store storage.Store, peer string, maxAge time.Duration) (*models.SyncCheckpoint, error) {
+	expired, err := store.DeleteCheckpointsBefore(time.Now().Add(-maxAge))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire sync checkpoints: %v", err)
+	}
+	if expired > 0 {
+		fmt.Printf("Expired %d sync checkpoints older than %s\n", expired, maxAge)
+	}
+
+	checkpoint, err := store.Checkpoint(peer)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync checkpoint: %v", err)
+	}
+	return checkpoint, nil
+}
+
+// finishCheckpoint ends the session with peer. Items in left could not be
+// pushed, they are kept for the next session; with nothing left the
+// checkpoint is deleted. A non-zero since is kept as the checkpoint's last
+// update, so that it expires since then.
+func finishCheckpoint(store storage.Store, peer string, left models.SyncProgress, since time.Time) error {
+	if len(left.MissingMessages) == 0 && len(left.MissingBulletins) == 0 && len(left.MissingUsers) == 0 {
+		return store.DeleteCheckpoint(peer)
+	}
+	fmt.Printf("Keeping %d messages, %d bulletins and %d users to push to %s next session\n",
+		len(left.MissingMessages), len(left.MissingBulletins), len(left.MissingUsers), peer)
+	// No ranges are left, so the engine does not matter
+	return store.SaveCheckpoint(&models.SyncCheckpoint{Peer: peer, Engine: api.EngineTime, Progress: left, UpdatedAt: since})
+}
+
+// hasRanges reports whether progress has ranges left to compare
+func hasRanges(progress models.SyncProgress) bool {
+	return len(progress.MessageRanges) > 0 || len(progress.BulletinRanges) > 0 ||
+		len(progress.MessageIDRanges) > 0 || len(progress.BulletinIDRanges) > 0 || len(progress.UserRanges) > 0
+}
+
+// appendNew appends to carried the items of found it does not have yet
+func appendNew[T any](carried, found []T, key func(T) string) []T {
+	seen := map[string]bool{}
+	for _, item := range carried {
+		seen[key(item)] = true
+	}
+	for _, item := range found {
+		if !seen[key(item)] {
+			seen[key(item)] = true
+			carried = append(carried, item)
+		}
+	}
+	return carried
+}
+
+// startingProgress is where a new session with engine starts: the top level
+// ranges of the engine and the whole fingerprint space, which the remote
+// splits further where it needs to.
+func startingProgress(engine string) models.SyncProgress {
+	progress := models.SyncProgress{UserRanges: []models.StringRange{models.FullFingerprintRange}}
+	if engine == api.EngineRBSR {
+		progress.MessageIDRanges = []models.StringRange{models.FullIDRange}
+		progress.BulletinIDRanges = []models.StringRange{models.FullIDRange}
+		return progress
+	}
+	for _, r := range models.TopSyncRanges(time.Now()) {
+		progress.MessageRanges = append(progress.MessageRanges, r.ID)
+	}
+	progress.BulletinRanges = progress.MessageRanges
+	return progress
+}
+
+// parseSyncRanges parses checkpointed range IDs, skipping any we do not
+// understand
+func parseSyncRanges(ids []string) []models.SyncRange {
+	ranges := []models.SyncRange{}
+	for _, id := range ids {
+		r, err := models.ParseSyncRange(id)
+		if err != nil {
+			fmt.Printf("Skipping checkpointed range: %v\n", err)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func rangeIDs(periods []models.HashedPeriod) []string {
+	ids := []string{}
+	for _, p := range periods {
+		ids = append(ids, p.RangeID)
+	}
+	return ids
+}
+
+func idRanges(hashed []models.HashedIDRange) []models.StringRange {
+	ranges := []models.StringRange{}
+	for _, h := range hashed {
+		ranges = append(ranges, h.StringRange)
+	}
+	return ranges
+}
+
+func userRanges(hashed []models.HashedUsersRange) []models.StringRange {
+	ranges := []models.StringRange{}
+	for _, h := range hashed {
+		ranges = append(ranges, h.StringRange)
+	}
+	return ranges
+}
+
+func messageIDs(messages []models.Message) []string {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func bulletinIDs(bulletins []models.Bulletin) []string {
+	ids := []string{}
+	for _, b := range bulletins {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+func userFingerprints(users []models.User) []string {
+	fingerprints := []string{}
+	for _, u := range users {
+		fingerprints = append(fingerprints, u.Fingerprint)
+	}
+	return fingerprints
+}
@@ -0,0 +1,82 @@
+package synchronization
+
+import (
+	"fmt"
+	"time"
+
+	"axial/api"
+	"axial/models"
+	"axial/remote"
+	"axial/storage"
+)
+
+// journalStore counts the items a session stores in journal, and those it
+// rejects
+type journalStore struct {
+	storage.Store
+	journal  *models.SyncSession
+	rejected int
+}
+
+func (s *journalStore) IngestUsers(users []models.User) (models.IngestReport, error) {
+	report, err := s.Store.IngestUsers(users)
+	s.journal.Received.Users += report.Accepted
+	s.rejected += report.Rejected
+	return report, err
+}
+
+func (s *journalStore) IngestMessages(messages []models.Message) (models.IngestReport, error) {
+	report, err := s.Store.IngestMessages(messages)
+	s.journal.Received.Messages += report.Accepted
+	s.rejected += report.Rejected
+	return report, err
+}
+
+func (s *journalStore) IngestBulletins(bulletins []models.Bulletin) (models.IngestReport, error) {
+	report, err := s.Store.IngestBulletins(bulletins)
+	s.journal.Received.Bulletins += report.Accepted
+	s.rejected += report.Rejected
+	return report, err
+}
+
+// journalRequester counts the rounds of a session in journal, and records
+// the engine the remote answered with
+type journalRequester struct {
+	SyncRequester
+	journal *models.SyncSession
+}
+
+func (r journalRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
+	resp, err := r.SyncRequester.RequestSync(node, req)
+	if err != nil || resp.IsBusy {
+		return resp, err
+	}
+	r.journal.Rounds++
+	r.journal.Engine = resp.Engine
+	if resp.Engine == "" {
+		r.journal.Engine = api.EngineTime
+	}
+	return resp, err
+}
+
+// saveJournal ends journal with err and stores it, then deletes the
+// sessions that ended longer than maxAge ago, if it is set. A journal that
+// cannot be stored is only logged, it must not fail the session.
+func saveJournal(store storage.Store, journal *models.SyncSession, node remote.API, err error, maxAge time.Duration) {
+	journal.BytesSent = node.Traffic.Sent()
+	journal.BytesReceived = node.Traffic.Received()
+	journal.End(err)
+	if err := store.SaveSyncSession(journal); err != nil {
+		fmt.Printf("Failed to journal sync session with %s: %v\n", journal.PeerAddress, err)
+	}
+
+	if maxAge <= 0 {
+		return
+	}
+	expired, err := store.DeleteSyncSessionsBefore(time.Now().Add(-maxAge))
+	if err != nil {
+		fmt.Printf("Failed to expire sync journal: %v\n", err)
+	} else if expired > 0 {
+		fmt.Printf("Expired %d journaled sync sessions older than %s\n", expired, maxAge)
+	}
+}
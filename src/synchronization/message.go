@@ -3,18 +3,26 @@ package synchronization
 import (
 	"fmt"
 
+	"axial/api"
 	"axial/models"
 	"axial/remote"
 )
 
-func SyncMessages(node remote.API, message []models.Message) error {
+// SyncMessages pushes messages the remote node is missing and returns its report of
+// what it stored
+func SyncMessages(node remote.API, messages []models.Message) (models.IngestReport, error) {
+	if len(messages) == 0 {
+		return models.IngestReport{}, nil
+	}
+
 	endpoint := node.SyncMessages()
-	responseData, response, err := endpoint.Post(message)
+	report, response, err := endpoint.Post(api.SyncMessagesRequest{Messages: messages})
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	fmt.Printf("Received %s response from %s: %+v\n", response.Status, node.Address, responseData)
+	fmt.Printf("Received %s response from %s: ", response.Status, node.Address)
+	logIngestReport("message", report)
 
-	return nil
+	return report, nil
 }
@@ -0,0 +1,78 @@
+package synchronization
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"axial/config"
+	"axial/models"
+	"axial/remote"
+	"axial/storage"
+)
+
+// backoffJitter spreads retry delays by up to a fifth either way
+const backoffJitter = 0.2
+
+// PeerReady reports whether peer may be synced with now, i.e. it is neither
+// backing off after failed sessions nor quarantined. Peers we know nothing
+// about are ready. Node IDs of unsigned beacons are not authenticated, so
+// no node at the host of a quarantined peer is ready.
+func PeerReady(store storage.Store, peer string) bool {
+	if quarantined, err := store.QuarantinedPeerAt(models.SyncPeerHost(peer)); err == nil {
+		fmt.Printf("Not syncing with %s, %s at its host is quarantined\n", peer, quarantined.Peer)
+		return false
+	}
+	health, err := store.PeerHealth(peer)
+	if errors.Is(err, storage.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		fmt.Printf("Failed to get health of %s: %v\n", peer, err)
+		return true
+	}
+	return health.Ready(time.Now())
+}
+
+// recordPeerHealth updates the health of node after a session with it ended
+// with err, in which we rejected rejected of the items it served. A busy
+// remote is not a failure.
+func recordPeerHealth(store storage.Store, cfg config.SyncConfig, node remote.API, err error, rejected int) {
+	peer := node.SyncPeer()
+	health, getErr := store.PeerHealth(peer)
+	if errors.Is(getErr, storage.ErrNotFound) {
+		health, getErr = &models.PeerHealth{Peer: peer}, nil
+	}
+	if getErr != nil {
+		fmt.Printf("Failed to get health of %s: %v\n", peer, getErr)
+		return
+	}
+	if node.NodeID != "" {
+		health.NodeID = node.NodeID
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		health.Succeeded(now)
+	case errors.Is(err, ErrRemoteBusy):
+	default:
+		health.Failed(err, now, models.Backoff{Base: cfg.RetryBackoff, Max: cfg.MaxRetryBackoff, Jitter: backoffJitter})
+		fmt.Printf("Sync with %s failed %d times in a row, next attempt at %s\n",
+			peer, health.ConsecutiveFailures, health.NextAttemptAt.Format(time.RFC3339))
+	}
+
+	// Only a session that went through tells that the peer served nothing
+	// invalid
+	if rejected > 0 || err == nil {
+		quarantined := health.Quarantined()
+		health.Served(rejected > 0, now, cfg.QuarantineAfter)
+		if !quarantined && health.Quarantined() {
+			fmt.Printf("Quarantining %s, it served invalid items in %d sessions in a row\n", peer, health.InvalidSessions)
+		}
+	}
+
+	if err := store.SavePeerHealth(health); err != nil {
+		fmt.Printf("Failed to save health of %s: %v\n", peer, err)
+	}
+}
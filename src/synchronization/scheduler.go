@@ -0,0 +1,215 @@
+package synchronization
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"axial/remote"
+)
+
+// SyncEvent is a peer advertising the hash of its data. Events with a
+// higher Priority run first.
+type SyncEvent struct {
+	Peer     remote.API
+	Hash     string
+	Priority int
+}
+
+// Priorities discovery gives the events of peers by how they proved who
+// they are, so that beacons anyone can forge never hold verified peers back
+const (
+	PriorityUnsigned = 0 // legacy beacons and unsigned pings
+	PrioritySigned   = 1 // signed with the key pinned to the node ID
+	PriorityTrusted  = 2 // signed with a trusted key, or the node key of a static peer
+)
+
+// lastSyncMaxAge is how long the scheduler remembers when it last synced
+// with a peer
+const lastSyncMaxAge = 24 * time.Hour
+
+// pendingEvent is the latest event of a peer waiting for a worker
+type pendingEvent struct {
+	SyncEvent
+	seenAt time.Time
+}
+
+// Scheduler runs sync sessions for the events it is given on a pool of
+// workers, so that whoever reports events never waits for a session.
+//
+// Events are deduplicated per sync peer (node ID at host): a peer has at
+// most one pending event, the latest, and at most one session running.
+// Pending events run by priority, then the peer we synced with least recently
+// first, then in the order they came. Events of peers that ready refuses when
+// their turn comes are dropped; peers keep advertising, so they come back.
+type Scheduler struct {
+	workers int
+	run     func(ctx context.Context, peer remote.API, hash string) error
+	ready   func(peer string) bool
+
+	mu       sync.Mutex
+	pending  map[string]*pendingEvent
+	running  map[string]bool
+	lastSync map[string]time.Time
+	wake     chan struct{}
+}
+
+// NewScheduler creates a scheduler running run on workers workers, for the
+// peers ready accepts
+func NewScheduler(workers int, run func(ctx context.Context, peer remote.API, hash string) error, ready func(peer string) bool) *Scheduler {
+	return &Scheduler{
+		workers:  workers,
+		run:      run,
+		ready:    ready,
+		pending:  map[string]*pendingEvent{},
+		running:  map[string]bool{},
+		lastSync: map[string]time.Time{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Enqueue schedules a session for event, replacing any pending event of the
+// same peer. It never blocks.
+func (s *Scheduler) Enqueue(event SyncEvent) {
+	peer := event.Peer.SyncPeer()
+	s.mu.Lock()
+	if previous, ok := s.pending[peer]; ok && previous.Priority > event.Priority {
+		event.Priority = previous.Priority
+	}
+	s.pending[peer] = &pendingEvent{SyncEvent: event, seenAt: time.Now()}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// Pending returns the number of events waiting for a worker
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Run runs the workers until ctx is cancelled and the sessions they are
+// running are over. Sessions are bound to sessionCtx, so that they can
+// outlive ctx.
+func (s *Scheduler) Run(ctx context.Context, sessionCtx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work(ctx, sessionCtx)
+		}()
+	}
+	workers.Wait()
+}
+
+func (s *Scheduler) work(ctx context.Context, sessionCtx context.Context) {
+	for ctx.Err() == nil {
+		event, ok := s.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			}
+			continue
+		}
+
+		err := s.run(sessionCtx, event.Peer, event.Hash)
+		if err != nil {
+			fmt.Printf("Failed to sync with %s: %v\n", event.Peer.Address, err)
+		} else {
+			fmt.Printf("Synchronized with %s\n", event.Peer.Address)
+		}
+		s.finish(event.Peer.SyncPeer())
+	}
+}
+
+// next takes the pending event to run next, if any can run now. ready may
+// query the store, so it is asked without holding the lock; the peer is
+// marked running meanwhile so that no other worker takes it.
+func (s *Scheduler) next() (SyncEvent, bool) {
+	for {
+		event, ok := s.take()
+		if !ok {
+			return SyncEvent{}, false
+		}
+		peer := event.Peer.SyncPeer()
+		if s.ready(peer) {
+			s.mu.Lock()
+			pending := len(s.pending) > 0
+			s.mu.Unlock()
+			// Let another worker look at what is left
+			if pending {
+				s.signal()
+			}
+			return event, true
+		}
+
+		fmt.Printf("Dropping sync with %s: no free session, or it is backing off or quarantined\n", event.Peer.Address)
+		s.mu.Lock()
+		delete(s.running, peer)
+		s.mu.Unlock()
+	}
+}
+
+// take removes the first pending event in order whose peer is not running,
+// and marks its peer running
+func (s *Scheduler) take() (SyncEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first *pendingEvent
+	for peer, event := range s.pending {
+		if !s.running[peer] && (first == nil || s.before(event, first)) {
+			first = event
+		}
+	}
+	if first == nil {
+		return SyncEvent{}, false
+	}
+	peer := first.Peer.SyncPeer()
+	delete(s.pending, peer)
+	s.running[peer] = true
+	return first.SyncEvent, true
+}
+
+// before reports whether a runs before b
+func (s *Scheduler) before(a, b *pendingEvent) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	lastA, lastB := s.lastSync[a.Peer.SyncPeer()], s.lastSync[b.Peer.SyncPeer()]
+	if !lastA.Equal(lastB) {
+		return lastA.Before(lastB)
+	}
+	return a.seenAt.Before(b.seenAt)
+}
+
+// finish records the end of the session with peer. Syncs older than
+// lastSyncMaxAge are forgotten, so that peers that went away are not
+// remembered forever; they order like peers never synced with.
+func (s *Scheduler) finish(peer string) {
+	s.mu.Lock()
+	delete(s.running, peer)
+	now := time.Now()
+	s.lastSync[peer] = now
+	for p, last := range s.lastSync {
+		if now.Sub(last) > lastSyncMaxAge {
+			delete(s.lastSync, p)
+		}
+	}
+	pending := len(s.pending) > 0
+	s.mu.Unlock()
+	// An event of peer may have come in while it ran
+	if pending {
+		s.signal()
+	}
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
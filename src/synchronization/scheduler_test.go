@@ -0,0 +1,226 @@
+package synchronization
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"axial/remote"
+)
+
+// recordingRun records the sessions a scheduler runs and holds each one
+// until released
+type recordingRun struct {
+	mu      sync.Mutex
+	runs    []string
+	started chan string
+	release chan struct{}
+}
+
+func newRecordingRun() *recordingRun {
+	return &recordingRun{started: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (r *recordingRun) run(ctx context.Context, peer remote.API, hash string) error {
+	r.mu.Lock()
+	r.runs = append(r.runs, peer.Address+"="+hash)
+	r.mu.Unlock()
+	r.started <- peer.Address
+	<-r.release
+	return nil
+}
+
+func waitStarted(t *testing.T, r *recordingRun) string {
+	t.Helper()
+	select {
+	case peer := <-r.started:
+		return peer
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a session to start")
+		return ""
+	}
+}
+
+func TestSchedulerDeduplicatesAndOrders(t *testing.T) {
+	r := newRecordingRun()
+	s := NewScheduler(1, r.run, func(string) bool { return true })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(done)
+	}()
+
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.1:8080"}, Hash: "h1"})
+	waitStarted(t, r)
+
+	// While the only worker is busy: b is deduplicated to its latest hash,
+	// c has priority, and a waits for its running session to end
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.2:8080"}, Hash: "h1"})
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.3:8080"}, Hash: "h1", Priority: 1})
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.2:8080"}, Hash: "h2"})
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.1:8080"}, Hash: "h3"})
+	if pending := s.Pending(); pending != 3 {
+		t.Fatalf("expected 3 pending events, got %d", pending)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.release <- struct{}{}
+		waitStarted(t, r)
+	}
+	r.release <- struct{}{}
+	cancel()
+	<-done
+
+	// a ran last since it synced most recently
+	want := []string{"10.0.0.1:8080=h1", "10.0.0.3:8080=h1", "10.0.0.2:8080=h2", "10.0.0.1:8080=h3"}
+	if len(r.runs) != len(want) {
+		t.Fatalf("expected runs %v, got %v", want, r.runs)
+	}
+	for i := range want {
+		if r.runs[i] != want[i] {
+			t.Fatalf("expected runs %v, got %v", want, r.runs)
+		}
+	}
+}
+
+func TestSchedulerRunsPrioritisedEventsFirst(t *testing.T) {
+	r := newRecordingRun()
+	s := NewScheduler(1, r.run, func(string) bool { return true })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(done)
+	}()
+
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.1:8080"}, Hash: "h"})
+	waitStarted(t, r)
+
+	// The trusted event overtakes the older unsigned one, which keeps its
+	// place among events of its own priority
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.2:8080"}, Hash: "h", Priority: PriorityUnsigned})
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.3:8080"}, Hash: "h", Priority: PriorityUnsigned})
+	time.Sleep(10 * time.Millisecond)
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.4:8080"}, Hash: "h", Priority: PriorityTrusted})
+	for i := 0; i < 3; i++ {
+		r.release <- struct{}{}
+		waitStarted(t, r)
+	}
+	r.release <- struct{}{}
+	cancel()
+	<-done
+
+	want := []string{"10.0.0.1:8080=h", "10.0.0.4:8080=h", "10.0.0.2:8080=h", "10.0.0.3:8080=h"}
+	if len(r.runs) != len(want) {
+		t.Fatalf("expected runs %v, got %v", want, r.runs)
+	}
+	for i := range want {
+		if r.runs[i] != want[i] {
+			t.Fatalf("expected runs %v, got %v", want, r.runs)
+		}
+	}
+}
+
+func TestSchedulerRunsWorkersConcurrently(t *testing.T) {
+	r := newRecordingRun()
+	ready := func(peer string) bool { return peer != "10.0.0.9:8080" }
+	s := NewScheduler(2, r.run, ready)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(done)
+	}()
+
+	for _, address := range []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"} {
+		s.Enqueue(SyncEvent{Peer: remote.API{Address: address}, Hash: "h"})
+	}
+	waitStarted(t, r)
+	waitStarted(t, r)
+	select {
+	case peer := <-r.started:
+		t.Fatalf("expected 2 sessions at most, %s started a third", peer)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Peers that are not ready are dropped when their turn comes, here
+	// before 10.0.0.3's
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.9:8080"}, Hash: "h", Priority: 1})
+	r.release <- struct{}{}
+	waitStarted(t, r)
+	r.release <- struct{}{}
+	r.release <- struct{}{}
+	cancel()
+	<-done
+
+	if len(r.runs) != 3 || s.Pending() != 0 {
+		t.Fatalf("expected 3 runs and nothing pending, got %v and %d pending", r.runs, s.Pending())
+	}
+}
+
+func TestSchedulerAsksReadyWithoutLocking(t *testing.T) {
+	r := newRecordingRun()
+	var s *Scheduler
+	var once sync.Once
+	// ready may be slow, events keep coming in meanwhile
+	ready := func(peer string) bool {
+		once.Do(func() {
+			s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.2:8080"}, Hash: "h"})
+		})
+		return peer != "10.0.0.1:8080"
+	}
+	s = NewScheduler(1, r.run, ready)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(done)
+	}()
+
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "10.0.0.1:8080"}, Hash: "h"})
+	if peer := waitStarted(t, r); peer != "10.0.0.2:8080" {
+		t.Fatalf("expected 10.0.0.2 to sync, got %s", peer)
+	}
+	r.release <- struct{}{}
+	cancel()
+	<-done
+
+	if len(r.runs) != 1 || s.Pending() != 0 {
+		t.Fatalf("expected 1 run and nothing pending, got %v and %d pending", r.runs, s.Pending())
+	}
+}
+
+func TestSchedulerForgetsOldSyncs(t *testing.T) {
+	s := NewScheduler(1, nil, nil)
+	s.lastSync["10.0.0.1"] = time.Now().Add(-lastSyncMaxAge - time.Minute)
+	s.lastSync["10.0.0.2"] = time.Now().Add(-time.Minute)
+	s.running["10.0.0.3"] = true
+
+	s.finish("10.0.0.3")
+	if _, ok := s.lastSync["10.0.0.1"]; ok || len(s.lastSync) != 2 {
+		t.Fatalf("expected only recent syncs to be remembered, got %v", s.lastSync)
+	}
+}
+
+func TestSchedulerRunsPeersOnOneHostApart(t *testing.T) {
+	r := newRecordingRun()
+	s := NewScheduler(2, r.run, func(string) bool { return true })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(done)
+	}()
+
+	// Two nodes on 127.0.0.1 are not deduplicated into one
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "127.0.0.1:8080", NodeID: "axial-a"}, Hash: "h"})
+	s.Enqueue(SyncEvent{Peer: remote.API{Address: "127.0.0.1:8081", NodeID: "axial-b"}, Hash: "h"})
+	waitStarted(t, r)
+	waitStarted(t, r)
+	r.release <- struct{}{}
+	r.release <- struct{}{}
+	cancel()
+	<-done
+}
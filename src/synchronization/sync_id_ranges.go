@@ -0,0 +1,153 @@
+package synchronization
+
+import (
+	"errors"
+	"fmt"
+
+	"axial/api"
+	"axial/models"
+	"axial/remote"
+	"axial/storage"
+)
+
+// ErrEngineUnsupported is returned when the remote node answered a request
+// without using the engine it asked for, i.e. it predates that engine.
+var ErrEngineUnsupported = errors.New("sync engine not supported by remote")
+
+// SyncIDRangesWithRequester runs a session with the range-based set
+// reconciliation engine (api.EngineRBSR), starting from the given
+// fingerprints. Each round sends our fingerprints of the ranges the remote
+// split. Content types converge independently, as in SyncWithRequester. It
+// returns the items present locally but missing in the remote.
+//
+// If the remote does not speak the engine, ErrEngineUnsupported is returned
+// before anything is ingested, so the caller can fall back to the time
+// engine. If it is busy, ErrRemoteBusy is returned, and if it keeps ranges
+// mismatching for too long, ErrTooManyRounds.
+func SyncIDRangesWithRequester(store storage.Store, requester SyncRequester, node remote.API, hashedMessages []models.HashedIDRange, hashedBulletins []models.HashedIDRange, hashedUsers []models.HashedUsersRange) ([]models.Message, []models.Bulletin, []models.User, error) {
+	return syncIDRanges(store, requester, node, hashedMessages, hashedBulletins, hashedUsers, nil)
+}
+
+// syncIDRanges runs the rounds of SyncIDRangesWithRequester, calling
+// checkpoint, if set, with what is left to do after every round
+func syncIDRanges(store storage.Store, requester SyncRequester, node remote.API, hashedMessages []models.HashedIDRange, hashedBulletins []models.HashedIDRange, hashedUsers []models.HashedUsersRange, checkpoint func(models.SyncProgress) error) ([]models.Message, []models.Bulletin, []models.User, error) {
+	messagesMissingInRemote := []models.Message{}
+	bulletinsMissingInRemote := []models.Bulletin{}
+	usersMissingInRemote := []models.User{}
+
+	for round := 1; len(hashedMessages) > 0 || len(hashedBulletins) > 0 || len(hashedUsers) > 0; round++ {
+		if round > maxSessionRounds {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, ErrTooManyRounds
+		}
+		syncRequest := api.SyncRequest{
+			Engine:           api.EngineRBSR,
+			MessageIDRanges:  hashedMessages,
+			BulletinIDRanges: hashedBulletins,
+			Users:            hashedUsers,
+		}
+
+		fmt.Printf("Sending ID range sync request %d to %s\n", round, node.Address)
+		syncResponse, err := requester.RequestSync(node, syncRequest)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
+
+		if syncResponse.IsBusy {
+			// Wait until another time.
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, ErrRemoteBusy
+		}
+		if syncResponse.Engine != api.EngineRBSR {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, ErrEngineUnsupported
+		}
+
+		// Messages
+		for _, messagesRange := range syncResponse.MessagesByID {
+			ourMessages, err := store.MessagesInIDRange(messagesRange.StringRange)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get messages by ID range: %v", err)
+			}
+			missing, err := ingestMessages(store, ourMessages, messagesRange.Messages)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+			}
+			messagesMissingInRemote = append(messagesMissingInRemote, missing...)
+		}
+		hashedMessages, err = mismatchedIDRanges(syncResponse.MessageIDRanges, store.MessageIDs)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get message IDs: %v", err)
+		}
+
+		// Bulletins
+		for _, bulletinsRange := range syncResponse.BulletinsByID {
+			ourBulletins, err := store.BulletinsInIDRange(bulletinsRange.StringRange)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get bulletins by ID range: %v", err)
+			}
+			missing, err := ingestBulletins(store, ourBulletins, bulletinsRange.Bulletins)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+			}
+			bulletinsMissingInRemote = append(bulletinsMissingInRemote, missing...)
+		}
+		hashedBulletins, err = mismatchedIDRanges(syncResponse.BulletinIDRanges, store.BulletinIDs)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get bulletin IDs: %v", err)
+		}
+
+		// Users
+		missingUsers, userRangesToCheck, err := reconcileUsers(store, syncResponse)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
+		usersMissingInRemote = append(usersMissingInRemote, missingUsers...)
+		hashedUsers = userRangesToCheck
+
+		// Types whose hashes already agree are done, whatever ranges are left
+		done, err := convergedTypes(store, syncResponse.Hashes)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
+		if done.messages {
+			hashedMessages = nil
+		}
+		if done.bulletins {
+			hashedBulletins = nil
+		}
+		if done.users {
+			hashedUsers = nil
+		}
+
+		if checkpoint != nil {
+			err := checkpoint(models.SyncProgress{
+				MessageIDRanges:  idRanges(hashedMessages),
+				BulletinIDRanges: idRanges(hashedBulletins),
+				UserRanges:       userRanges(hashedUsers),
+				MissingMessages:  messageIDs(messagesMissingInRemote),
+				MissingBulletins: bulletinIDs(bulletinsMissingInRemote),
+				MissingUsers:     userFingerprints(usersMissingInRemote),
+			})
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to save sync checkpoint: %v", err)
+			}
+		}
+	}
+
+	return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, nil
+}
+
+// mismatchedIDRanges returns our fingerprints of the remote's ranges that
+// differ from the remote's
+func mismatchedIDRanges(theirs []models.HashedIDRange, idsIn func(models.StringRange) ([]string, error)) ([]models.HashedIDRange, error) {
+	out := []models.HashedIDRange{}
+	for _, theirRange := range theirs {
+		ids, err := idsIn(theirRange.StringRange)
+		if err != nil {
+			return nil, err
+		}
+		ours := models.HashIDRange(theirRange.StringRange, ids)
+		if !ours.Matches(theirRange) {
+			out = append(out, ours)
+		}
+	}
+	return out, nil
+}
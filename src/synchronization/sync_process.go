@@ -2,17 +2,35 @@ package synchronization
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"axial/api"
+	"axial/config"
 	"axial/models"
 	"axial/remote"
+	"axial/storage"
 )
 
+// ErrRemoteBusy is returned when the remote refused a round of a session for
+// lack of a free session. The session can be resumed from its checkpoint.
+var ErrRemoteBusy = errors.New("remote node is busy")
+
+// maxSessionRounds caps the rounds of a session. Every round goes one level
+// down the range trees, which are five levels of time ranges and one level
+// per character of a fingerprint or ID prefix, so a remote that keeps a
+// session going longer is not converging.
+const maxSessionRounds = 64
+
+// ErrTooManyRounds is returned when a session did not converge within
+// maxSessionRounds rounds
+var ErrTooManyRounds = fmt.Errorf("sync session did not converge in %d rounds", maxSessionRounds)
+
 // SyncRequester abstracts how a sync request is sent to a remote node.
 // Production uses HTTP; tests can provide an in-memory implementation to
 // simulate back-and-forth exchanges without network or servers.
@@ -21,16 +39,22 @@ type SyncRequester interface {
 }
 
 // httpSyncRequester implements SyncRequester over HTTP to the node's address.
+// Requests are bound to Ctx so that a shutdown aborts a session in flight,
+// and name us by NodeID.
 type httpSyncRequester struct {
 	Client *http.Client
+	Ctx    context.Context
+	NodeID string
 }
 
 func (h httpSyncRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
+	req.NodeID = h.NodeID
 	jsonRequest, err := json.Marshal(req)
 	if err != nil {
 		return api.SyncResponse{}, err
 	}
 
+	node.Traffic.AddSent(len(jsonRequest))
 	response, err := h.httpPost(node, jsonRequest)
 	if err != nil {
 		return api.SyncResponse{}, fmt.Errorf("failed to send sync request: %v", err)
@@ -38,7 +62,7 @@ func (h httpSyncRequester) RequestSync(node remote.API, req api.SyncRequest) (ap
 	defer response.Body.Close()
 
 	var syncResponse api.SyncResponse
-	err = json.NewDecoder(response.Body).Decode(&syncResponse)
+	err = json.NewDecoder(node.Traffic.CountBody(response.Body)).Decode(&syncResponse)
 	if err != nil {
 		return api.SyncResponse{}, fmt.Errorf("failed to decode sync response: %v", err)
 	}
@@ -50,11 +74,33 @@ func (h httpSyncRequester) httpPost(node remote.API, jsonRequest []byte) (*http.
 	if client == nil {
 		client = http.DefaultClient
 	}
-	return client.Post(fmt.Sprintf("http://%s/v1/sync", node.Address), "application/json", bytes.NewBuffer(jsonRequest))
+	ctx := h.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	endpoint := node.Sync()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL().String(), bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range node.Header {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return client.Do(request)
 }
 
-func StartSync(node remote.API, hash string) error {
-	hashes, err := models.GetDatabaseHashes(models.DB)
+// StartSync runs a full sync session with node using the local store and sync
+// state. Cancelling ctx aborts the session between requests; whatever was
+// ingested so far is kept, and the session's progress is checkpointed so
+// that the next session with node resumes it.
+//
+// cfg.Sync.Engine is the sync engine to try first. If node does not support
+// api.EngineRBSR the session falls back to api.EngineTime.
+func StartSync(ctx context.Context, store storage.Store, state *models.SyncState, node remote.API, hash string, cfg config.Config) (err error) {
+	hashes, err := state.GetDatabaseHashes(store)
 	if err != nil {
 		return err
 	}
@@ -63,49 +109,165 @@ func StartSync(node remote.API, hash string) error {
 		return nil
 	}
 
-	if !models.StartSync() {
-		return fmt.Errorf("failed to start sync")
+	peer := node.SyncPeer()
+	if !state.StartSync(peer) {
+		return fmt.Errorf("failed to start sync: already syncing with %s or no free session (%+v)", peer, state.Capacity())
 	}
-	defer models.EndSync()
+	defer state.EndSync(peer)
+	// Whatever we ingested changes our hashes
+	defer state.RefreshHashes(store)
 
-	periods, stringRanges := startingSyncRanges()
-	hashedMessagesPeriods, err := models.GetMessagesHashRanges(models.DB, periods)
-	if err != nil {
-		return err
-	}
+	fmt.Printf("Synchronizing with %s\n", node.Address)
 
-	hashedBulletinsPeriods, err := models.GetBulletinsHashRanges(models.DB, periods)
+	node.Traffic = &remote.Traffic{}
+	node.Header = api.PeerHeader(cfg.NodeID, cfg.APIPort)
+	journal := &models.SyncSession{
+		PeerNodeID:  node.NodeID,
+		PeerAddress: peer,
+		Direction:   models.SyncOutgoing,
+		StartedAt:   time.Now(),
+	}
+	sessionStore := &journalStore{Store: store, journal: journal}
+
+	// Failed pushes do not fail the session, but are journaled and count
+	// against the peer's health. Sessions we abort do not.
+	pushErrs := []error{}
+	defer func() {
+		sessionErr := errors.Join(append([]error{err}, pushErrs...)...)
+		saveJournal(store, journal, node, sessionErr, cfg.Sync.JournalMaxAge)
+		if ctx.Err() == nil {
+			recordPeerHealth(store, cfg.Sync, node, sessionErr, sessionStore.rejected)
+		}
+	}()
+
+	// Use HTTP requester by default in production flows.
+	requester := journalRequester{SyncRequester: httpSyncRequester{Ctx: ctx, NodeID: cfg.NodeID}, journal: journal}
+	messages, bulletins, users, pendingSince, err := syncSession(sessionStore, requester, node, cfg.Sync.Engine, cfg.Sync.CheckpointMaxAge)
 	if err != nil {
 		return err
 	}
 
-	hashedUsers, err := models.GetUsersHashRanges(models.DB, stringRanges)
-	if err != nil {
+	// Don't start pushing data if we were asked to stop
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	fmt.Printf("Synchronizing with %s\n", node.Address)
+	// Items that fail to push stay in the checkpoint for the next session
+	left := models.SyncProgress{}
 
-	// Use HTTP requester by default in production flows.
-	messages, bulletins, users, err := Sync(node, hashedMessagesPeriods, hashedBulletinsPeriods, hashedUsers)
+	report, err := SyncUsers(node, users)
 	if err != nil {
-		return err
+		fmt.Printf("Failed to push users to %s: %v\n", node.Address, err)
+		left.MissingUsers = userFingerprints(users)
+		pushErrs = append(pushErrs, fmt.Errorf("failed to push users: %v", err))
 	}
-
-	SyncUsers(node, users)
+	journal.Sent.Users = report.Accepted
 
 	// Sort messages by creation time
 	SortMessages(messages)
 
 	// Send messages unique to this node to the remote node
-	SyncMessages(node, messages)
+	report, err = SyncMessages(node, messages)
+	if err != nil {
+		fmt.Printf("Failed to push messages to %s: %v\n", node.Address, err)
+		left.MissingMessages = messageIDs(messages)
+		pushErrs = append(pushErrs, fmt.Errorf("failed to push messages: %v", err))
+	}
+	journal.Sent.Messages = report.Accepted
 
 	SortBulletins(bulletins)
 
 	// Send bulletins unique to this node to the remote node
-	SyncBulletins(node, bulletins)
+	report, err = SyncBulletins(node, bulletins)
+	if err != nil {
+		fmt.Printf("Failed to push bulletins to %s: %v\n", node.Address, err)
+		left.MissingBulletins = bulletinIDs(bulletins)
+		pushErrs = append(pushErrs, fmt.Errorf("failed to push bulletins: %v", err))
+	}
+	journal.Sent.Bulletins = report.Accepted
 
-	return nil
+	return finishCheckpoint(store, peer, left, pendingSince)
+}
+
+// syncSession reconciles store with node, using engine or, if node does not
+// support it, the time engine. It resumes the checkpoint of an unfinished
+// session with node if there is one no older than maxAge, and starts from
+// the top level ranges otherwise. It returns the items present locally but
+// missing in the remote, including those the resumed session had found.
+//
+// A checkpoint left with only items to push has no ranges to resume, so the
+// session starts over from the top level ranges and carries its items
+// forward. pendingSince is when they were first left behind, which the
+// checkpoint saved after pushing keeps so that retrying the pushes alone
+// does not keep it from expiring; it is zero otherwise.
+func syncSession(store storage.Store, requester SyncRequester, node remote.API, engine string, maxAge time.Duration) (messages []models.Message, bulletins []models.Bulletin, users []models.User, pendingSince time.Time, err error) {
+	peer := node.SyncPeer()
+	progress := startingProgress(engine)
+	checkpoint, err := loadCheckpoint(store, peer, maxAge)
+	if err != nil {
+		return nil, nil, nil, time.Time{}, err
+	}
+	if checkpoint != nil && !hasRanges(checkpoint.Progress) {
+		fmt.Printf("Retrying the pushes of the %s sync session with %s saved at %s\n", checkpoint.Engine, peer, checkpoint.UpdatedAt.Format(time.RFC3339))
+		pendingSince = checkpoint.UpdatedAt
+		progress.MissingMessages = checkpoint.Progress.MissingMessages
+		progress.MissingBulletins = checkpoint.Progress.MissingBulletins
+		progress.MissingUsers = checkpoint.Progress.MissingUsers
+	} else if checkpoint != nil {
+		fmt.Printf("Resuming %s sync session with %s saved at %s\n", checkpoint.Engine, peer, checkpoint.UpdatedAt.Format(time.RFC3339))
+		engine = checkpoint.Engine
+		progress = checkpoint.Progress
+	}
+
+	c, err := resumeCheckpoint(store, peer, progress)
+	if err != nil {
+		return nil, nil, nil, time.Time{}, err
+	}
+
+	messages, bulletins, users, err = runSession(store, requester, node, engine, progress, c)
+	if engine == api.EngineRBSR && errors.Is(err, ErrEngineUnsupported) {
+		fmt.Printf("%s does not support the %s sync engine, falling back to %s\n", node.Address, api.EngineRBSR, api.EngineTime)
+		messages, bulletins, users, err = runSession(store, requester, node, api.EngineTime, startingProgress(api.EngineTime), c)
+	}
+
+	// Starting over finds the carried items again if they are still missing
+	messages = appendNew(c.messages, messages, func(m models.Message) string { return m.ID })
+	bulletins = appendNew(c.bulletins, bulletins, func(b models.Bulletin) string { return b.ID })
+	users = appendNew(c.users, users, func(u models.User) string { return u.Fingerprint })
+	return messages, bulletins, users, pendingSince, err
+}
+
+// runSession runs the rounds of a session with engine from the ranges of
+// progress, hashed with our current data
+func runSession(store storage.Store, requester SyncRequester, node remote.API, engine string, progress models.SyncProgress, c *checkpointer) ([]models.Message, []models.Bulletin, []models.User, error) {
+	hashedUsers, err := storage.UsersHashRanges(store, progress.UserRanges)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if engine == api.EngineRBSR {
+		hashedMessages, err := storage.MessagesHashIDRanges(store, progress.MessageIDRanges)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		hashedBulletins, err := storage.BulletinsHashIDRanges(store, progress.BulletinIDRanges)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return syncIDRanges(store, requester, node, hashedMessages, hashedBulletins, hashedUsers, c.saver(api.EngineRBSR))
+	}
+
+	hashedMessagesPeriods, err := storage.MessagesHashRanges(store, parseSyncRanges(progress.MessageRanges))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	hashedBulletinsPeriods, err := storage.BulletinsHashRanges(store, parseSyncRanges(progress.BulletinRanges))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return syncTimeRanges(store, requester, node, hashedMessagesPeriods, hashedBulletinsPeriods, hashedUsers, c.saver(api.EngineTime))
 }
 
 func SortMessages(messages []models.Message) {
@@ -133,131 +295,241 @@ func SortBulletins(bulletins []models.Bulletin) {
 //
 // For unit tests, prefer calling SyncWithRequester with a custom requester that
 // uses in-memory handlers to return api.SyncResponse.
-func Sync(node remote.API, hashedMessagePeriods []models.HashedPeriod, hashedBulletinPeriods []models.HashedPeriod, hashedUsers []models.HashedUsersRange) ([]models.Message, []models.Bulletin, []models.User, error) {
-	return SyncWithRequester(httpSyncRequester{}, node, hashedMessagePeriods, hashedBulletinPeriods, hashedUsers)
+func Sync(store storage.Store, node remote.API, hashedMessagePeriods []models.HashedPeriod, hashedBulletinPeriods []models.HashedPeriod, hashedUsers []models.HashedUsersRange) ([]models.Message, []models.Bulletin, []models.User, error) {
+	return SyncWithRequester(store, httpSyncRequester{}, node, hashedMessagePeriods, hashedBulletinPeriods, hashedUsers)
 }
 
 // SyncWithRequester is identical to Sync but allows the caller to provide a
 // pluggable requester for testability.
-func SyncWithRequester(requester SyncRequester, node remote.API, hashedMessagesPeriods []models.HashedPeriod, hashedBulletinPeriods []models.HashedPeriod, hashedUsers []models.HashedUsersRange) ([]models.Message, []models.Bulletin, []models.User, error) {
-	if len(hashedMessagesPeriods) == 0 {
-		fmt.Printf("No periods to sync with %s\n", node.Address)
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, nil
-	}
+//
+// Each content type is reconciled on its own: it drops out of the session
+// once none of its ranges mismatch, or once the remote's hash of it matches
+// ours, while the others carry on. The session ends when every type is done.
+// If the remote is busy, ErrRemoteBusy is returned with what was found so
+// far, and ErrTooManyRounds if the remote keeps ranges mismatching for
+// longer than the range tree is deep.
+func SyncWithRequester(store storage.Store, requester SyncRequester, node remote.API, hashedMessagesPeriods []models.HashedPeriod, hashedBulletinPeriods []models.HashedPeriod, hashedUsers []models.HashedUsersRange) ([]models.Message, []models.Bulletin, []models.User, error) {
+	return syncTimeRanges(store, requester, node, hashedMessagesPeriods, hashedBulletinPeriods, hashedUsers, nil)
+}
 
-	syncRequest := api.SyncRequest{
-		MessageRanges:  hashedMessagesPeriods,
-		BulletinRanges: hashedBulletinPeriods,
-		Users:          hashedUsers,
-	}
+// syncTimeRanges runs the rounds of SyncWithRequester, calling checkpoint,
+// if set, with what is left to do after every round
+func syncTimeRanges(store storage.Store, requester SyncRequester, node remote.API, hashedMessagesPeriods []models.HashedPeriod, hashedBulletinPeriods []models.HashedPeriod, hashedUsers []models.HashedUsersRange, checkpoint func(models.SyncProgress) error) ([]models.Message, []models.Bulletin, []models.User, error) {
+	messagesMissingInRemote := []models.Message{}
+	bulletinsMissingInRemote := []models.Bulletin{}
+	usersMissingInRemote := []models.User{}
 
-	// Let the requester handle the transport (HTTP in prod, in-memory in tests).
-	fmt.Printf("Sending sync request to %s\n", node.Address)
-	syncResponse, err := requester.RequestSync(node, syncRequest)
-	if err != nil {
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, err
-	}
+	for round := 1; len(hashedMessagesPeriods) > 0 || len(hashedBulletinPeriods) > 0 || len(hashedUsers) > 0; round++ {
+		if round > maxSessionRounds {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, ErrTooManyRounds
+		}
+		syncRequest := api.SyncRequest{
+			MessageRanges:  hashedMessagesPeriods,
+			BulletinRanges: hashedBulletinPeriods,
+			Users:          hashedUsers,
+		}
 
-	fmt.Printf("Received sync response from %s: %+v\n", node.Address, syncResponse)
+		// Let the requester handle the transport (HTTP in prod, in-memory in tests).
+		fmt.Printf("Sending sync request %d to %s\n", round, node.Address)
+		syncResponse, err := requester.RequestSync(node, syncRequest)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
 
-	if syncResponse.IsBusy {
-		// Wait until another time.
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, nil
-	}
+		fmt.Printf("Received sync response from %s: %+v\n", node.Address, syncResponse)
 
-	// Messages
-	messagesMissingInRemote := []models.Message{}
+		if syncResponse.IsBusy {
+			// Wait until another time.
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, ErrRemoteBusy
+		}
 
-	for _, messagesPeriod := range syncResponse.Messages {
-		ourMessages, err := models.GetMessagesByPeriod(models.DB, messagesPeriod.Period)
+		// Messages
+		for _, messagesPeriod := range syncResponse.Messages {
+			ourMessages, err := store.MessagesInPeriod(messagesPeriod.Period)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get messages by period: %v", err)
+			}
+
+			missing, err := ingestMessages(store, ourMessages, messagesPeriod.Messages)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+			}
+			messagesMissingInRemote = append(messagesMissingInRemote, missing...)
+		}
+
+		ourMessagesHashes, err := storage.MessagesHashRanges(store, syncRangesOf(syncResponse.MessageRanges))
 		if err != nil {
-			return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to get messages by period: %v", err)
-		}
-
-		for _, message := range messagesPeriod.Messages {
-			if !message.In(ourMessages) {
-				fmt.Printf("Inserting message into our database: %+v\n", message)
-				// Insert message into our database
-				if err := models.DB.Create(&message).Error; err != nil {
-					// Ignore duplicate key errors since those messages were already synced
-					if !strings.Contains(err.Error(), "duplicate key") {
-						return []models.Message{}, []models.Bulletin{}, []models.User{}, err
-					}
-				}
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to generate hash ranges: %v", err)
+		}
+		hashedMessagesPeriods = mismatchedMessagesPeriods(ourMessagesHashes, syncResponse.MessageRanges)
+
+		// Bulletins
+		for _, bulletinPeriod := range syncResponse.Bulletins {
+			ourBulletins, err := store.BulletinsInPeriod(bulletinPeriod.Period)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to get bulletins by period: %v", err)
+			}
+
+			missing, err := ingestBulletins(store, ourBulletins, bulletinPeriod.Bulletins)
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
 			}
+			bulletinsMissingInRemote = append(bulletinsMissingInRemote, missing...)
 		}
 
-		for _, message := range ourMessages {
-			if !message.In(messagesPeriod.Messages) {
-				messagesMissingInRemote = append(messagesMissingInRemote, message)
+		ourBulletinHashes, err := storage.BulletinsHashRanges(store, syncRangesOf(syncResponse.BulletinRanges))
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to generate bulletin hash ranges: %v", err)
+		}
+		hashedBulletinPeriods = mismatchedMessagesPeriods(ourBulletinHashes, syncResponse.BulletinRanges)
+
+		// Users
+		missingUsers, userRangesToCheck, err := reconcileUsers(store, syncResponse)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
+		usersMissingInRemote = append(usersMissingInRemote, missingUsers...)
+		hashedUsers = userRangesToCheck
+
+		// Types whose hashes already agree are done, whatever ranges are left
+		done, err := convergedTypes(store, syncResponse.Hashes)
+		if err != nil {
+			return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, err
+		}
+		if done.messages {
+			hashedMessagesPeriods = nil
+		}
+		if done.bulletins {
+			hashedBulletinPeriods = nil
+		}
+		if done.users {
+			hashedUsers = nil
+		}
+
+		if checkpoint != nil {
+			err := checkpoint(models.SyncProgress{
+				MessageRanges:    rangeIDs(hashedMessagesPeriods),
+				BulletinRanges:   rangeIDs(hashedBulletinPeriods),
+				UserRanges:       userRanges(hashedUsers),
+				MissingMessages:  messageIDs(messagesMissingInRemote),
+				MissingBulletins: bulletinIDs(bulletinsMissingInRemote),
+				MissingUsers:     userFingerprints(usersMissingInRemote),
+			})
+			if err != nil {
+				return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, fmt.Errorf("failed to save sync checkpoint: %v", err)
 			}
 		}
 	}
 
-	periodsForRemoteMessagesHashes := []models.Period{}
-	for _, hashedPeriod := range syncResponse.MessageRanges {
-		periodsForRemoteMessagesHashes = append(periodsForRemoteMessagesHashes, hashedPeriod.Period)
-	}
+	fmt.Printf("No periods left to sync with %s\n", node.Address)
+	return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, nil
+}
+
+// converged tells which content types hold the same items on both sides of
+// a session
+type converged struct {
+	messages  bool
+	bulletins bool
+	users     bool
+}
 
-	ourMessagesHashes, err := models.GetMessagesHashRanges(models.DB, periodsForRemoteMessagesHashes)
+// convergedTypes compares the per-type hashes the remote sent with its
+// response with ours. A remote that sent no hashes has converged on nothing.
+func convergedTypes(store storage.Store, theirs models.HashSet) (converged, error) {
+	if theirs.Full == "" {
+		return converged{}, nil
+	}
+	ours, err := store.Hashes()
 	if err != nil {
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to generate hash ranges: %v", err)
+		return converged{}, fmt.Errorf("failed to get database hashes: %v", err)
 	}
+	return converged{
+		messages:  ours.Messages == theirs.Messages,
+		bulletins: ours.Bulletins == theirs.Bulletins,
+		users:     ours.Users == theirs.Users,
+	}, nil
+}
 
-	hashedMessagesPeriodsToCheck := mismatchedMessagesPeriods(ourMessagesHashes, syncResponse.MessageRanges)
-
-	// Bulletins
-	bulletinsMissingInRemote := []models.Bulletin{}
-
-	for _, bulletinPeriod := range syncResponse.Bulletins {
-		ourBulletins, err := models.GetBulletinsByPeriod(models.DB, bulletinPeriod.Period)
+// ingestMessages stores the messages the remote sent for a range in one
+// batch and returns those of ours in the same range that the remote does not
+// have
+func ingestMessages(store storage.Store, ourMessages []models.Message, theirMessages []models.Message) ([]models.Message, error) {
+	newMessages := []models.Message{}
+	for _, message := range theirMessages {
+		if !message.In(ourMessages) {
+			newMessages = append(newMessages, message)
+		}
+	}
+	if len(newMessages) > 0 {
+		report, err := store.IngestMessages(newMessages)
 		if err != nil {
-			return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to get bulletins by period: %v", err)
-		}
-
-		for _, bulletin := range bulletinPeriod.Bulletins {
-			if !bulletin.In(ourBulletins) {
-				fmt.Printf("Inserting bulletin into our database: %+v\n", bulletin)
-				// Insert bulletin into our database
-				if err := models.DB.Create(&bulletin).Error; err != nil {
-					// Ignore duplicate key errors since those bulletins were already synced
-					if !strings.Contains(err.Error(), "duplicate key") {
-						return []models.Message{}, []models.Bulletin{}, []models.User{}, err
-					}
-				}
-			}
+			return nil, fmt.Errorf("failed to ingest messages: %v", err)
 		}
+		logIngestReport("message", report)
+	}
 
-		for _, bulletin := range ourBulletins {
-			if !bulletin.In(bulletinPeriod.Bulletins) {
-				bulletinsMissingInRemote = append(bulletinsMissingInRemote, bulletin)
-			}
+	missing := []models.Message{}
+	for _, message := range ourMessages {
+		if !message.In(theirMessages) {
+			missing = append(missing, message)
 		}
 	}
+	return missing, nil
+}
 
-	periodsForRemoteBulletinHashes := []models.Period{}
-	for _, hashedPeriod := range syncResponse.BulletinRanges {
-		periodsForRemoteBulletinHashes = append(periodsForRemoteBulletinHashes, hashedPeriod.Period)
+// ingestBulletins stores the bulletins the remote sent for a range in one
+// batch and returns those of ours in the same range that the remote does not
+// have
+func ingestBulletins(store storage.Store, ourBulletins []models.Bulletin, theirBulletins []models.Bulletin) ([]models.Bulletin, error) {
+	newBulletins := []models.Bulletin{}
+	for _, bulletin := range theirBulletins {
+		if !bulletin.In(ourBulletins) {
+			newBulletins = append(newBulletins, bulletin)
+		}
+	}
+	if len(newBulletins) > 0 {
+		report, err := store.IngestBulletins(newBulletins)
+		if err != nil {
+			return nil, fmt.Errorf("failed to ingest bulletins: %v", err)
+		}
+		logIngestReport("bulletin", report)
 	}
 
-	ourBulletinHashes, err := models.GetBulletinsHashRanges(models.DB, periodsForRemoteBulletinHashes)
-	if err != nil {
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to generate bulletin hash ranges: %v", err)
+	missing := []models.Bulletin{}
+	for _, bulletin := range ourBulletins {
+		if !bulletin.In(theirBulletins) {
+			missing = append(missing, bulletin)
+		}
 	}
+	return missing, nil
+}
 
-	hashedBulletinPeriodsToCheck := mismatchedMessagesPeriods(ourBulletinHashes, syncResponse.BulletinRanges)
+// logIngestReport prints the outcome of a batch and why items were rejected
+func logIngestReport(name string, report models.IngestReport) {
+	fmt.Printf("Ingested %d %ss: %d accepted, %d duplicates, %d rejected\n",
+		len(report.Items), name, report.Accepted, report.Duplicates, report.Rejected)
+	for _, item := range report.Items {
+		if item.Status == models.IngestRejected {
+			fmt.Printf("Rejected %s %s: %s\n", name, item.ID, item.Error)
+		}
+	}
+}
 
-	// Users
+// reconcileUsers ingests the users of syncResponse. It returns our users the
+// remote does not have and the user ranges that still need comparing. Every
+// engine reconciles users the same way.
+func reconcileUsers(store storage.Store, syncResponse api.SyncResponse) ([]models.User, []models.HashedUsersRange, error) {
 	usersMissingInRemote := []models.User{}
 
 	// Ingest users returned by the remote for mismatching ranges
 	for _, usersRange := range syncResponse.Users {
-		ourUsers, err := models.GetUsersByFingerprintRange(models.DB, usersRange.StringRange.Start, usersRange.StringRange.End)
+		ourUsers, err := store.UsersInRange(usersRange.StringRange)
 		if err != nil {
-			return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to get users by fingerprint range: %v", err)
+			return nil, nil, fmt.Errorf("failed to get users by fingerprint range: %v", err)
 		}
 
 		// Insert any users present on remote but missing locally
+		newUsers := []models.User{}
 		for _, user := range usersRange.Users {
 			found := false
 			for _, ou := range ourUsers {
@@ -267,13 +539,15 @@ func SyncWithRequester(requester SyncRequester, node remote.API, hashedMessagesP
 				}
 			}
 			if !found {
-				fmt.Printf("Inserting user into our database: %+v\n", user)
-				if err := models.DB.Create(&user).Error; err != nil {
-					if !strings.Contains(err.Error(), "duplicate key") {
-						return []models.Message{}, []models.Bulletin{}, []models.User{}, err
-					}
-				}
+				newUsers = append(newUsers, user)
+			}
+		}
+		if len(newUsers) > 0 {
+			report, err := store.IngestUsers(newUsers)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to ingest users: %v", err)
 			}
+			logIngestReport("user", report)
 		}
 
 		// Track any local users missing on remote so we can push them
@@ -294,27 +568,20 @@ func SyncWithRequester(requester SyncRequester, node remote.API, hashedMessagesP
 	userRangesToCheck := []models.HashedUsersRange{}
 
 	for _, hashedUserRange := range syncResponse.UserRangeHashes {
-		ourUserHash, err := models.GetUsersHashByFingerprintRange(models.DB, hashedUserRange.Start, hashedUserRange.End)
+		ourUserHash, err := store.UsersRangeHash(hashedUserRange.StringRange)
 		if err != nil {
-			return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to get users by fingerprint range: %v", err)
+			return nil, nil, fmt.Errorf("failed to get users by fingerprint range: %v", err)
 		}
 
 		if ourUserHash != hashedUserRange.Hash {
-			userRangesToCheck = append(userRangesToCheck, hashedUserRange)
+			userRangesToCheck = append(userRangesToCheck, models.HashedUsersRange{
+				StringRange: hashedUserRange.StringRange,
+				Hash:        ourUserHash,
+			})
 		}
-
 	}
 
-	newMessagesMissingInRemote, newBulletinsMissingInRemote, newUsersMissingInRemote, err := SyncWithRequester(requester, node, hashedMessagesPeriodsToCheck, hashedBulletinPeriodsToCheck, userRangesToCheck)
-	if err != nil {
-		return []models.Message{}, []models.Bulletin{}, []models.User{}, fmt.Errorf("failed to sync new messages missing in remote: %v", err)
-	}
-
-	messagesMissingInRemote = append(messagesMissingInRemote, newMessagesMissingInRemote...)
-	bulletinsMissingInRemote = append(bulletinsMissingInRemote, newBulletinsMissingInRemote...)
-	usersMissingInRemote = append(usersMissingInRemote, newUsersMissingInRemote...)
-
-	return messagesMissingInRemote, bulletinsMissingInRemote, usersMissingInRemote, nil
+	return usersMissingInRemote, userRangesToCheck, nil
 }
 
 // sameUserGroup attempts to determine if two fingerprints represent the same
@@ -341,97 +608,32 @@ func userGroupPrefix(s string) string {
 	return s[:first+1+second]
 }
 
-// mismatchedMessagesPeriods returns the set of hashed periods from the remote that
-// correspond to the same concrete time ranges as ours but have different
-// content hashes.
+// syncRangesOf returns the canonical ranges named by hashed. Ranges with an
+// unknown ID are dropped, we cannot compute a hash for them.
+func syncRangesOf(hashed []models.HashedPeriod) []models.SyncRange {
+	ranges := []models.SyncRange{}
+	for _, h := range hashed {
+		r, err := models.ParseSyncRange(h.RangeID)
+		if err != nil {
+			fmt.Printf("Skipping range: %v\n", err)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// mismatchedMessagesPeriods returns our hashed periods that name the same
+// canonical range as one from the remote but have a different content hash.
+// Our hashes are what the remote compares against in the next round.
 func mismatchedMessagesPeriods(our []models.HashedPeriod, theirs []models.HashedPeriod) []models.HashedPeriod {
 	out := []models.HashedPeriod{}
 	for _, ourHash := range our {
-		start := models.RealizeStart(ourHash.Start)
-		end := models.RealizeEnd(ourHash.End)
 		for _, theirHash := range theirs {
-			theirStart := models.RealizeStart(theirHash.Start)
-			theirEnd := models.RealizeEnd(theirHash.End)
-			if theirStart == start && theirEnd == end && theirHash.Hash != ourHash.Hash {
-				out = append(out, theirHash)
+			if theirHash.RangeID == ourHash.RangeID && theirHash.Hash != ourHash.Hash {
+				out = append(out, ourHash)
 			}
 		}
 	}
 	return out
 }
-
-func startingSyncRanges() ([]models.Period, []models.StringRange) {
-
-	earliestStartTime := models.RealizeStart(nil)
-	latestEndTime := models.RealizeEnd(nil)
-
-	periodSteps := []struct {
-		Years  int `json:"years"`
-		Months int `json:"months"`
-		Days   int `json:"days"`
-	}{
-		{0, -1, 0},
-		{0, -6, 0},
-		{-2, 0, 0},
-	}
-	var previousStart *time.Time
-	weekStart := getWeekStart()
-	if weekStart.Before(earliestStartTime) {
-		previousStart = &earliestStartTime
-	} else {
-		previousStart = &weekStart
-	}
-
-	periods := []models.Period{
-		{
-			Start: previousStart,
-			End:   &latestEndTime,
-		},
-	}
-
-	for _, step := range periodSteps {
-		start := previousStart.AddDate(step.Years, step.Months, step.Days)
-		if start.Before(earliestStartTime) {
-			periods = append(periods, models.Period{
-				Start: &earliestStartTime,
-				End:   previousStart,
-			})
-			break
-		}
-		periods = append(periods, models.Period{
-			Start: &start,
-			End:   previousStart,
-		})
-		previousStart = &start
-	}
-
-	periods = append(periods, models.Period{
-		Start: &earliestStartTime,
-		End:   previousStart,
-	})
-
-	// Generate user fingerprint ranges, an array of 0-9 and a-z
-	var userRanges []models.StringRange
-	for i := 0; i < 10; i++ {
-		userRanges = append(userRanges, models.StringRange{
-			Start: fmt.Sprintf("%c", '0'+i),
-			End:   fmt.Sprintf("%c", '0'+i+1),
-		})
-	}
-	for i := 0; i < 25; i++ {
-		userRanges = append(userRanges, models.StringRange{
-			Start: fmt.Sprintf("%c", 'a'+i),
-			End:   fmt.Sprintf("%c", 'a'+i+1),
-		})
-	}
-	return periods, userRanges
-}
-
-func getWeekStart() time.Time {
-	now := time.Now()
-	weekday := now.Weekday()
-	if weekday == time.Sunday {
-		weekday = 7
-	}
-	return now.AddDate(0, 0, -int(weekday-time.Monday)).Truncate(24 * time.Hour)
-}
@@ -2,72 +2,88 @@ package synchronization
 
 import (
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"axial/api"
+	"axial/config"
 	"axial/models"
 	"axial/remote"
+	"axial/storage"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// fakeRequester uses the target DB to compute the real sync response
+// fakeRequester uses the target store to compute the real sync response
 // via api.ComputeSyncResponse, avoiding HTTP for unit tests.
 type fakeRequester struct {
-	DB *gorm.DB
+	Store storage.Store
 }
 
-// We can't import *gorm.DB type alias directly here without extra deps, so the
-// test skeleton below demonstrates structure without full DB wiring. The real
-// implementation should hold a *gorm.DB and call api.ComputeSyncResponse.
-
 func (f fakeRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
-	return api.ComputeSyncResponse(f.DB, req)
+	resp, err := api.ComputeSyncResponse(f.Store, req)
+	if err != nil {
+		return resp, err
+	}
+	// The handler sends our hashes along, so do the same
+	resp.Hashes, err = f.Store.Hashes()
+	return resp, err
 }
 
-func newTestDBUnit(t *testing.T) *gorm.DB {
+// newTestStoreUnit returns a store on a migrated SQLite memory DB. Hooks are
+// skipped so tests can insert synthetic, unsigned content.
+func newTestStoreUnit(t *testing.T) storage.Store {
 	t.Helper()
 	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 	if err != nil {
 		t.Fatalf("failed to open sqlite memory DB: %v", err)
 	}
-	if err := db.AutoMigrate(&models.User{}, &models.Message{}, &models.Bulletin{}); err != nil {
+	if err := models.Migrate(db); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
-	return db
+	return storage.NewSQL(db.Session(&gorm.Session{SkipHooks: true}))
 }
 
-func insertMessageRawUnit(t *testing.T, db *gorm.DB, content models.Crypto) models.Message {
+func newMemoryStoreUnit(t *testing.T) storage.Store {
+	store := storage.NewMemory()
+	store.SkipHooks = true
+	return store
+}
+
+func insertMessageRawUnit(t *testing.T, store storage.Store, content models.Crypto) models.Message {
 	t.Helper()
 	m := models.Message{CreateMessage: models.CreateMessage{Content: content}}
 	m.Base.ID = m.Hash()
 	m.Base.BeforeCreate(nil)
-	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&m).Error; err != nil {
+	if err := store.CreateMessage(&m); err != nil {
 		t.Fatalf("create message: %v", err)
 	}
 	return m
 }
 
-func insertBulletinRawUnit(t *testing.T, db *gorm.DB, topic string, content models.Crypto, parentId string) models.Bulletin {
+func insertBulletinRawUnit(t *testing.T, store storage.Store, topic string, content models.Crypto, parentId string) models.Bulletin {
 	t.Helper()
 	b := models.Bulletin{CreateBulletin: models.CreateBulletin{Topic: topic, Content: content, ParentID: &parentId}}
 	b.Base.ID = b.Hash()
 	b.Base.BeforeCreate(nil)
-	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&b).Error; err != nil {
+	if err := store.CreateBulletin(&b); err != nil {
 		t.Fatalf("create bulletin: %v", err)
 	}
 	return b
 }
 
-func insertUserRawUnit(t *testing.T, db *gorm.DB, fingerprint string) models.User {
+func insertUserRawUnit(t *testing.T, store storage.Store, fingerprint string) models.User {
 	t.Helper()
 	u := models.User{Fingerprint: fingerprint}
 	u.Base.ID = u.Hash()
 	u.Base.BeforeCreate(nil)
-	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&u).Error; err != nil {
+	if err := store.CreateUser(&u); err != nil {
 		t.Fatalf("create user: %v", err)
 	}
 	return u
@@ -82,193 +98,523 @@ func randStringUnit(t *testing.T) string {
 	return time.Now().UTC().Format(time.RFC3339Nano) + string(buf)
 }
 
-func isDuplicateUnit(err error) bool {
-	if models.IsDuplicateError(err) {
-		return true
-	}
-	s := err.Error()
-	return containsAnyUnit(s, []string{"unique", "constraint failed", "duplicate"})
-}
-
-func containsAnyUnit(s string, needles []string) bool {
-	for _, n := range needles {
-		if strings.Contains(strings.ToLower(s), strings.ToLower(n)) {
-			return true
-		}
-	}
-	return false
-}
-
 func TestMismatchedPeriods(t *testing.T) {
-	now := time.Now().UTC()
-	earlier := now.Add(-24 * time.Hour)
-
 	our := []models.HashedPeriod{
-		{Period: models.Period{Start: &earlier, End: &now}, Hash: "aaa"},
+		{RangeID: "D2025-06-03", Hash: "aaa"},
+		{RangeID: "D2025-06-04", Hash: "ccc"},
 	}
 	theirs := []models.HashedPeriod{
-		{Period: models.Period{Start: &earlier, End: &now}, Hash: "bbb"},
+		{RangeID: "D2025-06-03", Hash: "bbb"},
+		{RangeID: "D2025-06-04", Hash: "ccc"},
+		{RangeID: "D2025-06-05", Hash: "ddd"},
 	}
 
 	out := mismatchedMessagesPeriods(our, theirs)
 	if len(out) != 1 {
 		t.Fatalf("expected 1 mismatched period, got %d", len(out))
 	}
-	if out[0].Hash != "bbb" {
-		t.Fatalf("expected remote hash 'bbb', got '%s'", out[0].Hash)
+	// The remote compares our hash in the next round, so it must not get
+	// its own back
+	if out[0].RangeID != "D2025-06-03" || out[0].Hash != "aaa" {
+		t.Fatalf("expected our hash 'aaa' for D2025-06-03, got %+v", out[0])
 	}
 }
 
+// engines are the sync engines every convergence test runs with
+var engines = []string{api.EngineTime, api.EngineRBSR}
+
+// sessionUnit runs one sync session from local against the remote store
+// with engine and returns what local has that remote lacks. Users are
+// compared over the whole fingerprint space.
+func sessionUnit(t *testing.T, engine string, local storage.Store, remoteStore storage.Store) ([]models.Message, []models.Bulletin, []models.User) {
+	t.Helper()
+	node := remote.API{Address: "remote"}
+	requester := fakeRequester{Store: remoteStore}
+	hashedUsers, err := storage.UsersHashRanges(local, []models.StringRange{models.FullFingerprintRange})
+	if err != nil {
+		t.Fatalf("hash users ranges: %v", err)
+	}
+
+	var messages []models.Message
+	var bulletins []models.Bulletin
+	var users []models.User
+	switch engine {
+	case api.EngineTime:
+		periods := models.TopSyncRanges(time.Now())
+		hashedMessages, err := storage.MessagesHashRanges(local, periods)
+		if err != nil {
+			t.Fatalf("hash messages ranges: %v", err)
+		}
+		hashedBulletins, err := storage.BulletinsHashRanges(local, periods)
+		if err != nil {
+			t.Fatalf("hash bulletins ranges: %v", err)
+		}
+		messages, bulletins, users, err = SyncWithRequester(local, requester, node, hashedMessages, hashedBulletins, hashedUsers)
+	case api.EngineRBSR:
+		full := []models.StringRange{models.FullIDRange}
+		hashedMessages, err := storage.MessagesHashIDRanges(local, full)
+		if err != nil {
+			t.Fatalf("hash messages ID ranges: %v", err)
+		}
+		hashedBulletins, err := storage.BulletinsHashIDRanges(local, full)
+		if err != nil {
+			t.Fatalf("hash bulletins ID ranges: %v", err)
+		}
+		messages, bulletins, users, err = SyncIDRangesWithRequester(local, requester, node, hashedMessages, hashedBulletins, hashedUsers)
+	}
+	if err != nil {
+		t.Fatalf("%s sync: %v", engine, err)
+	}
+	return messages, bulletins, users
+}
+
 func TestSyncExchangeSkeleton(t *testing.T) {
-	// Minimal working exchange: two DBs, split messages, run SyncWithRequester both ways.
-	dbA := newTestDBUnit(t)
-	dbB := newTestDBUnit(t)
+	for _, engine := range engines {
+		t.Run("sqlite/"+engine, func(t *testing.T) { runSyncExchange(t, newTestStoreUnit, engine) })
+		t.Run("memory/"+engine, func(t *testing.T) { runSyncExchange(t, newMemoryStoreUnit, engine) })
+	}
+}
+
+func runSyncExchange(t *testing.T, newStore func(t *testing.T) storage.Store, engine string) {
+	// Minimal working exchange: two stores, split messages, sync both ways.
+	storeA := newStore(t)
+	storeB := newStore(t)
 
 	// Seed messages (synthetic content, skip hooks)
-	insertMessageRawUnit(t, dbA, models.Crypto("m1-"+randStringUnit(t)))
-	m2 := insertMessageRawUnit(t, dbA, models.Crypto("m2-"+randStringUnit(t)))
-	insertMessageRawUnit(t, dbB, models.Crypto(string(m2.Content))) // share m2 on B
-	insertMessageRawUnit(t, dbB, models.Crypto("m3-"+randStringUnit(t)))
+	insertMessageRawUnit(t, storeA, models.Crypto("m1-"+randStringUnit(t)))
+	m2 := insertMessageRawUnit(t, storeA, models.Crypto("m2-"+randStringUnit(t)))
+	insertMessageRawUnit(t, storeB, models.Crypto(string(m2.Content))) // share m2 on B
+	insertMessageRawUnit(t, storeB, models.Crypto("m3-"+randStringUnit(t)))
 
 	// Seed bulletins (synthetic content, skip hooks)
-	insertBulletinRawUnit(t, dbA, "topic1", models.Crypto("b1-"+randStringUnit(t)), "")
-	b2 := insertBulletinRawUnit(t, dbA, "topic2", models.Crypto("b2-"+randStringUnit(t)), "")
-	insertBulletinRawUnit(t, dbB, "topic2", models.Crypto(string(b2.Content)), b2.Base.ID)
-	insertBulletinRawUnit(t, dbB, "topic3", models.Crypto("b3-"+randStringUnit(t)), "")
+	insertBulletinRawUnit(t, storeA, "topic1", models.Crypto("b1-"+randStringUnit(t)), "")
+	b2 := insertBulletinRawUnit(t, storeA, "topic2", models.Crypto("b2-"+randStringUnit(t)), "")
+	insertBulletinRawUnit(t, storeB, "topic2", models.Crypto(string(b2.Content)), b2.Base.ID)
+	insertBulletinRawUnit(t, storeB, "topic3", models.Crypto("b3-"+randStringUnit(t)), "")
 
 	// Seed user profiles (synthetic fingerprints, skip hooks)
-	insertUserRawUnit(t, dbA, "FP_A1_"+randStringUnit(t))
-	insertUserRawUnit(t, dbA, "FP_A2_"+randStringUnit(t))
-	insertUserRawUnit(t, dbB, "FP_A2_"+randStringUnit(t)) // share FP_A2 on B
-	insertUserRawUnit(t, dbB, "FP_B3_"+randStringUnit(t))
+	insertUserRawUnit(t, storeA, "FP_A1_"+randStringUnit(t))
+	insertUserRawUnit(t, storeA, "FP_A2_"+randStringUnit(t))
+	insertUserRawUnit(t, storeB, "FP_A2_"+randStringUnit(t)) // share FP_A2 on B
+	insertUserRawUnit(t, storeB, "FP_B3_"+randStringUnit(t))
 
-	periods, _ := startingSyncRanges()
-	hashedMessagesA, err := models.GetMessagesHashRanges(dbA, periods)
-	if err != nil {
-		t.Fatalf("hash messages ranges A: %v", err)
+	// Round 1: A pulls from B and computes what to send to B
+	messages, bulletins, users := sessionUnit(t, engine, storeA, storeB)
+	applyUnit(t, "A->B", storeB, messages, bulletins, users)
+
+	// Round 2: B pulls from A and applies
+	messages, bulletins, users = sessionUnit(t, engine, storeB, storeA)
+	applyUnit(t, "B->A", storeA, messages, bulletins, users)
+
+	// both stores should have all 3 messages, bulletins and users
+	for name, store := range map[string]storage.Store{"A": storeA, "B": storeB} {
+		messages, err := store.Messages()
+		if err != nil {
+			t.Fatalf("list messages %s: %v", name, err)
+		}
+		if len(messages) != 3 {
+			t.Fatalf("expected 3 messages in %s, got %d", name, len(messages))
+		}
+
+		bulletins, err := store.Bulletins()
+		if err != nil {
+			t.Fatalf("list bulletins %s: %v", name, err)
+		}
+		if len(bulletins) != 3 {
+			t.Fatalf("expected 3 bulletins in %s, got %d", name, len(bulletins))
+		}
+
+		users, err := store.Users()
+		if err != nil {
+			t.Fatalf("list users %s: %v", name, err)
+		}
+		if len(users) != 3 {
+			t.Fatalf("expected 3 users in %s, got %d", name, len(users))
+		}
 	}
+}
 
-	hashedBulletinsA, err := models.GetBulletinsHashRanges(dbA, periods)
-	if err != nil {
-		t.Fatalf("hash bulletins ranges A: %v", err)
+// insertMessageAtUnit stores a synthetic message created at createdAt
+func insertMessageAtUnit(t *testing.T, store storage.Store, content string, createdAt time.Time) {
+	t.Helper()
+	m := models.Message{CreateMessage: models.CreateMessage{Content: models.Crypto(content)}}
+	m.CreatedAt = createdAt
+	m.ID = m.Hash()
+	if err := store.CreateMessage(&m); err != nil {
+		t.Fatalf("create message: %v", err)
 	}
+}
 
-	hashedUsersA, err := models.GetUsersHashRanges(dbA, []models.StringRange{{Start: "", End: "zzzz"}})
-	if err != nil {
-		t.Fatalf("hash users ranges A: %v", err)
+func TestSyncConvergesOnLargeSets(t *testing.T) {
+	base := time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC)
+	cases := map[string]func(i int) time.Time{
+		// Too many items for one response, spread over days, so the time
+		// engine has to drill down
+		"spread": func(i int) time.Time { return base.Add(time.Duration(i) * 7 * time.Minute) },
+		// Everything within one hour, which the time engine cannot split
+		"same hour": func(i int) time.Time { return base.Add(time.Duration(i) * time.Millisecond) },
+	}
+	for name, createdAt := range cases {
+		for _, engine := range engines {
+			t.Run(name+"/"+engine, func(t *testing.T) {
+				storeA := newMemoryStoreUnit(t)
+				storeB := newMemoryStoreUnit(t)
+				// A holds 0-2199, B holds 2000-2499
+				for i := 0; i < 2500; i++ {
+					content := "m-" + strconv.Itoa(i)
+					if i < 2200 {
+						insertMessageAtUnit(t, storeA, content, createdAt(i))
+					}
+					if i >= 2000 {
+						insertMessageAtUnit(t, storeB, content, createdAt(i))
+					}
+				}
+
+				// B initiates, so the responder holds too many items for
+				// one response
+				messages, bulletins, users := sessionUnit(t, engine, storeB, storeA)
+				applyUnit(t, "B->A", storeA, messages, bulletins, users)
+
+				hashesA, _ := storeA.Hashes()
+				hashesB, _ := storeB.Hashes()
+				if hashesA != hashesB {
+					t.Fatalf("stores did not converge:\nA %+v\nB %+v", hashesA, hashesB)
+				}
+				if all, _ := storeA.Messages(); len(all) != 2500 {
+					t.Fatalf("expected 2500 messages, got %d", len(all))
+				}
+			})
+		}
+	}
+}
+
+func TestSyncConvergesEachTypeIndependently(t *testing.T) {
+	base := time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC)
+	for _, engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			storeA := newMemoryStoreUnit(t)
+			storeB := newMemoryStoreUnit(t)
+			// Messages agree from the start, so they are done after the
+			// first round while bulletins and users need drilling down
+			for i := 0; i < 3; i++ {
+				insertMessageAtUnit(t, storeA, "m-"+strconv.Itoa(i), base)
+				insertMessageAtUnit(t, storeB, "m-"+strconv.Itoa(i), base)
+			}
+			for i := 0; i < 2500; i++ {
+				b := models.Bulletin{CreateBulletin: models.CreateBulletin{Topic: "topic", Content: models.Crypto("b-" + strconv.Itoa(i))}}
+				b.CreatedAt = base.Add(time.Duration(i) * 7 * time.Minute)
+				b.ID = b.Hash()
+				if err := storeB.CreateBulletin(&b); err != nil {
+					t.Fatalf("create bulletin: %v", err)
+				}
+				insertUserRawUnit(t, storeB, fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15))
+			}
+
+			sessionUnit(t, engine, storeA, storeB)
+
+			hashesA, _ := storeA.Hashes()
+			hashesB, _ := storeB.Hashes()
+			if hashesA != hashesB {
+				t.Fatalf("stores did not converge:\nA %+v\nB %+v", hashesA, hashesB)
+			}
+		})
 	}
+}
+
+// legacyRequester answers like a node that predates sync engines: it drops
+// the fields it does not know from requests and responses.
+type legacyRequester struct {
+	Store storage.Store
+}
+
+func (l legacyRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
+	req.Engine = ""
+	req.MessageIDRanges = nil
+	req.BulletinIDRanges = nil
+	resp, err := api.ComputeSyncResponse(l.Store, req)
+	resp.Engine = ""
+	return resp, err
+}
+
+// mismatchingRequester answers every round with mismatching ranges, the
+// way a buggy or hostile remote could
+type mismatchingRequester struct {
+	rounds int
+}
 
-	hashedMessagesB, err := models.GetMessagesHashRanges(dbB, periods)
+func (m *mismatchingRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
+	m.rounds++
+	bogus := strings.Repeat("f", 64)
+	return api.SyncResponse{
+		Engine:          req.Engine,
+		MessageRanges:   []models.HashedPeriod{{RangeID: "Y2025", Hash: bogus}},
+		MessageIDRanges: []models.HashedIDRange{{StringRange: models.FullIDRange, Hash: bogus}},
+	}, nil
+}
+
+func TestSyncRoundsAreCapped(t *testing.T) {
+	store := newMemoryStoreUnit(t)
+	insertMessageRawUnit(t, store, models.Crypto("m1-"+randStringUnit(t)))
+	ranges, err := storage.MessagesHashRanges(store, models.TopSyncRanges(time.Now()))
 	if err != nil {
-		t.Fatalf("hash messages ranges B: %v", err)
+		t.Fatalf("hash ranges: %v", err)
 	}
 
-	hashedBulletinsB, err := models.GetBulletinsHashRanges(dbB, periods)
-	if err != nil {
-		t.Fatalf("hash bulletins ranges B: %v", err)
+	requester := &mismatchingRequester{}
+	_, _, _, err = SyncWithRequester(store, requester, remote.API{Address: "remote"}, ranges, nil, nil)
+	if !errors.Is(err, ErrTooManyRounds) || requester.rounds != maxSessionRounds {
+		t.Fatalf("expected the session to stop after %d rounds, got %d rounds and %v", maxSessionRounds, requester.rounds, err)
 	}
 
-	hashedUsersB, err := models.GetUsersHashRanges(dbB, []models.StringRange{{Start: "", End: "zzzz"}})
-	if err != nil {
-		t.Fatalf("hash users ranges B: %v", err)
+	requester = &mismatchingRequester{}
+	_, _, _, err = SyncIDRangesWithRequester(store, requester, remote.API{Address: "remote"}, []models.HashedIDRange{models.HashIDRange(models.FullIDRange, nil)}, nil, nil)
+	if !errors.Is(err, ErrTooManyRounds) || requester.rounds != maxSessionRounds {
+		t.Fatalf("expected the ID range session to stop after %d rounds, got %d rounds and %v", maxSessionRounds, requester.rounds, err)
 	}
+}
 
-	nodeA := remote.API{Address: "nodeA"}
-	nodeB := remote.API{Address: "nodeB"}
+func TestSyncSessionFallsBackToTimeEngine(t *testing.T) {
+	storeA := newMemoryStoreUnit(t)
+	storeB := newMemoryStoreUnit(t)
+	insertMessageRawUnit(t, storeA, models.Crypto("m1-"+randStringUnit(t)))
+	insertMessageRawUnit(t, storeB, models.Crypto("m2-"+randStringUnit(t)))
 
-	// Round 1: A pulls from B and computes messages to send to B
-	models.DB = dbA.Session(&gorm.Session{SkipHooks: true})
-	missingMessagesForBFromA, missingBulletinsForBFromA, missingUsersForBFromA, err := SyncWithRequester(fakeRequester{DB: dbB}, nodeB, hashedMessagesA, hashedBulletinsA, hashedUsersA)
+	messages, _, _, _, err := syncSession(storeA, legacyRequester{Store: storeB}, remote.API{Address: "legacy"}, api.EngineRBSR, time.Hour)
 	if err != nil {
-		t.Fatalf("sync A->B: %v", err)
-	}
-	// Apply remote messages to A
-	for _, m := range missingMessagesForBFromA {
-		if err := dbB.Session(&gorm.Session{SkipHooks: true}).Create(&m).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply A->B message: %v", err)
-		}
+		t.Fatalf("sync: %v", err)
 	}
-	for _, b := range missingBulletinsForBFromA {
-		if err := dbB.Session(&gorm.Session{SkipHooks: true}).Create(&b).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply A->B bulletin: %v", err)
-		}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message missing in the remote, got %d", len(messages))
 	}
-	for _, u := range missingUsersForBFromA {
-		if err := dbB.Session(&gorm.Session{SkipHooks: true}).Create(&u).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply A->B user: %v", err)
-		}
+	if ours, _ := storeA.Messages(); len(ours) != 2 {
+		t.Fatalf("expected the remote message to be ingested, got %d messages", len(ours))
 	}
+}
 
-	// Round 2: B pulls from A and applies
-	models.DB = dbB.Session(&gorm.Session{SkipHooks: true})
-	missingMessagesForAFromB, missingBulletinsForAFromB, missingUsersForAFromB, err := SyncWithRequester(fakeRequester{DB: dbA}, nodeA, hashedMessagesB, hashedBulletinsB, hashedUsersB)
-	if err != nil {
-		t.Fatalf("sync B->A: %v", err)
+// interruptedRequester answers the first rounds of a session and then fails,
+// like a link going down. It records the requests it gets.
+type interruptedRequester struct {
+	Store    storage.Store
+	Rounds   int
+	requests *[]api.SyncRequest
+}
+
+func (i interruptedRequester) RequestSync(node remote.API, req api.SyncRequest) (api.SyncResponse, error) {
+	*i.requests = append(*i.requests, req)
+	if len(*i.requests) > i.Rounds {
+		return api.SyncResponse{}, errors.New("link down")
 	}
-	for _, m := range missingMessagesForAFromB {
-		if err := dbA.Session(&gorm.Session{SkipHooks: true}).Create(&m).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply B->A message: %v", err)
-		}
+	return fakeRequester{Store: i.Store}.RequestSync(node, req)
+}
+
+func TestSyncSessionResumesFromCheckpoint(t *testing.T) {
+	base := time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC)
+	for _, engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			storeA := newMemoryStoreUnit(t)
+			storeB := newMemoryStoreUnit(t)
+			node := remote.API{Address: "10.0.0.2:8080"}
+			peer := node.SyncPeer()
+			insertMessageAtUnit(t, storeA, "ours", base)
+			for i := 0; i < 2500; i++ {
+				b := models.Bulletin{CreateBulletin: models.CreateBulletin{Topic: "topic", Content: models.Crypto("b-" + strconv.Itoa(i))}}
+				b.CreatedAt = base.Add(time.Duration(i) * 7 * time.Minute)
+				b.ID = b.Hash()
+				if err := storeB.CreateBulletin(&b); err != nil {
+					t.Fatalf("create bulletin: %v", err)
+				}
+			}
+
+			// The link goes down after the first round
+			requests := []api.SyncRequest{}
+			_, _, _, _, err := syncSession(storeA, interruptedRequester{Store: storeB, Rounds: 1, requests: &requests}, node, engine, time.Hour)
+			if err == nil {
+				t.Fatalf("expected the interrupted session to fail")
+			}
+			checkpoint, err := storeA.Checkpoint(peer)
+			if err != nil {
+				t.Fatalf("expected a checkpoint: %v", err)
+			}
+			if checkpoint.Engine != engine || len(checkpoint.Progress.MissingMessages) != 1 {
+				t.Fatalf("unexpected checkpoint %+v", checkpoint)
+			}
+
+			// The next session picks up the ranges the first one had left
+			requests = nil
+			messages, _, _, _, err := syncSession(storeA, interruptedRequester{Store: storeB, Rounds: 100, requests: &requests}, node, engine, time.Hour)
+			if err != nil {
+				t.Fatalf("resumed sync: %v", err)
+			}
+			first := requests[0]
+			resumed := reflect.DeepEqual(rangeIDs(first.BulletinRanges), checkpoint.Progress.BulletinRanges)
+			if engine == api.EngineRBSR {
+				resumed = reflect.DeepEqual(idRanges(first.BulletinIDRanges), checkpoint.Progress.BulletinIDRanges)
+			}
+			if !resumed {
+				t.Fatalf("expected the session to resume from %+v, got %+v", checkpoint.Progress, first)
+			}
+			if len(messages) != 1 || messages[0].ID != checkpoint.Progress.MissingMessages[0] {
+				t.Fatalf("expected the checkpointed message to be pushed, got %d messages", len(messages))
+			}
+			if bulletins, _ := storeA.Bulletins(); len(bulletins) != 2500 {
+				t.Fatalf("expected 2500 bulletins, got %d", len(bulletins))
+			}
+
+			// Once pushed, nothing is left for the next session
+			if err := finishCheckpoint(storeA, peer, models.SyncProgress{}, time.Time{}); err != nil {
+				t.Fatalf("finish checkpoint: %v", err)
+			}
+			if _, err := storeA.Checkpoint(peer); !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("expected the checkpoint to be deleted, got %v", err)
+			}
+		})
 	}
-	for _, b := range missingBulletinsForAFromB {
-		if err := dbA.Session(&gorm.Session{SkipHooks: true}).Create(&b).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply B->A bulletin: %v", err)
-		}
+}
+
+func TestSyncSessionRetriesPushOnlyCheckpoint(t *testing.T) {
+	for _, engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			storeA := newMemoryStoreUnit(t)
+			storeB := newMemoryStoreUnit(t)
+			node := remote.API{Address: "10.0.0.2:8080"}
+			peer := node.SyncPeer()
+			insertMessageAtUnit(t, storeA, "ours", time.Date(2025, 6, 3, 14, 0, 0, 0, time.UTC))
+			ours, _ := storeA.Messages()
+
+			// A previous session only failed to push our message
+			savedAt := time.Now().Add(-50 * time.Minute).Truncate(time.Second)
+			left := models.SyncProgress{MissingMessages: []string{ours[0].ID}}
+			if err := finishCheckpoint(storeA, peer, left, savedAt); err != nil {
+				t.Fatalf("finish checkpoint: %v", err)
+			}
+
+			// The next session reconciles from the top and pushes it once
+			requests := []api.SyncRequest{}
+			messages, _, _, pendingSince, err := syncSession(storeA, interruptedRequester{Store: storeB, Rounds: 100, requests: &requests}, node, engine, time.Hour)
+			if err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			start := startingProgress(engine)
+			first := requests[0]
+			started := reflect.DeepEqual(rangeIDs(first.MessageRanges), start.MessageRanges)
+			if engine == api.EngineRBSR {
+				started = reflect.DeepEqual(idRanges(first.MessageIDRanges), start.MessageIDRanges)
+			}
+			if !started {
+				t.Fatalf("expected the session to start from %+v, got %+v", start, first)
+			}
+			if len(messages) != 1 || messages[0].ID != ours[0].ID {
+				t.Fatalf("expected our message to be pushed once, got %d messages", len(messages))
+			}
+			if !pendingSince.Equal(savedAt) {
+				t.Fatalf("expected the pushes to be pending since %s, got %s", savedAt, pendingSince)
+			}
+
+			// Failing to push again does not keep the checkpoint from expiring
+			if err := finishCheckpoint(storeA, peer, left, pendingSince); err != nil {
+				t.Fatalf("finish checkpoint: %v", err)
+			}
+			checkpoint, err := loadCheckpoint(storeA, peer, 30*time.Minute)
+			if err != nil || checkpoint != nil {
+				t.Fatalf("expected the checkpoint to expire, got %+v, %v", checkpoint, err)
+			}
+		})
 	}
-	for _, u := range missingUsersForAFromB {
-		if err := dbA.Session(&gorm.Session{SkipHooks: true}).Create(&u).Error; err != nil && !isDuplicateUnit(err) {
-			t.Fatalf("apply B->A user: %v", err)
-		}
+}
+
+func TestSyncSessionIsJournaled(t *testing.T) {
+	storeA := newMemoryStoreUnit(t)
+	storeB := newMemoryStoreUnit(t)
+	insertMessageRawUnit(t, storeA, models.Crypto("m1-"+randStringUnit(t)))
+	for i := 0; i < 3; i++ {
+		insertBulletinRawUnit(t, storeB, "topic", models.Crypto("b-"+strconv.Itoa(i)), "")
 	}
 
-	// both DBs should have all 3 messages
-	var countA int64
-	if err := dbA.Model(&models.Message{}).Count(&countA).Error; err != nil {
-		t.Fatalf("count messages A: %v", err)
+	journal := &models.SyncSession{}
+	requester := journalRequester{SyncRequester: fakeRequester{Store: storeB}, journal: journal}
+	if _, _, _, _, err := syncSession(&journalStore{Store: storeA, journal: journal}, requester, remote.API{Address: "remote"}, api.EngineRBSR, time.Hour); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if journal.Engine != api.EngineRBSR || journal.Rounds == 0 || journal.Received.Bulletins != 3 || journal.Received.Messages != 0 {
+		t.Fatalf("unexpected journal %+v", journal)
 	}
-	if countA != 3 {
-		t.Fatalf("expected 3 messages in A, got %d", countA)
+}
+
+func TestSessionOutcomesUpdatePeerHealth(t *testing.T) {
+	store := newMemoryStoreUnit(t)
+	cfg := config.SyncConfig{RetryBackoff: time.Hour, MaxRetryBackoff: time.Hour, QuarantineAfter: 2}
+	node := remote.API{Address: "10.0.0.2:8080", NodeID: "node-b"}
+
+	// Busy remotes are not failing
+	recordPeerHealth(store, cfg, node, ErrRemoteBusy, 0)
+	if !PeerReady(store, node.SyncPeer()) {
+		t.Fatalf("expected a busy peer to stay ready")
 	}
 
-	var countB int64
-	if err := dbB.Model(&models.Message{}).Count(&countB).Error; err != nil {
-		t.Fatalf("count messages B: %v", err)
+	recordPeerHealth(store, cfg, node, errors.New("connection refused"), 0)
+	if PeerReady(store, node.SyncPeer()) {
+		t.Fatalf("expected a failing peer to back off")
 	}
-	if countB != 3 {
-		t.Fatalf("expected 3 messages in B, got %d", countB)
+	recordPeerHealth(store, cfg, node, nil, 0)
+	if !PeerReady(store, node.SyncPeer()) {
+		t.Fatalf("expected a successful session to clear the backoff")
 	}
 
-	// both DBs should have all 3 bulletins
-	var bcountA int64
-	if err := dbA.Model(&models.Bulletin{}).Count(&bcountA).Error; err != nil {
-		t.Fatalf("count bulletins A: %v", err)
+	recordPeerHealth(store, cfg, node, nil, 1)
+	recordPeerHealth(store, cfg, node, nil, 5)
+	health, err := store.PeerHealth(node.SyncPeer())
+	if err != nil {
+		t.Fatalf("peer health: %v", err)
+	}
+	if !health.Quarantined() || health.NodeID != "node-b" || PeerReady(store, node.SyncPeer()) {
+		t.Fatalf("expected the peer to be quarantined, got %+v", health)
+	}
+	// Beacons with another node ID from its host do not get past it
+	for _, other := range []remote.API{{Address: "10.0.0.2:8080", NodeID: "node-c"}, {Address: "10.0.0.2:8081"}} {
+		if PeerReady(store, other.SyncPeer()) {
+			t.Fatalf("expected %s at the quarantined host not to be ready", other.SyncPeer())
+		}
 	}
-	if bcountA != 3 {
-		t.Fatalf("expected 3 bulletins in A, got %d", bcountA)
+	elsewhere := remote.API{Address: "10.0.0.3:8080", NodeID: "node-c"}
+	if !PeerReady(store, elsewhere.SyncPeer()) {
+		t.Fatalf("expected a peer at another host to stay ready")
 	}
+}
 
-	var bcountB int64
-	if err := dbB.Model(&models.Bulletin{}).Count(&bcountB).Error; err != nil {
-		t.Fatalf("count bulletins B: %v", err)
+func TestSyncCheckpointsExpire(t *testing.T) {
+	store := newMemoryStoreUnit(t)
+	if err := store.SaveCheckpoint(&models.SyncCheckpoint{Peer: "10.0.0.2", Engine: api.EngineTime}); err != nil {
+		t.Fatalf("save checkpoint: %v", err)
 	}
-	if bcountB != 3 {
-		t.Fatalf("expected 3 bulletins in B, got %d", bcountB)
+	if checkpoint, err := loadCheckpoint(store, "10.0.0.2", time.Hour); err != nil || checkpoint == nil {
+		t.Fatalf("expected the checkpoint to be loaded, got %v, %v", checkpoint, err)
 	}
 
-	// both DBs should have all 3 users
-	var ucountA int64
-	if err := dbA.Model(&models.User{}).Count(&ucountA).Error; err != nil {
-		t.Fatalf("count users A: %v", err)
+	time.Sleep(10 * time.Millisecond)
+	if checkpoint, err := loadCheckpoint(store, "10.0.0.2", time.Millisecond); err != nil || checkpoint != nil {
+		t.Fatalf("expected the checkpoint to expire, got %v, %v", checkpoint, err)
 	}
-	if ucountA != 3 {
-		t.Fatalf("expected 3 users in A, got %d", ucountA)
+	if _, err := store.Checkpoint("10.0.0.2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected the checkpoint to be deleted, got %v", err)
 	}
+}
 
-	var ucountB int64
-	if err := dbB.Model(&models.User{}).Count(&ucountB).Error; err != nil {
-		t.Fatalf("count users B: %v", err)
+// applyUnit stores items pushed by a peer, ignoring the ones already present
+func applyUnit(t *testing.T, direction string, store storage.Store, messages []models.Message, bulletins []models.Bulletin, users []models.User) {
+	t.Helper()
+	for _, m := range messages {
+		if err := store.CreateMessage(&m); err != nil && !errors.Is(err, storage.ErrDuplicate) {
+			t.Fatalf("apply %s message: %v", direction, err)
+		}
 	}
-	if ucountB != 3 {
-		t.Fatalf("expected 3 users in B, got %d", ucountB)
+	for _, b := range bulletins {
+		if err := store.CreateBulletin(&b); err != nil && !errors.Is(err, storage.ErrDuplicate) {
+			t.Fatalf("apply %s bulletin: %v", direction, err)
+		}
+	}
+	for _, u := range users {
+		if err := store.CreateUser(&u); err != nil && !errors.Is(err, storage.ErrDuplicate) {
+			t.Fatalf("apply %s user: %v", direction, err)
+		}
 	}
 }
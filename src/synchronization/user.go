@@ -3,18 +3,26 @@ package synchronization
 import (
 	"fmt"
 
+	"axial/api"
 	"axial/models"
 	"axial/remote"
 )
 
-func SyncUsers(node remote.API, users []models.User) error {
+// SyncUsers pushes users the remote node is missing and returns its report of
+// what it stored
+func SyncUsers(node remote.API, users []models.User) (models.IngestReport, error) {
+	if len(users) == 0 {
+		return models.IngestReport{}, nil
+	}
+
 	endpoint := node.SyncUsers()
-	responseData, response, err := endpoint.Post(users)
+	report, response, err := endpoint.Post(api.SyncUsersRequest{Users: users})
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	fmt.Printf("Received %s response from %s: %+v\n", response.Status, node.Address, responseData)
+	fmt.Printf("Received %s response from %s: ", response.Status, node.Address)
+	logIngestReport("user", report)
 
-	return nil
+	return report, nil
 }